@@ -0,0 +1,315 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+
+	"github.com/henderiw/logger/log"
+	"github.com/henderiw/store/watch"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// AdaptV1 returns a Storer for a StorerV2. The Storer has no context, its calls
+// use a background context and cannot be cancelled, and the errors that the
+// Storer cannot return are logged. The Storer of a store with indexes implements
+// Indexer.
+func AdaptV1[T1 any](s StorerV2[T1]) Storer[T1] {
+	if a, ok := s.(*v2Adapter[T1]); ok {
+		return a.s
+	}
+	if i, ok := s.(IndexedStorerV2[T1]); ok {
+		return AdaptIndexedV1(i)
+	}
+	return &v1Adapter[T1]{s: s}
+}
+
+// AdaptIndexedV1 returns an IndexedStorer for an IndexedStorerV2
+func AdaptIndexedV1[T1 any](s IndexedStorerV2[T1]) IndexedStorer[T1] {
+	return &indexedV1Adapter[T1]{v1Adapter: v1Adapter[T1]{s: s}, Indexer: s}
+}
+
+// AdaptV2 returns a StorerV2 for a Storer, the context is checked before every
+// call but a call in progress cannot be cancelled
+func AdaptV2[T1 any](s Storer[T1]) StorerV2[T1] {
+	switch a := s.(type) {
+	case *v1Adapter[T1]:
+		return a.s
+	case *indexedV1Adapter[T1]:
+		return a.s
+	}
+	return &v2Adapter[T1]{s: s}
+}
+
+// AdaptPatchV1 returns a PatchStorer for a PatchStorerV2, e.g. an
+// UnstructuredStore for an UnstructuredStoreV2
+func AdaptPatchV1[T1 any](s PatchStorerV2[T1]) PatchStorer[T1] {
+	if p, ok := AdaptV1[T1](s).(PatchStorer[T1]); ok {
+		return p
+	}
+	return &v1Adapter[T1]{s: s}
+}
+
+// AdaptPatchV2 returns a PatchStorerV2 for a PatchStorer
+func AdaptPatchV2[T1 any](s PatchStorer[T1]) PatchStorerV2[T1] {
+	if p, ok := AdaptV2[T1](s).(PatchStorerV2[T1]); ok {
+		return p
+	}
+	return &v2Adapter[T1]{s: s}
+}
+
+// v1Adapter has no context to pass to the StorerV2, a call runs to completion
+// with context.Background
+type v1Adapter[T1 any] struct {
+	s StorerV2[T1]
+}
+
+var _ PatchStorer[any] = &v1Adapter[any]{}
+
+type indexedV1Adapter[T1 any] struct {
+	v1Adapter[T1]
+	Indexer[T1]
+}
+
+func (r *v1Adapter[T1]) Start(ctx context.Context) {
+	r.s.Start(ctx)
+}
+
+func (r *v1Adapter[T1]) Stop() {
+	r.s.Stop()
+}
+
+func (r *v1Adapter[T1]) Get(key Key, opts ...GetOption) (T1, error) {
+	return r.s.Get(context.Background(), key, opts...)
+}
+
+func (r *v1Adapter[T1]) List(visitorFunc func(Key, T1), opts ...ListOption) {
+	ctx := context.Background()
+	if err := r.s.List(ctx, func(key Key, obj T1) error {
+		if visitorFunc != nil {
+			visitorFunc(key, obj)
+		}
+		return nil
+	}, opts...); err != nil {
+		log := log.FromContext(ctx)
+		log.Error("cannot list", "error", err.Error())
+	}
+}
+
+func (r *v1Adapter[T1]) ListKeys(opts ...ListOption) []string {
+	ctx := context.Background()
+	keys, err := r.s.ListKeys(ctx, opts...)
+	if err != nil {
+		log := log.FromContext(ctx)
+		log.Error("cannot list keys", "error", err.Error())
+	}
+	return keys
+}
+
+func (r *v1Adapter[T1]) Len(opts ...ListOption) int {
+	ctx := context.Background()
+	n, err := r.s.Len(ctx, opts...)
+	if err != nil {
+		log := log.FromContext(ctx)
+		log.Error("cannot count", "error", err.Error())
+	}
+	return n
+}
+
+func (r *v1Adapter[T1]) Apply(key Key, data T1, opts ...ApplyOption) error {
+	return r.s.Apply(context.Background(), key, data, opts...)
+}
+
+func (r *v1Adapter[T1]) Create(key Key, data T1, opts ...CreateOption) error {
+	return r.s.Create(context.Background(), key, data, opts...)
+}
+
+func (r *v1Adapter[T1]) Update(key Key, data T1, opts ...UpdateOption) error {
+	return r.s.Update(context.Background(), key, data, opts...)
+}
+
+func (r *v1Adapter[T1]) UpdateWithKeyFn(key Key, updateFunc func(obj T1) T1) {
+	ctx := context.Background()
+	var fn func(context.Context, T1) (T1, error)
+	if updateFunc != nil {
+		fn = func(_ context.Context, obj T1) (T1, error) {
+			return updateFunc(obj), nil
+		}
+	}
+	if err := r.s.UpdateWithKeyFn(ctx, key, fn); err != nil {
+		log := log.FromContext(ctx)
+		log.Error("cannot update", "key", key.String(), "error", err.Error())
+	}
+}
+
+func (r *v1Adapter[T1]) Delete(key Key, opts ...DeleteOption) error {
+	return r.s.Delete(context.Background(), key, opts...)
+}
+
+// Patch fails with an invalid error when the StorerV2 does not patch its objects
+func (r *v1Adapter[T1]) Patch(key Key, patchType types.PatchType, patch []byte, opts ...PatchOption) (T1, error) {
+	p, ok := r.s.(PatcherV2[T1])
+	if !ok {
+		return *new(T1), NewInvalidError(key, "store does not support patch", nil)
+	}
+	return p.Patch(context.Background(), key, patchType, patch, opts...)
+}
+
+func (r *v1Adapter[T1]) Watch(ctx context.Context, opts ...ListOption) (watch.WatchInterface[T1], error) {
+	return r.s.Watch(ctx, opts...)
+}
+
+type v2Adapter[T1 any] struct {
+	s Storer[T1]
+}
+
+var _ PatchStorerV2[any] = &v2Adapter[any]{}
+
+func (r *v2Adapter[T1]) Start(ctx context.Context) {
+	r.s.Start(ctx)
+}
+
+func (r *v2Adapter[T1]) Stop() {
+	r.s.Stop()
+}
+
+func (r *v2Adapter[T1]) Get(ctx context.Context, key Key, opts ...GetOption) (T1, error) {
+	if err := ctx.Err(); err != nil {
+		return *new(T1), err
+	}
+	return r.s.Get(key, opts...)
+}
+
+// List stops calling the visitorFunc once the context is cancelled or the
+// visitorFunc fails, the list of the Storer itself runs to completion
+func (r *v2Adapter[T1]) List(ctx context.Context, visitorFunc func(Key, T1) error, opts ...ListOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var err error
+	r.s.List(func(key Key, obj T1) {
+		if err != nil {
+			return
+		}
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if visitorFunc != nil {
+			err = visitorFunc(key, obj)
+		}
+	}, opts...)
+	return err
+}
+
+func (r *v2Adapter[T1]) ListKeys(ctx context.Context, opts ...ListOption) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.s.ListKeys(opts...), nil
+}
+
+func (r *v2Adapter[T1]) Len(ctx context.Context, opts ...ListOption) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.s.Len(opts...), nil
+}
+
+func (r *v2Adapter[T1]) Apply(ctx context.Context, key Key, data T1, opts ...ApplyOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.s.Apply(key, data, opts...)
+}
+
+func (r *v2Adapter[T1]) Create(ctx context.Context, key Key, data T1, opts ...CreateOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.s.Create(key, data, opts...)
+}
+
+func (r *v2Adapter[T1]) Update(ctx context.Context, key Key, data T1, opts ...UpdateOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.s.Update(key, data, opts...)
+}
+
+// UpdateWithKeyFn cannot abort the UpdateWithKeyFn of the Storer, instead the
+// object is read, passed to the updateFunc and updated with its resource version
+// as a precondition. Nothing is written when the updateFunc fails, a concurrent
+// change of the object fails the update with a conflict.
+func (r *v2Adapter[T1]) UpdateWithKeyFn(ctx context.Context, key Key, updateFunc func(ctx context.Context, obj T1) (T1, error), opts ...UpdateOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if updateFunc == nil {
+		return nil
+	}
+	o := UpdateOptions{}
+	o.ApplyOptions(opts)
+	exists := true
+	obj, err := r.s.Get(key)
+	if err != nil {
+		if !IsNotFound(err) {
+			return err
+		}
+		exists = false
+		obj = *new(T1)
+	}
+	// a missing object has no resource version, its zero value can be a nil pointer
+	rv := ""
+	if exists {
+		rv = GetResourceVersion(obj)
+	}
+	if err := CheckResourceVersion(key, o.ResourceVersion, rv); err != nil {
+		return err
+	}
+	newObj, err := updateFunc(ctx, DeepCopy(obj))
+	if err != nil {
+		return err
+	}
+	if err := CheckUpdated(key, exists, newObj); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.s.Update(key, newObj, &UpdateOptions{ResourceVersion: rv, DryRun: o.DryRun})
+}
+
+func (r *v2Adapter[T1]) Delete(ctx context.Context, key Key, opts ...DeleteOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.s.Delete(key, opts...)
+}
+
+// Patch fails with an invalid error when the Storer does not patch its objects
+func (r *v2Adapter[T1]) Patch(ctx context.Context, key Key, patchType types.PatchType, patch []byte, opts ...PatchOption) (T1, error) {
+	if err := ctx.Err(); err != nil {
+		return *new(T1), err
+	}
+	p, ok := r.s.(Patcher[T1])
+	if !ok {
+		return *new(T1), NewInvalidError(key, "store does not support patch", nil)
+	}
+	return p.Patch(key, patchType, patch, opts...)
+}
+
+func (r *v2Adapter[T1]) Watch(ctx context.Context, opts ...ListOption) (watch.WatchInterface[T1], error) {
+	return r.s.Watch(ctx, opts...)
+}
@@ -0,0 +1,224 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/memory"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newMemory() store.PatchStorerV2[*unstructured.Unstructured] {
+	return memory.NewStoreV2(func() *unstructured.Unstructured { return &unstructured.Unstructured{} })
+}
+
+// v2Store hides the patch of a v2 store
+type v2Store struct {
+	store.StorerV2[*unstructured.Unstructured]
+}
+
+func TestAdaptUnwrap(t *testing.T) {
+	s := newMemory()
+	if got := store.AdaptV2(store.AdaptV1[*unstructured.Unstructured](s)); got != store.StorerV2[*unstructured.Unstructured](s) {
+		t.Errorf("want the v2 store of the v1 adapter, got %T", got)
+	}
+	v1 := v1Store{memory.NewStore(func() *unstructured.Unstructured { return &unstructured.Unstructured{} })}
+	if got := store.AdaptV1(store.AdaptV2[*unstructured.Unstructured](v1)); got != store.Storer[*unstructured.Unstructured](v1) {
+		t.Errorf("want the v1 store of the v2 adapter, got %T", got)
+	}
+	indexed := memory.NewIndexedStoreV2(&memory.Config[*unstructured.Unstructured]{})
+	if _, ok := store.AdaptV1[*unstructured.Unstructured](indexed).(store.Indexer[*unstructured.Unstructured]); !ok {
+		t.Errorf("want the v1 adapter of an indexed store to be an indexer")
+	}
+}
+
+func TestAdaptV2Context(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := backends["adapted"](t)
+	if err := s.Create(ctx, testKey("a"), newObject("a", "1")); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	calls := map[string]func() error{
+		"Get": func() error {
+			_, err := s.Get(ctx, testKey("a"))
+			return err
+		},
+		"List": func() error {
+			return s.List(ctx, func(store.Key, *unstructured.Unstructured) error { return nil })
+		},
+		"ListKeys": func() error {
+			_, err := s.ListKeys(ctx)
+			return err
+		},
+		"Len": func() error {
+			_, err := s.Len(ctx)
+			return err
+		},
+		"Create": func() error { return s.Create(ctx, testKey("b"), newObject("b", "1")) },
+		"Update": func() error { return s.Update(ctx, testKey("a"), newObject("a", "2")) },
+		"Apply":  func() error { return s.Apply(ctx, testKey("a"), newObject("a", "2")) },
+		"UpdateWithKeyFn": func() error {
+			return s.UpdateWithKeyFn(ctx, testKey("a"), func(_ context.Context, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+				return newObject("a", "2"), nil
+			})
+		},
+		"Patch": func() error {
+			_, err := s.Patch(ctx, testKey("a"), types.MergePatchType, []byte(`{"data":{"x":"2"}}`))
+			return err
+		},
+		"Delete": func() error { return s.Delete(ctx, testKey("a")) },
+	}
+	for name, call := range calls {
+		t.Run(name, func(t *testing.T) {
+			if err := call(); !errors.Is(err, context.Canceled) {
+				t.Errorf("want canceled, got %v", err)
+			}
+		})
+	}
+	got, err := s.Get(context.Background(), testKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x(got) != "1" {
+		t.Errorf("want x 1, got %s", x(got))
+	}
+	if _, err := s.Get(context.Background(), testKey("b")); !store.IsNotFound(err) {
+		t.Errorf("want b not to be created, got %v", err)
+	}
+}
+
+func TestAdaptV2ListStops(t *testing.T) {
+	ctx := context.Background()
+	s := backends["adapted"](t)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := s.Create(ctx, testKey(name), newObject(name, "1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errStop := errors.New("stop")
+	visited := 0
+	err := s.List(ctx, func(store.Key, *unstructured.Unstructured) error {
+		visited++
+		return errStop
+	})
+	if !errors.Is(err, errStop) || visited != 1 {
+		t.Errorf("want the list to stop with the error of the visitor, got %v after %d objects", err, visited)
+	}
+}
+
+func TestAdaptV2UpdateWithKeyFn(t *testing.T) {
+	errAbort := errors.New("abort")
+	cases := map[string]struct {
+		updateFunc func(ctx context.Context, s testStore) func(context.Context, *unstructured.Unstructured) (*unstructured.Unstructured, error)
+		errFunc    func(error) bool
+		// want is x of a after the update
+		want string
+	}{
+		"Update": {
+			updateFunc: func(ctx context.Context, s testStore) func(context.Context, *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+				return func(_ context.Context, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+					obj.Object["data"] = map[string]any{"x": "2"}
+					return obj, nil
+				}
+			},
+			want: "2",
+		},
+		"Abort": {
+			updateFunc: func(ctx context.Context, s testStore) func(context.Context, *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+				return func(_ context.Context, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+					obj.Object["data"] = map[string]any{"x": "2"}
+					return obj, errAbort
+				}
+			},
+			errFunc: func(err error) bool { return errors.Is(err, errAbort) },
+			want:    "1",
+		},
+		// the object is changed while the update func runs
+		"Conflict": {
+			updateFunc: func(ctx context.Context, s testStore) func(context.Context, *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+				return func(_ context.Context, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+					if err := s.Update(ctx, testKey("a"), newObject("a", "3")); err != nil {
+						return nil, err
+					}
+					obj.Object["data"] = map[string]any{"x": "2"}
+					return obj, nil
+				}
+			},
+			errFunc: store.IsConflict,
+			want:    "3",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := backends["adapted"](t)
+			if err := s.Create(ctx, testKey("a"), newObject("a", "1")); err != nil {
+				t.Fatal(err)
+			}
+			err := s.UpdateWithKeyFn(ctx, testKey("a"), tc.updateFunc(ctx, s))
+			if tc.errFunc != nil {
+				if !tc.errFunc(err) {
+					t.Fatalf("want error, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, err := s.Get(ctx, testKey("a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if x(got) != tc.want {
+				t.Errorf("want x %s, got %s", tc.want, x(got))
+			}
+		})
+	}
+}
+
+func TestAdaptV1(t *testing.T) {
+	s := store.AdaptPatchV1(newMemory())
+	if err := s.Create(testKey("a"), newObject("a", "1")); err != nil {
+		t.Fatal(err)
+	}
+	s.UpdateWithKeyFn(testKey("a"), func(obj *unstructured.Unstructured) *unstructured.Unstructured {
+		obj.Object["data"] = map[string]any{"x": "2"}
+		return obj
+	})
+	got, err := s.Get(testKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x(got) != "2" {
+		t.Errorf("want x 2, got %s", x(got))
+	}
+	names := []string{}
+	s.List(func(key store.Key, _ *unstructured.Unstructured) { names = append(names, key.Name) })
+	if len(names) != 1 || s.Len() != 1 || len(s.ListKeys()) != 1 {
+		t.Errorf("want a to be listed, got %v", names)
+	}
+
+	// a v2 store without patch
+	p := store.AdaptV1[*unstructured.Unstructured](v2Store{newMemory()}).(store.PatchStorer[*unstructured.Unstructured])
+	if _, err := p.Patch(testKey("a"), types.MergePatchType, []byte(`{}`)); !store.IsInvalid(err) {
+		t.Errorf("want invalid for a store without patch, got %v", err)
+	}
+}
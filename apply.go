@@ -0,0 +1,134 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/managedfields"
+)
+
+// ServerSideApply merges the configuration applied by the field manager of the
+// options into the live object and replaces the content of the applied object
+// with the result, including the managed fields of all managers in its metadata.
+// It returns false when the apply does not change the live object, apart from
+// the timestamps of the managed fields. The content of the applied object is
+// also replaced when the apply does not change the live object, or is a dry
+// run, such that the caller always gets the result; the live object is not
+// changed.
+//
+// Only unstructured objects are supported. Their fields are merged without a
+// schema, maps per field and lists as a whole. A field that is set by another
+// manager to a different value is a conflict unless the apply is forced, which
+// moves the field to the field manager. The fields of an existing object
+// without managed fields are owned by the manager "before-first-apply". A
+// resource version in the applied object is a precondition.
+func ServerSideApply[T1 any](key Key, live T1, exists bool, applied T1, o *ApplyOptions) (bool, error) {
+	appliedObj, ok := any(applied).(*unstructured.Unstructured)
+	if !ok {
+		return false, NewInvalidError(key, "server-side apply supports unstructured objects only", nil)
+	}
+	gvk := appliedObj.GroupVersionKind()
+	if gvk.Kind == "" || gvk.Version == "" {
+		return false, NewInvalidError(key, "server-side apply needs the apiVersion and kind of the object", nil)
+	}
+	liveObj := &unstructured.Unstructured{}
+	liveObj.SetGroupVersionKind(gvk)
+	if exists {
+		u, ok := any(live).(*unstructured.Unstructured)
+		if !ok {
+			return false, NewInvalidError(key, "server-side apply supports unstructured objects only", nil)
+		}
+		liveObj = u.DeepCopy()
+		if err := CheckResourceVersion(key, appliedObj.GetResourceVersion(), liveObj.GetResourceVersion()); err != nil {
+			return false, err
+		}
+	}
+
+	fieldManager, err := managedfields.NewDefaultCRDFieldManager(
+		managedfields.NewDeducedTypeConverter(),
+		unstructuredScheme{}, unstructuredScheme{}, unstructuredScheme{},
+		gvk, gvk.GroupVersion(), "", nil,
+	)
+	if err != nil {
+		return false, NewInvalidError(key, "cannot create field manager", err)
+	}
+	obj, err := fieldManager.Apply(liveObj, appliedObj.DeepCopy(), o.FieldManager, o.Force)
+	if err != nil {
+		if apierrors.IsConflict(err) {
+			return false, &Error{Err: ErrConflict, Key: key, Cause: err}
+		}
+		return false, NewInvalidError(key, "cannot apply object", err)
+	}
+	merged, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return false, NewInvalidError(key, fmt.Sprintf("unexpected applied object %T", obj), nil)
+	}
+
+	if exists && equalIgnoringManagedFieldsTime(liveObj, merged) {
+		appliedObj.Object = liveObj.Object
+		return false, nil
+	}
+	appliedObj.Object = merged.Object
+	return true, nil
+}
+
+// equalIgnoringManagedFieldsTime compares the objects without the timestamps of
+// their managed fields, which change on every apply
+func equalIgnoringManagedFieldsTime(a, b *unstructured.Unstructured) bool {
+	a, b = a.DeepCopy(), b.DeepCopy()
+	for _, obj := range []*unstructured.Unstructured{a, b} {
+		fields := obj.GetManagedFields()
+		for i := range fields {
+			fields[i].Time = nil
+		}
+		obj.SetManagedFields(fields)
+	}
+	return equality.Semantic.DeepEqual(a.Object, b.Object)
+}
+
+// unstructuredScheme creates, defaults and converts unstructured objects for
+// the field manager. Without a schema the objects cannot be converted to
+// another version and have no defaults.
+type unstructuredScheme struct{}
+
+func (unstructuredScheme) New(gvk schema.GroupVersionKind) (runtime.Object, error) {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+	return obj, nil
+}
+
+func (unstructuredScheme) Default(runtime.Object) {}
+
+func (unstructuredScheme) Convert(in, out, context any) error {
+	return fmt.Errorf("cannot convert %T to %T", in, out)
+}
+
+func (unstructuredScheme) ConvertToVersion(in runtime.Object, gv runtime.GroupVersioner) (runtime.Object, error) {
+	gvk := in.GetObjectKind().GroupVersionKind()
+	if target, ok := gv.KindForGroupVersionKinds([]schema.GroupVersionKind{gvk}); !ok || target != gvk {
+		return nil, fmt.Errorf("cannot convert %s to another version", gvk.String())
+	}
+	return in, nil
+}
+
+func (unstructuredScheme) ConvertFieldLabel(gvk schema.GroupVersionKind, label, value string) (string, string, error) {
+	return label, value, nil
+}
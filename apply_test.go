@@ -0,0 +1,155 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestServerSideApply(t *testing.T) {
+	// the live object is created by the manager a and owns data.x
+	live := testObject("a", "", map[string]any{"x": "1"})
+	if _, err := ServerSideApply(testKey("a"), nil, false, live, &ApplyOptions{FieldManager: "a"}); err != nil {
+		t.Fatalf("cannot create live object: %v", err)
+	}
+	live.SetResourceVersion("1")
+
+	cases := map[string]struct {
+		applied *unstructured.Unstructured
+		manager string
+		force   bool
+		changed bool
+		errFunc func(error) bool
+		// want are the data fields of the result
+		want map[string]any
+		// owners are the managers of data.x in the managed fields of the result
+		owners []string
+	}{
+		"SameManagerNoChange": {
+			applied: testObject("a", "", map[string]any{"x": "1"}),
+			manager: "a",
+			want:    map[string]any{"x": "1"},
+			owners:  []string{"a"},
+		},
+		"SameManagerChange": {
+			applied: testObject("a", "", map[string]any{"x": "2"}),
+			manager: "a",
+			changed: true,
+			want:    map[string]any{"x": "2"},
+			owners:  []string{"a"},
+		},
+		"OtherManagerOtherField": {
+			applied: testObject("a", "", map[string]any{"y": "1"}),
+			manager: "b",
+			changed: true,
+			want:    map[string]any{"x": "1", "y": "1"},
+			owners:  []string{"a"},
+		},
+		"OtherManagerSameValue": {
+			applied: testObject("a", "", map[string]any{"x": "1"}),
+			manager: "b",
+			changed: true,
+			want:    map[string]any{"x": "1"},
+			owners:  []string{"a", "b"},
+		},
+		"OtherManagerConflict": {
+			applied: testObject("a", "", map[string]any{"x": "2"}),
+			manager: "b",
+			errFunc: IsConflict,
+		},
+		"OtherManagerForce": {
+			applied: testObject("a", "", map[string]any{"x": "2"}),
+			manager: "b",
+			force:   true,
+			changed: true,
+			want:    map[string]any{"x": "2"},
+			owners:  []string{"b"},
+		},
+		"StaleResourceVersion": {
+			applied: testObject("a", "2", map[string]any{"x": "1"}),
+			manager: "a",
+			errFunc: IsConflict,
+		},
+		"MatchingResourceVersion": {
+			applied: testObject("a", "1", map[string]any{"x": "2"}),
+			manager: "a",
+			changed: true,
+			want:    map[string]any{"x": "2"},
+			owners:  []string{"a"},
+		},
+		"NoKind": {
+			applied: &unstructured.Unstructured{Object: map[string]any{"data": map[string]any{"x": "1"}}},
+			manager: "a",
+			errFunc: IsInvalid,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			l := live.DeepCopy()
+			changed, err := ServerSideApply(testKey("a"), l, true, tc.applied, &ApplyOptions{FieldManager: tc.manager, Force: tc.force})
+			if tc.errFunc != nil {
+				if err == nil || !tc.errFunc(err) {
+					t.Fatalf("want error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if changed != tc.changed {
+				t.Errorf("want changed %t, got %t", tc.changed, changed)
+			}
+			data, _, _ := unstructured.NestedMap(tc.applied.Object, "data")
+			if len(data) != len(tc.want) {
+				t.Errorf("want data %v, got %v", tc.want, data)
+			}
+			for k, v := range tc.want {
+				if data[k] != v {
+					t.Errorf("data %s: want %v, got %v", k, v, data[k])
+				}
+			}
+			owners := map[string]bool{}
+			for _, entry := range tc.applied.GetManagedFields() {
+				if entry.FieldsV1 != nil && strings.Contains(string(entry.FieldsV1.Raw), `"f:x"`) {
+					owners[entry.Manager] = true
+				}
+			}
+			if len(owners) != len(tc.owners) {
+				t.Errorf("want managers %v, got %v", tc.owners, owners)
+			}
+			for _, owner := range tc.owners {
+				if !owners[owner] {
+					t.Errorf("want manager %s, got %v", owner, owners)
+				}
+			}
+			if !reflect.DeepEqual(l.Object, live.Object) {
+				t.Errorf("the live object is changed")
+			}
+		})
+	}
+}
+
+func TestServerSideApplyTyped(t *testing.T) {
+	type typed struct{ Name string }
+	_, err := ServerSideApply(testKey("a"), &typed{}, true, &typed{Name: "a"}, &ApplyOptions{FieldManager: "a"})
+	if !IsInvalid(err) {
+		t.Fatalf("want invalid error, got %v", err)
+	}
+}
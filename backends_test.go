@@ -0,0 +1,1028 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The tests in this file run against all backends, they live in an external test
+// package as the backends import the store package.
+package store_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/file"
+	"github.com/henderiw/store/fileu"
+	"github.com/henderiw/store/gitu"
+	"github.com/henderiw/store/memory"
+	"github.com/henderiw/store/memoryu"
+	"github.com/henderiw/store/watch"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// testStore is a store under test with unstructured objects
+type testStore interface {
+	store.StorerV2[*unstructured.Unstructured]
+	store.PatcherV2[*unstructured.Unstructured]
+}
+
+var groupResource = schema.GroupResource{Group: "test", Resource: "configmaps"}
+
+// backends return a new store of every backend
+var backends = map[string]func(t *testing.T) testStore{
+	"memory": func(t *testing.T) testStore {
+		return memory.NewStoreV2(func() *unstructured.Unstructured { return &unstructured.Unstructured{} })
+	},
+	"memoryu": func(t *testing.T) testStore {
+		return &typedStore[runtime.Unstructured]{s: memoryu.NewStoreV2()}
+	},
+	"file": func(t *testing.T) testStore {
+		s, err := file.NewStoreV2(&file.Config{
+			GroupResource: groupResource,
+			RootPath:      t.TempDir(),
+			Codec:         unstructured.UnstructuredJSONScheme,
+			NewFunc:       func() runtime.Object { return &unstructured.Unstructured{} },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &typedStore[runtime.Object]{s: s}
+	},
+	"fileu": func(t *testing.T) testStore {
+		s, err := fileu.NewStoreV2(&fileu.Config{
+			GroupResource: groupResource,
+			RootPath:      t.TempDir(),
+			NewFunc:       func() runtime.Unstructured { return &unstructured.Unstructured{} },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &typedStore[runtime.Unstructured]{s: s}
+	},
+	// the v2 adapter of a v1 store, the v1 store is not unwrapped such that the
+	// calls pass the v1 and the v2 adapter
+	"adapted": func(t *testing.T) testStore {
+		return store.AdaptPatchV2[*unstructured.Unstructured](v1Store{memory.NewStore(func() *unstructured.Unstructured { return &unstructured.Unstructured{} })})
+	},
+	"gitu": func(t *testing.T) testStore {
+		s, err := gitu.NewStoreV2(&gitu.Config{
+			GroupResource: groupResource,
+			RootPath:      t.TempDir(),
+			NewFunc:       func() runtime.Unstructured { return &unstructured.Unstructured{} },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &typedStore[runtime.Unstructured]{s: s}
+	},
+}
+
+// v1Store hides the adapter of a v1 store
+type v1Store struct {
+	store.PatchStorer[*unstructured.Unstructured]
+}
+
+// typedStore is a store of another object type as a testStore, the objects are
+// unstructured objects
+type typedStore[T1 runtime.Object] struct {
+	s interface {
+		store.StorerV2[T1]
+		store.PatcherV2[T1]
+	}
+}
+
+func in[T1 runtime.Object](obj *unstructured.Unstructured) T1 {
+	if obj == nil {
+		var zero T1
+		return zero
+	}
+	return any(obj).(T1)
+}
+
+func out[T1 runtime.Object](obj T1) *unstructured.Unstructured {
+	u, _ := any(obj).(*unstructured.Unstructured)
+	return u
+}
+
+func (r *typedStore[T1]) Start(ctx context.Context) { r.s.Start(ctx) }
+
+func (r *typedStore[T1]) Stop() { r.s.Stop() }
+
+func (r *typedStore[T1]) Get(ctx context.Context, key store.Key, opts ...store.GetOption) (*unstructured.Unstructured, error) {
+	obj, err := r.s.Get(ctx, key, opts...)
+	return out(obj), err
+}
+
+func (r *typedStore[T1]) List(ctx context.Context, visitorFunc func(store.Key, *unstructured.Unstructured) error, opts ...store.ListOption) error {
+	return r.s.List(ctx, func(key store.Key, obj T1) error {
+		return visitorFunc(key, out(obj))
+	}, opts...)
+}
+
+func (r *typedStore[T1]) ListKeys(ctx context.Context, opts ...store.ListOption) ([]string, error) {
+	return r.s.ListKeys(ctx, opts...)
+}
+
+func (r *typedStore[T1]) Len(ctx context.Context, opts ...store.ListOption) (int, error) {
+	return r.s.Len(ctx, opts...)
+}
+
+func (r *typedStore[T1]) Apply(ctx context.Context, key store.Key, data *unstructured.Unstructured, opts ...store.ApplyOption) error {
+	return r.s.Apply(ctx, key, in[T1](data), opts...)
+}
+
+func (r *typedStore[T1]) Create(ctx context.Context, key store.Key, data *unstructured.Unstructured, opts ...store.CreateOption) error {
+	return r.s.Create(ctx, key, in[T1](data), opts...)
+}
+
+func (r *typedStore[T1]) Update(ctx context.Context, key store.Key, data *unstructured.Unstructured, opts ...store.UpdateOption) error {
+	return r.s.Update(ctx, key, in[T1](data), opts...)
+}
+
+func (r *typedStore[T1]) UpdateWithKeyFn(ctx context.Context, key store.Key, updateFunc func(ctx context.Context, obj *unstructured.Unstructured) (*unstructured.Unstructured, error), opts ...store.UpdateOption) error {
+	return r.s.UpdateWithKeyFn(ctx, key, func(ctx context.Context, obj T1) (T1, error) {
+		newObj, err := updateFunc(ctx, out(obj))
+		return in[T1](newObj), err
+	}, opts...)
+}
+
+func (r *typedStore[T1]) Delete(ctx context.Context, key store.Key, opts ...store.DeleteOption) error {
+	return r.s.Delete(ctx, key, opts...)
+}
+
+func (r *typedStore[T1]) Patch(ctx context.Context, key store.Key, patchType types.PatchType, patch []byte, opts ...store.PatchOption) (*unstructured.Unstructured, error) {
+	obj, err := r.s.Patch(ctx, key, patchType, patch, opts...)
+	return out(obj), err
+}
+
+func (r *typedStore[T1]) Watch(ctx context.Context, opts ...store.ListOption) (watch.WatchInterface[*unstructured.Unstructured], error) {
+	w, err := r.s.Watch(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	tw := &typedWatch[T1]{
+		w:    w,
+		ch:   make(chan watch.WatchEvent[*unstructured.Unstructured]),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(tw.ch)
+		for event := range w.ResultChan() {
+			select {
+			case <-tw.done:
+				return
+			case tw.ch <- watch.WatchEvent[*unstructured.Unstructured]{
+				Type:            event.Type,
+				Key:             event.Key,
+				Object:          out(event.Object),
+				OldObject:       out(event.OldObject),
+				ResourceVersion: event.ResourceVersion,
+				Commit:          event.Commit,
+				Err:             event.Err,
+			}:
+			}
+		}
+	}()
+	return tw, nil
+}
+
+// typedWatch is a watch of another object type with unstructured objects
+type typedWatch[T1 runtime.Object] struct {
+	w    watch.WatchInterface[T1]
+	ch   chan watch.WatchEvent[*unstructured.Unstructured]
+	done chan struct{}
+	once sync.Once
+}
+
+func (r *typedWatch[T1]) Stop() {
+	r.once.Do(func() { close(r.done) })
+	r.w.Stop()
+}
+
+func (r *typedWatch[T1]) ResultChan() <-chan watch.WatchEvent[*unstructured.Unstructured] {
+	return r.ch
+}
+
+func testKey(name string) store.Key {
+	return store.KeyFromNSN(types.NamespacedName{Namespace: "default", Name: name})
+}
+
+// newObject returns an object with the data field x
+func newObject(name, x string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]any{"data": map[string]any{"x": x}}}
+	u.SetAPIVersion("v1")
+	u.SetKind("ConfigMap")
+	u.SetNamespace("default")
+	u.SetName(name)
+	return u
+}
+
+// x returns the data field x of the object
+func x(obj *unstructured.Unstructured) string {
+	v, _, _ := unstructured.NestedString(obj.Object, "data", "x")
+	return v
+}
+
+// nextEvent returns the next event of the watch
+func nextEvent(t *testing.T, w watch.WatchInterface[*unstructured.Unstructured]) watch.WatchEvent[*unstructured.Unstructured] {
+	t.Helper()
+	select {
+	case event := <-w.ResultChan():
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("want an event")
+		return watch.WatchEvent[*unstructured.Unstructured]{}
+	}
+}
+
+func mustParse(t *testing.T, rv string) uint64 {
+	t.Helper()
+	v, err := store.ParseResourceVersion(rv)
+	if err != nil {
+		t.Fatalf("invalid resource version %q: %v", rv, err)
+	}
+	return v
+}
+
+func TestResourceVersionPreconditions(t *testing.T) {
+	setX := func(_ context.Context, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+		obj.Object["data"] = map[string]any{"x": "3"}
+		return obj, nil
+	}
+	// the ops change x of a to 3 or delete a with the resource version precondition
+	cases := map[string]struct {
+		op func(ctx context.Context, s testStore, rv string) error
+		// deletes is true when the op deletes a, false when it changes x
+		deletes bool
+		// reads is true when the op does not change a
+		reads bool
+	}{
+		"Get": {
+			op: func(ctx context.Context, s testStore, rv string) error {
+				_, err := s.Get(ctx, testKey("a"), &store.GetOptions{ResourceVersion: rv})
+				return err
+			},
+			reads: true,
+		},
+		"Update": {
+			op: func(ctx context.Context, s testStore, rv string) error {
+				return s.Update(ctx, testKey("a"), newObject("a", "3"), &store.UpdateOptions{ResourceVersion: rv})
+			},
+		},
+		"UpdateWithKeyFn": {
+			op: func(ctx context.Context, s testStore, rv string) error {
+				return s.UpdateWithKeyFn(ctx, testKey("a"), setX, &store.UpdateOptions{ResourceVersion: rv})
+			},
+		},
+		"Patch": {
+			op: func(ctx context.Context, s testStore, rv string) error {
+				_, err := s.Patch(ctx, testKey("a"), types.MergePatchType, []byte(`{"data":{"x":"3"}}`), &store.PatchOptions{ResourceVersion: rv})
+				return err
+			},
+		},
+		"Delete": {
+			op: func(ctx context.Context, s testStore, rv string) error {
+				return s.Delete(ctx, testKey("a"), &store.DeleteOptions{ResourceVersion: rv})
+			},
+			deletes: true,
+		},
+	}
+
+	for backend, newStore := range backends {
+		for name, tc := range cases {
+			for _, stale := range []bool{false, true} {
+				name := name
+				if stale {
+					name += "Stale"
+				}
+				t.Run(backend+"/"+name, func(t *testing.T) {
+					ctx := context.Background()
+					s := newStore(t)
+					obj := newObject("a", "1")
+					if err := s.Create(ctx, testKey("a"), obj); err != nil {
+						t.Fatal(err)
+					}
+					staleRV := obj.GetResourceVersion()
+					obj = newObject("a", "2")
+					if err := s.Update(ctx, testKey("a"), obj); err != nil {
+						t.Fatal(err)
+					}
+					rv := obj.GetResourceVersion()
+					if mustParse(t, rv) <= mustParse(t, staleRV) {
+						t.Fatalf("want the resource version to increase, got %s after %s", rv, staleRV)
+					}
+					if stale {
+						rv = staleRV
+					}
+
+					err := tc.op(ctx, s, rv)
+					if stale {
+						if !store.IsConflict(err) {
+							t.Fatalf("want conflict, got %v", err)
+						}
+					} else if err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+
+					got, err := s.Get(ctx, testKey("a"))
+					switch {
+					case tc.deletes && !stale:
+						if !store.IsNotFound(err) {
+							t.Errorf("want not found, got %v", err)
+						}
+					case err != nil:
+						t.Fatal(err)
+					case tc.reads || stale:
+						if x(got) != "2" || got.GetResourceVersion() != obj.GetResourceVersion() {
+							t.Errorf("want x 2 with resource version %s, got %s with %s", obj.GetResourceVersion(), x(got), got.GetResourceVersion())
+						}
+					default:
+						if x(got) != "3" || mustParse(t, got.GetResourceVersion()) <= mustParse(t, obj.GetResourceVersion()) {
+							t.Errorf("want x 3 with a resource version after %s, got %s with %s", obj.GetResourceVersion(), x(got), got.GetResourceVersion())
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestUpdateWithKeyFnNil(t *testing.T) {
+	returnNil := func(context.Context, *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+		return nil, nil
+	}
+	for backend, newStore := range backends {
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			s := newStore(t)
+			if err := s.UpdateWithKeyFn(ctx, testKey("a"), returnNil); !store.IsNotFound(err) {
+				t.Errorf("want not found for a missing object, got %v", err)
+			}
+			if err := s.Create(ctx, testKey("a"), newObject("a", "1")); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.UpdateWithKeyFn(ctx, testKey("a"), returnNil); !store.IsInvalid(err) {
+				t.Errorf("want invalid for an existing object, got %v", err)
+			}
+			got, err := s.Get(ctx, testKey("a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if x(got) != "1" {
+				t.Errorf("want x 1, got %s", x(got))
+			}
+		})
+	}
+}
+
+func TestCreateExists(t *testing.T) {
+	for backend, newStore := range backends {
+		t.Run(backend, func(t *testing.T) {
+			ctx := context.Background()
+			s := newStore(t)
+			if err := s.Create(ctx, testKey("a"), newObject("a", "1")); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Create(ctx, testKey("a"), newObject("a", "2")); !store.IsAlreadyExists(err) {
+				t.Errorf("want already exists, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	// the ops are dry runs that would change a or create b, they return the
+	// would-be object if any
+	cases := map[string]struct {
+		op func(ctx context.Context, s testStore) (*unstructured.Unstructured, error)
+	}{
+		"Create": {
+			op: func(ctx context.Context, s testStore) (*unstructured.Unstructured, error) {
+				obj := newObject("b", "2")
+				return obj, s.Create(ctx, testKey("b"), obj, &store.CreateOptions{DryRun: true})
+			},
+		},
+		"Update": {
+			op: func(ctx context.Context, s testStore) (*unstructured.Unstructured, error) {
+				obj := newObject("a", "2")
+				return obj, s.Update(ctx, testKey("a"), obj, &store.UpdateOptions{DryRun: true})
+			},
+		},
+		"UpdateCreates": {
+			op: func(ctx context.Context, s testStore) (*unstructured.Unstructured, error) {
+				obj := newObject("b", "2")
+				return obj, s.Update(ctx, testKey("b"), obj, &store.UpdateOptions{DryRun: true})
+			},
+		},
+		"Apply": {
+			op: func(ctx context.Context, s testStore) (*unstructured.Unstructured, error) {
+				obj := newObject("a", "2")
+				return obj, s.Apply(ctx, testKey("a"), obj, &store.ApplyOptions{DryRun: true})
+			},
+		},
+		"ServerSideApply": {
+			op: func(ctx context.Context, s testStore) (*unstructured.Unstructured, error) {
+				obj := newObject("a", "2")
+				return obj, s.Apply(ctx, testKey("a"), obj, &store.ApplyOptions{DryRun: true, FieldManager: "test", Force: true})
+			},
+		},
+		"Patch": {
+			op: func(ctx context.Context, s testStore) (*unstructured.Unstructured, error) {
+				return s.Patch(ctx, testKey("a"), types.MergePatchType, []byte(`{"data":{"x":"2"}}`), &store.PatchOptions{DryRun: true})
+			},
+		},
+		"Delete": {
+			op: func(ctx context.Context, s testStore) (*unstructured.Unstructured, error) {
+				return nil, s.Delete(ctx, testKey("a"), &store.DeleteOptions{DryRun: true})
+			},
+		},
+	}
+
+	for backend, newStore := range backends {
+		for name, tc := range cases {
+			t.Run(backend+"/"+name, func(t *testing.T) {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				s := newStore(t)
+				s.Start(ctx)
+				defer s.Stop()
+				obj := newObject("a", "1")
+				if err := s.Create(ctx, testKey("a"), obj); err != nil {
+					t.Fatal(err)
+				}
+				rv := obj.GetResourceVersion()
+				w, err := s.Watch(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer w.Stop()
+				if event := nextEvent(t, w); event.Type != watch.Added || event.Key.Name != "a" {
+					t.Fatalf("want the initial Added event of a, got %s of %v", event.Type, event.Key)
+				}
+
+				got, err := tc.op(ctx, s)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if got != nil {
+					if x(got) != "2" {
+						t.Errorf("want the would-be object with x 2, got %s", x(got))
+					}
+					if mustParse(t, got.GetResourceVersion()) <= mustParse(t, rv) {
+						t.Errorf("want the would-be resource version after %s, got %s", rv, got.GetResourceVersion())
+					}
+				}
+
+				// nothing is stored
+				stored, err := s.Get(ctx, testKey("a"))
+				if err != nil {
+					t.Fatalf("want a to be kept, got %v", err)
+				}
+				if x(stored) != "1" || stored.GetResourceVersion() != rv {
+					t.Errorf("want x 1 with resource version %s, got %s with %s", rv, x(stored), stored.GetResourceVersion())
+				}
+				if _, err := s.Get(ctx, testKey("b")); !store.IsNotFound(err) {
+					t.Errorf("want b not to be created, got %v", err)
+				}
+				// and no event is sent, the next event is the one of a real change
+				if err := s.Create(ctx, testKey("c"), newObject("c", "1")); err != nil {
+					t.Fatal(err)
+				}
+				if event := nextEvent(t, w); event.Type != watch.Added || event.Key.Name != "c" {
+					t.Errorf("want the Added event of c, got %s of %v", event.Type, event.Key)
+				}
+			})
+		}
+	}
+}
+
+// patchSchema is the schema of a strategic merge patch of the objects of the
+// tests, the items are merged by name
+type patchSchema struct {
+	metav1.TypeMeta `json:",inline"`
+	Data            struct {
+		X     string `json:"x,omitempty"`
+		Y     string `json:"y,omitempty"`
+		Items []struct {
+			Name string `json:"name"`
+			V    string `json:"v,omitempty"`
+		} `json:"items,omitempty" patchStrategy:"merge" patchMergeKey:"name"`
+	} `json:"data"`
+}
+
+func (r *patchSchema) DeepCopyObject() runtime.Object {
+	c := *r
+	return &c
+}
+
+func TestPatchTypes(t *testing.T) {
+	items := func(vs ...string) []any {
+		l := []any{}
+		for i := 0; i < len(vs); i += 2 {
+			l = append(l, map[string]any{"name": vs[i], "v": vs[i+1]})
+		}
+		return l
+	}
+	cases := map[string]struct {
+		key       string
+		patchType types.PatchType
+		patch     string
+		schema    runtime.Object
+		// want is the data of the patched object
+		want    map[string]any
+		wantErr func(error) bool
+	}{
+		"Merge": {
+			patchType: types.MergePatchType,
+			patch:     `{"data":{"y":"2","items":[{"name":"c","v":"2"}]}}`,
+			want:      map[string]any{"x": "1", "y": "2", "items": items("c", "2")},
+		},
+		"MergeRemovesField": {
+			patchType: types.MergePatchType,
+			patch:     `{"data":{"x":null}}`,
+			want:      map[string]any{"items": items("a", "1", "b", "1")},
+		},
+		"JSON": {
+			patchType: types.JSONPatchType,
+			patch:     `[{"op":"replace","path":"/data/x","value":"2"},{"op":"remove","path":"/data/items/0"}]`,
+			want:      map[string]any{"x": "2", "items": items("b", "1")},
+		},
+		"JSONFailedTest": {
+			patchType: types.JSONPatchType,
+			patch:     `[{"op":"test","path":"/data/x","value":"2"},{"op":"replace","path":"/data/x","value":"3"}]`,
+			wantErr:   store.IsInvalid,
+		},
+		// without a schema the lists are replaced
+		"Strategic": {
+			patchType: types.StrategicMergePatchType,
+			patch:     `{"data":{"y":"2","items":[{"name":"c","v":"2"}]}}`,
+			want:      map[string]any{"x": "1", "y": "2", "items": items("c", "2")},
+		},
+		"StrategicReplaceDirective": {
+			patchType: types.StrategicMergePatchType,
+			patch:     `{"data":{"$patch":"replace","y":"2"}}`,
+			want:      map[string]any{"y": "2"},
+		},
+		"StrategicSchema": {
+			patchType: types.StrategicMergePatchType,
+			patch:     `{"data":{"items":[{"name":"b","v":"2"},{"name":"c","v":"2"}]}}`,
+			schema:    &patchSchema{},
+			want:      map[string]any{"x": "1", "items": items("a", "1", "b", "2", "c", "2")},
+		},
+		"StrategicSchemaDeleteItem": {
+			patchType: types.StrategicMergePatchType,
+			patch:     `{"data":{"items":[{"name":"a","$patch":"delete"}]}}`,
+			schema:    &patchSchema{},
+			want:      map[string]any{"x": "1", "items": items("b", "1")},
+		},
+		"Unsupported": {
+			patchType: types.ApplyPatchType,
+			patch:     `{}`,
+			wantErr:   store.IsInvalid,
+		},
+		"Rename": {
+			patchType: types.MergePatchType,
+			patch:     `{"metadata":{"name":"b"}}`,
+			wantErr:   store.IsInvalid,
+		},
+		"NotFound": {
+			key:       "b",
+			patchType: types.MergePatchType,
+			patch:     `{"data":{"x":"2"}}`,
+			wantErr:   store.IsNotFound,
+		},
+	}
+
+	for backend, newStore := range backends {
+		for name, tc := range cases {
+			t.Run(backend+"/"+name, func(t *testing.T) {
+				ctx := context.Background()
+				s := newStore(t)
+				obj := newObject("a", "1")
+				obj.Object["data"] = map[string]any{"x": "1", "items": items("a", "1", "b", "1")}
+				if err := s.Create(ctx, testKey("a"), obj); err != nil {
+					t.Fatal(err)
+				}
+				key := tc.key
+				if key == "" {
+					key = "a"
+				}
+
+				got, err := s.Patch(ctx, testKey(key), tc.patchType, []byte(tc.patch), &store.PatchOptions{Schema: tc.schema})
+				if tc.wantErr != nil {
+					if !tc.wantErr(err) {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					stored, err := s.Get(ctx, testKey("a"))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if stored.GetResourceVersion() != obj.GetResourceVersion() {
+						t.Errorf("want a failed patch to keep resource version %s, got %s", obj.GetResourceVersion(), stored.GetResourceVersion())
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if !reflect.DeepEqual(got.Object["data"], tc.want) {
+					t.Errorf("want data %v, got %v", tc.want, got.Object["data"])
+				}
+				stored, err := s.Get(ctx, testKey("a"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(stored.Object["data"], tc.want) {
+					t.Errorf("want stored data %v, got %v", tc.want, stored.Object["data"])
+				}
+				if stored.GetResourceVersion() != got.GetResourceVersion() || mustParse(t, got.GetResourceVersion()) <= mustParse(t, obj.GetResourceVersion()) {
+					t.Errorf("want the resource version after %s, got %s and stored %s", obj.GetResourceVersion(), got.GetResourceVersion(), stored.GetResourceVersion())
+				}
+			})
+		}
+	}
+}
+
+// labeledObject returns an object in the namespace with the label app and the
+// data field x
+func labeledObject(namespace, name, app, x string) (store.Key, *unstructured.Unstructured) {
+	obj := newObject(name, x)
+	obj.SetNamespace(namespace)
+	obj.SetLabels(map[string]string{"app": app})
+	return store.KeyFromNSN(types.NamespacedName{Namespace: namespace, Name: name}), obj
+}
+
+func TestSelectors(t *testing.T) {
+	cases := map[string]struct {
+		opts *store.ListOptions
+		want []string
+	}{
+		"All": {
+			opts: &store.ListOptions{},
+			want: []string{"default/a", "default/b", "other/a"},
+		},
+		"Namespace": {
+			opts: &store.ListOptions{Namespace: "default"},
+			want: []string{"default/a", "default/b"},
+		},
+		"LabelSelector": {
+			opts: &store.ListOptions{LabelSelector: labels.SelectorFromSet(labels.Set{"app": "a"})},
+			want: []string{"default/a", "other/a"},
+		},
+		"LabelSelectorNotIn": {
+			opts: &store.ListOptions{LabelSelector: mustSelector(t, "app notin (a)")},
+			want: []string{"default/b"},
+		},
+		"FieldSelectorName": {
+			opts: &store.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", "a")},
+			want: []string{"default/a", "other/a"},
+		},
+		"FieldSelectorContent": {
+			opts: &store.ListOptions{FieldSelector: fields.OneTermEqualSelector("data.x", "2")},
+			want: []string{"default/b"},
+		},
+		"FieldSelectorNotEqual": {
+			opts: &store.ListOptions{FieldSelector: fields.OneTermNotEqualSelector("metadata.namespace", "default")},
+			want: []string{"other/a"},
+		},
+		"Combined": {
+			opts: &store.ListOptions{
+				Namespace:     "default",
+				LabelSelector: labels.SelectorFromSet(labels.Set{"app": "a"}),
+				FieldSelector: fields.OneTermEqualSelector("data.x", "1"),
+			},
+			want: []string{"default/a"},
+		},
+		"NoMatch": {
+			opts: &store.ListOptions{LabelSelector: labels.SelectorFromSet(labels.Set{"app": "c"})},
+			want: []string{},
+		},
+	}
+
+	for backend, newStore := range backends {
+		for name, tc := range cases {
+			t.Run(backend+"/"+name, func(t *testing.T) {
+				ctx := context.Background()
+				s := newStore(t)
+				for _, o := range []struct{ namespace, name, app, x string }{
+					{"default", "a", "a", "1"},
+					{"default", "b", "b", "2"},
+					{"other", "a", "a", "3"},
+				} {
+					key, obj := labeledObject(o.namespace, o.name, o.app, o.x)
+					if err := s.Create(ctx, key, obj); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				got := []string{}
+				if err := s.List(ctx, func(key store.Key, obj *unstructured.Unstructured) error {
+					if key.Name != obj.GetName() || key.Namespace != obj.GetNamespace() {
+						t.Errorf("key %v of object %s/%s", key, obj.GetNamespace(), obj.GetName())
+					}
+					got = append(got, key.Namespace+"/"+key.Name)
+					return nil
+				}, tc.opts); err != nil {
+					t.Fatal(err)
+				}
+				sort.Strings(got)
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("list: want %v, got %v", tc.want, got)
+				}
+				keys, err := s.ListKeys(ctx, tc.opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(keys) != len(tc.want) {
+					t.Errorf("list keys: want %d keys, got %v", len(tc.want), keys)
+				}
+				n, err := s.Len(ctx, tc.opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != len(tc.want) {
+					t.Errorf("len: want %d, got %d", len(tc.want), n)
+				}
+			})
+		}
+	}
+}
+
+func mustSelector(t *testing.T, selector string) labels.Selector {
+	t.Helper()
+	s, err := labels.Parse(selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestWatchSelector(t *testing.T) {
+	for backend, newStore := range backends {
+		t.Run(backend, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			s := newStore(t)
+			s.Start(ctx)
+			defer s.Stop()
+			w, err := s.Watch(ctx, &store.ListOptions{LabelSelector: labels.SelectorFromSet(labels.Set{"app": "a"})})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Stop()
+
+			// want checks the next event of the watch, the object has the label
+			want := func(eventType watch.EventType, name, app string) {
+				t.Helper()
+				event := nextEvent(t, w)
+				if event.Type != eventType || event.Key.Name != name || event.Object == nil || event.Object.GetLabels()["app"] != app {
+					t.Fatalf("want %s of %s with app %s, got %s of %v with %v, %v", eventType, name, app, event.Type, event.Key, event.Object, event.Err)
+				}
+			}
+			write := func(name, app string, create bool) {
+				t.Helper()
+				key, obj := labeledObject("default", name, app, "1")
+				if create {
+					err = s.Create(ctx, key, obj)
+				} else {
+					err = s.Update(ctx, key, obj)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			remove := func(name string) {
+				t.Helper()
+				if err := s.Delete(ctx, testKey(name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			write("a", "a", true)
+			want(watch.Added, "a", "a")
+			// b is not selected
+			write("b", "b", true)
+			// b moves into the selector
+			write("b", "a", false)
+			want(watch.Added, "b", "a")
+			// a moves out of the selector, it is deleted as it was last seen
+			write("a", "b", false)
+			want(watch.Deleted, "a", "a")
+			// a is no longer selected
+			remove("a")
+			remove("b")
+			want(watch.Deleted, "b", "a")
+			write("c", "a", true)
+			want(watch.Added, "c", "a")
+		})
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	setX := func(x string) func(context.Context, *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+		return func(_ context.Context, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+			obj.Object["data"] = map[string]any{"x": x}
+			return obj, nil
+		}
+	}
+	// the ops change a one after the other, x is the data field x of a after
+	// the op, the old object has the x of the previous op
+	ops := []struct {
+		name      string
+		op        func(ctx context.Context, s testStore) error
+		eventType watch.EventType
+		x         string
+	}{
+		{
+			name:      "Create",
+			op:        func(ctx context.Context, s testStore) error { return s.Create(ctx, testKey("a"), newObject("a", "1")) },
+			eventType: watch.Added,
+			x:         "1",
+		},
+		{
+			name:      "Update",
+			op:        func(ctx context.Context, s testStore) error { return s.Update(ctx, testKey("a"), newObject("a", "2")) },
+			eventType: watch.Modified,
+			x:         "2",
+		},
+		{
+			name:      "Apply",
+			op:        func(ctx context.Context, s testStore) error { return s.Apply(ctx, testKey("a"), newObject("a", "3")) },
+			eventType: watch.Modified,
+			x:         "3",
+		},
+		{
+			name:      "UpdateWithKeyFn",
+			op:        func(ctx context.Context, s testStore) error { return s.UpdateWithKeyFn(ctx, testKey("a"), setX("4")) },
+			eventType: watch.Modified,
+			x:         "4",
+		},
+		{
+			name: "Patch",
+			op: func(ctx context.Context, s testStore) error {
+				_, err := s.Patch(ctx, testKey("a"), types.MergePatchType, []byte(`{"data":{"x":"5"}}`))
+				return err
+			},
+			eventType: watch.Modified,
+			x:         "5",
+		},
+		{
+			name:      "Delete",
+			op:        func(ctx context.Context, s testStore) error { return s.Delete(ctx, testKey("a")) },
+			eventType: watch.Deleted,
+			x:         "5",
+		},
+	}
+
+	for backend, newStore := range backends {
+		t.Run(backend, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			s := newStore(t)
+			s.Start(ctx)
+			defer s.Stop()
+			w, err := s.Watch(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Stop()
+
+			var old *unstructured.Unstructured
+			var rv uint64
+			for _, op := range ops {
+				if err := op.op(ctx, s); err != nil {
+					t.Fatalf("%s: %v", op.name, err)
+				}
+				event := nextEvent(t, w)
+				if event.Type != op.eventType || event.Key.Namespace != "default" || event.Key.Name != "a" {
+					t.Fatalf("%s: want %s of default/a, got %s of %v, %v", op.name, op.eventType, event.Type, event.Key, event.Err)
+				}
+				if event.Object == nil || x(event.Object) != op.x {
+					t.Errorf("%s: want object with x %s, got %v", op.name, op.x, event.Object)
+				}
+				switch op.eventType {
+				case watch.Added:
+					if event.OldObject != nil {
+						t.Errorf("%s: want no old object, got %v", op.name, event.OldObject)
+					}
+				default:
+					if event.OldObject == nil || x(event.OldObject) != x(old) || event.OldObject.GetResourceVersion() != old.GetResourceVersion() {
+						t.Errorf("%s: want old object with x %s and resource version %s, got %v", op.name, x(old), old.GetResourceVersion(), event.OldObject)
+					}
+				}
+				eventRV := mustParse(t, event.ResourceVersion)
+				if eventRV <= rv {
+					t.Errorf("%s: want a resource version after %d, got %d", op.name, rv, eventRV)
+				}
+				if op.eventType != watch.Deleted && event.Object.GetResourceVersion() != event.ResourceVersion {
+					t.Errorf("%s: want the object with the resource version %s of the event, got %s", op.name, event.ResourceVersion, event.Object.GetResourceVersion())
+				}
+				rv = eventRV
+				old = event.Object
+			}
+		})
+	}
+}
+
+func TestSlowWatcher(t *testing.T) {
+	cases := map[string]struct {
+		policy watch.SlowConsumerPolicy
+	}{
+		"Terminate":  {policy: watch.TerminatePolicy},
+		"DropOldest": {policy: watch.DropOldestPolicy},
+		"Block":      {policy: watch.BlockPolicy},
+	}
+	const n = 20
+
+	for backend, newStore := range backends {
+		for name, tc := range cases {
+			t.Run(backend+"/"+name, func(t *testing.T) {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				s := newStore(t)
+				s.Start(ctx)
+				defer s.Stop()
+				w, err := s.Watch(ctx, &store.ListOptions{WatchBufferSize: 2, WatchPolicy: tc.policy})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer w.Stop()
+				// the watcher has listed the store once it gets the event of the marker
+				if err := s.Create(ctx, testKey("marker"), newObject("marker", "1")); err != nil {
+					t.Fatal(err)
+				}
+				if event := nextEvent(t, w); event.Key.Name != "marker" {
+					t.Fatalf("want the event of the marker, got %s of %v", event.Type, event.Key)
+				}
+
+				// the writes do not wait for the watcher that is not read
+				done := make(chan error, 1)
+				go func() {
+					for i := 0; i < n; i++ {
+						name := fmt.Sprintf("a%d", i)
+						if err := s.Create(ctx, testKey(name), newObject(name, "1")); err != nil {
+							done <- err
+							return
+						}
+					}
+					done <- nil
+				}()
+				select {
+				case err := <-done:
+					if err != nil {
+						t.Fatal(err)
+					}
+				case <-time.After(10 * time.Second):
+					t.Fatalf("writes are blocked by the watcher")
+				}
+
+				got := []int{}
+				for {
+					event := nextEvent(t, w)
+					if event.Type == watch.Error {
+						if tc.policy != watch.TerminatePolicy || !store.IsUnavailable(event.Err) {
+							t.Fatalf("unexpected error event: %v", event.Err)
+						}
+						return
+					}
+					var i int
+					if _, err := fmt.Sscanf(event.Key.Name, "a%d", &i); err != nil {
+						t.Fatalf("unexpected event of %v", event.Key)
+					}
+					if len(got) > 0 && i <= got[len(got)-1] {
+						t.Fatalf("want the events in order, got a%d after %v", i, got)
+					}
+					got = append(got, i)
+					if i == n-1 {
+						break
+					}
+				}
+				// a terminated watcher may have kept up, a blocking watcher gets all events
+				if tc.policy != watch.DropOldestPolicy && len(got) != n {
+					t.Errorf("want all %d events, got %v", n, got)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package codec provides the serialization formats of the files of the
+// unstructured file based stores.
+package codec
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// Codec encodes the content of an unstructured object to the content of a
+// file and back
+type Codec interface {
+	// Name of the codec
+	Name() string
+	// Extension of the files, including the leading dot
+	Extension() string
+	// Encode encodes the content of an object
+	Encode(obj map[string]any) ([]byte, error)
+	// Decode decodes the content of an object
+	Decode(data []byte) (map[string]any, error)
+}
+
+var (
+	// YAML encodes the objects as yaml files
+	YAML Codec = yamlCodec{}
+	// JSON encodes the objects as indented json files
+	JSON Codec = jsonCodec{indent: true}
+	// CompactJSON encodes the objects as json files without whitespace
+	CompactJSON Codec = jsonCodec{}
+	// CBOR encodes the objects as deterministic cbor files
+	CBOR Codec = newCBORCodec()
+
+	// Default is the codec of the stores when none is configured
+	Default = YAML
+)
+
+type yamlCodec struct{}
+
+func (r yamlCodec) Name() string      { return "yaml" }
+func (r yamlCodec) Extension() string { return ".yaml" }
+
+func (r yamlCodec) Encode(obj map[string]any) ([]byte, error) {
+	return yaml.Marshal(obj)
+}
+
+func (r yamlCodec) Decode(data []byte) (map[string]any, error) {
+	obj := map[string]any{}
+	if err := yaml.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+type jsonCodec struct {
+	indent bool
+}
+
+func (r jsonCodec) Name() string {
+	if r.indent {
+		return "json"
+	}
+	return "compact-json"
+}
+
+func (r jsonCodec) Extension() string { return ".json" }
+
+func (r jsonCodec) Encode(obj map[string]any) ([]byte, error) {
+	if !r.indent {
+		return json.Marshal(obj)
+	}
+	b, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func (r jsonCodec) Decode(data []byte) (map[string]any, error) {
+	obj := map[string]any{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func newCBORCodec() cborCodec {
+	enc, err := cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		panic(err)
+	}
+	dec, err := cbor.DecOptions{
+		// objects are decoded like json: maps with string keys and signed integers
+		DefaultMapType: reflect.TypeOf(map[string]any(nil)),
+		IntDec:         cbor.IntDecConvertSignedOrFail,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return cborCodec{enc: enc, dec: dec}
+}
+
+func (r cborCodec) Name() string      { return "cbor" }
+func (r cborCodec) Extension() string { return ".cbor" }
+
+func (r cborCodec) Encode(obj map[string]any) ([]byte, error) {
+	return r.enc.Marshal(obj)
+}
+
+func (r cborCodec) Decode(data []byte) (map[string]any, error) {
+	obj := map[string]any{}
+	if err := r.dec.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
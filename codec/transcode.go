@@ -0,0 +1,145 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/encryption"
+	"github.com/henderiw/store/util.go"
+)
+
+// Transcode rewrites the files of one codec in the root path with another codec,
+// e.g. to move a store from yaml to cbor files. Hidden files and files with
+// another extension are left alone. The encrypter of the store decrypts and
+// encrypts the files, nil when the files are not encrypted.
+//
+// The files are rewritten under the key locks of their objects and the store
+// lock, with a journal such that either all or none of the files are rewritten.
+// A journal left behind by a crash is rolled back when the store is opened or
+// Transcode is run again, a rerun transcodes the files that are left. The store
+// must not be running with the old codec, for a git backed store the result has
+// to be committed.
+func Transcode(rootPath string, from, to Codec, e *encryption.Encrypter) error {
+	locks := util.NewStoreLocks(rootPath)
+	journal := util.NewJournal(rootPath)
+	if _, err := journal.Recover(locks); err != nil {
+		return err
+	}
+
+	keys := []string{}
+	if err := walk(rootPath, from.Extension(), func(key, _ string) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	kl, err := locks.LockKeys(keys, true)
+	if err != nil {
+		return err
+	}
+	defer kl.Unlock()
+	sl, err := locks.LockStore(true)
+	if err != nil {
+		return err
+	}
+	defer sl.Unlock()
+
+	locked := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		locked[key] = true
+	}
+	// all files are transcoded before any file is written, the files created
+	// since the keys were locked are left for a rerun
+	entries := []util.JournalEntry{}
+	if err := walk(rootPath, from.Extension(), func(key, rel string) error {
+		if !locked[key] {
+			return nil
+		}
+		path := filepath.Join(rootPath, filepath.FromSlash(rel))
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if e != nil {
+			if content, _, err = e.Decrypt(key, content); err != nil {
+				return &store.Error{Err: store.ErrInvalid, Message: fmt.Sprintf("cannot decrypt %s", path), Cause: err}
+			}
+		}
+		obj, err := from.Decode(content)
+		if err != nil {
+			return &store.Error{Err: store.ErrInvalid, Message: fmt.Sprintf("cannot decode %s as %s", path, from.Name()), Cause: err}
+		}
+		data, err := to.Encode(obj)
+		if err != nil {
+			return &store.Error{Err: store.ErrInvalid, Message: fmt.Sprintf("cannot encode %s as %s", path, to.Name()), Cause: err}
+		}
+		if e != nil {
+			if data, err = e.Encrypt(key, data); err != nil {
+				return &store.Error{Err: store.ErrInvalid, Message: fmt.Sprintf("cannot encrypt %s", path), Cause: err}
+			}
+		}
+		dst := key + to.Extension()
+		entries = append(entries, util.JournalEntry{Key: key, Path: dst, Data: data})
+		if dst == rel {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(rootPath, filepath.FromSlash(dst))); !errors.Is(err, os.ErrNotExist) {
+			if err != nil {
+				return err
+			}
+			return &store.Error{Err: store.ErrAlreadyExists, Message: fmt.Sprintf("cannot transcode %s, %s exists", rel, dst)}
+		}
+		entries = append(entries, util.JournalEntry{Key: key, Path: rel, Delete: true})
+		return nil
+	}); err != nil {
+		return err
+	}
+	return journal.Commit(entries)
+}
+
+// walk calls fn with the key lock path and the relative path of the files with
+// the extension in the root path, the store keeps its locks and journals in
+// hidden directories
+func walk(rootPath, extension string, fn func(key, rel string) error) error {
+	return filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != rootPath && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") || !strings.HasSuffix(info.Name(), extension) {
+			return nil
+		}
+		rel, err := filepath.Rel(rootPath, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		return fn(strings.TrimSuffix(rel, extension), rel)
+	})
+}
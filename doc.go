@@ -0,0 +1,25 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package store defines the stores of objects, their options, errors and watch
+// events. The stores are implemented by the memory, memoryu, file, fileu and gitu
+// packages.
+//
+// The file based stores map the keys to file paths with a KeyEncoder, the
+// namespaces and names are escaped such that every key has its own path. A store
+// with files written before the keys were escaped, e.g. a name with a ':', fails
+// to open with an Invalid error naming the file. Such files are moved once with
+// MigrateLegacyKeys, or every time the store is opened with the MigrateKeys option
+// of the file and fileu stores.
+package store
@@ -0,0 +1,209 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package encryption encrypts the files of the file based stores at rest with
+// AES-GCM. Every file carries the id of the key it is encrypted with, such that
+// keys can be rotated: a new key is added as primary key, the files are
+// re-encrypted and the old key is removed.
+//
+// The content of a file is bound to the path of its key, the path relative to
+// the root path of the store without the extension, such that the content of
+// one object cannot be passed off as another object. Files moved to another
+// path, e.g. by store.MigrateKeys, are rebound with Encrypter.Rebind.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// prefix is the header of an encrypted file, followed by the key id, a colon,
+// the nonce and the sealed content. The path of the key of the file is the
+// additional data of the sealed content.
+const prefix = "store:enc:aesgcm:v2:"
+
+// legacyPrefix is the header of the files encrypted before the content was
+// bound to its path, they are decrypted as stale content
+const legacyPrefix = "store:enc:aesgcm:v1:"
+
+// Key is an AES key of 16, 24 or 32 bytes identified by its id
+type Key struct {
+	ID     string `json:"id"`
+	Secret []byte `json:"secret"`
+}
+
+// KeyFile is the content of a key file, the first key is the primary key
+type KeyFile struct {
+	Keys []Key `json:"keys"`
+	// Require rejects the files that are not encrypted, by default they are read
+	// as is such that encryption can be enabled on an existing store
+	Require bool `json:"require,omitempty"`
+}
+
+// Encrypter encrypts with the primary key and decrypts with any of its keys
+type Encrypter struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+	// require rejects the content that is not encrypted
+	require bool
+}
+
+// New returns an encrypter for the keys, the first key is the primary key
+func New(keys []Key) (*Encrypter, error) {
+	return NewFromKeyFile(&KeyFile{Keys: keys})
+}
+
+// NewFromKeyFile returns an encrypter for the keys of the key file
+func NewFromKeyFile(keyFile *KeyFile) (*Encrypter, error) {
+	keys := keyFile.Keys
+	if len(keys) == 0 {
+		return nil, errors.New("no encryption keys")
+	}
+	r := &Encrypter{
+		primary: keys[0].ID,
+		aeads:   map[string]cipher.AEAD{},
+		require: keyFile.Require,
+	}
+	for _, key := range keys {
+		if key.ID == "" || strings.Contains(key.ID, ":") {
+			return nil, fmt.Errorf("invalid encryption key id %q", key.ID)
+		}
+		if _, ok := r.aeads[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate encryption key id %q", key.ID)
+		}
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %q, err: %v", key.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %q, err: %v", key.ID, err)
+		}
+		r.aeads[key.ID] = aead
+	}
+	return r, nil
+}
+
+// LoadKeyFile returns an encrypter for the keys in the yaml or json key file
+func LoadKeyFile(filename string) (*Encrypter, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	keyFile := KeyFile{}
+	if err := yaml.Unmarshal(b, &keyFile); err != nil {
+		return nil, fmt.Errorf("cannot decode key file %s, err: %v", filename, err)
+	}
+	return NewFromKeyFile(&keyFile)
+}
+
+// WriteKeyFile writes the keys to a key file only readable by its owner
+func WriteKeyFile(filename string, keys []Key) error {
+	b, err := yaml.Marshal(&KeyFile{Keys: keys})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, b, 0600)
+}
+
+// GenerateKey returns a new random 32 byte key
+func GenerateKey(id string) (Key, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, err
+	}
+	return Key{ID: id, Secret: secret}, nil
+}
+
+// IsEncrypted returns true if the content is encrypted
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(prefix)) || bytes.HasPrefix(data, []byte(legacyPrefix))
+}
+
+// Encrypt encrypts the content of the file of the key path with the primary key
+func (r *Encrypter) Encrypt(path string, plaintext []byte) ([]byte, error) {
+	aead := r.aeads[r.primary]
+	header := prefix + r.primary + ":"
+	out := make([]byte, len(header)+aead.NonceSize(), len(header)+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	copy(out, header)
+	nonce := out[len(header):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, plaintext, []byte(path)), nil
+}
+
+// Decrypt decrypts the content of the file of the key path, content that is not
+// encrypted is returned as is such that encryption can be enabled on an existing
+// store, unless encryption is required. Stale is true when the content is not
+// encrypted with the primary key and has to be re-encrypted.
+func (r *Encrypter) Decrypt(path string, data []byte) (plaintext []byte, stale bool, err error) {
+	if !IsEncrypted(data) && r.require {
+		return nil, false, errors.New("content is not encrypted")
+	}
+	return r.decrypt(path, data)
+}
+
+// Rebind encrypts the content of the file of the from key path for the to key
+// path, e.g. when the file is moved. Content that is not encrypted is returned
+// as is.
+func (r *Encrypter) Rebind(from, to string, data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+	plaintext, _, err := r.decrypt(from, data)
+	if err != nil {
+		return nil, err
+	}
+	return r.Encrypt(to, plaintext)
+}
+
+// decrypt decrypts the content, content that is not encrypted is returned as is
+func (r *Encrypter) decrypt(path string, data []byte) (plaintext []byte, stale bool, err error) {
+	var rest, ad []byte
+	switch {
+	case bytes.HasPrefix(data, []byte(prefix)):
+		rest, ad = data[len(prefix):], []byte(path)
+	case bytes.HasPrefix(data, []byte(legacyPrefix)):
+		rest = data[len(legacyPrefix):]
+	default:
+		return data, true, nil
+	}
+	i := bytes.IndexByte(rest, ':')
+	if i < 0 {
+		return nil, false, errors.New("invalid encryption header")
+	}
+	id := string(rest[:i])
+	aead, ok := r.aeads[id]
+	if !ok {
+		return nil, false, fmt.Errorf("unknown encryption key %q", id)
+	}
+	sealed := rest[i+1:]
+	if len(sealed) < aead.NonceSize() {
+		return nil, false, errors.New("truncated encrypted content")
+	}
+	plaintext, err = aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot decrypt %s with key %q, err: %v", path, id, err)
+	}
+	return plaintext, id != r.primary || ad == nil, nil
+}
@@ -0,0 +1,221 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encryption
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newKey(t *testing.T, id string) Key {
+	t.Helper()
+	key, err := GenerateKey(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newEncrypter(t *testing.T, keyFile *KeyFile) *Encrypter {
+	t.Helper()
+	e, err := NewFromKeyFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestDecrypt(t *testing.T) {
+	k1 := newKey(t, "k1")
+	k2 := newKey(t, "k2")
+	plaintext := []byte(`{"a":"1"}`)
+	encrypted, err := newEncrypter(t, &KeyFile{Keys: []Key{k1}}).Encrypt("default/a", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newEncrypter(t, &KeyFile{Keys: []Key{k1}}).Encrypt("default/b", []byte(`{"b":"1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Clone(encrypted)
+	tampered[len(tampered)-1] ^= 1
+
+	cases := map[string]struct {
+		keyFile *KeyFile
+		path    string
+		data    []byte
+		wantErr bool
+		// want is the decrypted content, the data when not set
+		want  []byte
+		stale bool
+	}{
+		"RoundTrip": {
+			keyFile: &KeyFile{Keys: []Key{k1}},
+			path:    "default/a",
+			data:    encrypted,
+			want:    plaintext,
+		},
+		"Rotated": {
+			keyFile: &KeyFile{Keys: []Key{k2, k1}},
+			path:    "default/a",
+			data:    encrypted,
+			want:    plaintext,
+			stale:   true,
+		},
+		"WrongKey": {
+			keyFile: &KeyFile{Keys: []Key{{ID: "k1", Secret: k2.Secret}}},
+			path:    "default/a",
+			data:    encrypted,
+			wantErr: true,
+		},
+		"UnknownKey": {
+			keyFile: &KeyFile{Keys: []Key{k2}},
+			path:    "default/a",
+			data:    encrypted,
+			wantErr: true,
+		},
+		"Tampered": {
+			keyFile: &KeyFile{Keys: []Key{k1}},
+			path:    "default/a",
+			data:    tampered,
+			wantErr: true,
+		},
+		"Truncated": {
+			keyFile: &KeyFile{Keys: []Key{k1}},
+			path:    "default/a",
+			data:    encrypted[:len(prefix)+len("k1:")+4],
+			wantErr: true,
+		},
+		"OtherPath": {
+			keyFile: &KeyFile{Keys: []Key{k1}},
+			path:    "default/a",
+			data:    other,
+			wantErr: true,
+		},
+		"Plaintext": {
+			keyFile: &KeyFile{Keys: []Key{k1}},
+			path:    "default/a",
+			data:    plaintext,
+			want:    plaintext,
+			stale:   true,
+		},
+		"PlaintextRequired": {
+			keyFile: &KeyFile{Keys: []Key{k1}, Require: true},
+			path:    "default/a",
+			data:    plaintext,
+			wantErr: true,
+		},
+		"EncryptedRequired": {
+			keyFile: &KeyFile{Keys: []Key{k1}, Require: true},
+			path:    "default/a",
+			data:    encrypted,
+			want:    plaintext,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, stale, err := newEncrypter(t, tc.keyFile).Decrypt(tc.path, tc.data)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("want %s, got %s", tc.want, got)
+			}
+			if stale != tc.stale {
+				t.Errorf("want stale %t, got %t", tc.stale, stale)
+			}
+		})
+	}
+}
+
+func TestRebind(t *testing.T) {
+	e := newEncrypter(t, &KeyFile{Keys: []Key{newKey(t, "k1")}})
+	plaintext := []byte(`{"a":"1"}`)
+	encrypted, err := e.Encrypt("default_a", plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebound, err := e.Rebind("default_a", "default/a", encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := e.Decrypt("default_a", rebound); err == nil {
+		t.Errorf("want the content not to be bound to the old path")
+	}
+	if got, _, err := e.Decrypt("default/a", rebound); err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("want %s, got %s: %v", plaintext, got, err)
+	}
+}
+
+func TestReEncrypt(t *testing.T) {
+	k1 := newKey(t, "k1")
+	k2 := newKey(t, "k2")
+	rootPath := t.TempDir()
+	write := func(name string, data []byte) {
+		t.Helper()
+		path := filepath.Join(rootPath, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := newEncrypter(t, &KeyFile{Keys: []Key{k1}})
+	encrypted, err := old.Encrypt("default/a", []byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("default/a.json", encrypted)
+	write("default/b.json", []byte("b"))
+
+	// the files are rotated to the primary key, also when encryption is required
+	e := newEncrypter(t, &KeyFile{Keys: []Key{k2, k1}, Require: true})
+	n, err := ReEncrypt(rootPath, ".json", e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("want 2 rewritten files, got %d", n)
+	}
+	// the old key is removed
+	e = newEncrypter(t, &KeyFile{Keys: []Key{k2}, Require: true})
+	for path, want := range map[string]string{"default/a": "a", "default/b": "b"} {
+		content, err := os.ReadFile(filepath.Join(rootPath, filepath.FromSlash(path)+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, stale, err := e.Decrypt(path, content)
+		if err != nil {
+			t.Fatalf("cannot decrypt %s: %v", path, err)
+		}
+		if string(got) != want || stale {
+			t.Errorf("want %s not stale, got %s stale %t", want, got, stale)
+		}
+	}
+	// the files encrypted with the primary key are left alone
+	if n, err := ReEncrypt(rootPath, ".json", e); err != nil || n != 0 {
+		t.Errorf("want no rewritten files, got %d: %v", n, err)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encryption
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/util.go"
+)
+
+// ReEncrypt encrypts the files with the extension in the root path with the
+// primary key of the encrypter, files encrypted with another key or not
+// encrypted at all are rewritten, also when encryption is required. It returns
+// the number of rewritten files.
+// Every file is rewritten under the lock of its object, such that the store can
+// be running, the content and resource version of the objects do not change.
+func ReEncrypt(rootPath, extension string, e *Encrypter) (int, error) {
+	locks := util.NewStoreLocks(rootPath)
+	n := 0
+	err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// the store keeps its locks in hidden directories
+			if path != rootPath && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") || !strings.HasSuffix(info.Name(), extension) {
+			return nil
+		}
+		rel, err := filepath.Rel(rootPath, path)
+		if err != nil {
+			return err
+		}
+		keyPath := strings.TrimSuffix(filepath.ToSlash(rel), extension)
+		l, err := locks.LockKey(keyPath, true)
+		if err != nil {
+			return err
+		}
+		defer l.Unlock()
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			// the object is deleted while walking the directory
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		plaintext, stale, err := e.decrypt(keyPath, content)
+		if err != nil {
+			return &store.Error{Err: store.ErrInvalid, Message: fmt.Sprintf("cannot decrypt %s", path), Cause: err}
+		}
+		if !stale {
+			return nil
+		}
+		data, err := e.Encrypt(keyPath, plaintext)
+		if err != nil {
+			return err
+		}
+		if err := util.WriteFileAtomic(path, data, info.Mode().Perm()); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,188 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// sentinel errors, the errors returned by the stores match them with errors.Is
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrConflict      = errors.New("conflict")
+	ErrInvalid       = errors.New("invalid")
+	ErrUnavailable   = errors.New("unavailable")
+	ErrGone          = errors.New("gone")
+)
+
+// Error is the error returned by the stores. The Err field identifies the
+// class of the error and is one of the sentinel errors, Cause holds the
+// underlying error if any.
+type Error struct {
+	Err     error
+	Key     Key
+	Message string
+	Cause   error
+}
+
+func (r *Error) Error() string {
+	msg := r.Err.Error()
+	if r.Key.Name != "" {
+		msg = fmt.Sprintf("%s, nsn: %s", msg, r.Key.String())
+	}
+	if r.Message != "" {
+		msg = fmt.Sprintf("%s, %s", msg, r.Message)
+	}
+	if r.Cause != nil {
+		msg = fmt.Sprintf("%s, err: %s", msg, r.Cause.Error())
+	}
+	return msg
+}
+
+func (r *Error) Is(target error) bool {
+	return target == r.Err
+}
+
+func (r *Error) Unwrap() error {
+	return r.Cause
+}
+
+func NewNotFoundError(key Key, cause error) error {
+	return &Error{Err: ErrNotFound, Key: key, Cause: cause}
+}
+
+func NewAlreadyExistsError(key Key) error {
+	return &Error{Err: ErrAlreadyExists, Key: key}
+}
+
+func NewConflictError(key Key, expected, actual string) error {
+	return &Error{
+		Err:     ErrConflict,
+		Key:     key,
+		Message: fmt.Sprintf("expected resourceVersion %q, actual resourceVersion %q", expected, actual),
+	}
+}
+
+func NewInvalidError(key Key, msg string, cause error) error {
+	return &Error{Err: ErrInvalid, Key: key, Message: msg, Cause: cause}
+}
+
+func NewUnavailableError(msg string, cause error) error {
+	return &Error{Err: ErrUnavailable, Message: msg, Cause: cause}
+}
+
+func NewGoneError(msg string) error {
+	return &Error{Err: ErrGone, Message: msg}
+}
+
+// IsNotFound returns true if the error indicates the object does not exist
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// IsAlreadyExists returns true if the error indicates the object already exists
+func IsAlreadyExists(err error) bool {
+	return errors.Is(err, ErrAlreadyExists)
+}
+
+// IsConflict returns true if the error is a resource version conflict
+func IsConflict(err error) bool {
+	return errors.Is(err, ErrConflict)
+}
+
+// IsInvalid returns true if the error indicates the object or request is invalid
+func IsInvalid(err error) bool {
+	return errors.Is(err, ErrInvalid)
+}
+
+// IsUnavailable returns true if the error indicates the store cannot serve the request
+func IsUnavailable(err error) bool {
+	return errors.Is(err, ErrUnavailable)
+}
+
+// IsGone returns true if the error indicates the requested resource version is too old
+func IsGone(err error) bool {
+	return errors.Is(err, ErrGone)
+}
+
+// SkippedObject is an object skipped by a list because it cannot be read
+type SkippedObject struct {
+	Key Key
+	Err error
+}
+
+// ListError is returned by a list that skipped objects that cannot be read, e.g.
+// corrupt files, once all other objects are visited. It is not returned when the
+// list options have an ErrorFunc.
+type ListError struct {
+	Skipped []SkippedObject
+}
+
+func (r *ListError) Error() string {
+	msgs := make([]string, 0, len(r.Skipped))
+	for _, skipped := range r.Skipped {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", skipped.Key.String(), skipped.Err.Error()))
+	}
+	return fmt.Sprintf("skipped %d unreadable objects: %s", len(r.Skipped), strings.Join(msgs, "; "))
+}
+
+// IsListError returns the objects skipped by a list
+func IsListError(err error) ([]SkippedObject, bool) {
+	var listErr *ListError
+	if errors.As(err, &listErr) {
+		return listErr.Skipped, true
+	}
+	return nil, false
+}
+
+// ToStatusError converts an error returned by a store to a k8s StatusError
+// for the given group resource. Errors that are not classified by the store
+// are returned as internal errors.
+func ToStatusError(gr schema.GroupResource, err error) *apierrors.StatusError {
+	if err == nil {
+		return nil
+	}
+	var statusErr *apierrors.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr
+	}
+	var storeErr *Error
+	if !errors.As(err, &storeErr) {
+		return apierrors.NewInternalError(err)
+	}
+	name := storeErr.Key.Name
+	switch storeErr.Err {
+	case ErrNotFound:
+		return apierrors.NewNotFound(gr, name)
+	case ErrAlreadyExists:
+		return apierrors.NewAlreadyExists(gr, name)
+	case ErrConflict:
+		return apierrors.NewConflict(gr, name, err)
+	case ErrInvalid:
+		return apierrors.NewBadRequest(err.Error())
+	case ErrUnavailable:
+		return apierrors.NewServiceUnavailable(err.Error())
+	case ErrGone:
+		return apierrors.NewResourceExpired(err.Error())
+	default:
+		return apierrors.NewInternalError(err)
+	}
+}
@@ -18,22 +18,20 @@ import (
 	"context"
 	"fmt"
 	"path/filepath"
-	"reflect"
 	"sync"
 
 	"github.com/henderiw/logger/log"
 	"github.com/henderiw/store"
+	"github.com/henderiw/store/encryption"
+	"github.com/henderiw/store/fswatch"
+	"github.com/henderiw/store/internal/filestore"
 	"github.com/henderiw/store/util.go"
 	"github.com/henderiw/store/watch"
 	"github.com/henderiw/store/watcher"
 	"github.com/henderiw/store/watchermanager"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-)
-
-const (
-	// errors
-	NotFound = "not found"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 type Config struct {
@@ -41,35 +39,137 @@ type Config struct {
 	RootPath      string
 	Codec         runtime.Codec
 	NewFunc       func() runtime.Object
+	// KeyEncoder maps the keys to file paths, store.DefaultKeyEncoder is used when not set
+	KeyEncoder store.KeyEncoder
+	// FileWatch enables the detection of files changed outside of the store when
+	// the store is started, e.g. by editing them, the watchers get the changed objects
+	FileWatch *fswatch.Config
+	// Encrypter encrypts the files at rest, see encryption.LoadKeyFile, the files
+	// are not encrypted when not set. Files that are not encrypted yet are read
+	// as is and encrypted when they are written, see encryption.ReEncrypt, unless
+	// the key file requires encryption.
+	Encrypter *encryption.Encrypter
+	// MigrateKeys moves the files written before the keys were escaped to the paths
+	// of the key encoder when the store is opened, see store.MigrateLegacyKeys. The
+	// other stores sharing the root path must not be running. Without it the store
+	// fails to open with such files.
+	MigrateKeys bool
 }
 
-func NewStore(cfg *Config) (store.Storer[runtime.Object], error) {
-	objRootPath := filepath.Join(cfg.RootPath, cfg.GroupResource.Group, cfg.GroupResource.Resource)
-	if err := util.EnsureDir(objRootPath); err != nil {
+func NewStore(cfg *Config) (store.ObjectStore, error) {
+	r, err := NewStoreV2(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return store.AdaptPatchV1[runtime.Object](r), nil
+}
+
+// NewStoreV2 returns a store of the files in the root path. The processes sharing
+// the root path are coordinated by advisory file locks, on platforms without
+// file locks (not unix) only the stores of a single process are coordinated and
+// a warning is logged once.
+func NewStoreV2(cfg *Config) (store.ObjectStoreV2, error) {
+	r := newFile(cfg)
+	if err := util.EnsureDir(r.objRootPath); err != nil {
 		return nil, fmt.Errorf("unable to write data dir: %s", err)
 	}
-	return &file{
+	// complete the transactions interrupted by a crash
+	if _, err := r.journal.Recover(r.locks); err != nil {
+		return nil, fmt.Errorf("unable to recover transactions: %s", err)
+	}
+	if cfg.MigrateKeys {
+		var rewrite store.RewriteFunc
+		if r.encrypter != nil {
+			rewrite = r.encrypter.Rebind
+		}
+		if err := store.MigrateLegacyKeys(r.objRootPath, ".json", r.keyEncoder, rewrite); err != nil {
+			return nil, fmt.Errorf("unable to migrate keys: %s", err)
+		}
+	}
+	// the files that are not a path of the key encoder would be skipped
+	if err := store.CheckKeys(r.objRootPath, ".json", r.keyEncoder); err != nil {
+		return nil, err
+	}
+	r.initResourceVersion()
+	return r, nil
+}
+
+// newFile returns the store of the config without touching the files
+func newFile(cfg *Config) *file {
+	objRootPath := filepath.Join(cfg.RootPath, cfg.GroupResource.Group, cfg.GroupResource.Resource)
+	r := &file{
 		objRootPath:    objRootPath,
+		keyEncoder:     cfg.KeyEncoder,
+		locks:          util.NewStoreLocks(objRootPath),
+		journal:        util.NewJournal(objRootPath),
+		encrypter:      cfg.Encrypter,
 		codec:          cfg.Codec,
 		newFunc:        cfg.NewFunc,
 		watchermanager: watchermanager.New[runtime.Object](64),
-	}, nil
+	}
+	if r.keyEncoder == nil {
+		r.keyEncoder = store.DefaultKeyEncoder
+	}
+	r.files = &filestore.Files[runtime.Object]{
+		RootPath:            objRootPath,
+		Extension:           ".json",
+		KeyEncoder:          r.keyEncoder,
+		Locks:               r.locks,
+		Journal:             r.journal,
+		LockKey:             r.lockKey,
+		ReadObject:          r.readFile,
+		ReadContent:         r.readContent,
+		Decrypt:             r.decrypt,
+		Decode:              r.decode,
+		Marshal:             r.marshal,
+		PeekResourceVersion: r.peekResourceVersion,
+		NextResourceVersion: func() (uint64, error) {
+			err := r.nextResourceVersion()
+			return r.rv, err
+		},
+		Notify: r.notifyWatcher,
+	}
+	if cfg.FileWatch != nil {
+		r.fileWatcher = fswatch.New(objRootPath, ".json", r.keyEncoder, cfg.FileWatch)
+	}
+	return r
 }
 
 type file struct {
-	objRootPath    string
+	objRootPath string
+	keyEncoder  store.KeyEncoder
+	// encrypter encrypts the files, nil when the files are not encrypted
+	encrypter *encryption.Encrypter
+	// locks coordinate the processes sharing the root path
+	locks *util.StoreLocks
+	// journal makes the changes of a transaction atomic
+	journal        *util.Journal
 	codec          runtime.Codec
 	newFunc        func() runtime.Object
 	watchermanager watchermanager.WatcherManager[runtime.Object]
 	m              sync.RWMutex
 	watching       bool
+	// rv is the resource version of the store, protected by the mutex
+	rv uint64
+	// fileWatcher detects the files changed outside of the store, nil when disabled
+	fileWatcher *fswatch.Watcher
+	// files track the files changed outside of the store
+	files *filestore.Files[runtime.Object]
+	// cancel stops watching the files
+	cancel context.CancelFunc
 }
 
 func (r *file) Start(ctx context.Context) {
 	r.m.Lock()
 	defer r.m.Unlock()
 	r.watching = true
+	r.watchermanager.SetResourceVersion(store.FormatResourceVersion(r.rv))
 	go r.watchermanager.Start(ctx)
+	if r.fileWatcher != nil {
+		r.files.WatchContents()
+		ctx, r.cancel = context.WithCancel(ctx)
+		go r.fileWatcher.Run(ctx, r.reconcileFiles)
+	}
 }
 
 func (r *file) Stop() {
@@ -77,144 +177,452 @@ func (r *file) Stop() {
 	defer r.m.Unlock()
 	r.watching = false
 	r.watchermanager.Stop()
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+	r.files.StopContents()
 }
 
 // Get return the type
-func (r *file) Get(key store.Key, opts ...store.GetOption) (runtime.Object, error) {
-	return r.readFile(key)
-}
+func (r *file) Get(ctx context.Context, key store.Key, opts ...store.GetOption) (runtime.Object, error) {
+	o := store.GetOptions{}
+	o.ApplyOptions(opts)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-func (r *file) List(visitorFunc func(key store.Key, obj runtime.Object), opts ...store.ListOption) {
-	log := log.FromContext(context.Background())
-	if err := r.visitDir(visitorFunc, opts...); err != nil {
-		log.Error("cannot list visiting dir failed", "error", err.Error())
+	obj, err := r.readFile(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.CheckResourceVersion(key, o.ResourceVersion, store.GetResourceVersion(obj)); err != nil {
+		return nil, err
 	}
+	return obj, nil
 }
 
-func (r *file) ListKeys(opts ...store.ListOption) []string {
+func (r *file) List(ctx context.Context, visitorFunc func(key store.Key, obj runtime.Object) error, opts ...store.ListOption) error {
+	return r.visitDir(ctx, visitorFunc, opts...)
+}
+
+func (r *file) ListKeys(ctx context.Context, opts ...store.ListOption) ([]string, error) {
 	keys := []string{}
-	r.List(func(key store.Key, _ runtime.Object) {
+	err := r.List(ctx, func(key store.Key, _ runtime.Object) error {
 		keys = append(keys, key.Name)
+		return nil
 	}, opts...)
-	return keys
+	return keys, err
 }
 
-func (r *file) Len(opts ...store.ListOption) int {
+func (r *file) Len(ctx context.Context, opts ...store.ListOption) (int, error) {
 	items := 0
-	r.List(func(key store.Key, _ runtime.Object) {
+	err := r.List(ctx, func(key store.Key, _ runtime.Object) error {
 		items++
+		return nil
 	}, opts...)
-	return items
+	return items, err
 }
 
-func (r *file) Apply(key store.Key, data runtime.Object, opts ...store.ApplyOption) error {
-	exists := r.exists(key)
+func (r *file) Apply(ctx context.Context, key store.Key, data runtime.Object, opts ...store.ApplyOption) error {
+	o := store.ApplyOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock, err := r.lockKey(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	oldd, err := r.readFile(key)
+	exists := err == nil
+	if o.FieldManager != "" {
+		changed, err := store.ServerSideApply(key, oldd, exists, data, &o)
+		if err != nil {
+			return err
+		}
+		// an apply that does not change the object does not allocate a new resource version
+		if !changed {
+			return nil
+		}
+	}
+	if o.DryRun {
+		return r.dryRun(key, data)
+	}
 	if err := r.update(key, data); err != nil {
 		return err
 	}
 	if !exists {
 		r.notifyWatcher(watch.WatchEvent[runtime.Object]{
-			Type:   watch.Added,
-			Object: data,
+			Type:            watch.Added,
+			Key:             key,
+			Object:          data,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
 		})
 	} else {
 		r.notifyWatcher(watch.WatchEvent[runtime.Object]{
-			Type:   watch.Modified,
-			Object: data,
+			Type:            watch.Modified,
+			Key:             key,
+			Object:          data,
+			OldObject:       oldd,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
 		})
 	}
 	return nil
 }
 
-func (r *file) Create(key store.Key, data runtime.Object, opts ...store.CreateOption) error {
-	// if an error is returned the entry already exists
-	if _, err := r.Get(key); err == nil {
-		return fmt.Errorf("duplicate entry %v", key.String())
+func (r *file) Create(ctx context.Context, key store.Key, data runtime.Object, opts ...store.CreateOption) error {
+	o := store.CreateOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock, err := r.lockKey(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// if the entry exists we return a duplicate error
+	if r.exists(key) {
+		return store.NewAlreadyExistsError(key)
+	}
+	if o.DryRun {
+		return r.dryRun(key, data)
 	}
 	// update the store before calling the callback since the cb fn will use this data
-	if err := r.update(key, data); err != nil {
+	if err := r.create(key, data); err != nil {
 		return err
 	}
 
 	// notify watchers
 	r.notifyWatcher(watch.WatchEvent[runtime.Object]{
-		Type:   watch.Added,
-		Object: data,
+		Type:            watch.Added,
+		Key:             key,
+		Object:          data,
+		ResourceVersion: store.FormatResourceVersion(r.rv),
 	})
 	return nil
 }
 
 // Upsert creates or updates the entry in the cache
-func (r *file) Update(key store.Key, data runtime.Object, opts ...store.UpdateOption) error {
+func (r *file) Update(ctx context.Context, key store.Key, data runtime.Object, opts ...store.UpdateOption) error {
+	o := store.UpdateOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock, err := r.lockKey(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	exists := true
-	oldd, err := r.Get(key)
+	oldd, err := r.readFile(key)
 	if err != nil {
 		exists = false
 	}
+	return r.upsert(key, oldd, exists, data, &o)
+}
 
+// upsert creates or updates the entry given the preconditions of the options and
+// notifies the watchers, the caller must hold the lock of the key
+func (r *file) upsert(key store.Key, oldd runtime.Object, exists bool, data runtime.Object, o *store.UpdateOptions) error {
+	oldrv := ""
+	if exists {
+		oldrv = store.GetResourceVersion(oldd)
+	}
+	if err := store.CheckResourceVersion(key, o.ResourceVersion, oldrv); err != nil {
+		return err
+	}
+	if exists {
+		// an update that does not change the data does not allocate a new resource version
+		if store.EqualIgnoringResourceVersion(oldd, data) {
+			return nil
+		}
+	}
+	if o.DryRun {
+		return r.dryRun(key, data)
+	}
 	// update the cache before calling the callback since the cb fn will use this data
 	if err := r.update(key, data); err != nil {
 		return err
 	}
 
-	// // notify watchers based on the fact the data got modified or not
+	// notify watchers based on the fact the data got modified or not
 	if exists {
-		if !reflect.DeepEqual(oldd, data) {
-			r.notifyWatcher(watch.WatchEvent[runtime.Object]{
-				Type:   watch.Modified,
-				Object: data,
-			})
-		}
+		r.notifyWatcher(watch.WatchEvent[runtime.Object]{
+			Type:            watch.Modified,
+			Key:             key,
+			Object:          data,
+			OldObject:       oldd,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
+		})
 	} else {
 		r.notifyWatcher(watch.WatchEvent[runtime.Object]{
-			Type:   watch.Added,
-			Object: data,
+			Type:            watch.Added,
+			Key:             key,
+			Object:          data,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
 		})
 	}
 	return nil
 }
 
-func (r *file) UpdateWithKeyFn(key store.Key, updateFunc func(obj runtime.Object) runtime.Object) {
-	obj, _ := r.readFile(key)
-	if updateFunc != nil {
-		obj = updateFunc(obj)
-		r.update(key, obj)
+// UpdateWithKeyFn updates the entry with the result of the updateFunc like
+// Update, the updateFunc gets nil when the entry does not exist
+func (r *file) UpdateWithKeyFn(ctx context.Context, key store.Key, updateFunc func(ctx context.Context, obj runtime.Object) (runtime.Object, error), opts ...store.UpdateOption) error {
+	o := store.UpdateOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if updateFunc == nil {
+		return nil
+	}
+
+	unlock, err := r.lockKey(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	oldd, err := r.readFile(key)
+	if err != nil && !store.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+	newd, err := updateFunc(ctx, store.DeepCopy(oldd))
+	if err != nil {
+		return err
+	}
+	if err := store.CheckUpdated(key, exists, newd); err != nil {
+		return err
+	}
+	return r.upsert(key, oldd, exists, newd, &o)
+}
+
+// Patch applies the patch to the entry under the lock of the key, a patch that
+// does not change the entry does not allocate a new resource version
+func (r *file) Patch(ctx context.Context, key store.Key, patchType types.PatchType, patch []byte, opts ...store.PatchOption) (runtime.Object, error) {
+	o := store.PatchOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	unlock, err := r.lockKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	oldd, err := r.readFile(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.CheckResourceVersion(key, o.ResourceVersion, store.GetResourceVersion(oldd)); err != nil {
+		return nil, err
+	}
+	newd, changed, err := store.PatchObject(key, oldd, patchType, patch, o.Schema)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return oldd, nil
+	}
+	if o.DryRun {
+		if err := r.dryRun(key, newd); err != nil {
+			return nil, err
+		}
+		return newd, nil
+	}
+	if err := r.update(key, newd); err != nil {
+		return nil, err
 	}
+
+	r.notifyWatcher(watch.WatchEvent[runtime.Object]{
+		Type:            watch.Modified,
+		Key:             key,
+		Object:          newd,
+		OldObject:       oldd,
+		ResourceVersion: store.FormatResourceVersion(r.rv),
+	})
+	return newd, nil
 }
 
+// update writes the entry with a new resource version, the caller must hold the
+// lock of the key
 func (r *file) update(key store.Key, newd runtime.Object) error {
-	return r.writeFile(key, newd)
+	if err := r.nextResourceVersion(); err != nil {
+		return err
+	}
+	rv := store.FormatResourceVersion(r.rv)
+	obj := newd.DeepCopyObject()
+	store.SetResourceVersion(obj, rv)
+	if err := r.writeFile(key, obj); err != nil {
+		return err
+	}
+	// the object of the caller only gets the resource version once it is written
+	store.SetResourceVersion(newd, rv)
+	return nil
+}
+
+// dryRun runs the checks of update without writing the entry, the entry is
+// valid when it can be encoded and encrypted. The entry gets the resource
+// version it would get.
+func (r *file) dryRun(key store.Key, newd runtime.Object) error {
+	next, err := r.peekResourceVersion()
+	if err != nil {
+		return err
+	}
+	rv := store.FormatResourceVersion(next)
+	obj := newd.DeepCopyObject()
+	store.SetResourceVersion(obj, rv)
+	if _, _, err := r.marshal(key, obj); err != nil {
+		return err
+	}
+	store.SetResourceVersion(newd, rv)
+	return nil
+}
+
+// create writes a new entry with a new resource version, it fails if the entry
+// exists. The caller must hold the lock of the key.
+func (r *file) create(key store.Key, newd runtime.Object) error {
+	if err := r.nextResourceVersion(); err != nil {
+		return err
+	}
+	rv := store.FormatResourceVersion(r.rv)
+	obj := newd.DeepCopyObject()
+	store.SetResourceVersion(obj, rv)
+	if err := r.createFile(key, obj); err != nil {
+		return err
+	}
+	// the object of the caller only gets the resource version once it is written
+	store.SetResourceVersion(newd, rv)
+	return nil
 }
 
+// delete removes the entry and bumps the resource version of the store,
+// the caller must hold the lock of the key
 func (r *file) delete(key store.Key) error {
-	return r.deleteFile(key)
+	if err := r.deleteFile(key); err != nil {
+		return err
+	}
+	return r.nextResourceVersion()
+}
+
+// peekResourceVersion returns the resource version the next write would get
+// without allocating it, the caller must hold the mutex
+func (r *file) peekResourceVersion() (uint64, error) {
+	rv, err := r.locks.ReadResourceVersion()
+	if err != nil {
+		return 0, store.NewUnavailableError("cannot read resource version", err)
+	}
+	return max(rv, r.rv) + 1, nil
+}
+
+// nextResourceVersion allocates the next resource version of the store, which is
+// shared by the processes using the root path. The caller must hold the mutex.
+func (r *file) nextResourceVersion() error {
+	rv, err := r.locks.NextResourceVersion(r.rv)
+	if err != nil {
+		return store.NewUnavailableError("cannot allocate resource version", err)
+	}
+	r.rv = rv
+	return nil
+}
+
+// lockKey locks the key for the processes sharing the root path, the caller
+// must hold the mutex. See util.StoreLocks for the lock ordering.
+func (r *file) lockKey(key store.Key) (func(), error) {
+	l, err := r.locks.LockKey(r.keyEncoder.Encode(key), true)
+	if err != nil {
+		return nil, store.NewUnavailableError("cannot lock "+key.String(), err)
+	}
+	return func() { l.Unlock() }, nil
 }
 
 // Delete deletes the entry in the cache
-func (r *file) Delete(key store.Key, opts ...store.DeleteOption) error {
+func (r *file) Delete(ctx context.Context, key store.Key, opts ...store.DeleteOption) error {
+	o := store.DeleteOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	unlock, err := r.lockKey(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// only if an exisitng object gets deleted we
-	// call the registered callbacks
-	exists := true
-	obj, err := r.Get(key)
+	// call the registered callbacks, an unreadable object is left for fsck
+	obj, err := r.readFile(key)
 	if err != nil {
+		if store.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if err := store.CheckResourceVersion(key, o.ResourceVersion, store.GetResourceVersion(obj)); err != nil {
+		return err
+	}
+	if o.DryRun {
 		return nil
 	}
-	// if exists call the callback
-	if exists {
-		r.notifyWatcher(watch.WatchEvent[runtime.Object]{
-			Type:   watch.Deleted,
-			Object: obj,
-		})
+	if err := r.delete(key); err != nil {
+		return err
 	}
-	// delete the entry to ensure the cb uses the proper data
-	return r.delete(key)
+
+	r.notifyWatcher(watch.WatchEvent[runtime.Object]{
+		Type:            watch.Deleted,
+		Key:             key,
+		Object:          obj,
+		OldObject:       obj,
+		ResourceVersion: store.FormatResourceVersion(r.rv),
+	})
+	return nil
 }
 
+// notifyWatcher queues the event in the watchermanager, the watchers get it once
+// the lock is released. The caller must hold the lock such that events are
+// ordered by resource version.
 func (r *file) notifyWatcher(event watch.WatchEvent[runtime.Object]) {
-	r.m.RLock()
-	defer r.m.RUnlock()
 	if r.watching {
-		r.watchermanager.WatchChan() <- event
+		r.watchermanager.Notify(event)
 	}
 }
 
@@ -224,12 +632,7 @@ func (r *file) Watch(ctx context.Context, opts ...store.ListOption) (watch.Watch
 	log := log.FromContext(ctx)
 	log.Debug("watch")
 
-	w := &watcher.Watcher[runtime.Object]{
-		Cancel:         cancel,
-		ResultChannel:  make(chan watch.WatchEvent[runtime.Object]),
-		WatcherManager: r.watchermanager,
-		New:            r.newFunc,
-	}
+	w := watcher.New(cancel, r.watchermanager, r.newFunc, opts...)
 
 	go w.ListAndWatch(ctx, r, opts...)
 
@@ -0,0 +1,332 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/encryption"
+	"github.com/henderiw/store/watch"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func testConfig(rootPath string) *Config {
+	return &Config{
+		GroupResource: schema.GroupResource{Group: "test", Resource: "configmaps"},
+		RootPath:      rootPath,
+		Codec:         unstructured.UnstructuredJSONScheme,
+		NewFunc:       func() runtime.Object { return &unstructured.Unstructured{} },
+	}
+}
+
+func testKey(name string) store.Key {
+	return store.KeyFromNSN(types.NamespacedName{Namespace: "default", Name: name})
+}
+
+func testObject(name, x string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]any{"data": map[string]any{"x": x}}}
+	u.SetAPIVersion("v1")
+	u.SetKind("ConfigMap")
+	u.SetNamespace("default")
+	u.SetName(name)
+	return u
+}
+
+func newTestStore(t *testing.T, cfg *Config) *file {
+	t.Helper()
+	s, err := NewStoreV2(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*file)
+}
+
+// nextEvent returns the next event of the watch
+func nextEvent(t *testing.T, w watch.WatchInterface[runtime.Object]) watch.WatchEvent[runtime.Object] {
+	t.Helper()
+	select {
+	case event := <-w.ResultChan():
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("want an event")
+		return watch.WatchEvent[runtime.Object]{}
+	}
+}
+
+// x returns the data field x of the object
+func x(obj runtime.Object) string {
+	v, _, _ := unstructured.NestedString(obj.(*unstructured.Unstructured).Object, "data", "x")
+	return v
+}
+
+func TestDelete(t *testing.T) {
+	cases := map[string]struct {
+		// content is the content of the file of a, the object is created when not set
+		content []byte
+		missing bool
+		opts    []store.DeleteOption
+		errFunc func(error) bool
+		// exists is true when the file of a is left
+		exists bool
+	}{
+		"Delete": {},
+		"Missing": {
+			missing: true,
+		},
+		"Unreadable": {
+			content: []byte(`{"apiVersion":`),
+			errFunc: store.IsInvalid,
+			exists:  true,
+		},
+		"ResourceVersionConflict": {
+			opts:    []store.DeleteOption{&store.DeleteOptions{ResourceVersion: "5"}},
+			errFunc: store.IsConflict,
+			exists:  true,
+		},
+		"DryRun": {
+			opts:   []store.DeleteOption{&store.DeleteOptions{DryRun: true}},
+			exists: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newTestStore(t, testConfig(t.TempDir()))
+			switch {
+			case tc.content != nil:
+				if err := os.MkdirAll(filepath.Dir(s.filename(testKey("a"))), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(s.filename(testKey("a")), tc.content, 0644); err != nil {
+					t.Fatal(err)
+				}
+			case !tc.missing:
+				if err := s.Create(ctx, testKey("a"), testObject("a", "1")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := s.Delete(ctx, testKey("a"), tc.opts...)
+			if tc.errFunc != nil {
+				if err == nil || !tc.errFunc(err) {
+					t.Fatalf("want error, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := os.Stat(s.filename(testKey("a"))); (err == nil) != tc.exists {
+				t.Errorf("want file exists %t, got %v", tc.exists, err)
+			}
+		})
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	cases := map[string]struct {
+		migrateKeys bool
+		encrypted   bool
+		errFunc     func(error) bool
+	}{
+		"NotMigrated": {
+			errFunc: store.IsInvalid,
+		},
+		"Migrated": {
+			migrateKeys: true,
+		},
+		"MigratedEncrypted": {
+			migrateKeys: true,
+			encrypted:   true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := testConfig(t.TempDir())
+			cfg.MigrateKeys = tc.migrateKeys
+			// a file written before the keys were escaped
+			key := testKey("a:b")
+			content, err := testObject("a:b", "1").MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			legacyPath := store.LegacyKeyEncoder{}.Encode(key)
+			if tc.encrypted {
+				encryptionKey, err := encryption.GenerateKey("k1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cfg.Encrypter, err = encryption.New([]encryption.Key{encryptionKey}); err != nil {
+					t.Fatal(err)
+				}
+				if content, err = cfg.Encrypter.Encrypt(legacyPath, content); err != nil {
+					t.Fatal(err)
+				}
+			}
+			filename := filepath.Join(cfg.RootPath, "test", "configmaps", filepath.FromSlash(legacyPath)+".json")
+			if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filename, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := NewStoreV2(cfg)
+			if tc.errFunc != nil {
+				if err == nil || !tc.errFunc(err) || !strings.Contains(err.Error(), "MigrateKeys") {
+					t.Fatalf("want error naming MigrateKeys, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			obj, err := s.Get(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if x(obj) != "1" {
+				t.Errorf("want x 1, got %s", x(obj))
+			}
+		})
+	}
+}
+
+func TestListUnreadable(t *testing.T) {
+	cases := map[string]struct {
+		errorFunc bool
+	}{
+		"ListError": {},
+		"ErrorFunc": {errorFunc: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newTestStore(t, testConfig(t.TempDir()))
+			for _, name := range []string{"a", "b", "c"} {
+				if err := s.Create(ctx, testKey(name), testObject(name, "1")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(s.filename(testKey("b")), []byte(`{"apiVersion":`), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var reported []store.Key
+			opts := &store.ListOptions{}
+			if tc.errorFunc {
+				opts.ErrorFunc = func(key store.Key, err error) { reported = append(reported, key) }
+			}
+			visited := []string{}
+			err := s.List(ctx, func(key store.Key, obj runtime.Object) error {
+				visited = append(visited, key.Name)
+				return nil
+			}, opts)
+			// the other objects are visited
+			if strings.Join(visited, ",") != "a,c" {
+				t.Errorf("want a and c to be visited, got %v", visited)
+			}
+			if tc.errorFunc {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(reported) != 1 || reported[0] != testKey("b") {
+					t.Errorf("want b to be reported, got %v", reported)
+				}
+				return
+			}
+			skipped, ok := store.IsListError(err)
+			if !ok {
+				t.Fatalf("want list error, got %v", err)
+			}
+			if len(skipped) != 1 || skipped[0].Key != testKey("b") || !store.IsInvalid(skipped[0].Err) {
+				t.Errorf("want b to be skipped as invalid, got %v", skipped)
+			}
+		})
+	}
+}
+
+func TestSharedRootPath(t *testing.T) {
+	ctx := context.Background()
+	rootPath := t.TempDir()
+	// the stores share the root path like processes
+	stores := []*file{newTestStore(t, testConfig(rootPath)), newTestStore(t, testConfig(rootPath))}
+	const n = 10
+
+	// a create is exclusive
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < 2*n; i++ {
+		wg.Add(1)
+		go func(s *file) {
+			defer wg.Done()
+			errs <- s.Create(ctx, testKey("a"), testObject("a", "0"))
+		}(stores[i%2])
+	}
+	wg.Wait()
+	close(errs)
+	created := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !store.IsAlreadyExists(err):
+			t.Fatalf("want already exists, got %v", err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("want one create, got %d", created)
+	}
+
+	// the updates of a read, modify and write the object under the key lock
+	increment := func(_ context.Context, obj runtime.Object) (runtime.Object, error) {
+		u := obj.(*unstructured.Unstructured)
+		v, _ := strconv.Atoi(x(u))
+		u.Object["data"] = map[string]any{"x": strconv.Itoa(v + 1)}
+		return u, nil
+	}
+	for i := 0; i < 2*n; i++ {
+		wg.Add(1)
+		go func(s *file) {
+			defer wg.Done()
+			if err := s.UpdateWithKeyFn(ctx, testKey("a"), increment); err != nil {
+				t.Error(err)
+			}
+		}(stores[i%2])
+	}
+	wg.Wait()
+	for _, s := range stores {
+		got, err := s.Get(ctx, testKey("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x(got) != strconv.Itoa(2*n) {
+			t.Errorf("want x %d, got %s", 2*n, x(got))
+		}
+	}
+}
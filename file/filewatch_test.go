@@ -0,0 +1,155 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/fswatch"
+	"github.com/henderiw/store/watch"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestFileWatchResourceVersion(t *testing.T) {
+	cases := map[string]struct {
+		// change changes the object a, which is created by the store, outside of
+		// the store and returns the resource version the object had on disk
+		change func(t *testing.T, rootPath, filename string) string
+		// adopted is true when the object keeps the resource version on disk
+		adopted bool
+	}{
+		"OtherStore": {
+			change: func(t *testing.T, rootPath, _ string) string {
+				obj := testObject("a", "2")
+				if err := newTestStore(t, testConfig(rootPath)).Update(context.Background(), testKey("a"), obj); err != nil {
+					t.Fatal(err)
+				}
+				return obj.GetResourceVersion()
+			},
+			adopted: true,
+		},
+		"EditedByHand": {
+			change: func(t *testing.T, _, filename string) string {
+				b, err := os.ReadFile(filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				obj := &unstructured.Unstructured{}
+				if err := obj.UnmarshalJSON(b); err != nil {
+					t.Fatal(err)
+				}
+				// the resource version is left as is
+				unstructured.SetNestedField(obj.Object, "2", "data", "x")
+				if b, err = obj.MarshalJSON(); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filename, b, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return obj.GetResourceVersion()
+			},
+		},
+		"FutureResourceVersion": {
+			change: func(t *testing.T, _, filename string) string {
+				obj := testObject("a", "2")
+				obj.SetResourceVersion("1000")
+				b, err := obj.MarshalJSON()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filename, b, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return obj.GetResourceVersion()
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			rootPath := t.TempDir()
+			cfg := testConfig(rootPath)
+			cfg.FileWatch = &fswatch.Config{Debounce: 10 * time.Millisecond, Poll: true, PollInterval: 20 * time.Millisecond}
+			s := newTestStore(t, cfg)
+			if err := s.Create(ctx, testKey("a"), testObject("a", "1")); err != nil {
+				t.Fatal(err)
+			}
+			s.Start(ctx)
+			defer s.Stop()
+			w, err := s.Watch(ctx, &store.ListOptions{ResourceVersion: "1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Stop()
+
+			filename := func(name string) string {
+				return filepath.Join(rootPath, "test", "configmaps", store.DefaultKeyEncoder.Encode(testKey(name))+".json")
+			}
+			// a file written by hand shows the files are watched, it is rewritten as
+			// the changes before the watch of the files starts are not noticed
+			for i := 0; ; i++ {
+				b, err := testObject("marker", strconv.Itoa(i)).MarshalJSON()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filename("marker"), b, 0644); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case event := <-w.ResultChan():
+					if event.Type == watch.Error {
+						t.Fatal(event.Err)
+					}
+				case <-time.After(100 * time.Millisecond):
+					if i < 50 {
+						continue
+					}
+					t.Fatalf("files are not watched")
+				}
+				break
+			}
+			// the changes of the marker are handled
+			time.Sleep(100 * time.Millisecond)
+			for len(w.ResultChan()) > 0 {
+				<-w.ResultChan()
+			}
+			rv := tc.change(t, rootPath, filename("a"))
+
+			event := nextEvent(t, w)
+			if event.Type != watch.Modified {
+				t.Fatalf("want Modified event, got %s: %v", event.Type, event.Err)
+			}
+			if adopted := event.ResourceVersion == rv; adopted != tc.adopted {
+				t.Errorf("want adopted %t, got resource version %s for %s on disk", tc.adopted, event.ResourceVersion, rv)
+			}
+			// the store reads the object with the resource version of the event
+			obj, err := s.Get(ctx, testKey("a"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if store.GetResourceVersion(obj) != event.ResourceVersion {
+				t.Errorf("want resource version %s, got %s", event.ResourceVersion, store.GetResourceVersion(obj))
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package file
+
+import (
+	"context"
+	"testing"
+
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/watch"
+)
+
+func TestTransaction(t *testing.T) {
+	cases := map[string]struct {
+		dryRun bool
+		// rv is the resource version of a in the transaction, empty to skip the check
+		rv      string
+		errFunc func(error) bool
+		// want are the values of x of a and b after the commit, empty when missing
+		wantA, wantB string
+	}{
+		"Commit": {
+			wantB: "2",
+		},
+		"DryRun": {
+			dryRun: true,
+			wantA:  "1",
+		},
+		"Conflict": {
+			rv:      "5",
+			errFunc: store.IsConflict,
+			wantA:   "1",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			s := newTestStore(t, testConfig(t.TempDir()))
+			if err := s.Create(ctx, testKey("a"), testObject("a", "1")); err != nil {
+				t.Fatal(err)
+			}
+			s.Start(ctx)
+			defer s.Stop()
+			w, err := s.Watch(ctx, &store.ListOptions{ResourceVersion: "1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Stop()
+
+			// a is deleted and b is created all or nothing
+			tx := s.Begin()
+			if tc.rv != "" {
+				if err := tx.Check(testKey("a"), tc.rv); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tx.Delete(testKey("a"), &store.DeleteOptions{DryRun: tc.dryRun}); err != nil {
+				t.Fatal(err)
+			}
+			b := testObject("b", "2")
+			if err := tx.Create(testKey("b"), b, &store.CreateOptions{DryRun: tc.dryRun}); err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Commit(ctx)
+			if tc.errFunc != nil {
+				if err == nil || !tc.errFunc(err) {
+					t.Fatalf("want error, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for key, want := range map[store.Key]string{testKey("a"): tc.wantA, testKey("b"): tc.wantB} {
+				obj, err := s.Get(ctx, key)
+				if want == "" {
+					if !store.IsNotFound(err) {
+						t.Errorf("want %s not found, got %v", key.Name, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if x(obj) != want {
+					t.Errorf("want x %s of %s, got %s", want, key.Name, x(obj))
+				}
+			}
+			if tc.errFunc != nil || tc.dryRun {
+				return
+			}
+			// the events are sent in the order of the operations
+			for _, want := range []watch.EventType{watch.Deleted, watch.Added} {
+				if event := nextEvent(t, w); event.Type != want {
+					t.Errorf("want %s event, got %s", want, event.Type)
+				}
+			}
+			if b.GetResourceVersion() == "" {
+				t.Errorf("want the resource version of the created object")
+			}
+		})
+	}
+}
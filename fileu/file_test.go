@@ -0,0 +1,143 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileu
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/henderiw/store"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func testConfig(rootPath string) *Config {
+	return &Config{
+		GroupResource: schema.GroupResource{Group: "test", Resource: "configmaps"},
+		RootPath:      rootPath,
+		NewFunc:       func() runtime.Unstructured { return &unstructured.Unstructured{} },
+	}
+}
+
+func testKey(name string) store.Key {
+	return store.KeyFromNSN(types.NamespacedName{Namespace: "default", Name: name})
+}
+
+func testObject(name, x string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]any{"data": map[string]any{"x": x}}}
+	u.SetAPIVersion("v1")
+	u.SetKind("ConfigMap")
+	u.SetNamespace("default")
+	u.SetName(name)
+	return u
+}
+
+func newTestStore(t *testing.T, cfg *Config) *file {
+	t.Helper()
+	s, err := NewStoreV2(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*file)
+}
+
+func TestListUnreadable(t *testing.T) {
+	cases := map[string]struct {
+		errorFunc bool
+	}{
+		"ListError": {},
+		"ErrorFunc": {errorFunc: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newTestStore(t, testConfig(t.TempDir()))
+			for _, name := range []string{"a", "b", "c"} {
+				if err := s.Create(ctx, testKey(name), testObject(name, "1")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(s.filename(testKey("b")), []byte("data: [\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var reported []store.Key
+			opts := &store.ListOptions{}
+			if tc.errorFunc {
+				opts.ErrorFunc = func(key store.Key, err error) { reported = append(reported, key) }
+			}
+			visited := []string{}
+			err := s.List(ctx, func(key store.Key, obj runtime.Unstructured) error {
+				visited = append(visited, key.Name)
+				return nil
+			}, opts)
+			// the other objects are visited
+			if strings.Join(visited, ",") != "a,c" {
+				t.Errorf("want a and c to be visited, got %v", visited)
+			}
+			if tc.errorFunc {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(reported) != 1 || reported[0] != testKey("b") {
+					t.Errorf("want b to be reported, got %v", reported)
+				}
+				return
+			}
+			skipped, ok := store.IsListError(err)
+			if !ok {
+				t.Fatalf("want list error, got %v", err)
+			}
+			if len(skipped) != 1 || skipped[0].Key != testKey("b") || !store.IsInvalid(skipped[0].Err) {
+				t.Errorf("want b to be skipped as invalid, got %v", skipped)
+			}
+		})
+	}
+}
+
+func TestWriteLeavesNoTemporaryFiles(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t, testConfig(t.TempDir()))
+	if err := s.Create(ctx, testKey("a"), testObject("a", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(ctx, testKey("a"), testObject("a", "2")); err != nil {
+		t.Fatal(err)
+	}
+	// a create of an existing object does not change its file
+	if err := s.Create(ctx, testKey("a"), testObject("a", "3")); !store.IsAlreadyExists(err) {
+		t.Fatalf("want already exists, got %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(s.filename(testKey("a"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != filepath.Base(s.filename(testKey("a"))) {
+		t.Errorf("want only the file of a, got %v", entries)
+	}
+	got, err := s.Get(ctx, testKey("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := unstructured.NestedString(got.UnstructuredContent(), "data", "x"); v != "2" {
+		t.Errorf("want x 2, got %s", v)
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileu
+
+import (
+	"github.com/henderiw/store/fsck"
+)
+
+// Fsck checks the files of the store with the config, see fsck.Check. The store
+// must not be running when the files are repaired or quarantined.
+func Fsck(cfg *Config, opts *fsck.Options) (*fsck.Report, error) {
+	return newFile(cfg).files.Fsck(opts)
+}
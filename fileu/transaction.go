@@ -0,0 +1,36 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fileu
+
+import (
+	"context"
+
+	"github.com/henderiw/store"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Begin starts a transaction, the changes are written to a journal before the
+// files are changed such that all or none of the changes survive a crash
+func (r *file) Begin() *store.Tx[runtime.Unstructured] {
+	return store.NewTx(r.commit)
+}
+
+// commit applies the operations of a transaction all or nothing, the events
+// are sent once all changes are applied
+func (r *file) commit(ctx context.Context, ops []store.TxOperation[runtime.Unstructured]) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.files.Commit(ctx, ops)
+}
@@ -15,37 +15,73 @@
 package fileu
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/henderiw/store"
+	"github.com/henderiw/store/codec"
+	"github.com/henderiw/store/util.go"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/types"
-	"sigs.k8s.io/yaml"
 )
 
 func (r *file) filename(key store.Key) string {
-	if key.Namespace != "" {
-		return filepath.Join(r.objRootPath, key.Namespace, key.Name+".yaml")
-	}
-	return filepath.Join(r.objRootPath, key.Name+".yaml")
+	return filepath.Join(r.objRootPath, filepath.FromSlash(r.keyEncoder.Encode(key))+r.codec.Extension())
 }
 
 func (r *file) readFile(key store.Key) (runtime.Unstructured, error) {
-	var obj runtime.Unstructured
+	content, err := r.readContent(key)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := r.decode(key, content)
+	if err != nil {
+		return nil, err
+	}
+	// a file changed outside of the store has the resource version of the store
+	r.files.SetFileVersion(key, content, obj)
+	return obj, nil
+}
+
+func (r *file) readContent(key store.Key) ([]byte, error) {
 	content, err := os.ReadFile(r.filename(key))
 	if err != nil {
-		return obj, err
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, store.NewNotFoundError(key, err)
+		}
+		return nil, err
 	}
-	object := map[string]any{}
-	if err := yaml.Unmarshal(content, &object); err != nil {
-		return obj, err
+	return r.decrypt(key, content)
+}
+
+// decrypt returns the content of an encrypted file as is when the files are not encrypted
+func (r *file) decrypt(key store.Key, content []byte) ([]byte, error) {
+	if r.encrypter == nil {
+		return content, nil
+	}
+	plaintext, _, err := r.encrypter.Decrypt(r.keyEncoder.Encode(key), content)
+	if err != nil {
+		return nil, store.NewInvalidError(key, "cannot decrypt object", err)
 	}
-	return &unstructured.Unstructured{
+	return plaintext, nil
+}
+
+func (r *file) decode(key store.Key, content []byte) (runtime.Unstructured, error) {
+	object, err := r.codec.Decode(content)
+	if err != nil {
+		return nil, store.NewInvalidError(key, "cannot decode object", err)
+	}
+	// a file truncated to nothing decodes without error
+	if len(object) == 0 {
+		return nil, store.NewInvalidError(key, "empty object", nil)
+	}
+	obj := &unstructured.Unstructured{
 		Object: object,
-	}, nil
+	}
+	return obj, nil
 }
 
 func (r *file) exists(key store.Key) bool {
@@ -54,54 +90,141 @@ func (r *file) exists(key store.Key) bool {
 }
 
 func (r *file) writeFile(key store.Key, obj runtime.Unstructured) error {
-	b, err := yaml.Marshal(obj)
+	return r.storeFile(key, obj, util.WriteFileAtomic)
+}
+
+// createFile writes the file of a new object, it fails if the file exists even
+// when it is created by another process
+func (r *file) createFile(key store.Key, obj runtime.Unstructured) error {
+	err := r.storeFile(key, obj, util.CreateFileAtomic)
+	if errors.Is(err, os.ErrExist) {
+		return store.NewAlreadyExistsError(key)
+	}
+	return err
+}
+
+func (r *file) storeFile(key store.Key, obj runtime.Unstructured, write func(string, []byte, os.FileMode) error) error {
+	b, data, err := r.marshal(key, obj)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(r.filename(key), b, 0644)
+	if err := util.EnsureDir(filepath.Dir(r.filename(key))); err != nil {
+		return err
+	}
+	if err := write(r.filename(key), data, 0644); err != nil {
+		return err
+	}
+	r.files.TrackContent(key, b)
+	return nil
+}
+
+// marshal returns the encoded object and the content of its file, which is
+// encrypted when the files are encrypted
+func (r *file) marshal(key store.Key, obj runtime.Unstructured) ([]byte, []byte, error) {
+	b, err := encode(r.codec, obj)
+	if err != nil {
+		return nil, nil, store.NewInvalidError(key, "cannot marshal object", err)
+	}
+	data := b
+	if r.encrypter != nil {
+		if data, err = r.encrypter.Encrypt(r.keyEncoder.Encode(key), b); err != nil {
+			return nil, nil, store.NewInvalidError(key, "cannot encrypt object", err)
+		}
+	}
+	return b, data, nil
+}
+
+func encode(c codec.Codec, obj runtime.Unstructured) ([]byte, error) {
+	if obj == nil {
+		return nil, errors.New("no object")
+	}
+	return c.Encode(obj.UnstructuredContent())
 }
 
 func (r *file) deleteFile(key store.Key) error {
-	return os.Remove(r.filename(key))
+	if err := os.Remove(r.filename(key)); err != nil {
+		return err
+	}
+	r.files.TrackContent(key, nil)
+	return util.SyncDir(filepath.Dir(r.filename(key)))
 }
 
-func (r *file) visitDir(visitorFunc func(store.Key, runtime.Unstructured), _ ...store.ListOption) error {
-	return filepath.Walk(r.objRootPath, func(path string, info os.FileInfo, err error) error {
+func (r *file) visitDir(ctx context.Context, visitorFunc func(store.Key, runtime.Unstructured) error, opts ...store.ListOption) error {
+	o := store.ListOptions{}
+	o.ApplyOptions(opts)
+
+	if err := filepath.Walk(r.objRootPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
+			// a temporary file of an atomic write is renamed while walking the directory
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// a long walk stops once the context is cancelled
+		if err := ctx.Err(); err != nil {
 			return err
 		}
 		if info.IsDir() {
 			return nil
 		}
-		// skip any non json file
-		if !strings.HasSuffix(info.Name(), ".yaml") {
+		// skip any file of another codec
+		if !strings.HasSuffix(info.Name(), r.codec.Extension()) {
 			return nil
 		}
 		// skip if the group resource prefix does not match
 		//if !strings.HasPrefix(info.Name(), r.grPrefix) {
 		//	return nil
 		//}
-		// this is a yaml file by now
-		// next step is find the key (namespace and name)
-		name := strings.TrimSuffix(filepath.Base(path), ".yaml")
-		namespace := ""
-		pathSplit := strings.Split(path, "/")
-		if len(pathSplit) > (len(strings.Split(r.objRootPath, "/")) + 1) {
-			namespace = pathSplit[len(pathSplit)-2]
+		// next step is find the key (namespace and name) from the path
+		rel, err := filepath.Rel(r.objRootPath, path)
+		if err != nil {
+			return err
+		}
+		key, ok := r.keyEncoder.Decode(strings.TrimSuffix(filepath.ToSlash(rel), r.codec.Extension()))
+		if !ok {
+			return nil
+		}
+		// skip reading the file if the namespace does not match
+		if o.Namespace != "" && o.Namespace != key.Namespace {
+			return nil
 		}
-		key := store.KeyFromNSN(types.NamespacedName{
-			Name:      name,
-			Namespace: namespace,
-		})
 
 		newObj, err := r.readFile(key)
 		if err != nil {
-			return err
+			// the file is removed while walking the directory
+			if store.IsNotFound(err) {
+				return nil
+			}
+			// a corrupt file does not stop the list, it is reported once the list completes
+			o.SkipError(ctx, key, err)
+			return nil
+		}
+		if !o.Matches(key, newObj) {
+			return nil
 		}
 		if visitorFunc != nil {
-			visitorFunc(key, newObj)
+			return visitorFunc(key, newObj)
 		}
 
+		return nil
+	}); err != nil {
+		return err
+	}
+	return o.SkippedError()
+}
+
+// initResourceVersion initializes the resource version of the store with the
+// highest resource version of the objects on disk and allocated by any process
+func (r *file) initResourceVersion() {
+	if rv, err := r.locks.ReadResourceVersion(); err == nil {
+		r.rv = rv
+	}
+	r.visitDir(context.Background(), func(_ store.Key, obj runtime.Unstructured) error {
+		rv, err := store.ParseResourceVersion(store.GetResourceVersion(obj))
+		if err == nil && rv > r.rv {
+			r.rv = rv
+		}
 		return nil
 	})
 }
@@ -0,0 +1,271 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fsck verifies the files of the file based stores and optionally
+// repairs them or moves them out of the way.
+package fsck
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/util.go"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// DefaultQuarantineDir is the directory in the root path of the store the
+// quarantined files are moved to, it is hidden such that the store ignores it
+const DefaultQuarantineDir = ".quarantine"
+
+type Config struct {
+	// RootPath is the directory of the files of the store
+	RootPath string
+	// Extension of the object files, including the leading dot
+	Extension string
+	// KeyEncoder maps the paths of the files to keys
+	KeyEncoder store.KeyEncoder
+	// Decode decodes the content of the file of the key to an object with metadata
+	Decode func(key store.Key, content []byte) (any, error)
+}
+
+type Options struct {
+	// Repair removes the orphan temporary files and moves the objects stored at
+	// the path of another key to the path of their key
+	Repair bool
+	// Quarantine moves the files that cannot be repaired, e.g. corrupt files and
+	// duplicates, to the quarantine directory
+	Quarantine bool
+	// QuarantineDir is the directory the files are moved to, every check uses a new
+	// sub directory. DefaultQuarantineDir in the root path is used when not set
+	QuarantineDir string
+}
+
+type IssueType string
+
+const (
+	// IssueTempFile is a temporary file left behind by an interrupted write
+	IssueTempFile IssueType = "TempFile"
+	// IssueUnknownPath is a file with the extension of the objects that is not at
+	// the path of a key
+	IssueUnknownPath IssueType = "UnknownPath"
+	// IssueCorrupt is a file that cannot be decoded
+	IssueCorrupt IssueType = "Corrupt"
+	// IssueKeyMismatch is an object whose namespace and name do not match the key
+	// of its path
+	IssueKeyMismatch IssueType = "KeyMismatch"
+	// IssueDuplicate is an object with the namespace and name of another object
+	IssueDuplicate IssueType = "Duplicate"
+)
+
+type Action string
+
+const (
+	ActionNone        Action = ""
+	ActionRemoved     Action = "Removed"
+	ActionMoved       Action = "Moved"
+	ActionQuarantined Action = "Quarantined"
+)
+
+// Issue is a problem found in a file
+type Issue struct {
+	Type IssueType
+	// Path of the file relative to the root path
+	Path string
+	// Key of the path, empty when the path is not the path of a key
+	Key store.Key
+	// ObjectKey is the key of the namespace and name of the object
+	ObjectKey store.Key
+	Message   string
+	// Action is the repair taken, Err is set when the repair failed
+	Action Action
+	Err    error
+}
+
+func (r Issue) String() string {
+	s := fmt.Sprintf("%s %s: %s", r.Type, r.Path, r.Message)
+	if r.Action != ActionNone {
+		s = fmt.Sprintf("%s (%s)", s, r.Action)
+	}
+	if r.Err != nil {
+		s = fmt.Sprintf("%s, repair failed: %s", s, r.Err.Error())
+	}
+	return s
+}
+
+// Report is the result of a check
+type Report struct {
+	// Checked is the number of object files
+	Checked int
+	Issues  []Issue
+}
+
+// OK returns true if no issues are found
+func (r *Report) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// Check verifies the files of a store: the files have to be decodable and
+// stored at the path of the key of their namespace and name, no two objects can
+// have the same key and no temporary files can be left behind. The issues are
+// repaired or quarantined according to the options, the store must not be
+// running when files are repaired or quarantined.
+func Check(cfg *Config, opts *Options) (*Report, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	quarantineDir := opts.QuarantineDir
+	if quarantineDir == "" {
+		quarantineDir = filepath.Join(cfg.RootPath, DefaultQuarantineDir)
+	}
+	quarantineDir = filepath.Join(quarantineDir, time.Now().UTC().Format("20060102T150405.000000000"))
+
+	type object struct {
+		rel    string
+		key    store.Key
+		objKey store.Key
+	}
+	report := &Report{Issues: []Issue{}}
+	objects := []object{}
+	if err := filepath.Walk(cfg.RootPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// the store keeps its locks and quarantined files in hidden directories
+			if path != cfg.RootPath && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(cfg.RootPath, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if strings.HasPrefix(info.Name(), ".") {
+			if strings.HasPrefix(info.Name(), util.TempFilePrefix) {
+				report.Issues = append(report.Issues, Issue{
+					Type:    IssueTempFile,
+					Path:    rel,
+					Message: "temporary file of an interrupted write",
+				})
+			}
+			return nil
+		}
+		if !strings.HasSuffix(info.Name(), cfg.Extension) {
+			return nil
+		}
+		key, ok := cfg.KeyEncoder.Decode(strings.TrimSuffix(rel, cfg.Extension))
+		if !ok {
+			report.Issues = append(report.Issues, Issue{
+				Type:    IssueUnknownPath,
+				Path:    rel,
+				Message: "path is not the path of a key",
+			})
+			return nil
+		}
+		report.Checked++
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		obj, err := cfg.Decode(key, content)
+		if err == nil && obj == nil {
+			err = fmt.Errorf("no object")
+		}
+		if err != nil {
+			report.Issues = append(report.Issues, Issue{
+				Type:    IssueCorrupt,
+				Path:    rel,
+				Key:     key,
+				Message: err.Error(),
+			})
+			return nil
+		}
+		objKey := key
+		if accessor, err := meta.Accessor(obj); err == nil && accessor.GetName() != "" {
+			objKey = store.KeyFromNSN(types.NamespacedName{Namespace: accessor.GetNamespace(), Name: accessor.GetName()})
+		}
+		objects = append(objects, object{rel: rel, key: key, objKey: objKey})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// an object stored at the path of another key moves to the path of its key,
+	// unless that path is taken by another object
+	taken := map[store.Key]bool{}
+	for _, o := range objects {
+		taken[o.key] = true
+	}
+	for _, o := range objects {
+		if o.objKey == o.key {
+			continue
+		}
+		issue := Issue{
+			Type:      IssueKeyMismatch,
+			Path:      o.rel,
+			Key:       o.key,
+			ObjectKey: o.objKey,
+			Message:   fmt.Sprintf("object %s is stored at the path of %s", o.objKey.String(), o.key.String()),
+		}
+		if taken[o.objKey] {
+			issue.Type = IssueDuplicate
+			issue.Message = fmt.Sprintf("object %s is also stored at another path", o.objKey.String())
+		}
+		taken[o.objKey] = true
+		report.Issues = append(report.Issues, issue)
+	}
+
+	for i := range report.Issues {
+		issue := &report.Issues[i]
+		src := filepath.Join(cfg.RootPath, filepath.FromSlash(issue.Path))
+		switch issue.Type {
+		case IssueTempFile:
+			if opts.Repair {
+				issue.Action, issue.Err = ActionRemoved, os.Remove(src)
+			}
+		case IssueKeyMismatch:
+			if opts.Repair {
+				dst := filepath.Join(cfg.RootPath, filepath.FromSlash(cfg.KeyEncoder.Encode(issue.ObjectKey))+cfg.Extension)
+				issue.Action, issue.Err = ActionMoved, move(src, dst)
+			}
+		default:
+			if opts.Quarantine {
+				dst := filepath.Join(quarantineDir, filepath.FromSlash(issue.Path))
+				issue.Action, issue.Err = ActionQuarantined, move(src, dst)
+			}
+		}
+	}
+	return report, nil
+}
+
+// move moves the file to a path that does not exist
+func move(src, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return &store.Error{Err: store.ErrAlreadyExists, Message: fmt.Sprintf("cannot move %s, %s exists", src, dst)}
+	}
+	if err := util.EnsureDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	return util.SyncDir(filepath.Dir(dst))
+}
@@ -0,0 +1,257 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fswatch detects changes made to the files of a file based store
+// outside of the store, e.g. by editing them, and maps them to store keys.
+package fswatch
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/henderiw/logger/log"
+	"github.com/henderiw/store"
+)
+
+const (
+	DefaultDebounce     = 100 * time.Millisecond
+	DefaultPollInterval = time.Second
+)
+
+type Config struct {
+	// Debounce is the time the changes are collected before they are handled,
+	// multiple writes of a file within this time result in a single change.
+	// DefaultDebounce is used when not set
+	Debounce time.Duration
+	// Poll polls the files instead of using filesystem notifications,
+	// polling is used as fallback when notifications are not supported
+	Poll bool
+	// PollInterval is the interval between two polls, DefaultPollInterval is used when not set
+	PollInterval time.Duration
+}
+
+// HandlerFunc handles the changed keys, all keys of the store have to be
+// checked when all is true, e.g. after a directory is moved or the
+// notifications overflowed
+type HandlerFunc func(keys []store.Key, all bool)
+
+// Watcher watches the files with the extension in the root path
+type Watcher struct {
+	rootPath     string
+	extension    string
+	keyEncoder   store.KeyEncoder
+	debounce     time.Duration
+	poll         bool
+	pollInterval time.Duration
+}
+
+func New(rootPath, extension string, keyEncoder store.KeyEncoder, cfg *Config) *Watcher {
+	r := &Watcher{
+		rootPath:     rootPath,
+		extension:    extension,
+		keyEncoder:   keyEncoder,
+		debounce:     cfg.Debounce,
+		poll:         cfg.Poll,
+		pollInterval: cfg.PollInterval,
+	}
+	if r.debounce <= 0 {
+		r.debounce = DefaultDebounce
+	}
+	if r.pollInterval <= 0 {
+		r.pollInterval = DefaultPollInterval
+	}
+	return r
+}
+
+// Run calls the handler with the changed keys until the context is done
+func (r *Watcher) Run(ctx context.Context, handler HandlerFunc) {
+	log := log.FromContext(ctx)
+	if !r.poll {
+		w, err := fsnotify.NewWatcher()
+		if err == nil {
+			if err = r.addDirs(w, r.rootPath); err == nil {
+				r.notify(ctx, w, handler)
+				return
+			}
+			w.Close()
+		}
+		log.Info("filesystem notifications not available, polling files", "path", r.rootPath, "error", err.Error())
+	}
+	r.pollFiles(ctx, handler)
+}
+
+// keyFromPath returns the key of the file, false if the file is not an object of the store
+func (r *Watcher) keyFromPath(path string) (store.Key, bool) {
+	if !strings.HasSuffix(path, r.extension) {
+		return store.Key{}, false
+	}
+	rel, err := filepath.Rel(r.rootPath, path)
+	if err != nil {
+		return store.Key{}, false
+	}
+	return r.keyEncoder.Decode(strings.TrimSuffix(filepath.ToSlash(rel), r.extension))
+}
+
+// addDirs watches the directory and its sub directories, fsnotify does not
+// watch recursively
+func (r *Watcher) addDirs(w *fsnotify.Watcher, dirname string) error {
+	return filepath.WalkDir(dirname, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		return w.Add(path)
+	})
+}
+
+// notify collects the changes reported by the filesystem and hands them to the
+// handler once the debounce time passed since the first change
+func (r *Watcher) notify(ctx context.Context, w *fsnotify.Watcher, handler HandlerFunc) {
+	log := log.FromContext(ctx)
+	defer w.Close()
+
+	pending := map[store.Key]struct{}{}
+	all := false
+	timer := time.NewTimer(r.debounce)
+	timer.Stop()
+	armed := false
+	arm := func() {
+		if !armed {
+			timer.Reset(r.debounce)
+			armed = true
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case event, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if r.handleEvent(w, event, pending) {
+				all = true
+			}
+			if all || len(pending) > 0 {
+				arm()
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Error("filesystem notification failed", "path", r.rootPath, "error", err.Error())
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				all = true
+				arm()
+			}
+		case <-timer.C:
+			armed = false
+			keys := make([]store.Key, 0, len(pending))
+			for key := range pending {
+				keys = append(keys, key)
+			}
+			pending = map[store.Key]struct{}{}
+			handler(keys, all)
+			all = false
+		}
+	}
+}
+
+// handleEvent adds the key of the changed file to the pending keys, true is
+// returned when all keys have to be checked
+func (r *Watcher) handleEvent(w *fsnotify.Watcher, event fsnotify.Event, pending map[store.Key]struct{}) bool {
+	// a new or moved in directory can already contain files
+	if event.Has(fsnotify.Create) {
+		if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+			r.addDirs(w, event.Name)
+			return true
+		}
+	}
+	// the files of a removed or moved out directory are gone
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		for _, dir := range w.WatchList() {
+			if dir == event.Name {
+				w.Remove(dir)
+				return true
+			}
+		}
+	}
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	if key, ok := r.keyFromPath(event.Name); ok {
+		pending[key] = struct{}{}
+	}
+	return false
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// pollFiles compares the modification time and the size of the files every
+// poll interval and hands the changed keys to the handler
+func (r *Watcher) pollFiles(ctx context.Context, handler HandlerFunc) {
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+	states := r.scan()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			newStates := r.scan()
+			keys := []store.Key{}
+			for key, state := range newStates {
+				if old, ok := states[key]; !ok || old != state {
+					keys = append(keys, key)
+				}
+			}
+			for key := range states {
+				if _, ok := newStates[key]; !ok {
+					keys = append(keys, key)
+				}
+			}
+			states = newStates
+			if len(keys) > 0 {
+				handler(keys, false)
+			}
+		}
+	}
+}
+
+func (r *Watcher) scan() map[store.Key]fileState {
+	states := map[store.Key]fileState{}
+	filepath.Walk(r.rootPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if key, ok := r.keyFromPath(path); ok {
+			states[key] = fileState{modTime: info.ModTime(), size: info.Size()}
+		}
+		return nil
+	})
+	return states
+}
@@ -0,0 +1,185 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fswatch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/henderiw/store"
+)
+
+// change is a call of the handler
+type change struct {
+	keys []store.Key
+	all  bool
+}
+
+// has returns true if the change has the key of the namespace/name
+func (r change) has(nsn string) bool {
+	for _, key := range r.keys {
+		if key.Namespace+"/"+key.Name == nsn {
+			return true
+		}
+	}
+	return false
+}
+
+// testWatcher runs a watcher of the root path and records its changes
+type testWatcher struct {
+	t        *testing.T
+	rootPath string
+	changes  chan change
+	markers  int
+}
+
+func newTestWatcher(ctx context.Context, t *testing.T, cfg *Config) *testWatcher {
+	r := &testWatcher{t: t, rootPath: t.TempDir(), changes: make(chan change, 100)}
+	r.write("default/marker.yaml", "")
+	w := New(r.rootPath, ".yaml", store.NestedKeyEncoder{}, cfg)
+	go w.Run(ctx, func(keys []store.Key, all bool) {
+		r.changes <- change{keys: keys, all: all}
+	})
+	// the watcher runs once it sees the marker
+	r.mark()
+	return r
+}
+
+func (r *testWatcher) write(path, content string) {
+	r.t.Helper()
+	filename := filepath.Join(r.rootPath, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		r.t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// next returns the changes up to the first change that matches
+func (r *testWatcher) next(match func(change) bool) []change {
+	r.t.Helper()
+	got := []change{}
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case c := <-r.changes:
+			got = append(got, c)
+			if match(c) {
+				return got
+			}
+		case <-deadline:
+			r.t.Fatalf("want a change, got %v", got)
+		}
+	}
+}
+
+// mark writes the marker until its change is seen, the changes before the
+// marker are returned
+func (r *testWatcher) mark() []change {
+	r.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	got := []change{}
+	for time.Now().Before(deadline) {
+		r.markers++
+		r.write("default/marker.yaml", strings.Repeat("x", r.markers))
+		select {
+		case c := <-r.changes:
+			got = append(got, c)
+			if c.has("default/marker") {
+				return got
+			}
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	r.t.Fatalf("want the change of the marker, got %v", got)
+	return nil
+}
+
+func TestWatcher(t *testing.T) {
+	cases := map[string]struct {
+		cfg *Config
+	}{
+		"Notify": {cfg: &Config{Debounce: 50 * time.Millisecond}},
+		"Poll":   {cfg: &Config{Poll: true, PollInterval: 10 * time.Millisecond}},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			w := newTestWatcher(ctx, t, tc.cfg)
+
+			w.write("default/a.yaml", "a")
+			w.next(func(c change) bool { return c.has("default/a") })
+			w.write("default/a.yaml", "aa")
+			w.next(func(c change) bool { return c.has("default/a") })
+			if err := os.Remove(filepath.Join(w.rootPath, "default", "a.yaml")); err != nil {
+				t.Fatal(err)
+			}
+			w.next(func(c change) bool { return c.has("default/a") })
+
+			// the files that are not objects of the store are ignored
+			w.write("default/README.md", "")
+			w.write("default/.tmp-b.yaml-1", "")
+			w.write(".locks/00.lock", "")
+			for _, c := range w.mark() {
+				for _, key := range c.keys {
+					if key.Name != "marker" {
+						t.Errorf("want no change of %v", key)
+					}
+				}
+			}
+
+			// a directory moved in with its files
+			dir := filepath.Join(t.TempDir(), "other")
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "b.yaml"), []byte("b"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(dir, filepath.Join(w.rootPath, "other")); err != nil {
+				t.Fatal(err)
+			}
+			w.next(func(c change) bool { return c.all || c.has("other/b") })
+			// the files of the moved in directory are watched
+			w.write("other/b.yaml", "bb")
+			w.next(func(c change) bool { return c.has("other/b") })
+		})
+	}
+}
+
+func TestWatcherDebounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := newTestWatcher(ctx, t, &Config{Debounce: 200 * time.Millisecond})
+
+	// the writes within the debounce time are handled at once
+	for _, name := range []string{"a", "b", "c"} {
+		w.write("default/"+name+".yaml", name)
+		w.write("default/"+name+".yaml", name+name)
+	}
+	got := w.next(func(c change) bool { return c.has("default/a") })
+	c := got[len(got)-1]
+	// the last writes of the marker can still be pending
+	if !c.has("default/b") || !c.has("default/c") {
+		t.Errorf("want the changes of a, b and c at once, got %v", c.keys)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitu
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/henderiw/store"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// branch is the branch a change is written to. The checked out branch is changed
+// in the worktree and its index. Another branch is changed by committing its
+// tree directly such that the checked out branch of the worktree stays the same.
+type branch struct {
+	r    *gitrepo
+	name string
+	// checkedOut is set for the checked out branch
+	checkedOut bool
+	// head is the head commit of a branch that is not checked out, nil when the
+	// repository has no commit yet
+	head *object.Commit
+	// files are the files of the tree of a branch that is not checked out,
+	// including the changes that are not committed yet
+	files map[string]treeFile
+}
+
+// openBranch returns the branch of the key and the key with its branch, the
+// checked out branch is used when the key has no branch. A branch that does not
+// exist starts at the checked out commit and is created by its first commit.
+// The caller must hold the lock.
+func (r *gitrepo) openBranch(key store.Key) (store.Key, *branch, error) {
+	current, err := r.currentBranch()
+	if err != nil {
+		return key, nil, err
+	}
+	if key.Branch == "" || key.Branch == current {
+		key.Branch = current
+		return key, &branch{r: r, name: current, checkedOut: true}, nil
+	}
+	if err := plumbing.NewBranchReferenceName(key.Branch).Validate(); err != nil {
+		return key, nil, store.NewInvalidError(key, "invalid branch "+key.Branch, err)
+	}
+	head, err := r.branchHead(key.Branch)
+	if err != nil {
+		if !store.IsNotFound(err) {
+			return key, nil, err
+		}
+		if head, err = r.headCommit(); err != nil {
+			return key, nil, err
+		}
+	}
+	var tree *object.Tree
+	if head != nil {
+		if tree, err = head.Tree(); err != nil {
+			return key, nil, store.NewUnavailableError("cannot get tree of branch "+key.Branch, err)
+		}
+	}
+	files, err := flattenTree(tree)
+	if err != nil {
+		return key, nil, store.NewUnavailableError("cannot get files of branch "+key.Branch, err)
+	}
+	return key, &branch{r: r, name: key.Branch, head: head, files: files}, nil
+}
+
+// headCommit returns the checked out commit, nil if the repository has no commit yet
+func (r *gitrepo) headCommit() (*object.Commit, error) {
+	head, err := r.repo.Head()
+	if err != nil {
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return nil, nil
+		}
+		return nil, store.NewUnavailableError("cannot get HEAD of the git repository", err)
+	}
+	commit, err := r.repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, store.NewUnavailableError("cannot get commit of HEAD", err)
+	}
+	return commit, nil
+}
+
+// read returns the object of the key on the branch
+func (b *branch) read(key store.Key) (runtime.Unstructured, error) {
+	if b.checkedOut {
+		return b.r.readFile(key)
+	}
+	f, ok := b.files[b.r.relFilename(key)]
+	if !ok {
+		return nil, store.NewNotFoundError(key, fmt.Errorf("%s not found on branch %s", b.r.relFilename(key), b.name))
+	}
+	content, err := b.r.readBlob(f.hash)
+	if err != nil {
+		return nil, store.NewUnavailableError("cannot read "+b.r.relFilename(key), err)
+	}
+	return b.r.decode(key, content)
+}
+
+// exists returns true when the object of the key exists on the branch
+func (b *branch) exists(key store.Key) bool {
+	if b.checkedOut {
+		return b.r.exists(key)
+	}
+	_, ok := b.files[b.r.relFilename(key)]
+	return ok
+}
+
+// write writes the object of the key to the branch
+func (b *branch) write(key store.Key, obj runtime.Unstructured) error {
+	if b.checkedOut {
+		return b.r.writeFile(key, obj)
+	}
+	content, err := b.r.encode(obj)
+	if err != nil {
+		return store.NewInvalidError(key, "cannot marshal object", err)
+	}
+	return b.writeContent(key, content)
+}
+
+// writeContent writes the encoded object of the key to a branch that is not checked out
+func (b *branch) writeContent(key store.Key, content []byte) error {
+	hash, err := b.r.writeBlob(content)
+	if err != nil {
+		return store.NewUnavailableError("cannot write "+b.r.relFilename(key), err)
+	}
+	b.files[b.r.relFilename(key)] = treeFile{hash: hash, mode: filemode.Regular}
+	return nil
+}
+
+// remove removes the object of the key from the branch
+func (b *branch) remove(key store.Key) error {
+	if b.checkedOut {
+		return b.r.deleteFile(key)
+	}
+	delete(b.files, b.r.relFilename(key))
+	return nil
+}
+
+// record records the change of the object of the key, see gitrepo.record. A
+// branch that is not checked out has no index, its changes are always committed.
+func (b *branch) record(op Operation, key store.Key) (string, error) {
+	if b.checkedOut {
+		return b.r.record(op, key)
+	}
+	return b.commit(b.r.messageFunc(op, key))
+}
+
+// commit commits the files of a branch that is not checked out and points the
+// branch to the commit
+func (b *branch) commit(message string) (string, error) {
+	tree, err := b.r.writeTree(b.files)
+	if err != nil {
+		return "", store.NewUnavailableError("cannot write tree of branch "+b.name, err)
+	}
+	parents := []plumbing.Hash{}
+	if b.head != nil {
+		parents = append(parents, b.head.Hash)
+	}
+	hash, err := b.r.writeCommit(tree, message, nil, parents...)
+	if err != nil {
+		return "", store.NewUnavailableError("cannot commit to branch "+b.name, err)
+	}
+	if err := b.r.setBranch(b.name, hash); err != nil {
+		return "", err
+	}
+	if b.head, err = b.r.repo.CommitObject(hash); err != nil {
+		return "", store.NewUnavailableError("cannot get commit of branch "+b.name, err)
+	}
+	return hash.String(), nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitu
+
+import (
+	"path/filepath"
+
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/codec"
+	"github.com/henderiw/store/fsck"
+)
+
+// Fsck checks the files of the store in the worktree with the config, see
+// fsck.Check. The store must not be running when the files are repaired or
+// quarantined, the repairs are not committed.
+func Fsck(cfg *Config, opts *fsck.Options) (*fsck.Report, error) {
+	r := &gitrepo{
+		rootPath:   filepath.Join(cfg.RootPath, cfg.GroupResource.Group, cfg.GroupResource.Resource),
+		keyEncoder: cfg.KeyEncoder,
+		codec:      cfg.Codec,
+	}
+	if r.keyEncoder == nil {
+		r.keyEncoder = store.DefaultKeyEncoder
+	}
+	if r.codec == nil {
+		r.codec = codec.Default
+	}
+	return fsck.Check(&fsck.Config{
+		RootPath:   r.rootPath,
+		Extension:  r.codec.Extension(),
+		KeyEncoder: r.keyEncoder,
+		Decode: func(key store.Key, content []byte) (any, error) {
+			return r.decode(key, content)
+		},
+	}, opts)
+}
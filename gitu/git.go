@@ -18,11 +18,16 @@ import (
 	"context"
 	"fmt"
 	"path/filepath"
-	"reflect"
 	"sync"
+	"time"
 
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/henderiw/logger/log"
 	"github.com/henderiw/store"
+	"github.com/henderiw/store/codec"
 	"github.com/henderiw/store/util.go"
 	"github.com/henderiw/store/watch"
 	"github.com/henderiw/store/watcher"
@@ -30,55 +35,260 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-)
-
-const (
-	// errors
-	NotFound = "not found"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 type Config struct {
-	RootPath   string
+	// RootPath is the directory in the worktree of the repository where the store keeps its data
+	RootPath string
+	// Deprecated: the path in the repository is derived from RootPath and the worktree of the repository
 	PathInRepo string
-	//Repo     *git.Repository
+	// Repo is the git repository of the store, when not set the repository is opened
+	// from RootPath or initialized at RootPath when it does not exist
+	Repo *git.Repository
+	// AuthorName and AuthorEmail are used as author of the commits,
+	// DefaultAuthorName and DefaultAuthorEmail are used when not set
+	AuthorName  string
+	AuthorEmail string
+	// MessageFunc returns the commit message for a change, a message listing the
+	// operation, the resource and the key is used when not set
+	MessageFunc MessageFunc
+	// DisableAutoCommit stages the changes in the worktree without committing them,
+	// the changes are committed as a single commit with Commit, changes to a branch
+	// that is not checked out are always committed
+	DisableAutoCommit bool
+	// Remotes are added to the repository, a remote with the same name and another url is replaced
+	Remotes []Remote
+	// Sync enables the periodic synchronization with a remote when the store is started
+	Sync *SyncConfig
+	// PollInterval enables polling the branches for commits made outside of the store,
+	// e.g. by another process or with git, the watchers get the changed objects
+	PollInterval time.Duration
+	// PollBranches are the polled branches, all branches are polled when not set
+	PollBranches []string
 
 	GroupResource schema.GroupResource
 	NewFunc       func() runtime.Unstructured
+	// KeyEncoder maps the keys to file paths, store.DefaultKeyEncoder is used when not set
+	KeyEncoder store.KeyEncoder
+	// Codec serializes the objects to files, codec.Default is used when not set
+	Codec codec.Codec
 }
 
-func NewStore(cfg *Config) (store.UnstructuredStore, error) {
+var (
+	DefaultAuthorName  = "store"
+	DefaultAuthorEmail = "store@localhost"
+)
+
+// Operation is the change of an object recorded in a commit
+type Operation string
+
+const (
+	OperationCreate Operation = "create"
+	OperationUpdate Operation = "update"
+	OperationDelete Operation = "delete"
+)
+
+// MessageFunc returns the commit message for the operation on the object with the given key
+type MessageFunc func(op Operation, key store.Key) string
+
+// Store is an unstructured store backed by a git repository, every change is committed
+// to the branch of the key, the checked out branch is used when the key has no branch
+type Store interface {
+	store.UnstructuredStore
+	Repo
+}
+
+// StoreV2 is the context aware version of Store
+type StoreV2 interface {
+	store.UnstructuredStoreV2
+	Repo
+}
+
+// Repo are the git operations of the store
+type Repo interface {
+	// Begin starts a transaction, it is committed as a single commit to the branch
+	// of its keys
+	Begin() *store.Tx[runtime.Unstructured]
+	// Repository returns the git repository of the store
+	Repository() *git.Repository
+	// Branch returns the checked out branch
+	Branch() (string, error)
+	// Checkout checks out the branch in the worktree, the branch is created from
+	// the checked out commit if it does not exist
+	Checkout(branch string) error
+	// Commit commits the staged changes of the checked out branch, it is only
+	// needed when auto commit is disabled
+	Commit(message string) (plumbing.Hash, error)
+	// History returns the commits changing the object of the key, newest first
+	History(ctx context.Context, key store.Key) ([]*object.Commit, error)
+	// Diff returns the changes of the objects between two revisions
+	Diff(ctx context.Context, from, to string, opts ...store.ListOption) ([]DiffEntry, error)
+	// DiffKey returns the change of the object of the key between two revisions,
+	// nil is returned when the object did not change
+	DiffKey(ctx context.Context, key store.Key, from, to string) (*DiffEntry, error)
+	// Merge merges the source revision into the target branch, conflicts are
+	// returned as a ConflictError
+	Merge(ctx context.Context, source, target string) (*MergeResult, error)
+	// Rebase replays the commits of the branch on top of the onto revision,
+	// conflicts are returned as a ConflictError
+	Rebase(ctx context.Context, branch, onto string) (*MergeResult, error)
+	// Fetch fetches the branches of the remote
+	Fetch(ctx context.Context, remote string) error
+	// Pull fetches the remote and merges the remote branch into the branch
+	Pull(ctx context.Context, remote, branch string) (*MergeResult, error)
+	// Push pushes the branch to the remote
+	Push(ctx context.Context, remote, branch string) error
+}
+
+func NewStore(cfg *Config) (Store, error) {
+	r, err := NewStoreV2(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &storeV1{UnstructuredStore: store.AdaptPatchV1[runtime.Unstructured](r), Repo: r}, nil
+}
+
+// storeV1 is the Store of a StoreV2
+type storeV1 struct {
+	store.UnstructuredStore
+	Repo
+}
+
+func NewStoreV2(cfg *Config) (StoreV2, error) {
 	rootPath := filepath.Join(cfg.RootPath, cfg.GroupResource.Group, cfg.GroupResource.Resource)
 
 	// this is adding the storage to the worktree
 	if err := util.EnsureDir(rootPath); err != nil {
 		return nil, fmt.Errorf("unable to write data dir: %s", err)
 	}
-	// WHEN Do we create a branch
-	return &gitrepo{
-		//repo:     cfg.Repo,
-		rootPath:       rootPath,
-		relRepoPath:    filepath.Join(cfg.PathInRepo, "db", cfg.GroupResource.Group, cfg.GroupResource.Resource),
-		newFunc:        cfg.NewFunc,
-		watchermanager: watchermanager.New[runtime.Unstructured](64),
-	}, nil
+	repo := cfg.Repo
+	if repo == nil {
+		var err error
+		repo, err = openRepository(cfg.RootPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	relRepoPath, err := relPathInWorktree(repo, rootPath)
+	if err != nil {
+		return nil, err
+	}
+	r := &gitrepo{
+		repo:              repo,
+		rootPath:          rootPath,
+		relRepoPath:       relRepoPath,
+		keyEncoder:        cfg.KeyEncoder,
+		codec:             cfg.Codec,
+		groupResource:     cfg.GroupResource,
+		authorName:        cfg.AuthorName,
+		authorEmail:       cfg.AuthorEmail,
+		messageFunc:       cfg.MessageFunc,
+		disableAutoCommit: cfg.DisableAutoCommit,
+		sync:              cfg.Sync,
+		pollInterval:      cfg.PollInterval,
+		pollBranches:      cfg.PollBranches,
+		newFunc:           cfg.NewFunc,
+		watchermanager:    watchermanager.New[runtime.Unstructured](64),
+	}
+	if r.keyEncoder == nil {
+		r.keyEncoder = store.DefaultKeyEncoder
+	}
+	if r.codec == nil {
+		r.codec = codec.Default
+	}
+	if r.authorName == "" {
+		r.authorName = DefaultAuthorName
+	}
+	if r.authorEmail == "" {
+		r.authorEmail = DefaultAuthorEmail
+	}
+	if r.messageFunc == nil {
+		r.messageFunc = func(op Operation, key store.Key) string {
+			return fmt.Sprintf("%s %s %s", op, cfg.GroupResource.String(), key.String())
+		}
+	}
+	// the files that are not a path of the key encoder would be skipped
+	if err := store.CheckKeys(r.rootPath, r.codec.Extension(), r.keyEncoder); err != nil {
+		return nil, err
+	}
+	if err := r.initRemotes(cfg.Remotes); err != nil {
+		return nil, err
+	}
+	r.initHeads()
+	r.initResourceVersion()
+	return r, nil
 }
 
 type gitrepo struct {
-	
-	//repo     *git.Repository
-	rootPath       string
-	relRepoPath    string
-	newFunc        func() runtime.Unstructured
-	watchermanager watchermanager.WatcherManager[runtime.Unstructured]
-	m sync.RWMutex
-	watching       bool
+	repo              *git.Repository
+	rootPath          string
+	relRepoPath       string
+	keyEncoder        store.KeyEncoder
+	codec             codec.Codec
+	groupResource     schema.GroupResource
+	authorName        string
+	authorEmail       string
+	messageFunc       MessageFunc
+	disableAutoCommit bool
+	auth              map[string]transport.AuthMethod
+	sync              *SyncConfig
+	pollInterval      time.Duration
+	pollBranches      []string
+	newFunc           func() runtime.Unstructured
+	watchermanager    watchermanager.WatcherManager[runtime.Unstructured]
+	// m protects the worktree, the checked out branch can only change with the lock held
+	m        sync.RWMutex
+	watching bool
+	// rv is the resource version of the store, protected by the mutex
+	rv uint64
+	// dirty indicates the worktree has staged changes that are not committed
+	dirty bool
+	// heads are the head commits of the branches known to the store
+	heads map[string]plumbing.Hash
+	// cancel stops the synchronization with the remote and the polling
+	cancel context.CancelFunc
+}
+
+func (r *gitrepo) Repository() *git.Repository {
+	return r.repo
+}
+
+func (r *gitrepo) Branch() (string, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.currentBranch()
+}
+
+func (r *gitrepo) Checkout(branch string) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	_, err := r.checkout(branch)
+	return err
+}
+
+func (r *gitrepo) Commit(message string) (plumbing.Hash, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if !r.dirty {
+		return plumbing.ZeroHash, nil
+	}
+	return r.commit(message)
 }
 
 func (r *gitrepo) Start(ctx context.Context) {
 	r.m.Lock()
 	defer r.m.Unlock()
 	r.watching = true
+	r.watchermanager.SetResourceVersion(store.FormatResourceVersion(r.rv))
 	go r.watchermanager.Start(ctx)
+	ctx, r.cancel = context.WithCancel(ctx)
+	if r.sync != nil && r.sync.Interval > 0 {
+		go r.syncRemote(ctx, r.sync)
+	}
+	if r.pollInterval > 0 {
+		go r.poll(ctx, r.pollInterval, r.pollBranches)
+	}
 }
 
 func (r *gitrepo) Stop() {
@@ -86,158 +296,497 @@ func (r *gitrepo) Stop() {
 	defer r.m.Unlock()
 	r.watching = false
 	r.watchermanager.Stop()
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
 }
 
 // Get return the type
-func (r *gitrepo) Get(key store.Key, opts ...store.GetOption) (runtime.Unstructured, error) {
+func (r *gitrepo) Get(ctx context.Context, key store.Key, opts ...store.GetOption) (runtime.Unstructured, error) {
 	o := store.GetOptions{}
 	o.ApplyOptions(opts)
-	if o.Commit != nil {
-		return r.readFileFromCommit(key, o.Commit)
+
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	return r.readFile(key)
+
+	commit := o.Commit
+	if commit == nil {
+		var err error
+		commit, err = r.branchCommit(key, key.Branch)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var obj runtime.Unstructured
+	var err error
+	if commit != nil {
+		obj, err = r.readFileFromCommit(key, commit)
+	} else {
+		obj, err = r.readFile(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := store.CheckResourceVersion(key, o.ResourceVersion, store.GetResourceVersion(obj)); err != nil {
+		return nil, err
+	}
+	return obj, nil
 }
 
-func (r *gitrepo) List(visitorFunc func(store.Key, runtime.Unstructured), opts ...store.ListOption) {
+// List lists the objects of the branch in the list options, the visitorFunc
+// is called once the lock is released such that it can use the store
+func (r *gitrepo) List(ctx context.Context, visitorFunc func(store.Key, runtime.Unstructured) error, opts ...store.ListOption) error {
 	o := store.ListOptions{}
 	o.ApplyOptions(opts)
-	if o.Commit != nil {
-		if err := r.visitCommitTree(o.Commit, visitorFunc); err != nil {
-			log := log.FromContext(context.Background())
-			log.Error("cannot list visiting dir failed", "error", err.Error())
+
+	type entry struct {
+		key store.Key
+		obj runtime.Unstructured
+	}
+	type failure struct {
+		key store.Key
+		err error
+	}
+	entries := []entry{}
+	failures := []failure{}
+	collect := func(key store.Key, obj runtime.Unstructured) {
+		entries = append(entries, entry{key: key, obj: obj})
+	}
+	// the unreadable objects are also reported once the lock is released
+	collectErr := &store.ListOptions{ErrorFunc: func(key store.Key, err error) {
+		failures = append(failures, failure{key: key, err: err})
+	}}
+
+	if err := r.list(ctx, collect, &o, append(append([]store.ListOption{}, opts...), collectErr)...); err != nil {
+		return err
+	}
+	for _, f := range failures {
+		o.SkipError(ctx, f.key, f.err)
+	}
+	if visitorFunc == nil {
+		return o.SkippedError()
+	}
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := visitorFunc(e.key, e.obj); err != nil {
+			return err
+		}
+	}
+	return o.SkippedError()
+}
+
+func (r *gitrepo) list(ctx context.Context, visitorFunc func(store.Key, runtime.Unstructured), o *store.ListOptions, opts ...store.ListOption) error {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	// the objects of a commit only get a branch if one is requested
+	branch := o.Branch
+	commit := o.Commit
+	if commit == nil {
+		var err error
+		if branch == "" {
+			branch, err = r.currentBranch()
+			if err != nil {
+				return err
+			}
+		}
+		commit, err = r.branchCommit(store.Key{}, branch)
+		if err != nil {
+			return err
 		}
-		return
 	}
-	if err := r.visitDir(visitorFunc); err != nil {
-		log := log.FromContext(context.Background())
-		log.Error("cannot list visiting dir failed", "error", err.Error())
+	if commit != nil {
+		return r.visitCommitTree(ctx, commit, branch, visitorFunc, opts...)
 	}
+	return r.visitDir(ctx, branch, visitorFunc, opts...)
 }
 
-func (r *gitrepo) ListKeys(opts ...store.ListOption) []string {
+func (r *gitrepo) ListKeys(ctx context.Context, opts ...store.ListOption) ([]string, error) {
 	keys := []string{}
-	r.List(func(key store.Key, _ runtime.Unstructured) {
+	err := r.List(ctx, func(key store.Key, _ runtime.Unstructured) error {
 		keys = append(keys, key.Name)
+		return nil
 	}, opts...)
-	return keys
+	return keys, err
 }
 
-func (r *gitrepo) Len(opts ...store.ListOption) int {
+func (r *gitrepo) Len(ctx context.Context, opts ...store.ListOption) (int, error) {
 	items := 0
-	r.List(func(key store.Key, _ runtime.Unstructured) {
+	err := r.List(ctx, func(key store.Key, _ runtime.Unstructured) error {
 		items++
+		return nil
 	}, opts...)
-	return items
+	return items, err
 }
 
-func (r *gitrepo) Apply(key store.Key, data runtime.Unstructured, opts ...store.ApplyOption) error {
-	exists := r.exists(key)
-	if err := r.update(key, data); err != nil {
+func (r *gitrepo) Apply(ctx context.Context, key store.Key, data runtime.Unstructured, opts ...store.ApplyOption) error {
+	o := store.ApplyOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	key, b, err := r.openBranch(key)
+	if err != nil {
+		return err
+	}
+	oldd, err := b.read(key)
+	exists := err == nil
+	if o.FieldManager != "" {
+		changed, err := store.ServerSideApply(key, oldd, exists, data, &o)
+		if err != nil {
+			return err
+		}
+		// an apply that does not change the object does not allocate a new resource version
+		if !changed {
+			return nil
+		}
+	}
+	if o.DryRun {
+		return r.dryRun(key, data)
+	}
+	op := OperationCreate
+	if exists {
+		op = OperationUpdate
+	}
+	commit, err := r.update(b, op, key, data)
+	if err != nil {
 		return err
 	}
 	if !exists {
 		r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
-			Type:   watch.Added,
-			Object: data,
+			Type:            watch.Added,
+			Key:             key,
+			Object:          data,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
+			Commit:          commit,
 		})
 	} else {
 		r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
-			Type:   watch.Modified,
-			Object: data,
+			Type:            watch.Modified,
+			Key:             key,
+			Object:          data,
+			OldObject:       oldd,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
+			Commit:          commit,
 		})
 	}
 	return nil
 }
 
-func (r *gitrepo) Create(key store.Key, data runtime.Unstructured, opts ...store.CreateOption) error {
-	// if an error is returned the entry already exists
-	if _, err := r.Get(key); err == nil {
-		return fmt.Errorf("duplicate entry %v", key.String())
+func (r *gitrepo) Create(ctx context.Context, key store.Key, data runtime.Unstructured, opts ...store.CreateOption) error {
+	o := store.CreateOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	key, b, err := r.openBranch(key)
+	if err != nil {
+		return err
+	}
+	// if the entry exists we return a duplicate error
+	if b.exists(key) {
+		return store.NewAlreadyExistsError(key)
+	}
+	if o.DryRun {
+		return r.dryRun(key, data)
 	}
 	// update the store before calling the callback since the cb fn will use this data
-	if err := r.update(key, data); err != nil {
+	commit, err := r.update(b, OperationCreate, key, data)
+	if err != nil {
 		return err
 	}
 
 	// notify watchers
 	r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
-		Type:   watch.Added,
-		Object: data,
+		Type:            watch.Added,
+		Key:             key,
+		Object:          data,
+		ResourceVersion: store.FormatResourceVersion(r.rv),
+		Commit:          commit,
 	})
 	return nil
 }
 
 // Upsert creates or updates the entry in the cache
-func (r *gitrepo) Update(key store.Key, data runtime.Unstructured, opts ...store.UpdateOption) error {
+func (r *gitrepo) Update(ctx context.Context, key store.Key, data runtime.Unstructured, opts ...store.UpdateOption) error {
+	o := store.UpdateOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	key, b, err := r.openBranch(key)
+	if err != nil {
+		return err
+	}
 	exists := true
-	oldd, err := r.Get(key)
+	oldd, err := b.read(key)
 	if err != nil {
 		exists = false
 	}
+	return r.upsert(b, key, oldd, exists, data, &o)
+}
 
+// upsert creates or updates the entry on the branch given the preconditions of
+// the options and notifies the watchers, the caller must hold the lock
+func (r *gitrepo) upsert(b *branch, key store.Key, oldd runtime.Unstructured, exists bool, data runtime.Unstructured, o *store.UpdateOptions) error {
+	oldrv := ""
+	if exists {
+		oldrv = store.GetResourceVersion(oldd)
+	}
+	if err := store.CheckResourceVersion(key, o.ResourceVersion, oldrv); err != nil {
+		return err
+	}
+	if exists {
+		// an update that does not change the data does not allocate a new resource version
+		if store.EqualIgnoringResourceVersion(oldd, data) {
+			return nil
+		}
+	}
+	if o.DryRun {
+		return r.dryRun(key, data)
+	}
 	// update the cache before calling the callback since the cb fn will use this data
-	if err := r.update(key, data); err != nil {
+	op := OperationCreate
+	if exists {
+		op = OperationUpdate
+	}
+	commit, err := r.update(b, op, key, data)
+	if err != nil {
 		return err
 	}
 
-	// // notify watchers based on the fact the data got modified or not
+	// notify watchers based on the fact the data got modified or not
 	if exists {
-		if !reflect.DeepEqual(oldd, data) {
-			r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
-				Type:   watch.Modified,
-				Object: data,
-			})
-		}
+		r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
+			Type:            watch.Modified,
+			Key:             key,
+			Object:          data,
+			OldObject:       oldd,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
+			Commit:          commit,
+		})
 	} else {
 		r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
-			Type:   watch.Added,
-			Object: data,
+			Type:            watch.Added,
+			Key:             key,
+			Object:          data,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
+			Commit:          commit,
 		})
 	}
 	return nil
 }
 
-func (r *gitrepo) UpdateWithKeyFn(key store.Key, updateFunc func(obj runtime.Unstructured, _ ...store.UpdateOption) runtime.Unstructured) {
-	obj, _ := r.readFile(key)
-	if updateFunc != nil {
-		obj = updateFunc(obj)
-		r.update(key, obj)
+// UpdateWithKeyFn updates the entry with the result of the updateFunc like
+// Update, the updateFunc gets nil when the entry does not exist
+func (r *gitrepo) UpdateWithKeyFn(ctx context.Context, key store.Key, updateFunc func(ctx context.Context, obj runtime.Unstructured) (runtime.Unstructured, error), opts ...store.UpdateOption) error {
+	o := store.UpdateOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if updateFunc == nil {
+		return nil
+	}
+
+	key, b, err := r.openBranch(key)
+	if err != nil {
+		return err
+	}
+	oldd, err := b.read(key)
+	if err != nil && !store.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+	newd, err := updateFunc(ctx, store.DeepCopy(oldd))
+	if err != nil {
+		return err
+	}
+	if err := store.CheckUpdated(key, exists, newd); err != nil {
+		return err
 	}
+	return r.upsert(b, key, oldd, exists, newd, &o)
 }
 
-func (r *gitrepo) update(key store.Key, newd runtime.Unstructured) error {
-	return r.writeFile(key, newd)
+// Patch applies the patch to the entry of the branch of the key and commits it,
+// a patch that does not change the entry does not allocate a new resource version
+func (r *gitrepo) Patch(ctx context.Context, key store.Key, patchType types.PatchType, patch []byte, opts ...store.PatchOption) (runtime.Unstructured, error) {
+	o := store.PatchOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	key, b, err := r.openBranch(key)
+	if err != nil {
+		return nil, err
+	}
+	oldd, err := b.read(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.CheckResourceVersion(key, o.ResourceVersion, store.GetResourceVersion(oldd)); err != nil {
+		return nil, err
+	}
+	newd, changed, err := store.PatchObject(key, oldd, patchType, patch, o.Schema)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return oldd, nil
+	}
+	if o.DryRun {
+		if err := r.dryRun(key, newd); err != nil {
+			return nil, err
+		}
+		return newd, nil
+	}
+	commit, err := r.update(b, OperationUpdate, key, newd)
+	if err != nil {
+		return nil, err
+	}
+
+	r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
+		Type:            watch.Modified,
+		Key:             key,
+		Object:          newd,
+		OldObject:       oldd,
+		ResourceVersion: store.FormatResourceVersion(r.rv),
+		Commit:          commit,
+	})
+	return newd, nil
+}
+
+// update writes the entry to the branch with a new resource version and records
+// the operation, the commit is returned if any. The caller must hold the lock.
+func (r *gitrepo) update(b *branch, op Operation, key store.Key, newd runtime.Unstructured) (string, error) {
+	rv := store.FormatResourceVersion(r.rv + 1)
+	obj := newd.DeepCopyObject().(runtime.Unstructured)
+	store.SetResourceVersion(obj, rv)
+	if err := b.write(key, obj); err != nil {
+		return "", err
+	}
+	commit, err := b.record(op, key)
+	if err != nil {
+		return "", err
+	}
+	// the object of the caller only gets the resource version once it is recorded
+	r.rv++
+	store.SetResourceVersion(newd, rv)
+	return commit, nil
+}
+
+// dryRun runs the checks of update without writing the entry, the entry is
+// valid when it can be encoded. The entry gets the resource version it would get.
+func (r *gitrepo) dryRun(key store.Key, newd runtime.Unstructured) error {
+	rv := store.FormatResourceVersion(r.rv + 1)
+	obj := newd.DeepCopyObject().(runtime.Unstructured)
+	store.SetResourceVersion(obj, rv)
+	if _, err := r.encode(obj); err != nil {
+		return store.NewInvalidError(key, "cannot marshal object", err)
+	}
+	store.SetResourceVersion(newd, rv)
+	return nil
 }
 
-func (r *gitrepo) delete(key store.Key) error {
-	return r.deleteFile(key)
+// delete removes the entry from the branch, records the operation and bumps the
+// resource version of the store, the commit is returned if any. The caller must
+// hold the lock.
+func (r *gitrepo) delete(b *branch, key store.Key) (string, error) {
+	if err := b.remove(key); err != nil {
+		return "", err
+	}
+	commit, err := b.record(OperationDelete, key)
+	if err != nil {
+		return "", err
+	}
+	r.rv++
+	return commit, nil
 }
 
 // Delete deletes the entry in the cache
-func (r *gitrepo) Delete(key store.Key, opts ...store.DeleteOption) error {
+func (r *gitrepo) Delete(ctx context.Context, key store.Key, opts ...store.DeleteOption) error {
+	o := store.DeleteOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	key, b, err := r.openBranch(key)
+	if err != nil {
+		return err
+	}
 	// only if an exisitng object gets deleted we
-	// call the registered callbacks
-	exists := true
-	obj, err := r.Get(key)
+	// call the registered callbacks, an unreadable object is left for fsck
+	obj, err := b.read(key)
 	if err != nil {
+		if store.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if err := store.CheckResourceVersion(key, o.ResourceVersion, store.GetResourceVersion(obj)); err != nil {
+		return err
+	}
+	if o.DryRun {
 		return nil
 	}
-	// if exists call the callback
-	if exists {
-		r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
-			Type:   watch.Deleted,
-			Object: obj,
-		})
+	commit, err := r.delete(b, key)
+	if err != nil {
+		return err
 	}
-	// delete the entry to ensure the cb uses the proper data
-	return r.delete(key)
+
+	r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
+		Type:            watch.Deleted,
+		Key:             key,
+		Object:          obj,
+		OldObject:       obj,
+		ResourceVersion: store.FormatResourceVersion(r.rv),
+		Commit:          commit,
+	})
+	return nil
 }
 
+// notifyWatcher queues the event in the watchermanager, the watchers get it once
+// the lock is released. The caller must hold the lock such that events are
+// ordered by resource version.
 func (r *gitrepo) notifyWatcher(event watch.WatchEvent[runtime.Unstructured]) {
-	r.m.RLock()
-	defer r.m.RUnlock()
 	if r.watching {
-		r.watchermanager.WatchChan() <- event
+		r.watchermanager.Notify(event)
 	}
 }
 
@@ -247,13 +796,23 @@ func (r *gitrepo) Watch(ctx context.Context, opts ...store.ListOption) (watch.Wa
 	log := log.FromContext(ctx)
 	log.Debug("watch")
 
-	w := &watcher.WatcherU{
-		Cancel:         cancel,
-		ResultChannel:  make(chan watch.WatchEvent[runtime.Unstructured]),
-		WatcherManager: r.watchermanager,
-		New:            func() runtime.Unstructured { return &unstructured.Unstructured{} },
+	// a watch without a branch watches the checked out branch like a list, the
+	// watchermanager filters the events of the other branches
+	o := store.ListOptions{}
+	o.ApplyOptions(opts)
+	if o.Branch == "" {
+		r.m.RLock()
+		branch, err := r.currentBranch()
+		r.m.RUnlock()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		opts = append(append([]store.ListOption{}, opts...), &store.ListOptions{Branch: branch})
 	}
 
+	w := watcher.New(cancel, r.watchermanager, func() runtime.Unstructured { return &unstructured.Unstructured{} }, opts...)
+
 	go w.ListAndWatch(ctx, r, opts...)
 
 	return w, nil
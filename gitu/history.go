@@ -0,0 +1,264 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/utils/merkletrie"
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/watch"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// DiffEntry is the change of an object between two revisions
+type DiffEntry struct {
+	Key store.Key
+	// Type is watch.Added, watch.Modified or watch.Deleted
+	Type watch.EventType
+	// Old is the object in the from revision, nil if the object is added
+	Old runtime.Unstructured
+	// New is the object in the to revision, nil if the object is deleted
+	New runtime.Unstructured
+	// Fields are the changed fields of a modified object
+	Fields []FieldDiff
+}
+
+// FieldDiff is the change of a field of an object
+type FieldDiff struct {
+	// Path is the path of the field in the unstructured content
+	Path []string
+	// Old is the value in the from revision, nil if the field is added
+	Old any
+	// New is the value in the to revision, nil if the field is removed
+	New any
+}
+
+func (r FieldDiff) String() string {
+	return fmt.Sprintf("%s: %v -> %v", strings.Join(r.Path, "."), r.Old, r.New)
+}
+
+// History returns the commits changing the object of the key, newest first.
+// The history starts at the branch of the key or at HEAD if the key has no branch.
+func (r *gitrepo) History(ctx context.Context, key store.Key) ([]*object.Commit, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	from, err := r.resolveCommit(key.Branch)
+	if err != nil {
+		if store.IsNotFound(err) {
+			return []*object.Commit{}, nil
+		}
+		return nil, err
+	}
+	filename := r.relFilename(key)
+	iter, err := r.repo.Log(&git.LogOptions{
+		From:       from.Hash,
+		PathFilter: func(path string) bool { return path == filename },
+	})
+	if err != nil {
+		return nil, store.NewUnavailableError("cannot get log of "+filename, err)
+	}
+	defer iter.Close()
+
+	commits := []*object.Commit{}
+	if err := iter.ForEach(func(commit *object.Commit) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		commits = append(commits, commit)
+		return nil
+	}); err != nil && !errors.Is(err, storer.ErrStop) {
+		return nil, err
+	}
+	return commits, nil
+}
+
+// Diff returns the changes of the objects between the from and to revisions,
+// the list options restrict the objects that are compared
+func (r *gitrepo) Diff(ctx context.Context, from, to string, opts ...store.ListOption) ([]DiffEntry, error) {
+	o := store.ListOptions{}
+	o.ApplyOptions(opts)
+	// the objects are selected by the revisions
+	o.Branch = ""
+
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	fromTree, err := r.revisionTree(from)
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := r.revisionTree(to)
+	if err != nil {
+		return nil, err
+	}
+	return r.diffTrees(ctx, fromTree, toTree, &o)
+}
+
+// DiffKey returns the change of the object of the key between the from and to
+// revisions, nil is returned when the object did not change
+func (r *gitrepo) DiffKey(ctx context.Context, key store.Key, from, to string) (*DiffEntry, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	oldObj, err := r.readRevision(key, from)
+	if err != nil {
+		return nil, err
+	}
+	newObj, err := r.readRevision(key, to)
+	if err != nil {
+		return nil, err
+	}
+	return newDiffEntry(key, oldObj, newObj), nil
+}
+
+// readRevision reads the object of the key in the revision, nil is returned
+// when the object does not exist in the revision
+func (r *gitrepo) readRevision(key store.Key, rev string) (runtime.Unstructured, error) {
+	commit, err := r.resolveCommit(rev)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := r.readFileFromCommit(key, commit)
+	if err != nil {
+		if store.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (r *gitrepo) revisionTree(rev string) (*object.Tree, error) {
+	commit, err := r.resolveCommit(rev)
+	if err != nil {
+		return nil, err
+	}
+	return r.subtree(commit)
+}
+
+// diffTrees returns the changes of the objects between the trees of the store,
+// a nil tree has no objects
+func (r *gitrepo) diffTrees(ctx context.Context, fromTree, toTree *object.Tree, o *store.ListOptions) ([]DiffEntry, error) {
+	changes, err := object.DiffTreeWithOptions(ctx, fromTree, toTree, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff trees err: %v", err)
+	}
+	entries := []DiffEntry{}
+	for _, change := range changes {
+		action, err := change.Action()
+		if err != nil {
+			return nil, err
+		}
+		name := change.To.Name
+		if action == merkletrie.Delete {
+			name = change.From.Name
+		}
+		key, ok := r.keyFromPath(name)
+		if !ok {
+			continue
+		}
+		if o.Namespace != "" && o.Namespace != key.Namespace {
+			continue
+		}
+		fromFile, toFile, err := change.Files()
+		if err != nil {
+			return nil, err
+		}
+		var oldObj, newObj runtime.Unstructured
+		if fromFile != nil {
+			if oldObj, err = r.decodeFile(key, fromFile); err != nil {
+				return nil, err
+			}
+		}
+		if toFile != nil {
+			if newObj, err = r.decodeFile(key, toFile); err != nil {
+				return nil, err
+			}
+		}
+		entry := newDiffEntry(key, oldObj, newObj)
+		if entry == nil {
+			continue
+		}
+		obj := newObj
+		if obj == nil {
+			obj = oldObj
+		}
+		if !o.Matches(key, obj) {
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, nil
+}
+
+// newDiffEntry compares the old and new object of the key, nil is returned
+// when both are equal
+func newDiffEntry(key store.Key, oldObj, newObj runtime.Unstructured) *DiffEntry {
+	switch {
+	case oldObj == nil && newObj == nil:
+		return nil
+	case oldObj == nil:
+		return &DiffEntry{Key: key, Type: watch.Added, New: newObj}
+	case newObj == nil:
+		return &DiffEntry{Key: key, Type: watch.Deleted, Old: oldObj}
+	}
+	fields := diffFields(nil, oldObj.UnstructuredContent(), newObj.UnstructuredContent())
+	if len(fields) == 0 {
+		return nil
+	}
+	return &DiffEntry{Key: key, Type: watch.Modified, Old: oldObj, New: newObj, Fields: fields}
+}
+
+// diffFields returns the changed fields between the old and new content, maps
+// are compared field by field, any other value is compared as a whole
+func diffFields(path []string, oldContent, newContent map[string]any) []FieldDiff {
+	names := make([]string, 0, len(oldContent)+len(newContent))
+	for name := range oldContent {
+		names = append(names, name)
+	}
+	for name := range newContent {
+		if _, ok := oldContent[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	diffs := []FieldDiff{}
+	for _, name := range names {
+		fieldPath := append(append([]string{}, path...), name)
+		oldValue, oldOk := oldContent[name]
+		newValue, newOk := newContent[name]
+		oldMap, oldIsMap := oldValue.(map[string]any)
+		newMap, newIsMap := newValue.(map[string]any)
+		switch {
+		case oldOk && newOk && oldIsMap && newIsMap:
+			diffs = append(diffs, diffFields(fieldPath, oldMap, newMap)...)
+		case oldOk && newOk && reflect.DeepEqual(oldValue, newValue):
+		default:
+			diffs = append(diffs, FieldDiff{Path: fieldPath, Old: oldValue, New: newValue})
+		}
+	}
+	return diffs
+}
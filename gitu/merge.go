@@ -0,0 +1,518 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/henderiw/store"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// MergeResult is the result of a merge or a rebase
+type MergeResult struct {
+	// Commit is the new head commit of the target branch
+	Commit plumbing.Hash
+	// FastForward is true when the target branch is moved to the source commit
+	FastForward bool
+	// Changes are the changes of the objects of the store on the target branch
+	Changes []DiffEntry
+}
+
+// Conflict is a file changed on both sides of a merge that cannot be merged
+type Conflict struct {
+	// Path is the path of the file in the repository
+	Path string
+	// Key is the key of the object, only set for the objects of the store
+	Key store.Key
+	// Fields are the conflicting fields, empty when the object conflicts as a whole,
+	// e.g. it is modified on one side and deleted on the other side
+	Fields []FieldConflict
+}
+
+// FieldConflict is a field changed differently on both sides of a merge
+type FieldConflict struct {
+	// Path is the path of the field in the unstructured content
+	Path []string
+	// Base, Ours and Theirs are the values of the field in the merge base, the
+	// target and the source; nil if the field does not exist
+	Base   any
+	Ours   any
+	Theirs any
+}
+
+// ConflictError is returned when a merge or a rebase has conflicts, the branches
+// are not changed. It matches store.ErrConflict.
+type ConflictError struct {
+	Conflicts []Conflict
+}
+
+func (r *ConflictError) Error() string {
+	paths := make([]string, 0, len(r.Conflicts))
+	for _, conflict := range r.Conflicts {
+		paths = append(paths, conflict.Path)
+	}
+	return fmt.Sprintf("%s, merge conflicts in: %s", store.ErrConflict.Error(), strings.Join(paths, ", "))
+}
+
+func (r *ConflictError) Is(target error) bool {
+	return target == store.ErrConflict
+}
+
+// IsConflictError returns the conflicts of a merge or a rebase
+func IsConflictError(err error) ([]Conflict, bool) {
+	var conflictErr *ConflictError
+	if errors.As(err, &conflictErr) {
+		return conflictErr.Conflicts, true
+	}
+	return nil, false
+}
+
+// Merge merges the source revision into the target branch. The target branch is
+// fast forwarded when possible, otherwise a merge commit is created with a
+// three-way merge of the objects that merges changes to different fields.
+// Conflicts are returned as a ConflictError without changing the target branch.
+func (r *gitrepo) Merge(ctx context.Context, source, target string) (*MergeResult, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	targetCommit, err := r.branchHead(target)
+	if err != nil {
+		return nil, err
+	}
+	sourceCommit, err := r.resolveCommit(source)
+	if err != nil {
+		return nil, err
+	}
+	return r.merge(ctx, source, sourceCommit, target, targetCommit)
+}
+
+// merge merges the source commit into the target branch, the caller must hold the lock
+func (r *gitrepo) merge(ctx context.Context, source string, sourceCommit *object.Commit, target string, targetCommit *object.Commit) (*MergeResult, error) {
+	base, err := mergeBase(targetCommit, sourceCommit)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case base != nil && base.Hash == sourceCommit.Hash:
+		// the target already contains the source
+		return &MergeResult{Commit: targetCommit.Hash, Changes: []DiffEntry{}}, nil
+	case base != nil && base.Hash == targetCommit.Hash:
+		return r.moveBranch(ctx, target, targetCommit, sourceCommit.Hash, true)
+	}
+	// the merged objects get resource versions ahead of the store, they are only
+	// taken by the store when the branch is moved
+	rvs := uint64(0)
+	tree, err := r.mergeCommits(base, targetCommit, sourceCommit, target, &rvs)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := r.writeCommit(tree, fmt.Sprintf("merge %s into %s", source, target), nil, targetCommit.Hash, sourceCommit.Hash)
+	if err != nil {
+		return nil, store.NewUnavailableError("cannot write merge commit", err)
+	}
+	return r.moveBranch(ctx, target, targetCommit, hash, false)
+}
+
+// Rebase replays the commits of the branch that are not part of the onto revision
+// on top of it, the commits keep their author and message. The commits are merged
+// like Merge does, a conflict stops the rebase without changing the branch.
+func (r *gitrepo) Rebase(ctx context.Context, branch, onto string) (*MergeResult, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	branchCommit, err := r.branchHead(branch)
+	if err != nil {
+		return nil, err
+	}
+	ontoCommit, err := r.resolveCommit(onto)
+	if err != nil {
+		return nil, err
+	}
+	base, err := mergeBase(branchCommit, ontoCommit)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case base != nil && base.Hash == ontoCommit.Hash:
+		// the branch is already based on onto
+		return &MergeResult{Commit: branchCommit.Hash, Changes: []DiffEntry{}}, nil
+	case base != nil && base.Hash == branchCommit.Hash:
+		return r.moveBranch(ctx, branch, branchCommit, ontoCommit.Hash, true)
+	}
+
+	commits, err := rebaseCommits(branchCommit, ontoCommit)
+	if err != nil {
+		return nil, err
+	}
+	// the merged objects get resource versions ahead of the store, they are only
+	// taken by the store when the branch is moved
+	rvs := uint64(0)
+	tip := ontoCommit
+	for _, commit := range commits {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// merge commits are not replayed, the commits they merge are replayed on
+		// their own like git rebase does
+		if commit.NumParents() > 1 {
+			continue
+		}
+		var parent *object.Commit
+		if commit.NumParents() == 1 {
+			if parent, err = commit.Parent(0); err != nil {
+				return nil, store.NewUnavailableError("cannot get parent commit", err)
+			}
+		}
+		tree, err := r.mergeCommits(parent, tip, commit, branch, &rvs)
+		if err != nil {
+			return nil, err
+		}
+		// skip commits that do not change anything on top of onto
+		if tree == tip.TreeHash {
+			continue
+		}
+		hash, err := r.writeCommit(tree, commit.Message, &commit.Author, tip.Hash)
+		if err != nil {
+			return nil, store.NewUnavailableError("cannot write rebased commit", err)
+		}
+		if tip, err = r.repo.CommitObject(hash); err != nil {
+			return nil, store.NewUnavailableError("cannot get rebased commit", err)
+		}
+	}
+	return r.moveBranch(ctx, branch, branchCommit, tip.Hash, false)
+}
+
+// rebaseCommits returns the commits of the branch that are not part of onto,
+// parents before their children, like git rev-list --topo-order --reverse
+// onto..branch. The commits merged into the branch are part of it, also when
+// they are merged as second parent.
+func rebaseCommits(branchCommit, ontoCommit *object.Commit) ([]*object.Commit, error) {
+	excluded := map[plumbing.Hash]bool{}
+	if err := object.NewCommitPreorderIter(ontoCommit, nil, nil).ForEach(func(commit *object.Commit) error {
+		excluded[commit.Hash] = true
+		return nil
+	}); err != nil {
+		return nil, store.NewUnavailableError("cannot get commits of onto", err)
+	}
+	commits := []*object.Commit{}
+	if excluded[branchCommit.Hash] {
+		return commits, nil
+	}
+	// a commit is added once all its parents are added
+	type frame struct {
+		commit *object.Commit
+		parent int
+	}
+	stack := []*frame{{commit: branchCommit}}
+	visited := map[plumbing.Hash]bool{branchCommit.Hash: true}
+	for len(stack) > 0 {
+		f := stack[len(stack)-1]
+		if f.parent < f.commit.NumParents() {
+			parent, err := f.commit.Parent(f.parent)
+			if err != nil {
+				return nil, store.NewUnavailableError("cannot get parent commit", err)
+			}
+			f.parent++
+			if !excluded[parent.Hash] && !visited[parent.Hash] {
+				visited[parent.Hash] = true
+				stack = append(stack, &frame{commit: parent})
+			}
+			continue
+		}
+		stack = stack[:len(stack)-1]
+		commits = append(commits, f.commit)
+	}
+	return commits, nil
+}
+
+// branchHead returns the head commit of the branch
+func (r *gitrepo) branchHead(branch string) (*object.Commit, error) {
+	ref, err := r.repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return nil, store.NewNotFoundError(store.Key{}, fmt.Errorf("branch %s not found", branch))
+		}
+		return nil, store.NewUnavailableError("cannot get branch "+branch, err)
+	}
+	commit, err := r.repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, store.NewUnavailableError("cannot get commit of branch "+branch, err)
+	}
+	return commit, nil
+}
+
+// mergeBase returns the best common ancestor of the commits, nil if the
+// commits have no common history
+func mergeBase(a, b *object.Commit) (*object.Commit, error) {
+	bases, err := a.MergeBase(b)
+	if err != nil {
+		return nil, store.NewUnavailableError("cannot get merge base", err)
+	}
+	if len(bases) == 0 {
+		return nil, nil
+	}
+	return bases[0], nil
+}
+
+// moveBranch points the branch to the commit and notifies the watchers of the
+// changed objects of the store, a nil old commit creates the branch.
+// The caller must hold the lock.
+func (r *gitrepo) moveBranch(ctx context.Context, branch string, oldCommit *object.Commit, hash plumbing.Hash, fastForward bool) (*MergeResult, error) {
+	newCommit, err := r.repo.CommitObject(hash)
+	if err != nil {
+		return nil, store.NewUnavailableError("cannot get commit", err)
+	}
+	var oldTree *object.Tree
+	if oldCommit != nil {
+		if oldTree, err = r.subtree(oldCommit); err != nil {
+			return nil, err
+		}
+	}
+	newTree, err := r.subtree(newCommit)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := r.diffTrees(ctx, oldTree, newTree, &store.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if err := r.setBranch(branch, hash); err != nil {
+		return nil, err
+	}
+	r.notifyChanges(branch, hash.String(), changes)
+	return &MergeResult{Commit: hash, FastForward: fastForward, Changes: changes}, nil
+}
+
+// mergeCommits merges the trees of ours and theirs with the tree of the base
+// and returns the merged tree, a nil base has no files. rvs counts the resource
+// versions after the resource version of the store given to the merged objects.
+func (r *gitrepo) mergeCommits(base, ours, theirs *object.Commit, branch string, rvs *uint64) (plumbing.Hash, error) {
+	trees := make([]map[string]treeFile, 3)
+	for i, commit := range []*object.Commit{base, ours, theirs} {
+		var tree *object.Tree
+		if commit != nil {
+			var err error
+			if tree, err = commit.Tree(); err != nil {
+				return plumbing.ZeroHash, store.NewUnavailableError("cannot get tree of commit "+commit.Hash.String(), err)
+			}
+		}
+		files, err := flattenTree(tree)
+		if err != nil {
+			return plumbing.ZeroHash, store.NewUnavailableError("cannot get files of tree", err)
+		}
+		trees[i] = files
+	}
+	files, conflicts, err := r.mergeFiles(trees[0], trees[1], trees[2], branch, rvs)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if len(conflicts) > 0 {
+		return plumbing.ZeroHash, &ConflictError{Conflicts: conflicts}
+	}
+	hash, err := r.writeTree(files)
+	if err != nil {
+		return plumbing.ZeroHash, store.NewUnavailableError("cannot write merged tree", err)
+	}
+	return hash, nil
+}
+
+// mergeFiles merges the files changed on both sides, object files are merged
+// field by field, any other file changed on both sides is a conflict
+func (r *gitrepo) mergeFiles(base, ours, theirs map[string]treeFile, branch string, rvs *uint64) (map[string]treeFile, []Conflict, error) {
+	paths := []string{}
+	for _, files := range []map[string]treeFile{base, ours, theirs} {
+		for path := range files {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	merged := map[string]treeFile{}
+	conflicts := []Conflict{}
+	for i, path := range paths {
+		if i > 0 && paths[i-1] == path {
+			continue
+		}
+		b, bok := base[path]
+		o, ook := ours[path]
+		t, tok := theirs[path]
+		switch {
+		case ook == tok && o == t:
+			if ook {
+				merged[path] = o
+			}
+		case bok == ook && b == o:
+			if tok {
+				merged[path] = t
+			}
+		case bok == tok && b == t:
+			if ook {
+				merged[path] = o
+			}
+		default:
+			conflict := Conflict{Path: path, Key: r.keyOfPath(path, branch)}
+			if !ook || !tok || !strings.HasSuffix(path, r.codec.Extension()) {
+				conflicts = append(conflicts, conflict)
+				continue
+			}
+			var baseHash *plumbing.Hash
+			if bok {
+				baseHash = &b.hash
+			}
+			hash, fields, err := r.mergeObject(baseHash, o.hash, t.hash, store.FormatResourceVersion(r.rv+*rvs+1))
+			if err != nil {
+				return nil, nil, err
+			}
+			if hash == nil || len(fields) > 0 {
+				conflict.Fields = fields
+				conflicts = append(conflicts, conflict)
+				continue
+			}
+			*rvs++
+			merged[path] = treeFile{hash: *hash, mode: o.mode}
+		}
+	}
+	return merged, conflicts, nil
+}
+
+// keyOfPath returns the key of the file when the file is an object of the store
+func (r *gitrepo) keyOfPath(path, branch string) store.Key {
+	rel, ok := strings.CutPrefix(path, r.relRepoPath+"/")
+	if !ok {
+		return store.Key{}
+	}
+	key, ok := r.keyFromPath(rel)
+	if !ok {
+		return store.Key{}
+	}
+	key.Branch = branch
+	return key
+}
+
+// mergeObject merges the objects in the blobs field by field and stores the merged
+// object with the resource version, no hash is returned when the objects conflict
+// or cannot be decoded. The caller must hold the lock.
+func (r *gitrepo) mergeObject(base *plumbing.Hash, ours, theirs plumbing.Hash, rv string) (*plumbing.Hash, []FieldConflict, error) {
+	decode := func(hash plumbing.Hash) (map[string]any, bool, error) {
+		content, err := r.readBlob(hash)
+		if err != nil {
+			return nil, false, store.NewUnavailableError("cannot read blob "+hash.String(), err)
+		}
+		object, err := r.codec.Decode(content)
+		if err != nil {
+			return nil, false, nil
+		}
+		return object, true, nil
+	}
+	baseObject := map[string]any{}
+	if base != nil {
+		object, ok, err := decode(*base)
+		if err != nil || !ok {
+			return nil, nil, err
+		}
+		baseObject = object
+	}
+	oursObject, ok, err := decode(ours)
+	if err != nil || !ok {
+		return nil, nil, err
+	}
+	theirsObject, ok, err := decode(theirs)
+	if err != nil || !ok {
+		return nil, nil, err
+	}
+	merged, conflicts := mergeFields(nil, baseObject, oursObject, theirsObject)
+	if len(conflicts) > 0 {
+		return nil, conflicts, nil
+	}
+	store.SetResourceVersion(&unstructured.Unstructured{Object: merged}, rv)
+	b, err := r.codec.Encode(merged)
+	if err != nil {
+		return nil, nil, store.NewInvalidError(store.Key{}, "cannot marshal merged object", err)
+	}
+	hash, err := r.writeBlob(b)
+	if err != nil {
+		return nil, nil, store.NewUnavailableError("cannot write merged object", err)
+	}
+	return &hash, nil, nil
+}
+
+// mergeFields merges the changes of ours and theirs to the base content, maps are
+// merged field by field, any other value changed on both sides is a conflict.
+// The resource version is not merged, the caller allocates a new one.
+func mergeFields(path []string, base, ours, theirs map[string]any) (map[string]any, []FieldConflict) {
+	names := []string{}
+	for _, content := range []map[string]any{base, ours, theirs} {
+		for name := range content {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	merged := map[string]any{}
+	conflicts := []FieldConflict{}
+	for i, name := range names {
+		if i > 0 && names[i-1] == name {
+			continue
+		}
+		fieldPath := append(append([]string{}, path...), name)
+		b, bok := base[name]
+		o, ook := ours[name]
+		t, tok := theirs[name]
+		switch {
+		case equalField(o, ook, t, tok):
+			if ook {
+				merged[name] = o
+			}
+		case equalField(b, bok, o, ook):
+			if tok {
+				merged[name] = t
+			}
+		case equalField(b, bok, t, tok):
+			if ook {
+				merged[name] = o
+			}
+		case len(fieldPath) == 2 && fieldPath[0] == "metadata" && fieldPath[1] == "resourceVersion":
+			// the merged object gets a new resource version
+			merged[name] = o
+		default:
+			oMap, oIsMap := o.(map[string]any)
+			tMap, tIsMap := t.(map[string]any)
+			if oIsMap && tIsMap {
+				bMap, _ := b.(map[string]any)
+				m, c := mergeFields(fieldPath, bMap, oMap, tMap)
+				merged[name] = m
+				conflicts = append(conflicts, c...)
+				continue
+			}
+			conflicts = append(conflicts, FieldConflict{Path: fieldPath, Base: b, Ours: o, Theirs: t})
+			if ook {
+				merged[name] = o
+			}
+		}
+	}
+	return merged, conflicts
+}
+
+func equalField(a any, aok bool, b any, bok bool) bool {
+	return aok == bok && reflect.DeepEqual(a, b)
+}
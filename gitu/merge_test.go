@@ -0,0 +1,261 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitu
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/henderiw/store"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestMergeFields(t *testing.T) {
+	cases := map[string]struct {
+		base, ours, theirs map[string]any
+		want               map[string]any
+		// conflicts are the paths of the conflicting fields, joined by "."
+		conflicts []string
+	}{
+		"Unchanged": {
+			base:   map[string]any{"a": "1"},
+			ours:   map[string]any{"a": "1"},
+			theirs: map[string]any{"a": "1"},
+			want:   map[string]any{"a": "1"},
+		},
+		"ChangedByOurs": {
+			base:   map[string]any{"a": "1"},
+			ours:   map[string]any{"a": "2"},
+			theirs: map[string]any{"a": "1"},
+			want:   map[string]any{"a": "2"},
+		},
+		"ChangedByTheirs": {
+			base:   map[string]any{"a": "1"},
+			ours:   map[string]any{"a": "1"},
+			theirs: map[string]any{"a": "2"},
+			want:   map[string]any{"a": "2"},
+		},
+		"SameChangeOnBoth": {
+			base:   map[string]any{"a": "1"},
+			ours:   map[string]any{"a": "2"},
+			theirs: map[string]any{"a": "2"},
+			want:   map[string]any{"a": "2"},
+		},
+		"DifferentFields": {
+			base:   map[string]any{"a": "1", "b": "1"},
+			ours:   map[string]any{"a": "2", "b": "1"},
+			theirs: map[string]any{"a": "1", "b": "2"},
+			want:   map[string]any{"a": "2", "b": "2"},
+		},
+		"AddedAndRemoved": {
+			base:   map[string]any{"a": "1", "b": "1"},
+			ours:   map[string]any{"a": "1", "b": "1", "c": "1"},
+			theirs: map[string]any{"a": "1"},
+			want:   map[string]any{"a": "1", "c": "1"},
+		},
+		"NoBase": {
+			base:   map[string]any{},
+			ours:   map[string]any{"a": "1"},
+			theirs: map[string]any{"b": "1"},
+			want:   map[string]any{"a": "1", "b": "1"},
+		},
+		"NestedDifferentFields": {
+			base:   map[string]any{"spec": map[string]any{"a": "1", "b": "1"}},
+			ours:   map[string]any{"spec": map[string]any{"a": "2", "b": "1"}},
+			theirs: map[string]any{"spec": map[string]any{"a": "1", "b": "2"}},
+			want:   map[string]any{"spec": map[string]any{"a": "2", "b": "2"}},
+		},
+		"NestedConflict": {
+			base:      map[string]any{"spec": map[string]any{"a": "1", "b": "1"}},
+			ours:      map[string]any{"spec": map[string]any{"a": "2", "b": "2"}},
+			theirs:    map[string]any{"spec": map[string]any{"a": "3", "b": "1"}},
+			want:      map[string]any{"spec": map[string]any{"a": "2", "b": "2"}},
+			conflicts: []string{"spec.a"},
+		},
+		"ConflictingValue": {
+			base:      map[string]any{"a": "1"},
+			ours:      map[string]any{"a": "2"},
+			theirs:    map[string]any{"a": "3"},
+			want:      map[string]any{"a": "2"},
+			conflicts: []string{"a"},
+		},
+		"ChangedAndRemoved": {
+			base:      map[string]any{"a": "1"},
+			ours:      map[string]any{"a": "2"},
+			theirs:    map[string]any{},
+			want:      map[string]any{"a": "2"},
+			conflicts: []string{"a"},
+		},
+		"ListsAreValues": {
+			base:      map[string]any{"a": []any{"1"}},
+			ours:      map[string]any{"a": []any{"1", "2"}},
+			theirs:    map[string]any{"a": []any{"1", "3"}},
+			want:      map[string]any{"a": []any{"1", "2"}},
+			conflicts: []string{"a"},
+		},
+		"ResourceVersionIsNotAConflict": {
+			base:   map[string]any{"metadata": map[string]any{"resourceVersion": "1"}},
+			ours:   map[string]any{"metadata": map[string]any{"resourceVersion": "2"}},
+			theirs: map[string]any{"metadata": map[string]any{"resourceVersion": "3"}},
+			want:   map[string]any{"metadata": map[string]any{"resourceVersion": "2"}},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			merged, conflicts := mergeFields(nil, tc.base, tc.ours, tc.theirs)
+			if !reflect.DeepEqual(merged, tc.want) {
+				t.Errorf("want %v, got %v", tc.want, merged)
+			}
+			paths := []string{}
+			for _, conflict := range conflicts {
+				paths = append(paths, strings.Join(conflict.Path, "."))
+			}
+			if len(paths) != len(tc.conflicts) || (len(paths) > 0 && !reflect.DeepEqual(paths, tc.conflicts)) {
+				t.Errorf("want conflicts %v, got %v", tc.conflicts, paths)
+			}
+		})
+	}
+}
+
+func newTestStore(t *testing.T) *gitrepo {
+	t.Helper()
+	s, err := NewStoreV2(&Config{
+		RootPath:      t.TempDir(),
+		GroupResource: schema.GroupResource{Group: "test", Resource: "configmaps"},
+		NewFunc:       func() runtime.Unstructured { return &unstructured.Unstructured{} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*gitrepo)
+}
+
+func testKey(branch, name string) store.Key {
+	return store.Key{Branch: branch, NamespacedName: types.NamespacedName{Namespace: "default", Name: name}}
+}
+
+func testObject(name string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]any{}}
+	u.SetAPIVersion("v1")
+	u.SetKind("ConfigMap")
+	u.SetNamespace("default")
+	u.SetName(name)
+	return u
+}
+
+func TestRebaseAfterMerge(t *testing.T) {
+	cases := map[string]struct {
+		// merged is the branch merged into feature before main gets m2
+		merged string
+		want   []string
+	}{
+		// the commits of topic are only reachable as second parent of the merge
+		"MergedTopic": {
+			merged: "topic",
+			want:   []string{"a", "f", "m", "m2", "t"},
+		},
+		// the merge base is the second parent of the merge
+		"MergedOnto": {
+			merged: "main",
+			want:   []string{"a", "f", "m", "m2"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newTestStore(t)
+			create := func(branch, name string) {
+				t.Helper()
+				if err := s.Create(ctx, testKey(branch, name), testObject(name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Checkout("main"); err != nil {
+				t.Fatal(err)
+			}
+			create("main", "a")
+			for _, branch := range []string{"feature", "topic", "main"} {
+				if err := s.Checkout(branch); err != nil {
+					t.Fatal(err)
+				}
+			}
+			create("topic", "t")
+			create("feature", "f")
+			create("main", "m")
+			if _, err := s.Merge(ctx, tc.merged, "feature"); err != nil {
+				t.Fatal(err)
+			}
+			create("main", "m2")
+
+			result, err := s.Rebase(ctx, "feature", "main")
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, err := s.ListKeys(ctx, &store.ListOptions{Branch: "feature"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(sorted(keys), tc.want) {
+				t.Errorf("want %v, got %v", tc.want, sorted(keys))
+			}
+			// the rebased branch is linear on top of main
+			commit, err := s.repo.CommitObject(result.Commit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			main, err := s.branchHead("main")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for commit.Hash != main.Hash {
+				if commit.NumParents() != 1 {
+					t.Fatalf("want a linear history, commit %s has %d parents", commit.Hash, commit.NumParents())
+				}
+				if commit, err = commit.Parent(0); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func sorted(s []string) []string {
+	s = append([]string{}, s...)
+	slices.Sort(s)
+	return s
+}
+
+func TestDeleteLastObject(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+	if err := s.Create(ctx, testKey("", "a"), testObject("a")); err != nil {
+		t.Fatal(err)
+	}
+	// the index is empty after the last object is deleted
+	if err := s.Delete(ctx, testKey("", "a")); err != nil {
+		t.Fatalf("cannot delete the last object: %v", err)
+	}
+	if _, err := s.Get(ctx, testKey("", "a")); !store.IsNotFound(err) {
+		t.Fatalf("want not found, got %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitu
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/henderiw/logger/log"
+	"github.com/henderiw/store"
+)
+
+// initHeads records the head commits of the branches, a branch moving away
+// from its recorded head is a change made outside of the store
+func (r *gitrepo) initHeads() {
+	r.heads = map[string]plumbing.Hash{}
+	branches, err := r.repo.Branches()
+	if err != nil {
+		return
+	}
+	branches.ForEach(func(ref *plumbing.Reference) error {
+		r.heads[ref.Name().Short()] = ref.Hash()
+		return nil
+	})
+}
+
+// trackHead records the head commit of a branch moved by the store, the caller
+// must hold the lock
+func (r *gitrepo) trackHead(branch string, hash plumbing.Hash) {
+	r.heads[branch] = hash
+}
+
+// poll polls the branches until the context is done
+func (r *gitrepo) poll(ctx context.Context, interval time.Duration, branches []string) {
+	log := log.FromContext(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.pollHeads(ctx, branches); err != nil {
+				log.Error("polling branches failed", "error", err.Error())
+			}
+		}
+	}
+}
+
+// pollHeads notifies the watchers of the changes of the objects on the branches
+// that moved since the last poll, e.g. by a commit, a pull or a reset outside of the
+// store. A new branch is compared to an empty tree, a deleted branch is forgotten.
+// All branches are polled when no branches are provided.
+func (r *gitrepo) pollHeads(ctx context.Context, branches []string) error {
+	log := log.FromContext(ctx)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	refs, err := r.repo.Branches()
+	if err != nil {
+		return store.NewUnavailableError("cannot list branches", err)
+	}
+	heads := map[string]plumbing.Hash{}
+	if err := refs.ForEach(func(ref *plumbing.Reference) error {
+		heads[ref.Name().Short()] = ref.Hash()
+		return nil
+	}); err != nil {
+		return store.NewUnavailableError("cannot list branches", err)
+	}
+	for branch := range r.heads {
+		if _, ok := heads[branch]; !ok {
+			delete(r.heads, branch)
+		}
+	}
+
+	for branch, hash := range heads {
+		if len(branches) > 0 && !slices.Contains(branches, branch) {
+			continue
+		}
+		oldHash, ok := r.heads[branch]
+		if ok && oldHash == hash {
+			continue
+		}
+		var oldTree *object.Tree
+		if ok {
+			// a commit that is no longer available is handled like a new branch
+			if oldCommit, err := r.repo.CommitObject(oldHash); err == nil {
+				if oldTree, err = r.subtree(oldCommit); err != nil {
+					return err
+				}
+			}
+		}
+		newCommit, err := r.repo.CommitObject(hash)
+		if err != nil {
+			return store.NewUnavailableError("cannot get commit of branch "+branch, err)
+		}
+		newTree, err := r.subtree(newCommit)
+		if err != nil {
+			return err
+		}
+		changes, err := r.diffTrees(ctx, oldTree, newTree, &store.ListOptions{})
+		if err != nil {
+			return err
+		}
+		log.Debug("branch moved", "branch", branch, "from", oldHash.String(), "to", hash.String(), "changes", len(changes))
+		r.notifyChanges(branch, hash.String(), changes)
+		r.trackHead(branch, hash)
+	}
+	return nil
+}
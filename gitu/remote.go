@@ -0,0 +1,222 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/henderiw/logger/log"
+	"github.com/henderiw/store"
+)
+
+// DefaultRemote is the name of the remote used when no remote is provided
+const DefaultRemote = "origin"
+
+// Remote is a remote repository of the store
+type Remote struct {
+	// Name of the remote, DefaultRemote is used when not set
+	Name string
+	// URL of the remote, e.g. a local path, file://, ssh:// or https:// url
+	URL string
+	// Auth is the authentication for the remote, e.g. ssh.PublicKeys or http.BasicAuth
+	Auth transport.AuthMethod
+}
+
+// SyncConfig configures the periodic synchronization of branches with a remote
+type SyncConfig struct {
+	// Interval between two synchronizations
+	Interval time.Duration
+	// Remote to synchronize with, DefaultRemote is used when not set
+	Remote string
+	// Branches to synchronize, the checked out branch is used when not set
+	Branches []string
+	// Push pushes the branches to the remote after pulling them
+	Push bool
+}
+
+// initRemotes adds the remotes to the repository, a remote with the same name
+// and another url is replaced
+func (r *gitrepo) initRemotes(remotes []Remote) error {
+	r.auth = map[string]transport.AuthMethod{}
+	for _, remote := range remotes {
+		name := remote.Name
+		if name == "" {
+			name = DefaultRemote
+		}
+		r.auth[name] = remote.Auth
+
+		existing, err := r.repo.Remote(name)
+		if err == nil {
+			urls := existing.Config().URLs
+			if len(urls) == 1 && urls[0] == remote.URL {
+				continue
+			}
+			if err := r.repo.DeleteRemote(name); err != nil {
+				return fmt.Errorf("cannot replace remote %s, err: %v", name, err)
+			}
+		} else if !errors.Is(err, git.ErrRemoteNotFound) {
+			return fmt.Errorf("cannot get remote %s, err: %v", name, err)
+		}
+		if _, err := r.repo.CreateRemote(&config.RemoteConfig{
+			Name: name,
+			URLs: []string{remote.URL},
+		}); err != nil {
+			return fmt.Errorf("cannot create remote %s, err: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Fetch fetches the branches of the remote
+func (r *gitrepo) Fetch(ctx context.Context, remote string) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.fetch(ctx, remote)
+}
+
+// fetch fetches the branches of the remote, the caller must hold the lock as the
+// repository storage does not support concurrent writes
+func (r *gitrepo) fetch(ctx context.Context, remote string) error {
+	if remote == "" {
+		remote = DefaultRemote
+	}
+	err := r.repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: remote,
+		Auth:       r.auth[remote],
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		if errors.Is(err, git.ErrRemoteNotFound) {
+			return store.NewNotFoundError(store.Key{}, fmt.Errorf("remote %s not found", remote))
+		}
+		return store.NewUnavailableError("cannot fetch from remote "+remote, err)
+	}
+	return nil
+}
+
+// Pull fetches the remote and merges the remote branch into the branch, the checked
+// out branch is used when no branch is provided. The branch is created when it does
+// not exist, the watchers get the changes of the objects of the store.
+func (r *gitrepo) Pull(ctx context.Context, remote, branch string) (*MergeResult, error) {
+	if remote == "" {
+		remote = DefaultRemote
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := r.fetch(ctx, remote); err != nil {
+		return nil, err
+	}
+	if branch == "" {
+		var err error
+		if branch, err = r.currentBranch(); err != nil {
+			return nil, err
+		}
+	}
+	ref, err := r.repo.Reference(plumbing.NewRemoteReferenceName(remote, branch), true)
+	if err != nil {
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return nil, store.NewNotFoundError(store.Key{}, fmt.Errorf("branch %s not found on remote %s", branch, remote))
+		}
+		return nil, store.NewUnavailableError("cannot get remote branch "+branch, err)
+	}
+	remoteCommit, err := r.repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, store.NewUnavailableError("cannot get commit of remote branch "+branch, err)
+	}
+	localCommit, err := r.branchHead(branch)
+	if err != nil {
+		if !store.IsNotFound(err) {
+			return nil, err
+		}
+		return r.moveBranch(ctx, branch, nil, remoteCommit.Hash, true)
+	}
+	return r.merge(ctx, remote+"/"+branch, remoteCommit, branch, localCommit)
+}
+
+// Push pushes the branch to the remote, the checked out branch is used when no
+// branch is provided. A push that is not a fast forward of the remote branch
+// returns a conflict, the branch has to be pulled first.
+func (r *gitrepo) Push(ctx context.Context, remote, branch string) error {
+	if remote == "" {
+		remote = DefaultRemote
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if branch == "" {
+		var err error
+		if branch, err = r.currentBranch(); err != nil {
+			return err
+		}
+	}
+	name := plumbing.NewBranchReferenceName(branch)
+	err := r.repo.PushContext(ctx, &git.PushOptions{
+		RemoteName: remote,
+		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("%s:%s", name, name))},
+		Auth:       r.auth[remote],
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		if errors.Is(err, git.ErrRemoteNotFound) {
+			return store.NewNotFoundError(store.Key{}, fmt.Errorf("remote %s not found", remote))
+		}
+		if strings.Contains(err.Error(), "non-fast-forward") {
+			return &store.Error{
+				Err:     store.ErrConflict,
+				Message: fmt.Sprintf("branch %s is behind remote %s", branch, remote),
+				Cause:   err,
+			}
+		}
+		return store.NewUnavailableError("cannot push to remote "+remote, err)
+	}
+	return nil
+}
+
+// syncRemote periodically pulls and optionally pushes the branches until the context is done
+func (r *gitrepo) syncRemote(ctx context.Context, cfg *SyncConfig) {
+	log := log.FromContext(ctx)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			branches := cfg.Branches
+			if len(branches) == 0 {
+				branches = []string{""}
+			}
+			for _, branch := range branches {
+				if _, err := r.Pull(ctx, cfg.Remote, branch); err != nil {
+					log.Error("sync pull failed", "remote", cfg.Remote, "branch", branch, "error", err.Error())
+					continue
+				}
+				if !cfg.Push {
+					continue
+				}
+				if err := r.Push(ctx, cfg.Remote, branch); err != nil {
+					log.Error("sync push failed", "remote", cfg.Remote, "branch", branch, "error", err.Error())
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/util.go"
+	"github.com/henderiw/store/watch"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Begin starts a transaction, the keys of the transaction must have the same
+// branch. The changes are committed as a single commit, or staged when auto
+// commit is disabled and the branch is checked out.
+func (r *gitrepo) Begin() *store.Tx[runtime.Unstructured] {
+	return store.NewTx(r.commitTx)
+}
+
+// commitTx applies the operations of a transaction all or nothing, the events
+// are sent once the changes are committed
+func (r *gitrepo) commitTx(ctx context.Context, ops []store.TxOperation[runtime.Unstructured]) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	current, err := r.currentBranch()
+	if err != nil {
+		return err
+	}
+	// a single commit changes a single branch
+	branch := ""
+	for i, op := range ops {
+		name := op.Key.Branch
+		if name == "" {
+			name = current
+		}
+		if i > 0 && name != branch {
+			return store.NewInvalidError(op.Key, fmt.Sprintf("transaction spans branches %s and %s", branch, name), nil)
+		}
+		branch = name
+	}
+	_, b, err := r.openBranch(store.Key{Branch: branch})
+	if err != nil {
+		return err
+	}
+	ops = append([]store.TxOperation[runtime.Unstructured]{}, ops...)
+	for i := range ops {
+		ops[i].Key.Branch = b.name
+	}
+
+	changes, err := store.PlanTx(ops, func(key store.Key) (runtime.Unstructured, string, bool, error) {
+		obj, err := b.read(key)
+		if err != nil {
+			if store.IsNotFound(err) {
+				return nil, "", false, nil
+			}
+			return nil, "", false, err
+		}
+		return obj, store.GetResourceVersion(obj), true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	// all objects are encoded before any file is changed, the resource versions
+	// are only allocated once the changes are committed
+	contents := make([][]byte, len(changes))
+	rvs := make([]string, len(changes))
+	for i, change := range changes {
+		rvs[i] = store.FormatResourceVersion(r.rv + uint64(i) + 1)
+		if change.Type == watch.Deleted {
+			continue
+		}
+		obj := change.Object.DeepCopyObject().(runtime.Unstructured)
+		store.SetResourceVersion(obj, rvs[i])
+		if contents[i], err = r.encode(obj); err != nil {
+			return store.NewInvalidError(change.Key, "cannot marshal object", err)
+		}
+	}
+	// a dry run validates the changes without applying them, the objects get the
+	// resource versions they would get
+	if store.TxDryRun(ops) {
+		for i, change := range changes {
+			if change.Type != watch.Deleted {
+				store.SetResourceVersion(change.Object, rvs[i])
+			}
+		}
+		return nil
+	}
+
+	var commit string
+	if b.checkedOut {
+		// the files are restored when the changes cannot be committed
+		keys := store.TxKeys(ops)
+		old := make(map[store.Key][]byte, len(keys))
+		for _, key := range keys {
+			content, err := os.ReadFile(r.filename(key))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			old[key] = content
+		}
+		dirty := r.dirty
+		if commit, err = r.applyTx(changes, contents, keys, old); err != nil {
+			if rerr := r.restoreTx(keys, old); rerr != nil {
+				return errors.Join(err, rerr)
+			}
+			r.dirty = dirty
+			return err
+		}
+	} else {
+		// a branch that is not checked out only changes when its commit is written
+		for i, change := range changes {
+			if change.Type == watch.Deleted {
+				b.remove(change.Key)
+				continue
+			}
+			if err := b.writeContent(change.Key, contents[i]); err != nil {
+				return err
+			}
+		}
+		if commit, err = b.commit(r.txMessage(changes)); err != nil {
+			return err
+		}
+	}
+	// the objects of the caller only get their resource version once they are committed
+	r.rv += uint64(len(changes))
+	for i, change := range changes {
+		if change.Type != watch.Deleted {
+			store.SetResourceVersion(change.Object, rvs[i])
+		}
+		r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
+			Type:            change.Type,
+			Key:             change.Key,
+			Object:          change.Object,
+			OldObject:       change.OldObject,
+			ResourceVersion: rvs[i],
+			Commit:          commit,
+		})
+	}
+	return nil
+}
+
+// applyTx writes the files of the changes, stages them and commits them unless
+// auto commit is disabled, the commit is returned if any
+func (r *gitrepo) applyTx(changes []store.TxChange[runtime.Unstructured], contents [][]byte, keys []store.Key, old map[store.Key][]byte) (string, error) {
+	for i, change := range changes {
+		if change.Type == watch.Deleted {
+			if err := r.deleteFile(change.Key); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return "", err
+			}
+			continue
+		}
+		if err := util.EnsureDir(filepath.Dir(r.filename(change.Key))); err != nil {
+			return "", err
+		}
+		if err := util.WriteFileAtomic(r.filename(change.Key), contents[i], 0644); err != nil {
+			return "", err
+		}
+	}
+	for _, key := range keys {
+		if r.exists(key) {
+			if err := r.stage(OperationUpdate, key); err != nil {
+				return "", err
+			}
+		} else if old[key] != nil {
+			if err := r.stage(OperationDelete, key); err != nil {
+				return "", err
+			}
+		}
+	}
+	if r.disableAutoCommit {
+		return "", nil
+	}
+	hash, err := r.commit(r.txMessage(changes))
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// txMessage returns the commit message of the changes of a transaction
+func (r *gitrepo) txMessage(changes []store.TxChange[runtime.Unstructured]) string {
+	lines := make([]string, 0, len(changes))
+	for _, change := range changes {
+		op := OperationUpdate
+		switch change.Type {
+		case watch.Added:
+			op = OperationCreate
+		case watch.Deleted:
+			op = OperationDelete
+		}
+		lines = append(lines, r.messageFunc(op, change.Key))
+	}
+	if len(lines) == 1 {
+		return lines[0]
+	}
+	return fmt.Sprintf("transaction %s, %d changes\n\n%s", r.groupResource.String(), len(lines), strings.Join(lines, "\n"))
+}
+
+// restoreTx restores the files of the keys and their staged state, the files
+// that cannot be restored are returned as an error
+func (r *gitrepo) restoreTx(keys []store.Key, old map[store.Key][]byte) error {
+	errs := []error{}
+	for _, key := range keys {
+		if old[key] == nil {
+			if err := os.Remove(r.filename(key)); err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					errs = append(errs, fmt.Errorf("cannot restore %s: %w", r.relFilename(key), err))
+				}
+				continue
+			}
+			if err := r.stage(OperationDelete, key); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if err := util.WriteFileAtomic(r.filename(key), old[key], 0644); err != nil {
+			errs = append(errs, fmt.Errorf("cannot restore %s: %w", r.relFilename(key), err))
+			continue
+		}
+		if err := r.stage(OperationUpdate, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
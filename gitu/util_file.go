@@ -15,24 +15,54 @@
 package gitu
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/henderiw/store"
 	"github.com/henderiw/store/util.go"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/types"
-	"sigs.k8s.io/yaml"
 )
 
 func (r *gitrepo) filename(key store.Key) string {
-	if key.Namespace != "" {
-		return filepath.Join(r.rootPath, key.Namespace, key.Name+".yaml")
+	return filepath.Join(r.rootPath, filepath.FromSlash(r.keyEncoder.Encode(key))+r.codec.Extension())
+}
+
+// keyFromPath returns the key of the object stored in the file at the path
+// relative to the root of the store, false if the path is not an object of the store
+func (r *gitrepo) keyFromPath(path string) (store.Key, bool) {
+	if !strings.HasSuffix(path, r.codec.Extension()) {
+		return store.Key{}, false
+	}
+	return r.keyEncoder.Decode(strings.TrimSuffix(path, r.codec.Extension()))
+}
+
+// decode decodes the content of the file of the key
+func (r *gitrepo) decode(key store.Key, content []byte) (runtime.Unstructured, error) {
+	object, err := r.codec.Decode(content)
+	if err != nil {
+		return nil, store.NewInvalidError(key, "cannot decode object", err)
+	}
+	// a file truncated to nothing decodes without error
+	if len(object) == 0 {
+		return nil, store.NewInvalidError(key, "empty object", nil)
+	}
+	return &unstructured.Unstructured{
+		Object: object,
+	}, nil
+}
+
+// encode encodes the object to the content of its file
+func (r *gitrepo) encode(obj runtime.Unstructured) ([]byte, error) {
+	if obj == nil {
+		return nil, errors.New("no object")
 	}
-	return filepath.Join(r.rootPath, key.Name+".yaml")
+	return r.codec.Encode(obj.UnstructuredContent())
 }
 
 func (r *gitrepo) readFile(key store.Key) (runtime.Unstructured, error) {
@@ -43,15 +73,12 @@ func (r *gitrepo) readFile(key store.Key) (runtime.Unstructured, error) {
 	var obj runtime.Unstructured
 	content, err := os.ReadFile(r.filename(key))
 	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return obj, store.NewNotFoundError(key, err)
+		}
 		return obj, err
 	}
-	object := map[string]any{}
-	if err := yaml.Unmarshal(content, &object); err != nil {
-		return obj, err
-	}
-	return &unstructured.Unstructured{
-		Object: object,
-	}, nil
+	return r.decode(key, content)
 }
 
 func (r *gitrepo) exists(key store.Key) bool {
@@ -60,53 +87,77 @@ func (r *gitrepo) exists(key store.Key) bool {
 }
 
 func (r *gitrepo) writeFile(key store.Key, obj runtime.Unstructured) error {
-	if err := util.EnsureDir(r.rootPath); err != nil {
-		return fmt.Errorf("unable to write data dir: %s", err)
-	}
-	b, err := yaml.Marshal(obj)
+	b, err := r.encode(obj)
 	if err != nil {
-		return err
+		return store.NewInvalidError(key, "cannot marshal object", err)
 	}
-	return os.WriteFile(r.filename(key), b, 0644)
+	if err := util.EnsureDir(filepath.Dir(r.filename(key))); err != nil {
+		return fmt.Errorf("unable to write data dir: %s", err)
+	}
+	return util.WriteFileAtomic(r.filename(key), b, 0644)
 }
 
 func (r *gitrepo) deleteFile(key store.Key) error {
-	return os.Remove(r.filename(key))
+	if err := os.Remove(r.filename(key)); err != nil {
+		return err
+	}
+	return util.SyncDir(filepath.Dir(r.filename(key)))
 }
 
-func (r *gitrepo) visitDir(visitorFunc func(store.Key, runtime.Unstructured)) error {
+// visitDir visits the objects in the worktree, the keys get the checked out branch
+func (r *gitrepo) visitDir(ctx context.Context, branch string, visitorFunc func(store.Key, runtime.Unstructured), opts ...store.ListOption) error {
+	o := store.ListOptions{}
+	o.ApplyOptions(opts)
+
 	if err := util.EnsureDir(r.rootPath); err != nil {
 		return fmt.Errorf("unable to write data dir: %s", err)
 	}
 	return filepath.Walk(r.rootPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
+			// a temporary file of an atomic write is renamed while walking the directory
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// a long walk stops once the context is cancelled
+		if err := ctx.Err(); err != nil {
 			return err
 		}
 		if info.IsDir() {
 			return nil
 		}
-		// skip any non yaml file
-		if !strings.HasSuffix(info.Name(), ".yaml") {
+		// skip any file of another codec
+		if !strings.HasSuffix(info.Name(), r.codec.Extension()) {
 			return nil
 		}
-		// this is a yaml file by now
-		// next step is find the key (namespace and name)
-		name := filepath.Base(path)
-		name = strings.TrimSuffix(name, ".yaml")
-		namespace := ""
-		parts := strings.Split(name, "_")
-		if len(parts) > 1 {
-			namespace = parts[0]
-			name = parts[1]
+		// next step is find the key (namespace and name) from the path
+		rel, err := filepath.Rel(r.rootPath, path)
+		if err != nil {
+			return err
+		}
+		key, ok := r.keyFromPath(filepath.ToSlash(rel))
+		if !ok {
+			return nil
+		}
+		key.Branch = branch
+		// skip reading the file if the namespace does not match
+		if o.Namespace != "" && o.Namespace != key.Namespace {
+			return nil
 		}
-		key := store.KeyFromNSN(types.NamespacedName{
-			Name:      name,
-			Namespace: namespace,
-		})
 
 		newObj, err := r.readFile(key)
 		if err != nil {
-			return err
+			// the file is removed while walking the directory
+			if store.IsNotFound(err) {
+				return nil
+			}
+			// a corrupt file does not stop the list, it is reported once the list completes
+			o.SkipError(ctx, key, err)
+			return nil
+		}
+		if !o.Matches(key, newObj) {
+			return nil
 		}
 		if visitorFunc != nil {
 			visitorFunc(key, newObj)
@@ -115,3 +166,29 @@ func (r *gitrepo) visitDir(visitorFunc func(store.Key, runtime.Unstructured)) er
 		return nil
 	})
 }
+
+// initResourceVersion initializes the resource version of the store with the
+// highest resource version of the objects in the worktree and the branches
+func (r *gitrepo) initResourceVersion() {
+	visitorFunc := func(_ store.Key, obj runtime.Unstructured) {
+		rv, err := store.ParseResourceVersion(store.GetResourceVersion(obj))
+		if err == nil && rv > r.rv {
+			r.rv = rv
+		}
+	}
+	ctx := context.Background()
+	r.visitDir(ctx, "", visitorFunc)
+
+	branches, err := r.repo.Branches()
+	if err != nil {
+		return
+	}
+	branches.ForEach(func(ref *plumbing.Reference) error {
+		commit, err := r.repo.CommitObject(ref.Hash())
+		if err != nil {
+			return nil
+		}
+		r.visitCommitTree(ctx, commit, ref.Name().Short(), visitorFunc)
+		return nil
+	})
+}
@@ -16,25 +16,33 @@ package gitu
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/henderiw/logger/log"
 	"github.com/henderiw/store"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"github.com/henderiw/store/watch"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/types"
-	"sigs.k8s.io/yaml"
 )
 
 func (r *gitrepo) readFileFromCommit(key store.Key, commit *object.Commit) (runtime.Unstructured, error) {
 	var obj runtime.Unstructured
 	// Retrieve the file from the commit
-	file, err := commit.File(r.filename(key))
+	file, err := commit.File(r.relFilename(key))
 	if err != nil {
+		if errors.Is(err, object.ErrFileNotFound) {
+			return obj, store.NewNotFoundError(key, err)
+		}
 		return obj, fmt.Errorf("failed to find file in commit %v", err)
 	}
 
@@ -49,17 +57,59 @@ func (r *gitrepo) readFileFromCommit(key store.Key, commit *object.Commit) (runt
 	if err != nil {
 		return obj, fmt.Errorf("failed to read file content %v", err)
 	}
-	object := map[string]any{}
-	if err := yaml.Unmarshal(content, &object); err != nil {
-		return obj, fmt.Errorf("failed to unmarshal file content %v", err)
+	return r.decode(key, content)
+}
+
+// decodeFile decodes the object of the key in the file of a commit
+func (r *gitrepo) decodeFile(key store.Key, f *object.File) (runtime.Unstructured, error) {
+	content, err := f.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("failed toget file content %v", err)
+	}
+	return r.decode(key, []byte(content))
+}
+
+// resolveCommit returns the commit of a revision, a revision is a branch, a tag,
+// a commit hash or any other revision git understands, e.g. main~1; an empty
+// revision is HEAD
+func (r *gitrepo) resolveCommit(rev string) (*object.Commit, error) {
+	if rev == "" {
+		rev = plumbing.HEAD.String()
+	}
+	hash, err := r.repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, store.NewNotFoundError(store.Key{}, fmt.Errorf("revision %s: %v", rev, err))
+	}
+	commit, err := r.repo.CommitObject(*hash)
+	if err != nil {
+		return nil, store.NewUnavailableError("cannot get commit of revision "+rev, err)
+	}
+	return commit, nil
+}
+
+// subtree returns the tree of the store in the commit, a commit without
+// objects of the store has no tree
+func (r *gitrepo) subtree(commit *object.Commit) (*object.Tree, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tree from commit err: %v", err)
+	}
+	subtree, err := tree.Tree(r.relRepoPath)
+	if err != nil {
+		if errors.Is(err, object.ErrDirectoryNotFound) {
+			return nil, nil
+		}
+		return nil, err
 	}
-	return &unstructured.Unstructured{
-		Object: object,
-	}, nil
+	return subtree, nil
 }
 
-func (r *gitrepo) visitCommitTree(commit *object.Commit, visitorFunc func(store.Key, runtime.Unstructured)) error {
-	log := log.FromContext(context.Background())
+// visitCommitTree visits the objects in the tree of the commit, the keys get the given branch
+func (r *gitrepo) visitCommitTree(ctx context.Context, commit *object.Commit, branch string, visitorFunc func(store.Key, runtime.Unstructured), opts ...store.ListOption) error {
+	o := store.ListOptions{}
+	o.ApplyOptions(opts)
+
+	log := log.FromContext(ctx)
 	// Get the tree from the commit
 	tree, err := commit.Tree()
 	if err != nil {
@@ -75,33 +125,28 @@ func (r *gitrepo) visitCommitTree(commit *object.Commit, visitorFunc func(store.
 	}
 	// List files in the subtree
 	err = subtree.Files().ForEach(func(f *object.File) error {
-		// skip any non yaml file
-		if !strings.HasSuffix(f.Name, ".yaml") {
+		// a long walk stops once the context is cancelled
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key, ok := r.keyFromPath(f.Name)
+		if !ok {
 			return nil
 		}
-		name := filepath.Base(f.Name)
-		name = strings.TrimSuffix(name, ".yaml")
-		namespace := ""
-		parts := strings.Split(name, "_")
-		if len(parts) > 1 {
-			namespace = parts[0]
-			name = parts[1]
+		key.Branch = branch
+		// skip reading the file if the namespace does not match
+		if o.Namespace != "" && o.Namespace != key.Namespace {
+			return nil
 		}
-		key := store.KeyFromNSN(types.NamespacedName{
-			Name:      name,
-			Namespace: namespace,
-		})
 
-		content, err := f.Contents()
+		newObj, err := r.decodeFile(key, f)
 		if err != nil {
-			return fmt.Errorf("failed toget file content %v", err)
-		}
-		object := map[string]any{}
-		if err := yaml.Unmarshal([]byte(content), &object); err != nil {
-			return fmt.Errorf("failed to unmarshal file content %v", err)
+			// a corrupt file does not stop the list, it is reported once the list completes
+			o.SkipError(ctx, key, err)
+			return nil
 		}
-		newObj := &unstructured.Unstructured{
-			Object: object,
+		if !o.Matches(key, newObj) {
+			return nil
 		}
 
 		if visitorFunc != nil {
@@ -111,3 +156,381 @@ func (r *gitrepo) visitCommitTree(commit *object.Commit, visitorFunc func(store.
 	})
 	return err
 }
+
+// openRepository opens the git repository containing the path or initializes
+// a new repository at the path when there is none
+func openRepository(path string) (*git.Repository, error) {
+	repo, err := git.PlainOpenWithOptions(path, &git.PlainOpenOptions{DetectDotGit: true})
+	if err == nil {
+		return repo, nil
+	}
+	if !errors.Is(err, git.ErrRepositoryNotExists) {
+		return nil, fmt.Errorf("cannot open git repository at %s, err: %v", path, err)
+	}
+	repo, err = git.PlainInit(path, false)
+	if err != nil {
+		return nil, fmt.Errorf("cannot init git repository at %s, err: %v", path, err)
+	}
+	return repo, nil
+}
+
+// relPathInWorktree returns the path relative to the root of the worktree of the repository
+func relPathInWorktree(repo *git.Repository, path string) (string, error) {
+	wt, err := repo.Worktree()
+	if err != nil {
+		return "", fmt.Errorf("cannot get worktree of the git repository, err: %v", err)
+	}
+	root, err := filepath.EvalSymlinks(wt.Filesystem.Root())
+	if err != nil {
+		return "", err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	path, err = filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("root path %s is not in the worktree %s", path, root)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// relFilename returns the path of the file in the repository
+func (r *gitrepo) relFilename(key store.Key) string {
+	return path.Join(r.relRepoPath, r.keyEncoder.Encode(key)+r.codec.Extension())
+}
+
+// currentBranch returns the branch HEAD points to, the branch might not have
+// a commit yet; a detached HEAD has no branch
+func (r *gitrepo) currentBranch() (string, error) {
+	head, err := r.repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return "", store.NewUnavailableError("cannot get HEAD of the git repository", err)
+	}
+	if head.Type() != plumbing.SymbolicReference {
+		return "", nil
+	}
+	return head.Target().Short(), nil
+}
+
+// branchCommit returns the head commit of the branch or nil if the branch is checked
+// out, in which case the data is read from the worktree
+func (r *gitrepo) branchCommit(key store.Key, branch string) (*object.Commit, error) {
+	if branch == "" {
+		return nil, nil
+	}
+	current, err := r.currentBranch()
+	if err != nil {
+		return nil, err
+	}
+	if branch == current {
+		return nil, nil
+	}
+	commit, err := r.branchHead(branch)
+	if err != nil && store.IsNotFound(err) {
+		return nil, store.NewNotFoundError(key, fmt.Errorf("branch %s not found", branch))
+	}
+	return commit, err
+}
+
+// checkout checks out the branch in the worktree and creates it from the checked
+// out commit if it does not exist, an empty branch keeps the checked out branch.
+// The caller must hold the lock.
+func (r *gitrepo) checkout(branch string) (string, error) {
+	current, err := r.currentBranch()
+	if err != nil {
+		return "", err
+	}
+	if branch == "" || branch == current {
+		return current, nil
+	}
+	name := plumbing.NewBranchReferenceName(branch)
+	if err := name.Validate(); err != nil {
+		return "", store.NewInvalidError(store.Key{}, "invalid branch "+branch, err)
+	}
+	if r.dirty {
+		return "", &store.Error{
+			Err:     store.ErrConflict,
+			Message: fmt.Sprintf("cannot checkout branch %s, branch %s has uncommitted changes", branch, current),
+		}
+	}
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		return "", store.NewUnavailableError("cannot get worktree", err)
+	}
+	opts := &git.CheckoutOptions{Branch: name}
+	if _, err := r.repo.Reference(name, true); err != nil {
+		if !errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return "", store.NewUnavailableError("cannot get branch "+branch, err)
+		}
+		head, err := r.repo.Head()
+		if err != nil {
+			if !errors.Is(err, plumbing.ErrReferenceNotFound) {
+				return "", store.NewUnavailableError("cannot get HEAD of the git repository", err)
+			}
+			// the repository has no commit yet, the branch is created by the first commit
+			if err := r.repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, name)); err != nil {
+				return "", store.NewUnavailableError("cannot set HEAD to branch "+branch, err)
+			}
+			return branch, nil
+		}
+		opts.Create = true
+		opts.Hash = head.Hash()
+	}
+	if err := wt.Checkout(opts); err != nil {
+		return "", store.NewUnavailableError("cannot checkout branch "+branch, err)
+	}
+	if opts.Create {
+		r.trackHead(branch, opts.Hash)
+	}
+	return branch, nil
+}
+
+// record stages the change of the file of the key in the index and commits it
+// unless auto commit is disabled, the commit is returned if any. The caller must
+// hold the lock.
+func (r *gitrepo) record(op Operation, key store.Key) (string, error) {
+	if err := r.stage(op, key); err != nil {
+		return "", err
+	}
+	if r.disableAutoCommit {
+		return "", nil
+	}
+	hash, err := r.commit(r.messageFunc(op, key))
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// stage stages the change of the file of the key in the index, the caller must
+// hold the lock
+func (r *gitrepo) stage(op Operation, key store.Key) error {
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		return store.NewUnavailableError("cannot get worktree", err)
+	}
+	if op == OperationDelete {
+		_, err = wt.Remove(r.relFilename(key))
+	} else {
+		_, err = wt.Add(r.relFilename(key))
+	}
+	if err != nil {
+		return store.NewUnavailableError("cannot stage "+r.relFilename(key), err)
+	}
+	r.dirty = true
+	return nil
+}
+
+// commit commits the staged changes, the caller must hold the lock
+func (r *gitrepo) commit(message string) (plumbing.Hash, error) {
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, store.NewUnavailableError("cannot get worktree", err)
+	}
+	// go-git refuses to commit an empty index, which is what deleting the
+	// last object of the repository stages
+	hash, err := wt.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  r.authorName,
+			Email: r.authorEmail,
+			When:  time.Now(),
+		},
+		AllowEmptyCommits: true,
+	})
+	if err != nil {
+		return plumbing.ZeroHash, store.NewUnavailableError("cannot commit", err)
+	}
+	r.dirty = false
+	if branch, err := r.currentBranch(); err == nil && branch != "" {
+		r.trackHead(branch, hash)
+	}
+	return hash, nil
+}
+
+// treeFile is a file in a git tree
+type treeFile struct {
+	hash plumbing.Hash
+	mode filemode.FileMode
+}
+
+// flattenTree returns the files of the tree by path, a nil tree has no files
+func flattenTree(tree *object.Tree) (map[string]treeFile, error) {
+	files := map[string]treeFile{}
+	if tree == nil {
+		return files, nil
+	}
+	err := tree.Files().ForEach(func(f *object.File) error {
+		files[f.Name] = treeFile{hash: f.Hash, mode: f.Mode}
+		return nil
+	})
+	return files, err
+}
+
+// readBlob returns the content of the blob
+func (r *gitrepo) readBlob(hash plumbing.Hash) ([]byte, error) {
+	blob, err := r.repo.BlobObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// writeBlob stores the content as a blob in the repository
+func (r *gitrepo) writeBlob(content []byte) (plumbing.Hash, error) {
+	obj := r.repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := w.Write(content); err != nil {
+		w.Close()
+		return plumbing.ZeroHash, err
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return r.repo.Storer.SetEncodedObject(obj)
+}
+
+// writeTree stores the files as a tree with its subtrees in the repository
+func (r *gitrepo) writeTree(files map[string]treeFile) (plumbing.Hash, error) {
+	entries := []object.TreeEntry{}
+	dirs := map[string]map[string]treeFile{}
+	for name, f := range files {
+		dir, rest, found := strings.Cut(name, "/")
+		if !found {
+			entries = append(entries, object.TreeEntry{Name: name, Mode: f.mode, Hash: f.hash})
+			continue
+		}
+		if dirs[dir] == nil {
+			dirs[dir] = map[string]treeFile{}
+		}
+		dirs[dir][rest] = f
+	}
+	for dir, files := range dirs {
+		hash, err := r.writeTree(files)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		entries = append(entries, object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: hash})
+	}
+	sort.Sort(object.TreeEntrySorter(entries))
+
+	obj := r.repo.Storer.NewEncodedObject()
+	if err := (&object.Tree{Entries: entries}).Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return r.repo.Storer.SetEncodedObject(obj)
+}
+
+// writeCommit stores a commit of the tree in the repository, the author is
+// the author of the store if not provided
+func (r *gitrepo) writeCommit(tree plumbing.Hash, message string, author *object.Signature, parents ...plumbing.Hash) (plumbing.Hash, error) {
+	committer := object.Signature{
+		Name:  r.authorName,
+		Email: r.authorEmail,
+		When:  time.Now(),
+	}
+	if author == nil {
+		author = &committer
+	}
+	commit := &object.Commit{
+		Author:       *author,
+		Committer:    committer,
+		Message:      message,
+		TreeHash:     tree,
+		ParentHashes: parents,
+	}
+	obj := r.repo.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return r.repo.Storer.SetEncodedObject(obj)
+}
+
+// setBranch points the branch to the commit, the worktree is updated when the
+// branch is checked out. The caller must hold the lock.
+func (r *gitrepo) setBranch(branch string, hash plumbing.Hash) error {
+	current, err := r.currentBranch()
+	if err != nil {
+		return err
+	}
+	if branch == current && r.dirty {
+		return &store.Error{
+			Err:     store.ErrConflict,
+			Message: fmt.Sprintf("cannot update branch %s, it has uncommitted changes", branch),
+		}
+	}
+	if err := r.repo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName(branch), hash)); err != nil {
+		return store.NewUnavailableError("cannot update branch "+branch, err)
+	}
+	r.trackHead(branch, hash)
+	if branch != current {
+		return nil
+	}
+	wt, err := r.repo.Worktree()
+	if err != nil {
+		return store.NewUnavailableError("cannot get worktree", err)
+	}
+	if err := wt.Reset(&git.ResetOptions{Commit: hash, Mode: git.MergeReset}); err != nil {
+		return store.NewUnavailableError("cannot update worktree of branch "+branch, err)
+	}
+	return nil
+}
+
+// notifyChanges sets the branch of the changes of the objects on the branch and
+// notifies the watchers with the commit of the changes. The event of an object
+// ahead of the store, e.g. written by another store sharing the repository, has
+// the resource version of the object, the other events get a new resource version
+// of the store such that the events stay ordered. The caller must hold the lock.
+func (r *gitrepo) notifyChanges(branch, commit string, changes []DiffEntry) {
+	rvs := make(map[store.Key]uint64, len(changes))
+	for i := range changes {
+		changes[i].Key.Branch = branch
+		if changes[i].New != nil {
+			if rv, err := store.ParseResourceVersion(store.GetResourceVersion(changes[i].New)); err == nil {
+				rvs[changes[i].Key] = rv
+			}
+		}
+	}
+	// the objects ahead of the store keep their resource version when their
+	// events are sent first, in the order of their resource versions
+	ordered := append([]DiffEntry{}, changes...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		ri, rj := rvs[ordered[i].Key], rvs[ordered[j].Key]
+		if ri > r.rv && rj > r.rv {
+			return ri < rj
+		}
+		return ri > r.rv && rj <= r.rv
+	})
+	for _, change := range ordered {
+		if rv := rvs[change.Key]; rv > r.rv {
+			r.rv = rv
+		} else {
+			r.rv++
+		}
+		event := watch.WatchEvent[runtime.Unstructured]{
+			Type:            change.Type,
+			Key:             change.Key,
+			Object:          change.New,
+			OldObject:       change.Old,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
+			Commit:          commit,
+		}
+		if change.Type == watch.Deleted {
+			event.Object = change.Old
+		}
+		r.notifyWatcher(event)
+	}
+}
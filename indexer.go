@@ -0,0 +1,181 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+)
+
+// IndexFunc returns the indexed values of an object, an object without values
+// is not in the index
+type IndexFunc[T1 any] func(key Key, obj T1) ([]string, error)
+
+// Indexers are the index functions of a store by index name
+type Indexers[T1 any] map[string]IndexFunc[T1]
+
+// Indexer looks up the objects of a store by the values of an index
+type Indexer[T1 any] interface {
+	// ByIndex returns the objects with the value in the index
+	ByIndex(indexName, indexedValue string) ([]T1, error)
+	// IndexKeys returns the keys of the objects with the value in the index
+	IndexKeys(indexName, indexedValue string) ([]Key, error)
+}
+
+// IndexedStorer is a Storer with indexes
+type IndexedStorer[T1 any] interface {
+	Storer[T1]
+	Indexer[T1]
+}
+
+// IndexedStorerV2 is a StorerV2 with indexes
+type IndexedStorerV2[T1 any] interface {
+	StorerV2[T1]
+	Indexer[T1]
+}
+
+// LabelIndexFunc indexes the objects by the value of the label
+func LabelIndexFunc[T1 any](label string) IndexFunc[T1] {
+	return func(_ Key, obj T1) ([]string, error) {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			return nil, err
+		}
+		v, ok := accessor.GetLabels()[label]
+		if !ok {
+			return nil, nil
+		}
+		return []string{v}, nil
+	}
+}
+
+// OwnerIndexFunc indexes the objects by the uids of their owner references
+func OwnerIndexFunc[T1 any]() IndexFunc[T1] {
+	return func(_ Key, obj T1) ([]string, error) {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			return nil, err
+		}
+		values := []string{}
+		for _, ref := range accessor.GetOwnerReferences() {
+			values = append(values, string(ref.UID))
+		}
+		return values, nil
+	}
+}
+
+// FieldIndexFunc indexes the objects by the value of the field, e.g.
+// spec.nodeName. The fields are looked up like the fields of a field selector,
+// only metadata.name and metadata.namespace are available for typed objects.
+func FieldIndexFunc[T1 any](field string) IndexFunc[T1] {
+	return func(key Key, obj T1) ([]string, error) {
+		f := &objectFields{key: key, obj: obj}
+		v, ok := f.lookup(field)
+		if !ok {
+			return nil, nil
+		}
+		return []string{v}, nil
+	}
+}
+
+// Index maintains the indexes of a store, it is not safe for concurrent use,
+// the store protects it with its lock
+type Index[T1 any] struct {
+	indexers Indexers[T1]
+	// indices are the keys by index name and indexed value
+	indices map[string]map[string]map[Key]struct{}
+	// values are the indexed values of the keys by index name, the stored objects
+	// can be changed in place so the old values are not derived from the object
+	values map[Key]map[string][]string
+}
+
+func NewIndex[T1 any](indexers Indexers[T1]) *Index[T1] {
+	r := &Index[T1]{
+		indexers: indexers,
+		indices:  map[string]map[string]map[Key]struct{}{},
+		values:   map[Key]map[string][]string{},
+	}
+	for name := range indexers {
+		r.indices[name] = map[string]map[Key]struct{}{}
+	}
+	return r
+}
+
+// Values returns the indexed values of the object, the index is not changed
+// such that a failing index function does not leave the index half updated
+func (r *Index[T1]) Values(key Key, obj T1) (map[string][]string, error) {
+	if len(r.indexers) == 0 {
+		return nil, nil
+	}
+	values := make(map[string][]string, len(r.indexers))
+	for name, indexFunc := range r.indexers {
+		v, err := indexFunc(key, obj)
+		if err != nil {
+			return nil, NewInvalidError(key, fmt.Sprintf("cannot index object with index %s", name), err)
+		}
+		if len(v) > 0 {
+			values[name] = v
+		}
+	}
+	return values, nil
+}
+
+// Set replaces the indexed values of the key with the values returned by Values
+func (r *Index[T1]) Set(key Key, values map[string][]string) {
+	r.Delete(key)
+	if len(values) == 0 {
+		return
+	}
+	for name, vs := range values {
+		index := r.indices[name]
+		for _, v := range vs {
+			keys, ok := index[v]
+			if !ok {
+				keys = map[Key]struct{}{}
+				index[v] = keys
+			}
+			keys[key] = struct{}{}
+		}
+	}
+	r.values[key] = values
+}
+
+// Delete removes the key from the indexes
+func (r *Index[T1]) Delete(key Key) {
+	for name, vs := range r.values[key] {
+		index := r.indices[name]
+		for _, v := range vs {
+			delete(index[v], key)
+			if len(index[v]) == 0 {
+				delete(index, v)
+			}
+		}
+	}
+	delete(r.values, key)
+}
+
+// Keys returns the keys with the value in the index, in no particular order
+func (r *Index[T1]) Keys(indexName, indexedValue string) ([]Key, error) {
+	index, ok := r.indices[indexName]
+	if !ok {
+		return nil, &Error{Err: ErrInvalid, Message: fmt.Sprintf("index %s does not exist", indexName)}
+	}
+	keys := make([]Key, 0, len(index[indexedValue]))
+	for key := range index[indexedValue] {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package filestore holds the logic shared by the file and fileu stores, it is
+// parameterised on the object type of the store.
+package filestore
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/util.go"
+	"github.com/henderiw/store/watch"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Files are the files of a file store with objects of type T1. The funcs are
+// provided by the store, the caller of a method must hold the mutex of the store
+// unless the method says otherwise.
+type Files[T1 runtime.Object] struct {
+	RootPath   string
+	Extension  string
+	KeyEncoder store.KeyEncoder
+	// Locks coordinate the processes sharing the root path
+	Locks *util.StoreLocks
+	// Journal makes the changes of a transaction atomic
+	Journal *util.Journal
+	// LockKey locks the key across the processes sharing the root path
+	LockKey func(key store.Key) (func(), error)
+	// ReadContent returns the decrypted content of the file of the key
+	ReadContent func(key store.Key) ([]byte, error)
+	// ReadObject returns the object of the key
+	ReadObject func(key store.Key) (T1, error)
+	// Decrypt decrypts the content of a file
+	Decrypt func(key store.Key, content []byte) ([]byte, error)
+	// Decode decodes the content of a file
+	Decode func(key store.Key, content []byte) (T1, error)
+	// Marshal returns the encoded object and the content of its file
+	Marshal func(key store.Key, obj T1) ([]byte, []byte, error)
+	// PeekResourceVersion returns the resource version the next write would get
+	PeekResourceVersion func() (uint64, error)
+	// NextResourceVersion allocates the next resource version of the store
+	NextResourceVersion func() (uint64, error)
+	// Notify notifies the watchers of the store
+	Notify func(event watch.WatchEvent[T1])
+
+	// contents are the contents of the files known to the store while the files
+	// are watched, protected by the mutex of the store
+	contents map[store.Key][]byte
+	// rvs are the resource versions of the files changed outside of the store,
+	// they are kept in memory instead of being written to the files. They are
+	// protected by rvm as the files are read without the mutex of the store.
+	rvm sync.Mutex
+	rvs map[store.Key]fileVersion
+}
+
+// keysOnDisk returns the keys of the files in the root path
+func (r *Files[T1]) keysOnDisk() []store.Key {
+	keys := []store.Key{}
+	filepath.Walk(r.RootPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(info.Name(), r.Extension) {
+			return nil
+		}
+		rel, err := filepath.Rel(r.RootPath, path)
+		if err != nil {
+			return nil
+		}
+		if key, ok := r.KeyEncoder.Decode(strings.TrimSuffix(filepath.ToSlash(rel), r.Extension)); ok {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys
+}
@@ -0,0 +1,209 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestore
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/henderiw/logger/log"
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/watch"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// WatchContents records the content of the files on disk, a file with another
+// content is changed outside of the store
+func (r *Files[T1]) WatchContents() {
+	r.contents = map[store.Key][]byte{}
+	for _, key := range r.keysOnDisk() {
+		if content, err := r.ReadContent(key); err == nil {
+			r.contents[key] = content
+		}
+	}
+}
+
+// StopContents stops recording the content of the files
+func (r *Files[T1]) StopContents() {
+	r.contents = nil
+}
+
+// TrackContent records the content written by the store, nil when the file is
+// removed
+func (r *Files[T1]) TrackContent(key store.Key, content []byte) {
+	r.rvm.Lock()
+	delete(r.rvs, key)
+	r.rvm.Unlock()
+	if r.contents == nil {
+		return
+	}
+	if content == nil {
+		delete(r.contents, key)
+		return
+	}
+	r.contents[key] = content
+}
+
+// fileVersion is the resource version of the content of a file changed outside
+// of the store
+type fileVersion struct {
+	content []byte
+	rv      string
+}
+
+// SetFileVersion sets the resource version of an object read from a file changed
+// outside of the store, as long as the file has the content the resource version
+// is allocated for. The caller does not need to hold the mutex.
+func (r *Files[T1]) SetFileVersion(key store.Key, content []byte, obj runtime.Object) {
+	r.rvm.Lock()
+	v, ok := r.rvs[key]
+	r.rvm.Unlock()
+	if ok && bytes.Equal(v.content, content) {
+		store.SetResourceVersion(obj, v.rv)
+	}
+}
+
+// Reconcile notifies the watchers of the objects whose files are changed outside
+// of the store, all keys are checked when all is true
+func (r *Files[T1]) Reconcile(keys []store.Key, all bool) {
+	if r.contents == nil {
+		return
+	}
+	if all {
+		keys = r.keysOnDisk()
+		for key := range r.contents {
+			keys = append(keys, key)
+		}
+	}
+	seen := map[store.Key]struct{}{}
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		r.reconcile(key)
+	}
+}
+
+// reconcile compares the file of the key with the content recorded by the
+// store. A changed object keeps the resource version written by another store
+// sharing the root path, otherwise it gets a new resource version which is kept
+// in memory such that the file of the user is not rewritten.
+func (r *Files[T1]) reconcile(key store.Key) {
+	log := log.FromContext(context.Background())
+
+	unlock, err := r.LockKey(key)
+	if err != nil {
+		log.Error("cannot lock object", "key", key.String(), "error", err.Error())
+		return
+	}
+	defer unlock()
+
+	oldContent, known := r.contents[key]
+	var oldObj T1
+	oldRV := ""
+	if known {
+		if oldObj, err = r.Decode(key, oldContent); err == nil {
+			oldRV = store.GetResourceVersion(oldObj)
+			r.SetFileVersion(key, oldContent, oldObj)
+		}
+	}
+	content, err := r.ReadContent(key)
+	if err != nil {
+		if !store.IsNotFound(err) || !known {
+			return
+		}
+		r.TrackContent(key, nil)
+		rv, err := r.NextResourceVersion()
+		if err != nil {
+			log.Error("cannot allocate resource version", "key", key.String(), "error", err.Error())
+			return
+		}
+		r.Notify(watch.WatchEvent[T1]{
+			Type:            watch.Deleted,
+			Key:             key,
+			Object:          oldObj,
+			OldObject:       oldObj,
+			ResourceVersion: store.FormatResourceVersion(rv),
+		})
+		return
+	}
+	if known && bytes.Equal(oldContent, content) {
+		return
+	}
+	obj, err := r.Decode(key, content)
+	if err != nil {
+		// a file that is still being written is handled on its next change
+		log.Error("skipping unreadable object", "key", key.String(), "error", err.Error())
+		return
+	}
+	rv := store.GetResourceVersion(obj)
+	adopted := r.writtenByStore(rv, oldRV)
+	if !adopted {
+		next, err := r.NextResourceVersion()
+		if err != nil {
+			log.Error("cannot allocate resource version", "key", key.String(), "error", err.Error())
+			return
+		}
+		rv = store.FormatResourceVersion(next)
+		store.SetResourceVersion(obj, rv)
+	}
+	r.contents[key] = content
+	r.rvm.Lock()
+	if adopted {
+		delete(r.rvs, key)
+	} else {
+		if r.rvs == nil {
+			r.rvs = map[store.Key]fileVersion{}
+		}
+		r.rvs[key] = fileVersion{content: content, rv: rv}
+	}
+	r.rvm.Unlock()
+	if !known {
+		r.Notify(watch.WatchEvent[T1]{
+			Type:            watch.Added,
+			Key:             key,
+			Object:          obj,
+			ResourceVersion: rv,
+		})
+		return
+	}
+	r.Notify(watch.WatchEvent[T1]{
+		Type:            watch.Modified,
+		Key:             key,
+		Object:          obj,
+		OldObject:       oldObj,
+		ResourceVersion: rv,
+	})
+}
+
+// writtenByStore reports whether the resource version of a changed file is
+// allocated by a store sharing the root path, it is newer than the resource
+// version of the previous content and not newer than the resource version of
+// the stores. A file edited by hand keeps its resource version or has none.
+func (r *Files[T1]) writtenByStore(rv, oldRV string) bool {
+	v, err := store.ParseResourceVersion(rv)
+	if err != nil || v == 0 {
+		return false
+	}
+	if old, err := store.ParseResourceVersion(oldRV); err == nil && v <= old {
+		return false
+	}
+	current, err := r.Locks.ReadResourceVersion()
+	if err != nil {
+		return false
+	}
+	return v <= current
+}
@@ -0,0 +1,37 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestore
+
+import (
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/fsck"
+)
+
+// Fsck checks the files, see fsck.Check. The store must not be running when the
+// files are repaired or quarantined.
+func (r *Files[T1]) Fsck(opts *fsck.Options) (*fsck.Report, error) {
+	return fsck.Check(&fsck.Config{
+		RootPath:   r.RootPath,
+		Extension:  r.Extension,
+		KeyEncoder: r.KeyEncoder,
+		Decode: func(key store.Key, content []byte) (any, error) {
+			plaintext, err := r.Decrypt(key, content)
+			if err != nil {
+				return nil, err
+			}
+			return r.Decode(key, plaintext)
+		},
+	}, opts)
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestore
+
+import (
+	"context"
+
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/util.go"
+	"github.com/henderiw/store/watch"
+)
+
+// Commit applies the operations of a transaction all or nothing, the events are
+// sent once all changes are applied
+func (r *Files[T1]) Commit(ctx context.Context, ops []store.TxOperation[T1]) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	keys := store.TxKeys(ops)
+	paths := make([]string, 0, len(keys))
+	for _, key := range keys {
+		paths = append(paths, r.KeyEncoder.Encode(key))
+	}
+	locks, err := r.Locks.LockKeys(paths, true)
+	if err != nil {
+		return store.NewUnavailableError("cannot lock the objects of the transaction", err)
+	}
+	defer locks.Unlock()
+
+	changes, err := store.PlanTx(ops, func(key store.Key) (T1, string, bool, error) {
+		var zero T1
+		obj, err := r.ReadObject(key)
+		if err != nil {
+			if store.IsNotFound(err) {
+				return zero, "", false, nil
+			}
+			return zero, "", false, err
+		}
+		return obj, store.GetResourceVersion(obj), true, nil
+	})
+	if err != nil {
+		return err
+	}
+	// all objects are encoded before any file is changed
+	entries := make([]util.JournalEntry, 0, len(changes))
+	contents := make([][]byte, len(changes))
+	rvs := make([]string, len(changes))
+	dryRun := store.TxDryRun(ops)
+	next := uint64(0)
+	if dryRun {
+		if next, err = r.PeekResourceVersion(); err != nil {
+			return err
+		}
+	}
+	for i, change := range changes {
+		if dryRun {
+			rvs[i] = store.FormatResourceVersion(next + uint64(i))
+		} else {
+			rv, err := r.NextResourceVersion()
+			if err != nil {
+				return err
+			}
+			rvs[i] = store.FormatResourceVersion(rv)
+		}
+		entry := util.JournalEntry{
+			Key:    r.KeyEncoder.Encode(change.Key),
+			Path:   r.KeyEncoder.Encode(change.Key) + r.Extension,
+			Delete: change.Type == watch.Deleted,
+		}
+		if !entry.Delete {
+			obj := store.DeepCopy(change.Object)
+			store.SetResourceVersion(obj, rvs[i])
+			if contents[i], entry.Data, err = r.Marshal(change.Key, obj); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, entry)
+	}
+	// a dry run validates the changes without applying them, the objects get the
+	// resource versions they would get
+	if dryRun {
+		for i, change := range changes {
+			if change.Type != watch.Deleted {
+				store.SetResourceVersion(change.Object, rvs[i])
+			}
+		}
+		return nil
+	}
+	if err := r.Journal.Commit(entries); err != nil {
+		return store.NewUnavailableError("cannot commit transaction", err)
+	}
+	// the objects of the caller only get their resource version once they are written
+	for i, change := range changes {
+		if change.Type != watch.Deleted {
+			store.SetResourceVersion(change.Object, rvs[i])
+		}
+		r.TrackContent(change.Key, contents[i])
+		r.Notify(watch.WatchEvent[T1]{
+			Type:            change.Type,
+			Key:             change.Key,
+			Object:          change.Object,
+			OldObject:       change.OldObject,
+			ResourceVersion: rvs[i],
+		})
+	}
+	return nil
+}
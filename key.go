@@ -15,23 +15,12 @@
 package store
 
 import (
-	"fmt"
-
+	"github.com/henderiw/store/key"
 	"k8s.io/apimachinery/pkg/types"
 )
-type Key struct {
-	Branch string
-	types.NamespacedName
-}
 
-// String returns the key as a string <namespace>.<name> or <name>
-// depending on the presence of the namespace
-func (r Key) String() string {
-	if r.Namespace == "" {
-		return r.Name
-	}
-	return fmt.Sprintf("%s.%s", r.Namespace, r.Name)
-}
+// Key identifies an object in the store
+type Key = key.Key
 
 // KeyFromNSN takes a types.NamespacedName and returns it
 // wrapped in the Key struct.
@@ -0,0 +1,37 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package key defines the key of the objects in the store. It is exposed as
+// store.Key and lives in its own package so the watch package can refer to it.
+package key
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type Key struct {
+	Branch string
+	types.NamespacedName
+}
+
+// String returns the key as a string <namespace>.<name> or <name>
+// depending on the presence of the namespace
+func (r Key) String() string {
+	if r.Namespace == "" {
+		return r.Name
+	}
+	return fmt.Sprintf("%s.%s", r.Namespace, r.Name)
+}
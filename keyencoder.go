@@ -0,0 +1,393 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/henderiw/store/util.go"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// KeyEncoder maps the keys of a file based store to file paths and back.
+// The paths are relative to the root of the store, use "/" as separator and
+// have no file extension. The branch of the key is not encoded.
+type KeyEncoder interface {
+	// Encode returns the path of the key
+	Encode(key Key) string
+	// Decode returns the key of the path, false if the path is not a path of the encoder
+	Decode(path string) (Key, bool)
+}
+
+var (
+	_ KeyEncoder = NestedKeyEncoder{}
+	_ KeyEncoder = FlatKeyEncoder{}
+	_ KeyEncoder = HashedKeyEncoder{}
+	_ KeyEncoder = LegacyKeyEncoder{}
+)
+
+// DefaultKeyEncoder is the key encoder of the file based stores when none is configured
+var DefaultKeyEncoder KeyEncoder = NestedKeyEncoder{}
+
+// NestedKeyEncoder stores namespaced objects in a directory per namespace,
+// <namespace>/<name>, and cluster scoped objects in the root, <name>
+type NestedKeyEncoder struct{}
+
+func (r NestedKeyEncoder) Encode(key Key) string {
+	if key.Namespace != "" {
+		return EscapePathSegment(key.Namespace) + "/" + EscapePathSegment(key.Name)
+	}
+	return EscapePathSegment(key.Name)
+}
+
+func (r NestedKeyEncoder) Decode(path string) (Key, bool) {
+	segments := strings.Split(path, "/")
+	switch len(segments) {
+	case 1:
+		return decodeKey("", segments[0])
+	case 2:
+		return decodeKey(segments[0], segments[1])
+	default:
+		return Key{}, false
+	}
+}
+
+// FlatKeyEncoder stores all objects in the root, <namespace>_<name> for
+// namespaced objects and <name> for cluster scoped objects
+type FlatKeyEncoder struct{}
+
+func (r FlatKeyEncoder) Encode(key Key) string {
+	if key.Namespace != "" {
+		return EscapePathSegment(key.Namespace) + "_" + EscapePathSegment(key.Name)
+	}
+	return EscapePathSegment(key.Name)
+}
+
+func (r FlatKeyEncoder) Decode(path string) (Key, bool) {
+	if strings.Contains(path, "/") {
+		return Key{}, false
+	}
+	// an underscore in the namespace or the name is escaped
+	parts := strings.Split(path, "_")
+	switch len(parts) {
+	case 1:
+		return decodeKey("", parts[0])
+	case 2:
+		return decodeKey(parts[0], parts[1])
+	default:
+		return Key{}, false
+	}
+}
+
+// HashedKeyEncoder spreads the objects over directories named after the hash of
+// the key to keep directories small, <h1>/<h2>/<namespace>_<name> for a depth of 2.
+// Every level is named after 2 hex characters of the sha256 hash of the flat
+// encoded key; a depth of 0 uses 1 level.
+type HashedKeyEncoder struct {
+	Depth int
+}
+
+func (r HashedKeyEncoder) depth() int {
+	if r.Depth <= 0 {
+		return 1
+	}
+	return r.Depth
+}
+
+func (r HashedKeyEncoder) fanout(flat string) []string {
+	sum := sha256.Sum256([]byte(flat))
+	h := hex.EncodeToString(sum[:])
+	levels := make([]string, 0, r.depth())
+	for i := 0; i < r.depth() && 2*i+2 <= len(h); i++ {
+		levels = append(levels, h[2*i:2*i+2])
+	}
+	return levels
+}
+
+func (r HashedKeyEncoder) Encode(key Key) string {
+	flat := FlatKeyEncoder{}.Encode(key)
+	return path.Join(append(r.fanout(flat), flat)...)
+}
+
+func (r HashedKeyEncoder) Decode(p string) (Key, bool) {
+	segments := strings.Split(p, "/")
+	if len(segments) != r.depth()+1 {
+		return Key{}, false
+	}
+	flat := segments[len(segments)-1]
+	for i, level := range r.fanout(flat) {
+		if segments[i] != level {
+			return Key{}, false
+		}
+	}
+	return FlatKeyEncoder{}.Decode(flat)
+}
+
+// LegacyKeyEncoder is the layout of the files written before the keys were
+// escaped, <namespace>/<name> for namespaced objects and <name> for cluster
+// scoped objects. It only decodes the paths that NestedKeyEncoder does not
+// decode, e.g. a name with an '_', such that MigrateKeys from LegacyKeyEncoder
+// to NestedKeyEncoder moves the legacy files only.
+type LegacyKeyEncoder struct{}
+
+func (r LegacyKeyEncoder) Encode(key Key) string {
+	if key.Namespace != "" {
+		return key.Namespace + "/" + key.Name
+	}
+	return key.Name
+}
+
+func (r LegacyKeyEncoder) Decode(path string) (Key, bool) {
+	if _, ok := (NestedKeyEncoder{}).Decode(path); ok {
+		return Key{}, false
+	}
+	segments := strings.Split(path, "/")
+	for _, segment := range segments {
+		if segment == "" {
+			return Key{}, false
+		}
+	}
+	switch len(segments) {
+	case 1:
+		return KeyFromNSN(types.NamespacedName{Name: segments[0]}), true
+	case 2:
+		return KeyFromNSN(types.NamespacedName{Namespace: segments[0], Name: segments[1]}), true
+	default:
+		return Key{}, false
+	}
+}
+
+// EscapePathSegment escapes a namespace or name such that it can be used as a
+// single path segment: any byte other than a letter, a digit, '-' or '.' is
+// encoded as %XX, as well as a leading '.' such that the segment is never a
+// hidden file, "." or "..".
+func EscapePathSegment(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isPathSafe(c) && !(i == 0 && c == '.') {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// UnescapePathSegment reverts EscapePathSegment, false is returned if the
+// segment is not an escaped segment
+func UnescapePathSegment(s string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", false
+		}
+		v, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", false
+		}
+		b.WriteByte(v[0])
+		i += 2
+	}
+	// only the canonical escaping of a segment is accepted
+	if EscapePathSegment(b.String()) != s {
+		return "", false
+	}
+	return b.String(), true
+}
+
+func isPathSafe(c byte) bool {
+	return (c >= 'a' && c <= 'z') ||
+		(c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') ||
+		c == '-' || c == '.'
+}
+
+func decodeKey(namespace, name string) (Key, bool) {
+	if name == "" {
+		return Key{}, false
+	}
+	name, ok := UnescapePathSegment(name)
+	if !ok {
+		return Key{}, false
+	}
+	if namespace != "" {
+		if namespace, ok = UnescapePathSegment(namespace); !ok {
+			return Key{}, false
+		}
+	}
+	return KeyFromNSN(types.NamespacedName{Namespace: namespace, Name: name}), true
+}
+
+// CheckKeys returns an error for the first file with the extension in the root
+// path that is not a path of the key encoder, the stores would skip such a file.
+// The files written before the keys were escaped are moved to the paths of the
+// encoder with MigrateLegacyKeys.
+// Hidden files and directories belong to the store and are not checked.
+func CheckKeys(rootPath, extension string, encoder KeyEncoder) error {
+	return filepath.WalkDir(rootPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == rootPath {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), extension) {
+			return nil
+		}
+		rel, err := filepath.Rel(rootPath, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if _, ok := encoder.Decode(strings.TrimSuffix(rel, extension)); !ok {
+			return NewInvalidError(Key{}, fmt.Sprintf("%s in %s is not the path of a key, files written before the keys were escaped are moved with MigrateLegacyKeys or the MigrateKeys option of the store", rel, rootPath), nil)
+		}
+		return nil
+	})
+}
+
+// MigrateLegacyKeys moves the files written before the keys were escaped to the
+// paths of the encoder, the files that are a path of the encoder are left alone
+// such that it can run every time the store is opened. See MigrateKeys.
+func MigrateLegacyKeys(rootPath, extension string, encoder KeyEncoder, rewrite RewriteFunc) error {
+	return MigrateKeys(rootPath, extension, legacyKeys{encoder: encoder}, encoder, rewrite)
+}
+
+// legacyKeys decodes the legacy paths that are not a path of the encoder
+type legacyKeys struct {
+	encoder KeyEncoder
+}
+
+func (r legacyKeys) Encode(key Key) string {
+	return LegacyKeyEncoder{}.Encode(key)
+}
+
+func (r legacyKeys) Decode(path string) (Key, bool) {
+	if _, ok := r.encoder.Decode(path); ok {
+		return Key{}, false
+	}
+	return LegacyKeyEncoder{}.Decode(path)
+}
+
+// RewriteFunc returns the content of a file moved from one key path to another,
+// e.g. encryption.Encrypter.Rebind as encrypted files are bound to their path
+type RewriteFunc func(from, to string, content []byte) ([]byte, error)
+
+// MigrateKeys moves the files with the extension in the root path from the layout
+// of one key encoder to the layout of another one, files that are not a path of the
+// from encoder are left alone and emptied directories are removed. The content of
+// a moved file is rewritten by rewrite, nil when it is moved as is. The store must
+// not be running during the migration, for a git backed store the result has to be
+// committed.
+func MigrateKeys(rootPath, extension string, from, to KeyEncoder, rewrite RewriteFunc) error {
+	type move struct{ src, dst, srcKey, dstKey string }
+	moves := []move{}
+	dirs := []string{}
+	if err := filepath.Walk(rootPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// hidden files and directories belong to the store
+		if p != rootPath && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if p != rootPath {
+				dirs = append(dirs, p)
+			}
+			return nil
+		}
+		if !strings.HasSuffix(info.Name(), extension) {
+			return nil
+		}
+		rel, err := filepath.Rel(rootPath, p)
+		if err != nil {
+			return err
+		}
+		key, ok := from.Decode(strings.TrimSuffix(filepath.ToSlash(rel), extension))
+		if !ok {
+			return nil
+		}
+		dst := filepath.Join(rootPath, filepath.FromSlash(to.Encode(key))+extension)
+		if dst != p {
+			moves = append(moves, move{src: p, dst: dst, srcKey: strings.TrimSuffix(filepath.ToSlash(rel), extension), dstKey: to.Encode(key)})
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, m := range moves {
+		if _, err := os.Stat(m.dst); err == nil {
+			return &Error{Err: ErrAlreadyExists, Message: fmt.Sprintf("cannot move %s, %s exists", m.src, m.dst)}
+		}
+	}
+	for _, m := range moves {
+		if err := os.MkdirAll(filepath.Dir(m.dst), 0755); err != nil {
+			return err
+		}
+		if rewrite == nil {
+			if err := os.Rename(m.src, m.dst); err != nil {
+				return err
+			}
+			continue
+		}
+		info, err := os.Stat(m.src)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(m.src)
+		if err != nil {
+			return err
+		}
+		if content, err = rewrite(m.srcKey, m.dstKey, content); err != nil {
+			return NewInvalidError(Key{}, fmt.Sprintf("cannot move %s", m.src), err)
+		}
+		if err := util.WriteFileAtomic(m.dst, content, info.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Remove(m.src); err != nil {
+			return err
+		}
+	}
+	// remove the emptied directories, deepest first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if entries, err := os.ReadDir(dirs[i]); err == nil && len(entries) == 0 {
+			os.Remove(dirs[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestKeyEncoderRoundTrip(t *testing.T) {
+	keys := map[string]Key{
+		"Namespaced":          KeyFromNSN(types.NamespacedName{Namespace: "default", Name: "a"}),
+		"ClusterScoped":       KeyFromNSN(types.NamespacedName{Name: "a"}),
+		"Underscore":          KeyFromNSN(types.NamespacedName{Namespace: "ns_1", Name: "a_b"}),
+		"Percent":             KeyFromNSN(types.NamespacedName{Namespace: "default", Name: "a%41b"}),
+		"PercentUnderscore":   KeyFromNSN(types.NamespacedName{Namespace: "default", Name: "a%5Fb_c"}),
+		"Slash":               KeyFromNSN(types.NamespacedName{Namespace: "default", Name: "a/b"}),
+		"LeadingDot":          KeyFromNSN(types.NamespacedName{Namespace: "default", Name: ".a"}),
+		"DotDot":              KeyFromNSN(types.NamespacedName{Namespace: "default", Name: ".."}),
+		"ClusterUnderscore":   KeyFromNSN(types.NamespacedName{Name: "a_b"}),
+		"NonASCII":            KeyFromNSN(types.NamespacedName{Namespace: "default", Name: "ä b"}),
+		"DotsInside":          KeyFromNSN(types.NamespacedName{Namespace: "default", Name: "a.b.c"}),
+		"ClusterScopedEscape": KeyFromNSN(types.NamespacedName{Name: "%2F"}),
+	}
+	encoders := map[string]KeyEncoder{
+		"Nested":  NestedKeyEncoder{},
+		"Flat":    FlatKeyEncoder{},
+		"Hashed":  HashedKeyEncoder{},
+		"Hashed3": HashedKeyEncoder{Depth: 3},
+	}
+
+	for encoderName, encoder := range encoders {
+		for keyName, key := range keys {
+			t.Run(encoderName+"/"+keyName, func(t *testing.T) {
+				p := encoder.Encode(key)
+				for _, segment := range strings.Split(p, "/") {
+					if segment == "" || strings.HasPrefix(segment, ".") {
+						t.Fatalf("unsafe path segment %q in %q", segment, p)
+					}
+				}
+				got, ok := encoder.Decode(p)
+				if !ok {
+					t.Fatalf("cannot decode %q", p)
+				}
+				if got != key {
+					t.Fatalf("want %v, got %v for %q", key, got, p)
+				}
+			})
+		}
+	}
+}
+
+func TestKeyEncoderDecodeInvalid(t *testing.T) {
+	cases := map[string]struct {
+		encoder KeyEncoder
+		path    string
+	}{
+		"NestedTooDeep":             {encoder: NestedKeyEncoder{}, path: "a/b/c"},
+		"NestedNonCanonical":        {encoder: NestedKeyEncoder{}, path: "default/a%61"},
+		"NestedLowerCaseEscape":     {encoder: NestedKeyEncoder{}, path: "default/a%5f"},
+		"NestedTruncatedEscape":     {encoder: NestedKeyEncoder{}, path: "default/a%5"},
+		"NestedUnescapedUnder":      {encoder: NestedKeyEncoder{}, path: "default/a_b"},
+		"NestedEmptyName":           {encoder: NestedKeyEncoder{}, path: "default/"},
+		"FlatNested":                {encoder: FlatKeyEncoder{}, path: "default/a"},
+		"FlatTwoUnderscores":        {encoder: FlatKeyEncoder{}, path: "a_b_c"},
+		"HashedWrongLevel":          {encoder: HashedKeyEncoder{}, path: "zz/default_a"},
+		"HashedWrongDepth":          {encoder: HashedKeyEncoder{}, path: "default_a"},
+		"LegacyOfNestedPath":        {encoder: LegacyKeyEncoder{}, path: "default/a"},
+		"LegacyEmptySegment":        {encoder: LegacyKeyEncoder{}, path: "default//a_b"},
+		"LegacyTooDeep":             {encoder: LegacyKeyEncoder{}, path: "a/b/c_d"},
+		"LegacyOfNestedClusterPath": {encoder: LegacyKeyEncoder{}, path: "a"},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if key, ok := tc.encoder.Decode(tc.path); ok {
+				t.Fatalf("want %q not to decode, got %v", tc.path, key)
+			}
+		})
+	}
+}
+
+func TestLegacyKeyEncoder(t *testing.T) {
+	cases := map[string]struct {
+		path string
+		want Key
+	}{
+		"Underscore":        {path: "default/a_b", want: KeyFromNSN(types.NamespacedName{Namespace: "default", Name: "a_b"})},
+		"Percent":           {path: "default/a%zz", want: KeyFromNSN(types.NamespacedName{Namespace: "default", Name: "a%zz"})},
+		"ClusterUnderscore": {path: "a_b", want: KeyFromNSN(types.NamespacedName{Name: "a_b"})},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, ok := LegacyKeyEncoder{}.Decode(tc.path)
+			if !ok || got != tc.want {
+				t.Fatalf("want %v, got %v, %t", tc.want, got, ok)
+			}
+			if p := (LegacyKeyEncoder{}).Encode(got); p != tc.path {
+				t.Errorf("want %q, got %q", tc.path, p)
+			}
+		})
+	}
+}
+
+func TestCheckAndMigrateKeys(t *testing.T) {
+	rootPath := t.TempDir()
+	files := map[string]string{
+		// a file written with the escaped keys
+		"default/a.yaml": "a",
+		// files written before the keys were escaped
+		"default/b_c.yaml": "b_c",
+		"d_e.yaml":         "d_e",
+		// hidden files and other extensions belong to the store or the user
+		".locks/00.lock":      "",
+		"default/.tmp-x.yaml": "",
+		"README.md":           "",
+	}
+	for path, content := range files {
+		filename := filepath.Join(rootPath, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := CheckKeys(rootPath, ".yaml", NestedKeyEncoder{}); !IsInvalid(err) {
+		t.Fatalf("want invalid error for the legacy files, got %v", err)
+	}
+	if err := MigrateKeys(rootPath, ".yaml", LegacyKeyEncoder{}, NestedKeyEncoder{}, nil); err != nil {
+		t.Fatalf("cannot migrate keys: %v", err)
+	}
+	if err := CheckKeys(rootPath, ".yaml", NestedKeyEncoder{}); err != nil {
+		t.Fatalf("want no error after the migration, got %v", err)
+	}
+
+	want := map[string]string{
+		"default/a.yaml":      "a",
+		"default/b%5Fc.yaml":  "b_c",
+		"d%5Fe.yaml":          "d_e",
+		".locks/00.lock":      "",
+		"default/.tmp-x.yaml": "",
+		"README.md":           "",
+	}
+	for path, content := range want {
+		got, err := os.ReadFile(filepath.Join(rootPath, filepath.FromSlash(path)))
+		if err != nil {
+			t.Errorf("want %s: %v", path, err)
+			continue
+		}
+		if string(got) != content {
+			t.Errorf("%s: want %q, got %q", path, content, got)
+		}
+	}
+	for _, path := range []string{"default/b_c.yaml", "d_e.yaml"} {
+		if _, err := os.Stat(filepath.Join(rootPath, filepath.FromSlash(path))); !os.IsNotExist(err) {
+			t.Errorf("want %s to be moved, got %v", path, err)
+		}
+	}
+}
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	rootPath := t.TempDir()
+	files := map[string]string{
+		// a file written with the escaped keys of the flat encoder
+		"default_a.yaml": "a",
+		// a file written before the keys were escaped
+		"default/b:c.yaml": "b:c",
+	}
+	for path, content := range files {
+		filename := filepath.Join(rootPath, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rewrite := func(from, to string, content []byte) ([]byte, error) {
+		return []byte(from + " " + to), nil
+	}
+	// the migration is run twice as it runs every time a store is opened
+	for i := 0; i < 2; i++ {
+		if err := MigrateLegacyKeys(rootPath, ".yaml", FlatKeyEncoder{}, rewrite); err != nil {
+			t.Fatalf("cannot migrate keys: %v", err)
+		}
+	}
+	if err := CheckKeys(rootPath, ".yaml", FlatKeyEncoder{}); err != nil {
+		t.Fatalf("want no error after the migration, got %v", err)
+	}
+	want := map[string]string{
+		"default_a.yaml":     "a",
+		"default_b%3Ac.yaml": "default/b:c default_b%3Ac",
+	}
+	for path, content := range want {
+		got, err := os.ReadFile(filepath.Join(rootPath, filepath.FromSlash(path)))
+		if err != nil {
+			t.Errorf("want %s: %v", path, err)
+			continue
+		}
+		if string(got) != content {
+			t.Errorf("%s: want %q, got %q", path, content, got)
+		}
+	}
+}
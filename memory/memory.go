@@ -16,8 +16,6 @@ package memory
 
 import (
 	"context"
-	"fmt"
-	"reflect"
 	"sync"
 
 	"github.com/henderiw/logger/log"
@@ -25,25 +23,50 @@ import (
 	"github.com/henderiw/store/watch"
 	"github.com/henderiw/store/watcher"
 	"github.com/henderiw/store/watchermanager"
+	"k8s.io/apimachinery/pkg/types"
 	//metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
 )
 
-const (
-	// errors
-	NotFound = "not found"
-)
+type Config[T1 any] struct {
+	// NewFunc returns an empty object
+	NewFunc func() T1
+	// Indexers are the indexes of the store, they are maintained on every change
+	// and queried with ByIndex and IndexKeys
+	Indexers store.Indexers[T1]
+}
+
+func NewStore[T1 any](new func() T1) store.PatchStorer[T1] {
+	return store.AdaptPatchV1(NewStoreV2(new))
+}
+
+func NewStoreV2[T1 any](new func() T1) store.PatchStorerV2[T1] {
+	return newMem(&Config[T1]{NewFunc: new})
+}
+
+func NewIndexedStore[T1 any](cfg *Config[T1]) store.IndexedStorer[T1] {
+	return store.AdaptIndexedV1(NewIndexedStoreV2(cfg))
+}
+
+func NewIndexedStoreV2[T1 any](cfg *Config[T1]) store.IndexedStorerV2[T1] {
+	return newMem(cfg)
+}
 
-func NewStore[T1 any](new func() T1) store.Storer[T1] {
+func newMem[T1 any](cfg *Config[T1]) *mem[T1] {
 	return &mem[T1]{
 		db:             map[store.Key]T1{},
+		versions:       map[store.Key]uint64{},
+		index:          store.NewIndex(cfg.Indexers),
 		watchermanager: watchermanager.New[T1](64),
-		new:            new,
+		new:            cfg.NewFunc,
 	}
 }
 
 type mem[T1 any] struct {
 	m              sync.RWMutex
 	db             map[store.Key]T1
+	versions       map[store.Key]uint64
+	index          *store.Index[T1]
+	rv             uint64
 	watchermanager watchermanager.WatcherManager[T1]
 	new            func() T1
 	watching       bool
@@ -53,6 +76,7 @@ func (r *mem[T1]) Start(ctx context.Context) {
 	r.m.Lock()
 	defer r.m.Unlock()
 	r.watching = true
+	r.watchermanager.SetResourceVersion(store.FormatResourceVersion(r.rv))
 	go r.watchermanager.Start(ctx)
 }
 
@@ -64,154 +88,461 @@ func (r *mem[T1]) Stop() {
 }
 
 // Get return the type
-func (r *mem[T1]) Get(key store.Key, opts ...store.GetOption) (T1, error) {
+func (r *mem[T1]) Get(ctx context.Context, key store.Key, opts ...store.GetOption) (T1, error) {
+	o := store.GetOptions{}
+	o.ApplyOptions(opts)
+
+	if err := ctx.Err(); err != nil {
+		return *new(T1), err
+	}
+
 	r.m.RLock()
 	defer r.m.RUnlock()
 
 	x, ok := r.db[key]
 	if !ok {
-		return *new(T1), fmt.Errorf("%s, nsn: %s", NotFound, key.String())
+		return *new(T1), store.NewNotFoundError(key, nil)
+	}
+	if err := store.CheckResourceVersion(key, o.ResourceVersion, store.FormatResourceVersion(r.versions[key])); err != nil {
+		return *new(T1), err
 	}
 	return x, nil
 }
 
-func (r *mem[T1]) List(visitorFunc func(key store.Key, obj T1), _ ...store.ListOption) {
+func (r *mem[T1]) List(ctx context.Context, visitorFunc func(key store.Key, obj T1) error, opts ...store.ListOption) error {
+	o := store.ListOptions{}
+	o.ApplyOptions(opts)
+
 	r.m.RLock()
 	defer r.m.RUnlock()
 
 	for key, obj := range r.db {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !o.Matches(key, obj) {
+			continue
+		}
 		if visitorFunc != nil {
-			visitorFunc(key, obj)
+			if err := visitorFunc(key, obj); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
 
-func (r *mem[T1]) ListKeys(opts ...store.ListOption) []string {
+func (r *mem[T1]) ListKeys(ctx context.Context, opts ...store.ListOption) ([]string, error) {
 	keys := []string{}
-	r.List(func(key store.Key, _ T1) {
+	err := r.List(ctx, func(key store.Key, _ T1) error {
 		keys = append(keys, key.Name)
+		return nil
 	}, opts...)
-	return keys
+	return keys, err
 }
 
-func (r *mem[T1]) Len(_ ...store.ListOption) int {
+func (r *mem[T1]) Len(ctx context.Context, opts ...store.ListOption) (int, error) {
+	o := store.ListOptions{}
+	o.ApplyOptions(opts)
+	if o.HasFilter() {
+		items := 0
+		err := r.List(ctx, func(_ store.Key, _ T1) error {
+			items++
+			return nil
+		}, opts...)
+		return items, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	r.m.RLock()
 	defer r.m.RUnlock()
 
-	return len(r.db)
+	return len(r.db), nil
 }
 
-func (r *mem[T1]) Apply(key store.Key, data T1, opts ...store.ApplyOption) error {
-	//_, exists := r.db[key]
-	exists := true
-	if _, err := r.Get(key); err != nil {
-		exists = false
+func (r *mem[T1]) Apply(ctx context.Context, key store.Key, data T1, opts ...store.ApplyOption) error {
+	o := store.ApplyOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	oldd, exists := r.db[key]
+	if o.FieldManager != "" {
+		changed, err := store.ServerSideApply(key, oldd, exists, data, &o)
+		if err != nil {
+			return err
+		}
+		// an apply that does not change the object does not allocate a new resource version
+		if !changed {
+			return nil
+		}
+	}
+	if o.DryRun {
+		return r.dryRun(key, data)
+	}
+	if err := r.update(key, data); err != nil {
+		return err
 	}
-	r.update(key, data)
 	if !exists {
 		r.notifyWatcher(watch.WatchEvent[T1]{
-			Type:   watch.Added,
-			Object: data,
+			Type:            watch.Added,
+			Key:             key,
+			Object:          data,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
 		})
 	} else {
 		r.notifyWatcher(watch.WatchEvent[T1]{
-			Type:   watch.Modified,
-			Object: data,
+			Type:            watch.Modified,
+			Key:             key,
+			Object:          data,
+			OldObject:       oldd,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
 		})
 	}
 	return nil
 }
 
-func (r *mem[T1]) Create(key store.Key, data T1, opts ...store.CreateOption) error {
-	// if an error is returned the entry already exists
-	if _, err := r.Get(key); err == nil {
-		return fmt.Errorf("duplicate entry %v", key.String())
+func (r *mem[T1]) Create(ctx context.Context, key store.Key, data T1, opts ...store.CreateOption) error {
+	o := store.CreateOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// if the entry exists we return a duplicate error
+	if _, exists := r.db[key]; exists {
+		return store.NewAlreadyExistsError(key)
+	}
+	if o.DryRun {
+		return r.dryRun(key, data)
 	}
 	// update the cache before calling the callback since the cb fn will use this data
-	r.update(key, data)
+	if err := r.update(key, data); err != nil {
+		return err
+	}
 
 	// notify watchers
 	r.notifyWatcher(watch.WatchEvent[T1]{
-		Type:   watch.Added,
-		Object: data,
+		Type:            watch.Added,
+		Key:             key,
+		Object:          data,
+		ResourceVersion: store.FormatResourceVersion(r.rv),
 	})
 	return nil
 }
 
 // Upsert creates or updates the entry in the cache
-func (r *mem[T1]) Update(key store.Key, data T1, opts ...store.UpdateOption) error {
-	exists := true
-	oldd, err := r.Get(key)
-	if err != nil {
-		exists = false
+func (r *mem[T1]) Update(ctx context.Context, key store.Key, data T1, opts ...store.UpdateOption) error {
+	o := store.UpdateOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	// update the cache before calling the callback since the cb fn will use this data
-	r.update(key, data)
+	oldd, exists := r.db[key]
+	return r.upsert(key, oldd, exists, data, &o)
+}
 
-	// // notify watchers based on the fact the data got modified or not
+// upsert creates or updates the entry given the preconditions of the options and
+// notifies the watchers, the caller must hold the lock
+func (r *mem[T1]) upsert(key store.Key, oldd T1, exists bool, data T1, o *store.UpdateOptions) error {
+	if err := store.CheckResourceVersion(key, o.ResourceVersion, store.FormatResourceVersion(r.versions[key])); err != nil {
+		return err
+	}
 	if exists {
-		if !reflect.DeepEqual(oldd, data) {
-			r.notifyWatcher(watch.WatchEvent[T1]{
-				Type:   watch.Modified,
-				Object: data,
-			})
+		// an update that does not change the data does not allocate a new resource version
+		if store.EqualIgnoringResourceVersion(oldd, data) {
+			return nil
 		}
+	}
+	if o.DryRun {
+		return r.dryRun(key, data)
+	}
+	// update the cache before calling the callback since the cb fn will use this data
+	if err := r.update(key, data); err != nil {
+		return err
+	}
+
+	// notify watchers based on the fact the data got modified or not
+	if exists {
+		r.notifyWatcher(watch.WatchEvent[T1]{
+			Type:            watch.Modified,
+			Key:             key,
+			Object:          data,
+			OldObject:       oldd,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
+		})
 	} else {
 		r.notifyWatcher(watch.WatchEvent[T1]{
-			Type:   watch.Added,
-			Object: data,
+			Type:            watch.Added,
+			Key:             key,
+			Object:          data,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
 		})
 	}
 	return nil
 }
 
-func (r *mem[T1]) UpdateWithKeyFn(key store.Key, updateFunc func(obj T1) T1) {
+// UpdateWithKeyFn updates the entry with the result of the updateFunc like
+// Update, the updateFunc gets a copy of the entry or the zero value when the
+// entry does not exist
+func (r *mem[T1]) UpdateWithKeyFn(ctx context.Context, key store.Key, updateFunc func(ctx context.Context, obj T1) (T1, error), opts ...store.UpdateOption) error {
+	o := store.UpdateOptions{}
+	o.ApplyOptions(opts)
+
 	r.m.Lock()
 	defer r.m.Unlock()
 
-	obj := r.db[key]
-	if updateFunc != nil {
-		r.db[key] = updateFunc(obj)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if updateFunc == nil {
+		return nil
+	}
+	oldd, exists := r.db[key]
+	newd, err := updateFunc(ctx, store.DeepCopy(oldd))
+	if err != nil {
+		return err
+	}
+	if err := store.CheckUpdated(key, exists, newd); err != nil {
+		return err
 	}
+	return r.upsert(key, oldd, exists, newd, &o)
 }
 
-func (r *mem[T1]) update(key store.Key, newd T1) {
+// Patch applies the patch to the entry, a patch that does not change the entry
+// does not allocate a new resource version
+func (r *mem[T1]) Patch(ctx context.Context, key store.Key, patchType types.PatchType, patch []byte, opts ...store.PatchOption) (T1, error) {
+	o := store.PatchOptions{}
+	o.ApplyOptions(opts)
+
 	r.m.Lock()
 	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return *new(T1), err
+	}
+
+	oldd, exists := r.db[key]
+	if !exists {
+		return *new(T1), store.NewNotFoundError(key, nil)
+	}
+	if err := store.CheckResourceVersion(key, o.ResourceVersion, store.FormatResourceVersion(r.versions[key])); err != nil {
+		return *new(T1), err
+	}
+	newd, changed, err := store.PatchObject(key, oldd, patchType, patch, o.Schema)
+	if err != nil {
+		return *new(T1), err
+	}
+	if !changed {
+		return oldd, nil
+	}
+	if o.DryRun {
+		if err := r.dryRun(key, newd); err != nil {
+			return *new(T1), err
+		}
+		return newd, nil
+	}
+	if err := r.update(key, newd); err != nil {
+		return *new(T1), err
+	}
+
+	r.notifyWatcher(watch.WatchEvent[T1]{
+		Type:            watch.Modified,
+		Key:             key,
+		Object:          newd,
+		OldObject:       oldd,
+		ResourceVersion: store.FormatResourceVersion(r.rv),
+	})
+	return newd, nil
+}
+
+// update stores the entry with a new resource version, the caller must hold the
+// lock. The entry is not stored when it cannot be indexed.
+func (r *mem[T1]) update(key store.Key, newd T1) error {
+	values, err := r.index.Values(key, newd)
+	if err != nil {
+		return err
+	}
+	r.set(key, newd, values)
+	return nil
+}
+
+// dryRun runs the checks of update without storing the entry, the entry is
+// valid when it can be indexed. The entry gets the resource version it would get.
+func (r *mem[T1]) dryRun(key store.Key, newd T1) error {
+	if _, err := r.index.Values(key, newd); err != nil {
+		return err
+	}
+	store.SetResourceVersion(newd, store.FormatResourceVersion(r.rv+1))
+	return nil
+}
+
+// set stores the entry with a new resource version and its index values, the
+// caller must hold the lock
+func (r *mem[T1]) set(key store.Key, newd T1, values map[string][]string) {
+	r.rv++
+	store.SetResourceVersion(newd, store.FormatResourceVersion(r.rv))
+	r.versions[key] = r.rv
 	r.db[key] = newd
+	r.index.Set(key, values)
 }
 
+// delete removes the entry and bumps the resource version of the store,
+// the caller must hold the lock
 func (r *mem[T1]) delete(key store.Key) {
+	r.rv++
+	delete(r.versions, key)
+	delete(r.db, key)
+	r.index.Delete(key)
+}
+
+// Begin starts a transaction
+func (r *mem[T1]) Begin() *store.Tx[T1] {
+	return store.NewTx(r.commit)
+}
+
+// commit applies the operations of a transaction all or nothing, the events
+// are sent once all changes are applied
+func (r *mem[T1]) commit(ctx context.Context, ops []store.TxOperation[T1]) error {
 	r.m.Lock()
 	defer r.m.Unlock()
-	delete(r.db, key)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	changes, err := store.PlanTx(ops, func(key store.Key) (T1, string, bool, error) {
+		obj, exists := r.db[key]
+		return obj, store.FormatResourceVersion(r.versions[key]), exists, nil
+	})
+	if err != nil {
+		return err
+	}
+	// the objects are indexed before the store is changed
+	values := make([]map[string][]string, len(changes))
+	for i, change := range changes {
+		if change.Type == watch.Deleted {
+			continue
+		}
+		if values[i], err = r.index.Values(change.Key, change.Object); err != nil {
+			return err
+		}
+	}
+	// a dry run validates the changes without applying them, the objects get the
+	// resource versions they would get
+	if store.TxDryRun(ops) {
+		for i, change := range changes {
+			if change.Type != watch.Deleted {
+				store.SetResourceVersion(change.Object, store.FormatResourceVersion(r.rv+uint64(i)+1))
+			}
+		}
+		return nil
+	}
+	events := make([]watch.WatchEvent[T1], 0, len(changes))
+	for i, change := range changes {
+		if change.Type == watch.Deleted {
+			r.delete(change.Key)
+		} else {
+			r.set(change.Key, change.Object, values[i])
+		}
+		events = append(events, watch.WatchEvent[T1]{
+			Type:            change.Type,
+			Key:             change.Key,
+			Object:          change.Object,
+			OldObject:       change.OldObject,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
+		})
+	}
+	for _, event := range events {
+		r.notifyWatcher(event)
+	}
+	return nil
+}
+
+// ByIndex returns the objects with the value in the index, in no particular order
+func (r *mem[T1]) ByIndex(indexName, indexedValue string) ([]T1, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	keys, err := r.index.Keys(indexName, indexedValue)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]T1, 0, len(keys))
+	for _, key := range keys {
+		objs = append(objs, r.db[key])
+	}
+	return objs, nil
+}
+
+// IndexKeys returns the keys of the objects with the value in the index, in no
+// particular order
+func (r *mem[T1]) IndexKeys(indexName, indexedValue string) ([]store.Key, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	return r.index.Keys(indexName, indexedValue)
 }
 
 // Delete deletes the entry in the cache
-func (r *mem[T1]) Delete(key store.Key, _ ...store.DeleteOption) error {
+func (r *mem[T1]) Delete(ctx context.Context, key store.Key, opts ...store.DeleteOption) error {
+	o := store.DeleteOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// only if an exisitng object gets deleted we
 	// call the registered callbacks
-	obj, err := r.Get(key)
-	if err != nil {
+	obj, exists := r.db[key]
+	if !exists {
+		return nil
+	}
+	if err := store.CheckResourceVersion(key, o.ResourceVersion, store.FormatResourceVersion(r.versions[key])); err != nil {
+		return err
+	}
+	if o.DryRun {
 		return nil
 	}
 	// delete the entry to ensure the cb uses the proper data
 	r.delete(key)
-	// if exists call the callback
+
 	r.notifyWatcher(watch.WatchEvent[T1]{
-		Type:   watch.Deleted,
-		Object: obj,
+		Type:            watch.Deleted,
+		Key:             key,
+		Object:          obj,
+		OldObject:       obj,
+		ResourceVersion: store.FormatResourceVersion(r.rv),
 	})
-
 	return nil
 }
 
+// notifyWatcher queues the event in the watchermanager, the watchers get it once
+// the lock is released. The caller must hold the lock such that events are
+// ordered by resource version.
 func (r *mem[T1]) notifyWatcher(event watch.WatchEvent[T1]) {
-	r.m.RLock()
-	defer r.m.RUnlock()
 	if r.watching {
-		r.watchermanager.WatchChan() <- event
+		r.watchermanager.Notify(event)
 	}
 }
 
@@ -221,12 +552,7 @@ func (r *mem[T1]) Watch(ctx context.Context, opts ...store.ListOption) (watch.Wa
 	log := log.FromContext(ctx)
 	log.Debug("watch")
 
-	w := &watcher.Watcher[T1]{
-		Cancel:         cancel,
-		ResultChannel:  make(chan watch.WatchEvent[T1]),
-		WatcherManager: r.watchermanager,
-		New:            r.new,
-	}
+	w := watcher.New(cancel, r.watchermanager, r.new, opts...)
 
 	go w.ListAndWatch(ctx, r, opts...)
 
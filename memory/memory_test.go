@@ -0,0 +1,438 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/watch"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newObject() *unstructured.Unstructured {
+	return &unstructured.Unstructured{}
+}
+
+func testKey(name string) store.Key {
+	return store.KeyFromNSN(types.NamespacedName{Namespace: "default", Name: name})
+}
+
+func testObject(name string, data map[string]any) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]any{}}
+	if data != nil {
+		u.Object["data"] = data
+	}
+	u.SetAPIVersion("v1")
+	u.SetKind("ConfigMap")
+	u.SetNamespace("default")
+	u.SetName(name)
+	return u
+}
+
+// create creates the objects a<from> up to a<to> in a goroutine and fails when
+// they are not created in time
+func create(t *testing.T, s store.StorerV2[*unstructured.Unstructured], from, to int) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		for i := from; i < to; i++ {
+			name := fmt.Sprintf("a%d", i)
+			if err := s.Create(context.Background(), testKey(name), testObject(name, nil)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("creates are blocked by the watch")
+	}
+}
+
+func TestWatchSlowConsumer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewStoreV2(newObject)
+	s.Start(ctx)
+	defer s.Stop()
+	create(t, s, 0, 300)
+
+	// a watch that is not read does not block the changes of the store
+	w, err := s.Watch(ctx, &store.ListOptions{WatchBufferSize: 10, WatchPolicy: watch.BlockPolicy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	create(t, s, 300, 600)
+
+	// the list and the changes are delivered once read
+	for i := 0; i < 600; i++ {
+		select {
+		case event := <-w.ResultChan():
+			if event.Type != watch.Added {
+				t.Fatalf("want Added event %d, got %s: %v", i, event.Type, event.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("want 600 events, got %d", i)
+		}
+	}
+}
+
+func TestWatchTerminateSlowConsumer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewStoreV2(newObject)
+	s.Start(ctx)
+	defer s.Stop()
+	create(t, s, 0, 50)
+
+	w, err := s.Watch(ctx, &store.ListOptions{WatchBufferSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Stop()
+	// the list is delivered as it is read
+	for i := 0; i < 50; i++ {
+		select {
+		case event := <-w.ResultChan():
+			if event.Type != watch.Added {
+				t.Fatalf("want Added event %d, got %s: %v", i, event.Type, event.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("want 50 events, got %d", i)
+		}
+	}
+
+	// the watch is terminated when it does not keep up with the changes, the
+	// changes during the switch from the list to the changes are not dropped
+	for n := 50; n < 500; n += 50 {
+		create(t, s, n, n+50)
+		for drained := false; !drained; {
+			select {
+			case event := <-w.ResultChan():
+				if event.Type == watch.Error {
+					if !store.IsUnavailable(event.Err) {
+						t.Errorf("want unavailable error, got %v", event.Err)
+					}
+					return
+				}
+			case <-time.After(100 * time.Millisecond):
+				drained = true
+			}
+		}
+	}
+	t.Fatalf("want the watch to be terminated")
+}
+
+// next returns the next event of the watch
+func next(t *testing.T, w watch.WatchInterface[*unstructured.Unstructured]) watch.WatchEvent[*unstructured.Unstructured] {
+	t.Helper()
+	select {
+	case event := <-w.ResultChan():
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("want an event")
+		return watch.WatchEvent[*unstructured.Unstructured]{}
+	}
+}
+
+func TestUpdateWithKeyFn(t *testing.T) {
+	setX := func(x string) func(context.Context, *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+		return func(_ context.Context, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+			if obj == nil {
+				obj = testObject("a", nil)
+			}
+			// the object is changed in place
+			if err := unstructured.SetNestedField(obj.Object, x, "data", "x"); err != nil {
+				return nil, err
+			}
+			return obj, nil
+		}
+	}
+	returnNil := func(context.Context, *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+		return nil, nil
+	}
+
+	cases := map[string]struct {
+		exists     bool
+		updateFunc func(context.Context, *unstructured.Unstructured) (*unstructured.Unstructured, error)
+		opts       []store.UpdateOption
+		errFunc    func(error) bool
+		// event is the type of the event, nil when no event is expected
+		event *watch.EventType
+		want  string
+	}{
+		"Create": {
+			updateFunc: setX("1"),
+			event:      ptr(watch.Added),
+			want:       "1",
+		},
+		"Modify": {
+			exists:     true,
+			updateFunc: setX("2"),
+			event:      ptr(watch.Modified),
+			want:       "2",
+		},
+		"NoChange": {
+			exists:     true,
+			updateFunc: setX("1"),
+			want:       "1",
+		},
+		"NilMissing": {
+			updateFunc: returnNil,
+			errFunc:    store.IsNotFound,
+		},
+		"NilExisting": {
+			exists:     true,
+			updateFunc: returnNil,
+			errFunc:    store.IsInvalid,
+			want:       "1",
+		},
+		"ResourceVersionMatch": {
+			exists:     true,
+			updateFunc: setX("2"),
+			opts:       []store.UpdateOption{&store.UpdateOptions{ResourceVersion: "1"}},
+			event:      ptr(watch.Modified),
+			want:       "2",
+		},
+		"ResourceVersionConflict": {
+			exists:     true,
+			updateFunc: setX("2"),
+			opts:       []store.UpdateOption{&store.UpdateOptions{ResourceVersion: "5"}},
+			errFunc:    store.IsConflict,
+			want:       "1",
+		},
+		"DryRun": {
+			exists:     true,
+			updateFunc: setX("2"),
+			opts:       []store.UpdateOption{&store.UpdateOptions{DryRun: true}},
+			want:       "1",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			s := NewStoreV2(newObject)
+			s.Start(ctx)
+			defer s.Stop()
+			rv := "0"
+			if tc.exists {
+				obj := testObject("a", map[string]any{"x": "1"})
+				if err := s.Create(ctx, testKey("a"), obj); err != nil {
+					t.Fatal(err)
+				}
+				rv = obj.GetResourceVersion()
+			}
+			// the watch starts after the create
+			w, err := s.Watch(ctx, &store.ListOptions{ResourceVersion: rv})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Stop()
+
+			err = s.UpdateWithKeyFn(ctx, testKey("a"), tc.updateFunc, tc.opts...)
+			if tc.errFunc != nil {
+				if err == nil || !tc.errFunc(err) {
+					t.Fatalf("want error, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			obj, err := s.Get(ctx, testKey("a"))
+			if tc.want == "" {
+				if !store.IsNotFound(err) {
+					t.Fatalf("want not found, got %v", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if x, _, _ := unstructured.NestedString(obj.Object, "data", "x"); x != tc.want {
+					t.Errorf("want x %s, got %s", tc.want, x)
+				}
+			}
+
+			// a marker change shows the event of the update comes first, if any
+			if err := s.Create(ctx, testKey("marker"), testObject("marker", nil)); err != nil {
+				t.Fatal(err)
+			}
+			event := next(t, w)
+			if tc.event == nil {
+				if event.Key != testKey("marker") {
+					t.Fatalf("want no event for the update, got %s %v", event.Type, event.Key)
+				}
+				return
+			}
+			if event.Type != *tc.event || event.Key != testKey("a") {
+				t.Fatalf("want %s event for a, got %s %v", *tc.event, event.Type, event.Key)
+			}
+			if event.ResourceVersion != obj.GetResourceVersion() {
+				t.Errorf("want resource version %s, got %s", obj.GetResourceVersion(), event.ResourceVersion)
+			}
+			if *tc.event == watch.Modified {
+				if x, _, _ := unstructured.NestedString(event.OldObject.Object, "data", "x"); x != "1" {
+					t.Errorf("want old x 1, got %s", x)
+				}
+			}
+			// the resource version is recorded for resuming watches
+			rw, err := s.Watch(ctx, &store.ListOptions{ResourceVersion: store.FormatResourceVersion(mustParse(t, event.ResourceVersion) - 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rw.Stop()
+			// the watch from resource version 0 lists the objects in any order
+			event = next(t, rw)
+			if !tc.exists && event.Key == testKey("marker") {
+				event = next(t, rw)
+			}
+			if event.Key != testKey("a") || event.Type != *tc.event {
+				t.Errorf("want resumed %s event for a, got %s %v", *tc.event, event.Type, event.Key)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func mustParse(t *testing.T, rv string) uint64 {
+	t.Helper()
+	v, err := store.ParseResourceVersion(rv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestIndex(t *testing.T) {
+	ctx := context.Background()
+	s := NewIndexedStoreV2(&Config[*unstructured.Unstructured]{
+		NewFunc: newObject,
+		Indexers: store.Indexers[*unstructured.Unstructured]{
+			"app": store.LabelIndexFunc[*unstructured.Unstructured]("app"),
+			"x":   store.FieldIndexFunc[*unstructured.Unstructured]("data.x"),
+			"bad": func(key store.Key, obj *unstructured.Unstructured) ([]string, error) {
+				if obj.GetLabels()["bad"] != "" {
+					return nil, fmt.Errorf("bad object")
+				}
+				return nil, nil
+			},
+		},
+	})
+	labeled := func(name, app string) *unstructured.Unstructured {
+		obj := testObject(name, map[string]any{"x": name})
+		if app != "" {
+			obj.SetLabels(map[string]string{"app": app})
+		}
+		return obj
+	}
+	// check checks the keys of the values of the app index
+	check := func(step string, want map[string]string) {
+		t.Helper()
+		for value, names := range want {
+			keys, err := s.IndexKeys("app", value)
+			if err != nil {
+				t.Fatalf("%s: %v", step, err)
+			}
+			got := []string{}
+			for _, key := range keys {
+				got = append(got, key.Name)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != names {
+				t.Errorf("%s: want %s for app %s, got %v", step, names, value, got)
+			}
+			objs, err := s.ByIndex("app", value)
+			if err != nil {
+				t.Fatalf("%s: %v", step, err)
+			}
+			if len(objs) != len(got) {
+				t.Errorf("%s: want %d objects for app %s, got %d", step, len(got), value, len(objs))
+			}
+			for _, obj := range objs {
+				if obj.GetLabels()["app"] != value {
+					t.Errorf("%s: want object with app %s, got %v", step, value, obj.GetLabels())
+				}
+			}
+		}
+	}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	must(s.Create(ctx, testKey("a"), labeled("a", "x")))
+	must(s.Create(ctx, testKey("b"), labeled("b", "x")))
+	must(s.Create(ctx, testKey("c"), labeled("c", "y")))
+	check("Create", map[string]string{"x": "a,b", "y": "c"})
+
+	must(s.Update(ctx, testKey("a"), labeled("a", "y")))
+	check("Update", map[string]string{"x": "b", "y": "a,c"})
+
+	must(s.UpdateWithKeyFn(ctx, testKey("b"), func(_ context.Context, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+		// the stored object is changed in place
+		obj.SetLabels(nil)
+		return obj, nil
+	}))
+	check("UpdateWithKeyFn", map[string]string{"x": "", "y": "a,c"})
+
+	must(s.Apply(ctx, testKey("c"), labeled("c", "z")))
+	check("Apply", map[string]string{"y": "a", "z": "c"})
+
+	_, err := s.(store.PatcherV2[*unstructured.Unstructured]).Patch(ctx, testKey("a"), types.MergePatchType, []byte(`{"metadata":{"labels":{"app":"z"}}}`))
+	must(err)
+	check("Patch", map[string]string{"y": "", "z": "a,c"})
+
+	must(s.Update(ctx, testKey("a"), labeled("a", "x"), &store.UpdateOptions{DryRun: true}))
+	check("DryRun", map[string]string{"x": "", "z": "a,c"})
+
+	must(s.Delete(ctx, testKey("c")))
+	check("Delete", map[string]string{"z": "a"})
+
+	// an object that cannot be indexed is not stored
+	bad := labeled("a", "x")
+	bad.SetLabels(map[string]string{"app": "x", "bad": "true"})
+	if err := s.Update(ctx, testKey("a"), bad); !store.IsInvalid(err) {
+		t.Fatalf("want invalid, got %v", err)
+	}
+	check("IndexError", map[string]string{"x": "", "z": "a"})
+
+	keys, err := s.IndexKeys("x", "a")
+	must(err)
+	if len(keys) != 1 || keys[0] != testKey("a") {
+		t.Errorf("want a for x a, got %v", keys)
+	}
+	if _, err := s.IndexKeys("unknown", "a"); !store.IsInvalid(err) {
+		t.Errorf("want invalid for an unknown index, got %v", err)
+	}
+}
@@ -16,8 +16,6 @@ package memoryu
 
 import (
 	"context"
-	"fmt"
-	"reflect"
 	"sync"
 
 	"github.com/henderiw/logger/log"
@@ -27,16 +25,36 @@ import (
 	"github.com/henderiw/store/watchermanager"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 )
 
-const (
-	// errors
-	NotFound = "not found"
-)
+type Config struct {
+	// Indexers are the indexes of the store, they are maintained on every change
+	// and queried with ByIndex and IndexKeys
+	Indexers store.Indexers[runtime.Unstructured]
+}
 
 func NewStore() store.UnstructuredStore {
+	return store.AdaptPatchV1[runtime.Unstructured](NewStoreV2())
+}
+
+func NewStoreV2() store.UnstructuredStoreV2 {
+	return newMem(&Config{})
+}
+
+func NewIndexedStore(cfg *Config) store.IndexedStorer[runtime.Unstructured] {
+	return store.AdaptIndexedV1(NewIndexedStoreV2(cfg))
+}
+
+func NewIndexedStoreV2(cfg *Config) store.IndexedStorerV2[runtime.Unstructured] {
+	return newMem(cfg)
+}
+
+func newMem(cfg *Config) *mem {
 	return &mem{
 		db:             map[store.Key]runtime.Unstructured{},
+		versions:       map[store.Key]uint64{},
+		index:          store.NewIndex(cfg.Indexers),
 		watchermanager: watchermanager.New[runtime.Unstructured](64),
 	}
 }
@@ -44,6 +62,9 @@ func NewStore() store.UnstructuredStore {
 type mem struct {
 	m              sync.RWMutex
 	db             map[store.Key]runtime.Unstructured
+	versions       map[store.Key]uint64
+	index          *store.Index[runtime.Unstructured]
+	rv             uint64
 	watchermanager watchermanager.WatcherManager[runtime.Unstructured]
 	watching       bool
 }
@@ -52,6 +73,7 @@ func (r *mem) Start(ctx context.Context) {
 	r.m.Lock()
 	defer r.m.Unlock()
 	r.watching = true
+	r.watchermanager.SetResourceVersion(store.FormatResourceVersion(r.rv))
 	go r.watchermanager.Start(ctx)
 }
 
@@ -63,154 +85,462 @@ func (r *mem) Stop() {
 }
 
 // Get return the type
-func (r *mem) Get(key store.Key, opts ...store.GetOption) (runtime.Unstructured, error) {
+func (r *mem) Get(ctx context.Context, key store.Key, opts ...store.GetOption) (runtime.Unstructured, error) {
+	o := store.GetOptions{}
+	o.ApplyOptions(opts)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	r.m.RLock()
 	defer r.m.RUnlock()
 
 	x, ok := r.db[key]
 	if !ok {
-		return nil, fmt.Errorf("%s, nsn: %s", NotFound, key.String())
+		return nil, store.NewNotFoundError(key, nil)
+	}
+	if err := store.CheckResourceVersion(key, o.ResourceVersion, store.FormatResourceVersion(r.versions[key])); err != nil {
+		return nil, err
 	}
 	return x, nil
 }
 
-func (r *mem) List(visitorFunc func(store.Key, runtime.Unstructured), opts ...store.ListOption) {
+func (r *mem) List(ctx context.Context, visitorFunc func(store.Key, runtime.Unstructured) error, opts ...store.ListOption) error {
+	o := store.ListOptions{}
+	o.ApplyOptions(opts)
+
 	r.m.RLock()
 	defer r.m.RUnlock()
 
 	for key, obj := range r.db {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !o.Matches(key, obj) {
+			continue
+		}
 		if visitorFunc != nil {
-			visitorFunc(key, obj)
+			if err := visitorFunc(key, obj); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
 
-func (r *mem) ListKeys(opts ...store.ListOption) []string {
+func (r *mem) ListKeys(ctx context.Context, opts ...store.ListOption) ([]string, error) {
 	keys := []string{}
-	r.List(func(key store.Key, _ runtime.Unstructured) {
+	err := r.List(ctx, func(key store.Key, _ runtime.Unstructured) error {
 		keys = append(keys, key.Name)
+		return nil
 	}, opts...)
-	return keys
+	return keys, err
 }
 
-func (r *mem) Len(opts ...store.ListOption) int {
+func (r *mem) Len(ctx context.Context, opts ...store.ListOption) (int, error) {
+	o := store.ListOptions{}
+	o.ApplyOptions(opts)
+	if o.HasFilter() {
+		items := 0
+		err := r.List(ctx, func(_ store.Key, _ runtime.Unstructured) error {
+			items++
+			return nil
+		}, opts...)
+		return items, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	r.m.RLock()
 	defer r.m.RUnlock()
 
-	return len(r.db)
+	return len(r.db), nil
 }
 
-func (r *mem) Apply(key store.Key, data runtime.Unstructured, opts ...store.ApplyOption) error {
-	_, exists := r.db[key]
-	r.update(key, data)
+func (r *mem) Apply(ctx context.Context, key store.Key, data runtime.Unstructured, opts ...store.ApplyOption) error {
+	o := store.ApplyOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	oldd, exists := r.db[key]
+	if o.FieldManager != "" {
+		changed, err := store.ServerSideApply(key, oldd, exists, data, &o)
+		if err != nil {
+			return err
+		}
+		// an apply that does not change the object does not allocate a new resource version
+		if !changed {
+			return nil
+		}
+	}
+	if o.DryRun {
+		return r.dryRun(key, data)
+	}
+	if err := r.update(key, data); err != nil {
+		return err
+	}
 	if !exists {
 		r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
-			Type:   watch.Added,
-			Object: data,
+			Type:            watch.Added,
+			Key:             key,
+			Object:          data,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
 		})
 	} else {
 		r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
-			Type:   watch.Modified,
-			Object: data,
+			Type:            watch.Modified,
+			Key:             key,
+			Object:          data,
+			OldObject:       oldd,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
 		})
 	}
 	return nil
 }
 
-func (r *mem) Create(key store.Key, data runtime.Unstructured, opts ...store.CreateOption) error {
-	// if an error is returned the entry already exists
-	if _, err := r.Get(key); err == nil {
-		return fmt.Errorf("duplicate entry %v", key.String())
+func (r *mem) Create(ctx context.Context, key store.Key, data runtime.Unstructured, opts ...store.CreateOption) error {
+	o := store.CreateOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// if the entry exists we return a duplicate error
+	if _, exists := r.db[key]; exists {
+		return store.NewAlreadyExistsError(key)
+	}
+	if o.DryRun {
+		return r.dryRun(key, data)
 	}
 	// update the cache before calling the callback since the cb fn will use this data
-	r.update(key, data)
+	if err := r.update(key, data); err != nil {
+		return err
+	}
 
 	// notify watchers
 	r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
-		Type:   watch.Added,
-		Object: data,
+		Type:            watch.Added,
+		Key:             key,
+		Object:          data,
+		ResourceVersion: store.FormatResourceVersion(r.rv),
 	})
 	return nil
 }
 
 // Upsert creates or updates the entry in the cache
-func (r *mem) Update(key store.Key, data runtime.Unstructured, opts ...store.UpdateOption) error {
-	exists := true
-	oldd, err := r.Get(key)
-	if err != nil {
-		exists = false
+func (r *mem) Update(ctx context.Context, key store.Key, data runtime.Unstructured, opts ...store.UpdateOption) error {
+	o := store.UpdateOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	// update the cache before calling the callback since the cb fn will use this data
-	r.update(key, data)
+	oldd, exists := r.db[key]
+	return r.upsert(key, oldd, exists, data, &o)
+}
 
-	// // notify watchers based on the fact the data got modified or not
+// upsert creates or updates the entry given the preconditions of the options and
+// notifies the watchers, the caller must hold the lock
+func (r *mem) upsert(key store.Key, oldd runtime.Unstructured, exists bool, data runtime.Unstructured, o *store.UpdateOptions) error {
+	if err := store.CheckResourceVersion(key, o.ResourceVersion, store.FormatResourceVersion(r.versions[key])); err != nil {
+		return err
+	}
 	if exists {
-		if !reflect.DeepEqual(oldd, data) {
-			r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
-				Type:   watch.Modified,
-				Object: data,
-			})
+		// an update that does not change the data does not allocate a new resource version
+		if store.EqualIgnoringResourceVersion(oldd, data) {
+			return nil
 		}
+	}
+	if o.DryRun {
+		return r.dryRun(key, data)
+	}
+	// update the cache before calling the callback since the cb fn will use this data
+	if err := r.update(key, data); err != nil {
+		return err
+	}
+
+	// notify watchers based on the fact the data got modified or not
+	if exists {
+		r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
+			Type:            watch.Modified,
+			Key:             key,
+			Object:          data,
+			OldObject:       oldd,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
+		})
 	} else {
 		r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
-			Type:   watch.Added,
-			Object: data,
+			Type:            watch.Added,
+			Key:             key,
+			Object:          data,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
 		})
 	}
 	return nil
 }
 
-func (r *mem) UpdateWithKeyFn(key store.Key, updateFunc func(obj runtime.Unstructured, _ ...store.UpdateOption) runtime.Unstructured) {
+// UpdateWithKeyFn updates the entry with the result of the updateFunc like
+// Update, the updateFunc gets a copy of the entry or the zero value when the
+// entry does not exist
+func (r *mem) UpdateWithKeyFn(ctx context.Context, key store.Key, updateFunc func(ctx context.Context, obj runtime.Unstructured) (runtime.Unstructured, error), opts ...store.UpdateOption) error {
+	o := store.UpdateOptions{}
+	o.ApplyOptions(opts)
+
 	r.m.Lock()
 	defer r.m.Unlock()
 
-	obj := r.db[key]
-	if updateFunc != nil {
-		r.db[key] = updateFunc(obj)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if updateFunc == nil {
+		return nil
+	}
+	oldd, exists := r.db[key]
+	newd, err := updateFunc(ctx, store.DeepCopy(oldd))
+	if err != nil {
+		return err
+	}
+	if err := store.CheckUpdated(key, exists, newd); err != nil {
+		return err
 	}
+	return r.upsert(key, oldd, exists, newd, &o)
 }
 
-func (r *mem) update(key store.Key, newd runtime.Unstructured) {
+// Patch applies the patch to the entry, a patch that does not change the entry
+// does not allocate a new resource version
+func (r *mem) Patch(ctx context.Context, key store.Key, patchType types.PatchType, patch []byte, opts ...store.PatchOption) (runtime.Unstructured, error) {
+	o := store.PatchOptions{}
+	o.ApplyOptions(opts)
+
 	r.m.Lock()
 	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return *new(runtime.Unstructured), err
+	}
+
+	oldd, exists := r.db[key]
+	if !exists {
+		return *new(runtime.Unstructured), store.NewNotFoundError(key, nil)
+	}
+	if err := store.CheckResourceVersion(key, o.ResourceVersion, store.FormatResourceVersion(r.versions[key])); err != nil {
+		return *new(runtime.Unstructured), err
+	}
+	newd, changed, err := store.PatchObject(key, oldd, patchType, patch, o.Schema)
+	if err != nil {
+		return *new(runtime.Unstructured), err
+	}
+	if !changed {
+		return oldd, nil
+	}
+	if o.DryRun {
+		if err := r.dryRun(key, newd); err != nil {
+			return *new(runtime.Unstructured), err
+		}
+		return newd, nil
+	}
+	if err := r.update(key, newd); err != nil {
+		return *new(runtime.Unstructured), err
+	}
+
+	r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
+		Type:            watch.Modified,
+		Key:             key,
+		Object:          newd,
+		OldObject:       oldd,
+		ResourceVersion: store.FormatResourceVersion(r.rv),
+	})
+	return newd, nil
+}
+
+// update stores the entry with a new resource version, the caller must hold the
+// lock. The entry is not stored when it cannot be indexed.
+func (r *mem) update(key store.Key, newd runtime.Unstructured) error {
+	values, err := r.index.Values(key, newd)
+	if err != nil {
+		return err
+	}
+	r.set(key, newd, values)
+	return nil
+}
+
+// dryRun runs the checks of update without storing the entry, the entry is
+// valid when it can be indexed. The entry gets the resource version it would get.
+func (r *mem) dryRun(key store.Key, newd runtime.Unstructured) error {
+	if _, err := r.index.Values(key, newd); err != nil {
+		return err
+	}
+	store.SetResourceVersion(newd, store.FormatResourceVersion(r.rv+1))
+	return nil
+}
+
+// set stores the entry with a new resource version and its index values, the
+// caller must hold the lock
+func (r *mem) set(key store.Key, newd runtime.Unstructured, values map[string][]string) {
+	r.rv++
+	store.SetResourceVersion(newd, store.FormatResourceVersion(r.rv))
+	r.versions[key] = r.rv
 	r.db[key] = newd
+	r.index.Set(key, values)
 }
 
+// delete removes the entry and bumps the resource version of the store,
+// the caller must hold the lock
 func (r *mem) delete(key store.Key) {
+	r.rv++
+	delete(r.versions, key)
+	delete(r.db, key)
+	r.index.Delete(key)
+}
+
+// Begin starts a transaction
+func (r *mem) Begin() *store.Tx[runtime.Unstructured] {
+	return store.NewTx(r.commit)
+}
+
+// commit applies the operations of a transaction all or nothing, the events
+// are sent once all changes are applied
+func (r *mem) commit(ctx context.Context, ops []store.TxOperation[runtime.Unstructured]) error {
 	r.m.Lock()
 	defer r.m.Unlock()
-	delete(r.db, key)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	changes, err := store.PlanTx(ops, func(key store.Key) (runtime.Unstructured, string, bool, error) {
+		obj, exists := r.db[key]
+		return obj, store.FormatResourceVersion(r.versions[key]), exists, nil
+	})
+	if err != nil {
+		return err
+	}
+	// the objects are indexed before the store is changed
+	values := make([]map[string][]string, len(changes))
+	for i, change := range changes {
+		if change.Type == watch.Deleted {
+			continue
+		}
+		if values[i], err = r.index.Values(change.Key, change.Object); err != nil {
+			return err
+		}
+	}
+	// a dry run validates the changes without applying them, the objects get the
+	// resource versions they would get
+	if store.TxDryRun(ops) {
+		for i, change := range changes {
+			if change.Type != watch.Deleted {
+				store.SetResourceVersion(change.Object, store.FormatResourceVersion(r.rv+uint64(i)+1))
+			}
+		}
+		return nil
+	}
+	events := make([]watch.WatchEvent[runtime.Unstructured], 0, len(changes))
+	for i, change := range changes {
+		if change.Type == watch.Deleted {
+			r.delete(change.Key)
+		} else {
+			r.set(change.Key, change.Object, values[i])
+		}
+		events = append(events, watch.WatchEvent[runtime.Unstructured]{
+			Type:            change.Type,
+			Key:             change.Key,
+			Object:          change.Object,
+			OldObject:       change.OldObject,
+			ResourceVersion: store.FormatResourceVersion(r.rv),
+		})
+	}
+	for _, event := range events {
+		r.notifyWatcher(event)
+	}
+	return nil
+}
+
+// ByIndex returns the objects with the value in the index, in no particular order
+func (r *mem) ByIndex(indexName, indexedValue string) ([]runtime.Unstructured, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	keys, err := r.index.Keys(indexName, indexedValue)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]runtime.Unstructured, 0, len(keys))
+	for _, key := range keys {
+		objs = append(objs, r.db[key])
+	}
+	return objs, nil
+}
+
+// IndexKeys returns the keys of the objects with the value in the index, in no
+// particular order
+func (r *mem) IndexKeys(indexName, indexedValue string) ([]store.Key, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	return r.index.Keys(indexName, indexedValue)
 }
 
 // Delete deletes the entry in the cache
-func (r *mem) Delete(key store.Key, opts ...store.DeleteOption) error {
+func (r *mem) Delete(ctx context.Context, key store.Key, opts ...store.DeleteOption) error {
+	o := store.DeleteOptions{}
+	o.ApplyOptions(opts)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// only if an exisitng object gets deleted we
 	// call the registered callbacks
-	exists := true
-	obj, err := r.Get(key)
-	if err != nil {
+	obj, exists := r.db[key]
+	if !exists {
 		return nil
 	}
-	// if exists call the callback
-	if exists {
-		r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
-			Type:   watch.Deleted,
-			Object: obj,
-		})
+	if err := store.CheckResourceVersion(key, o.ResourceVersion, store.FormatResourceVersion(r.versions[key])); err != nil {
+		return err
+	}
+	if o.DryRun {
+		return nil
 	}
 	// delete the entry to ensure the cb uses the proper data
 	r.delete(key)
+
+	r.notifyWatcher(watch.WatchEvent[runtime.Unstructured]{
+		Type:            watch.Deleted,
+		Key:             key,
+		Object:          obj,
+		OldObject:       obj,
+		ResourceVersion: store.FormatResourceVersion(r.rv),
+	})
 	return nil
 }
 
+// notifyWatcher queues the event in the watchermanager, the watchers get it once
+// the lock is released. The caller must hold the lock such that events are
+// ordered by resource version.
 func (r *mem) notifyWatcher(event watch.WatchEvent[runtime.Unstructured]) {
-	r.m.RLock()
-	defer r.m.RUnlock()
 	if r.watching {
-		r.watchermanager.WatchChan() <- event
+		r.watchermanager.Notify(event)
 	}
-
 }
 
 func (r *mem) Watch(ctx context.Context, opts ...store.ListOption) (watch.WatchInterface[runtime.Unstructured], error) {
@@ -219,12 +549,7 @@ func (r *mem) Watch(ctx context.Context, opts ...store.ListOption) (watch.WatchI
 	log := log.FromContext(ctx)
 	log.Debug("watch")
 
-	w := &watcher.WatcherU{
-		Cancel:         cancel,
-		ResultChannel:  make(chan watch.WatchEvent[runtime.Unstructured]),
-		WatcherManager: r.watchermanager,
-		New:            func() runtime.Unstructured { return &unstructured.Unstructured{} },
-	}
+	w := watcher.New(cancel, r.watchermanager, func() runtime.Unstructured { return &unstructured.Unstructured{} }, opts...)
 
 	go w.ListAndWatch(ctx, r, opts...)
 
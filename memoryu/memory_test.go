@@ -0,0 +1,115 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memoryu
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/henderiw/store"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func testKey(name string) store.Key {
+	return store.KeyFromNSN(types.NamespacedName{Namespace: "default", Name: name})
+}
+
+func testObject(name, app string) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]any{}}
+	u.SetAPIVersion("v1")
+	u.SetKind("ConfigMap")
+	u.SetNamespace("default")
+	u.SetName(name)
+	if app != "" {
+		u.SetLabels(map[string]string{"app": app})
+	}
+	return u
+}
+
+func TestIndex(t *testing.T) {
+	ctx := context.Background()
+	s := NewIndexedStoreV2(&Config{
+		Indexers: store.Indexers[runtime.Unstructured]{
+			"app": store.LabelIndexFunc[runtime.Unstructured]("app"),
+		},
+	})
+	// check checks the keys of the values of the app index
+	check := func(step string, want map[string]string) {
+		t.Helper()
+		for value, names := range want {
+			keys, err := s.IndexKeys("app", value)
+			if err != nil {
+				t.Fatalf("%s: %v", step, err)
+			}
+			got := []string{}
+			for _, key := range keys {
+				got = append(got, key.Name)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != names {
+				t.Errorf("%s: want %s for app %s, got %v", step, names, value, got)
+			}
+			objs, err := s.ByIndex("app", value)
+			if err != nil {
+				t.Fatalf("%s: %v", step, err)
+			}
+			if len(objs) != len(got) {
+				t.Errorf("%s: want %d objects for app %s, got %d", step, len(got), value, len(objs))
+			}
+		}
+	}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	must(s.Create(ctx, testKey("a"), testObject("a", "x")))
+	must(s.Create(ctx, testKey("b"), testObject("b", "x")))
+	must(s.Create(ctx, testKey("c"), testObject("c", "y")))
+	check("Create", map[string]string{"x": "a,b", "y": "c"})
+
+	must(s.Update(ctx, testKey("a"), testObject("a", "y")))
+	check("Update", map[string]string{"x": "b", "y": "a,c"})
+
+	must(s.UpdateWithKeyFn(ctx, testKey("b"), func(_ context.Context, obj runtime.Unstructured) (runtime.Unstructured, error) {
+		// the stored object is changed in place
+		obj.(*unstructured.Unstructured).SetLabels(nil)
+		return obj, nil
+	}))
+	check("UpdateWithKeyFn", map[string]string{"x": "", "y": "a,c"})
+
+	must(s.Apply(ctx, testKey("c"), testObject("c", "z")))
+	check("Apply", map[string]string{"y": "a", "z": "c"})
+
+	_, err := s.(store.PatcherV2[runtime.Unstructured]).Patch(ctx, testKey("a"), types.MergePatchType, []byte(`{"metadata":{"labels":{"app":"z"}}}`))
+	must(err)
+	check("Patch", map[string]string{"y": "", "z": "a,c"})
+
+	must(s.Delete(ctx, testKey("c"), &store.DeleteOptions{DryRun: true}))
+	check("DryRun", map[string]string{"z": "a,c"})
+
+	must(s.Delete(ctx, testKey("c")))
+	check("Delete", map[string]string{"z": "a"})
+
+	if _, err := s.IndexKeys("unknown", "a"); !store.IsInvalid(err) {
+		t.Errorf("want invalid for an unknown index, got %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// Patcher patches the objects of the storage
+type Patcher[T1 any] interface {
+	// Patch applies the patch of the patch type to the object of the key under
+	// the lock of the store and returns the patched object
+	Patch(key Key, patchType types.PatchType, patch []byte, opts ...PatchOption) (T1, error)
+}
+
+// PatcherV2 is the context aware version of Patcher
+type PatcherV2[T1 any] interface {
+	// Patch applies the patch of the patch type to the object of the key under
+	// the lock of the store and returns the patched object
+	Patch(ctx context.Context, key Key, patchType types.PatchType, patch []byte, opts ...PatchOption) (T1, error)
+}
+
+// PatchStorer is a Storer that patches its objects
+type PatchStorer[T1 any] interface {
+	Storer[T1]
+	Patcher[T1]
+}
+
+// PatchStorerV2 is a StorerV2 that patches its objects
+type PatchStorerV2[T1 any] interface {
+	StorerV2[T1]
+	PatcherV2[T1]
+}
+
+// PatchJSON applies the patch of the patch type to the JSON document of the
+// object of the key: a JSON merge patch (RFC 7386), a JSON patch (RFC 6902) or a
+// strategic merge patch. The strategic merge patch uses the patch strategies and
+// merge keys of the struct tags of the schema, a typed object. Without a schema,
+// e.g. for unstructured objects, maps are merged and lists are replaced like a
+// merge patch and the patch directives are honored.
+func PatchJSON(key Key, original []byte, patchType types.PatchType, patch []byte, schema any) ([]byte, error) {
+	var patched []byte
+	var err error
+	switch patchType {
+	case types.MergePatchType:
+		patched, err = jsonpatch.MergePatch(original, patch)
+	case types.JSONPatchType:
+		var p jsonpatch.Patch
+		if p, err = jsonpatch.DecodePatch(patch); err == nil {
+			patched, err = p.Apply(original)
+		}
+	case types.StrategicMergePatchType:
+		var lookup strategicpatch.LookupPatchMeta = schemaless{}
+		if _, ok := schema.(runtime.Unstructured); schema != nil && !ok {
+			lookup, err = strategicpatch.NewPatchMetaFromStruct(schema)
+		}
+		if err == nil {
+			patched, err = strategicpatch.StrategicMergePatchUsingLookupPatchMeta(original, patch, lookup)
+		}
+	default:
+		return nil, NewInvalidError(key, fmt.Sprintf("unsupported patch type %q", patchType), nil)
+	}
+	if err != nil {
+		return nil, NewInvalidError(key, "cannot apply patch", err)
+	}
+	return patched, nil
+}
+
+// PatchObject returns a new object with the patch applied to the object and
+// whether the patch changes the object, the object itself is not changed. The
+// object is the schema of a strategic merge patch when the schema is nil. The
+// patch cannot change the name and namespace of the object, a resource version
+// set by the patch is a precondition.
+func PatchObject[T1 any](key Key, obj T1, patchType types.PatchType, patch []byte, schema any) (T1, bool, error) {
+	original, err := marshalObject(obj)
+	if err != nil {
+		return obj, false, NewInvalidError(key, "cannot marshal object", err)
+	}
+	if schema == nil {
+		schema = obj
+	}
+	patched, err := PatchJSON(key, original, patchType, patch, schema)
+	if err != nil {
+		return obj, false, err
+	}
+	newObj, err := unmarshalObject(obj, patched)
+	if err != nil {
+		return obj, false, NewInvalidError(key, "cannot unmarshal patched object", err)
+	}
+
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return newObj, true, nil
+	}
+	newAccessor, err := meta.Accessor(newObj)
+	if err != nil {
+		return obj, false, NewInvalidError(key, "patched object has no metadata", err)
+	}
+	if newAccessor.GetName() != accessor.GetName() || newAccessor.GetNamespace() != accessor.GetNamespace() {
+		return obj, false, NewInvalidError(key, "patch cannot change the name or namespace", nil)
+	}
+	rv := accessor.GetResourceVersion()
+	if err := CheckResourceVersion(key, newAccessor.GetResourceVersion(), rv); err != nil {
+		return obj, false, err
+	}
+	newAccessor.SetResourceVersion(rv)
+
+	b, err := marshalObject(newObj)
+	if err != nil {
+		return obj, false, NewInvalidError(key, "cannot marshal patched object", err)
+	}
+	return newObj, !bytes.Equal(original, b), nil
+}
+
+func marshalObject(obj any) ([]byte, error) {
+	if u, ok := obj.(runtime.Unstructured); ok {
+		return json.Marshal(u.UnstructuredContent())
+	}
+	return json.Marshal(obj)
+}
+
+// unmarshalObject decodes the JSON document into a new object of the type of the object
+func unmarshalObject[T1 any](obj T1, data []byte) (T1, error) {
+	if _, ok := any(obj).(runtime.Unstructured); ok {
+		content := map[string]any{}
+		if err := json.Unmarshal(data, &content); err != nil {
+			return obj, err
+		}
+		newObj, ok := any(&unstructured.Unstructured{Object: content}).(T1)
+		if !ok {
+			return obj, fmt.Errorf("unsupported type: %T", obj)
+		}
+		return newObj, nil
+	}
+	t := reflect.TypeOf(obj)
+	if t == nil || t.Kind() != reflect.Pointer {
+		return obj, fmt.Errorf("unsupported type: %T", obj)
+	}
+	newObj := reflect.New(t.Elem()).Interface().(T1)
+	if err := json.Unmarshal(data, newObj); err != nil {
+		return obj, err
+	}
+	return newObj, nil
+}
+
+// schemaless is the patch metadata of objects without a schema, no field has a
+// patch strategy or merge key
+type schemaless struct{}
+
+func (schemaless) LookupPatchMetadataForStruct(key string) (strategicpatch.LookupPatchMeta, strategicpatch.PatchMeta, error) {
+	return schemaless{}, strategicpatch.PatchMeta{}, nil
+}
+
+func (schemaless) LookupPatchMetadataForSlice(key string) (strategicpatch.LookupPatchMeta, strategicpatch.PatchMeta, error) {
+	return schemaless{}, strategicpatch.PatchMeta{}, nil
+}
+
+func (schemaless) Name() string {
+	return ""
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"reflect"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// FormatResourceVersion returns the string representation of a resource version
+func FormatResourceVersion(rv uint64) string {
+	if rv == 0 {
+		return ""
+	}
+	return strconv.FormatUint(rv, 10)
+}
+
+// ParseResourceVersion parses a resource version string; an empty string
+// is resource version 0
+func ParseResourceVersion(rv string) (uint64, error) {
+	if rv == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(rv, 10, 64)
+}
+
+// GetResourceVersion returns the resource version stored in the metadata of the object.
+// Objects that dont implement metav1.Object return an empty string
+func GetResourceVersion(obj any) string {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return ""
+	}
+	return accessor.GetResourceVersion()
+}
+
+// SetResourceVersion stores the resource version in the metadata of the object.
+// Objects that dont implement metav1.Object are left untouched
+func SetResourceVersion(obj any, rv string) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	accessor.SetResourceVersion(rv)
+}
+
+// EqualIgnoringResourceVersion reports whether the object equals the stored object
+// apart from its resource version, the object is not changed. An object that is
+// not a runtime.Object cannot be copied and only equals the stored object when
+// its resource version is the same.
+func EqualIgnoringResourceVersion[T1 any](stored, obj T1) bool {
+	rv := GetResourceVersion(stored)
+	if GetResourceVersion(obj) != rv {
+		o, ok := any(obj).(runtime.Object)
+		if !ok {
+			return false
+		}
+		if obj, ok = o.DeepCopyObject().(T1); !ok {
+			return false
+		}
+		SetResourceVersion(obj, rv)
+	}
+	return reflect.DeepEqual(stored, obj)
+}
+
+// CheckResourceVersion validates the precondition resource version against
+// the actual resource version of the object identified by the key.
+// An empty precondition always succeeds.
+func CheckResourceVersion(key Key, precondition, actual string) error {
+	if precondition == "" || precondition == actual {
+		return nil
+	}
+	return NewConflictError(key, precondition, actual)
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/henderiw/logger/log"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// HasFilter returns true if the list options restrict the result
+func (o *ListOptions) HasFilter() bool {
+	return o.Branch != "" ||
+		o.Namespace != "" ||
+		(o.LabelSelector != nil && !o.LabelSelector.Empty()) ||
+		(o.FieldSelector != nil && !o.FieldSelector.Empty())
+}
+
+// Matches returns true if the object stored with the key matches the
+// branch, namespace, label and field restrictions of the list options.
+// Label selectors only match objects implementing metav1.Object.
+func (o *ListOptions) Matches(key Key, obj any) bool {
+	if o.Branch != "" && o.Branch != key.Branch {
+		return false
+	}
+	if o.Namespace != "" && o.Namespace != key.Namespace {
+		return false
+	}
+	if o.LabelSelector != nil && !o.LabelSelector.Empty() {
+		accessor, err := meta.Accessor(obj)
+		if err != nil {
+			return false
+		}
+		if !o.LabelSelector.Matches(labels.Set(accessor.GetLabels())) {
+			return false
+		}
+	}
+	if o.FieldSelector != nil && !o.FieldSelector.Empty() {
+		if !o.FieldSelector.Matches(&objectFields{key: key, obj: obj}) {
+			return false
+		}
+	}
+	return true
+}
+
+// SkipError reports an object that cannot be read and is skipped by a list to the
+// ErrorFunc of the list options. Without an ErrorFunc the error is logged with
+// the context of the list and returned by SkippedError once the list completes.
+func (o *ListOptions) SkipError(ctx context.Context, key Key, err error) {
+	if o.ErrorFunc != nil {
+		o.ErrorFunc(key, err)
+		return
+	}
+	log := log.FromContext(ctx)
+	log.Error("skipping unreadable object", "key", key.String(), "error", err.Error())
+	o.skipped = append(o.skipped, SkippedObject{Key: key, Err: err})
+}
+
+// SkippedError returns the objects skipped by the list as a ListError, nil when
+// no object is skipped or the skipped objects are reported to the ErrorFunc
+func (o *ListOptions) SkippedError() error {
+	if len(o.skipped) == 0 {
+		return nil
+	}
+	return &ListError{Skipped: o.skipped}
+}
+
+// objectFields implements fields.Fields for a stored object.
+// metadata.name and metadata.namespace are derived from the key, other
+// field paths are looked up in the content of unstructured objects.
+type objectFields struct {
+	key Key
+	obj any
+}
+
+var _ fields.Fields = &objectFields{}
+
+func (r *objectFields) Has(field string) bool {
+	_, found := r.lookup(field)
+	return found
+}
+
+func (r *objectFields) Get(field string) string {
+	v, _ := r.lookup(field)
+	return v
+}
+
+func (r *objectFields) lookup(field string) (string, bool) {
+	switch field {
+	case "metadata.name":
+		return r.key.Name, true
+	case "metadata.namespace":
+		return r.key.Namespace, true
+	}
+	u, ok := r.obj.(runtime.Unstructured)
+	if !ok {
+		return "", false
+	}
+	v, found, err := unstructured.NestedFieldNoCopy(u.UnstructuredContent(), strings.Split(field, ".")...)
+	if err != nil || !found {
+		return "", false
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case map[string]any, []any:
+		return "", false
+	default:
+		return fmt.Sprintf("%v", v), true
+	}
+}
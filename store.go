@@ -16,9 +16,12 @@ package store
 
 import (
 	"context"
+	"time"
 
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/henderiw/store/watch"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -50,27 +53,63 @@ type Storer[T1 any] interface {
 	Watch(ctx context.Context, opts ...ListOption) (watch.WatchInterface[T1], error)
 }
 
+// UnstructuredStore is the storage system for unstructured objects
 type UnstructuredStore interface {
-	// Retrieve retrieves data for the given key from the storage
-	Get(key Key, opts ...GetOption) (runtime.Unstructured, error)
-	// Retrieve retrieves data for the given key from the storage
-	List(visitorFunc func(key Key, obj runtime.Unstructured), opts ...ListOption)
-	// Retrieve retrieves data for the given key from the storage
-	ListKeys(opts ...ListOption) []string
+	Storer[runtime.Unstructured]
+	Patcher[runtime.Unstructured]
+}
+
+// ObjectStore is the storage system for typed objects, the objects are
+// patched through their JSON encoding
+type ObjectStore interface {
+	Storer[runtime.Object]
+	Patcher[runtime.Object]
+}
+
+// StorerV2 is the context aware version of Storer, every call honors the
+// cancellation of its context and the errors of List are returned. Storer is
+// kept for the existing users, see AdaptV1 and AdaptV2.
+type StorerV2[T1 any] interface {
+	// Starting the watcher manager
+	Start(context.Context)
+	// Stopping the watcher manager
+	Stop()
+	// Get retrieves data for the given key from the storage
+	Get(ctx context.Context, key Key, opts ...GetOption) (T1, error)
+	// List calls the visitorFunc for the entries in the storage, an error of the
+	// visitorFunc stops the list and is returned
+	List(ctx context.Context, visitorFunc func(Key, T1) error, opts ...ListOption) error
+	// ListKeys returns the names of the keys in the storage
+	ListKeys(ctx context.Context, opts ...ListOption) ([]string, error)
 	// Len returns the # entries in the store
-	Len(opts ...ListOption) int
-	// Create data with the given key in the storage irrespective of create/delete 
-	Apply(key Key, obj runtime.Unstructured, opts ...ApplyOption) error
+	Len(ctx context.Context, opts ...ListOption) (int, error)
+	// Create data with the given key in the storage irrespective of create/delete
+	Apply(ctx context.Context, key Key, data T1, opts ...ApplyOption) error
 	// Create data with the given key in the storage
-	Create(key Key, obj runtime.Unstructured, opts ...CreateOption) error
+	Create(ctx context.Context, key Key, data T1, opts ...CreateOption) error
 	// Update data with the given key in the storage
-	Update(key Key, obj runtime.Unstructured, opts ...UpdateOption) error
-	// Update data in a concurrent way through a function
-	UpdateWithKeyFn(key Key, updateFunc func(obj runtime.Unstructured, opts ...UpdateOption) runtime.Unstructured)
+	Update(ctx context.Context, key Key, data T1, opts ...UpdateOption) error
+	// Update data in a concurrent way through a function, an error of the
+	// updateFunc aborts the update and is returned. The result of the updateFunc
+	// is stored like Update, a nil result fails with a not found error when the
+	// object does not exist and an invalid error otherwise.
+	UpdateWithKeyFn(ctx context.Context, key Key, updateFunc func(ctx context.Context, obj T1) (T1, error), opts ...UpdateOption) error
 	// Delete deletes data and key from the storage
-	Delete(key Key, opts ...DeleteOption) error
+	Delete(ctx context.Context, key Key, opts ...DeleteOption) error
 	// Watch watches change
-	Watch(ctx context.Context, opts ...ListOption) (watch.WatchInterface[runtime.Unstructured], error)
+	Watch(ctx context.Context, opts ...ListOption) (watch.WatchInterface[T1], error)
+}
+
+// UnstructuredStoreV2 is the context aware storage system for unstructured objects
+type UnstructuredStoreV2 interface {
+	StorerV2[runtime.Unstructured]
+	PatcherV2[runtime.Unstructured]
+}
+
+// ObjectStoreV2 is the context aware storage system for typed objects
+type ObjectStoreV2 interface {
+	StorerV2[runtime.Object]
+	PatcherV2[runtime.Object]
 }
 
 type GetOption interface {
@@ -82,12 +121,18 @@ var _ GetOption = &GetOptions{}
 
 type GetOptions struct {
 	Commit *object.Commit
+	// ResourceVersion is a precondition, when set the get fails with a
+	// conflict if the object has a different resource version
+	ResourceVersion string
 }
 
 func (o *GetOptions) ApplyToGet(lo *GetOptions) {
 	if o.Commit != nil {
 		lo.Commit = o.Commit
 	}
+	if o.ResourceVersion != "" {
+		lo.ResourceVersion = o.ResourceVersion
+	}
 }
 
 // ApplyOptions applies the given get options on these options,
@@ -109,12 +154,76 @@ var _ ListOption = &ListOptions{}
 type ListOptions struct {
 	Commit *object.Commit
 	Watch  bool
+	// Branch restricts the result to the objects of the branch, stores without
+	// branches only store objects without a branch
+	Branch string
+	// Namespace restricts the result to the objects in the namespace
+	Namespace string
+	// LabelSelector restricts the result to the objects matching the labels
+	LabelSelector labels.Selector
+	// FieldSelector restricts the result to the objects matching the fields
+	FieldSelector fields.Selector
+	// ResourceVersion starts a watch after the resource version, the events
+	// since the resource version are replayed and the initial list is skipped
+	ResourceVersion string
+	// AllowBookmarks requests periodic bookmark events on a watch
+	AllowBookmarks bool
+	// BookmarkInterval is the interval of the bookmark events of a watch,
+	// watchermanager.DefaultBookmarkInterval is used when not set
+	BookmarkInterval time.Duration
+	// WatchBufferSize is the number of events buffered for a watcher,
+	// watch.DefaultChanSize is used when not set
+	WatchBufferSize int
+	// WatchPolicy defines how a watcher handles a full buffer, the watch is
+	// terminated by default
+	WatchPolicy watch.SlowConsumerPolicy
+	// ErrorFunc is called with the key of every object that cannot be read,
+	// e.g. a corrupt file. The object is skipped and the list continues. When
+	// not set the list returns the unreadable objects as a ListError once it
+	// visited all other objects.
+	ErrorFunc func(key Key, err error)
+
+	// skipped are the unreadable objects of a list without ErrorFunc
+	skipped []SkippedObject
 }
 
 func (o *ListOptions) ApplyToList(lo *ListOptions) {
 	if o.Commit != nil {
 		lo.Commit = o.Commit
 	}
+	if o.Watch {
+		lo.Watch = o.Watch
+	}
+	if o.Branch != "" {
+		lo.Branch = o.Branch
+	}
+	if o.Namespace != "" {
+		lo.Namespace = o.Namespace
+	}
+	if o.LabelSelector != nil {
+		lo.LabelSelector = o.LabelSelector
+	}
+	if o.FieldSelector != nil {
+		lo.FieldSelector = o.FieldSelector
+	}
+	if o.ResourceVersion != "" {
+		lo.ResourceVersion = o.ResourceVersion
+	}
+	if o.AllowBookmarks {
+		lo.AllowBookmarks = o.AllowBookmarks
+	}
+	if o.BookmarkInterval != 0 {
+		lo.BookmarkInterval = o.BookmarkInterval
+	}
+	if o.WatchBufferSize != 0 {
+		lo.WatchBufferSize = o.WatchBufferSize
+	}
+	if o.WatchPolicy != watch.TerminatePolicy {
+		lo.WatchPolicy = o.WatchPolicy
+	}
+	if o.ErrorFunc != nil {
+		lo.ErrorFunc = o.ErrorFunc
+	}
 }
 
 // ApplyOptions applies the given get options on these options,
@@ -134,9 +243,30 @@ type ApplyOption interface {
 var _ ApplyOption = &ApplyOptions{}
 
 type ApplyOptions struct {
+	// FieldManager makes the apply a server-side apply by the manager, see
+	// ServerSideApply. The content of the applied object is replaced by the
+	// result, also when the apply does not change the object. The applied object
+	// replaces the object in the store when not set.
+	FieldManager string
+	// Force takes over the fields of the other managers instead of failing
+	// with a conflict
+	Force bool
+	// DryRun runs the apply without storing the object or notifying the
+	// watchers, the applied object is the would-be result with the resource
+	// version it would get
+	DryRun bool
 }
 
 func (o *ApplyOptions) ApplyToApply(lo *ApplyOptions) {
+	if o.FieldManager != "" {
+		lo.FieldManager = o.FieldManager
+	}
+	if o.Force {
+		lo.Force = o.Force
+	}
+	if o.DryRun {
+		lo.DryRun = o.DryRun
+	}
 }
 
 // ApplyOptions applies the given get options on these options,
@@ -156,9 +286,15 @@ type CreateOption interface {
 var _ CreateOption = &CreateOptions{}
 
 type CreateOptions struct {
+	// DryRun runs the create without storing the object or notifying the watchers,
+	// the object gets the resource version it would get
+	DryRun bool
 }
 
 func (o *CreateOptions) ApplyToCreate(lo *CreateOptions) {
+	if o.DryRun {
+		lo.DryRun = o.DryRun
+	}
 }
 
 func (o *CreateOptions) ApplyOptions(opts []CreateOption) *CreateOptions {
@@ -176,9 +312,21 @@ type UpdateOption interface {
 var _ UpdateOption = &UpdateOptions{}
 
 type UpdateOptions struct {
+	// ResourceVersion is a precondition, when set the update fails with a
+	// conflict if the object in the store has a different resource version
+	ResourceVersion string
+	// DryRun runs the update without storing the object or notifying the watchers,
+	// the object gets the resource version it would get
+	DryRun bool
 }
 
 func (o *UpdateOptions) ApplyToUpdate(lo *UpdateOptions) {
+	if o.ResourceVersion != "" {
+		lo.ResourceVersion = o.ResourceVersion
+	}
+	if o.DryRun {
+		lo.DryRun = o.DryRun
+	}
 }
 
 func (o *UpdateOptions) ApplyOptions(opts []UpdateOption) *UpdateOptions {
@@ -196,9 +344,20 @@ type DeleteOption interface {
 var _ DeleteOption = &DeleteOptions{}
 
 type DeleteOptions struct {
+	// ResourceVersion is a precondition, when set the delete fails with a
+	// conflict if the object in the store has a different resource version
+	ResourceVersion string
+	// DryRun runs the delete without removing the object or notifying the watchers
+	DryRun bool
 }
 
 func (o *DeleteOptions) ApplyToDelete(lo *DeleteOptions) {
+	if o.ResourceVersion != "" {
+		lo.ResourceVersion = o.ResourceVersion
+	}
+	if o.DryRun {
+		lo.DryRun = o.DryRun
+	}
 }
 
 func (o *DeleteOptions) ApplyOptions(opts []DeleteOption) *DeleteOptions {
@@ -208,6 +367,45 @@ func (o *DeleteOptions) ApplyOptions(opts []DeleteOption) *DeleteOptions {
 	return o
 }
 
+type PatchOption interface {
+	// ApplyToPatch applies this configuration to the given patch options.
+	ApplyToPatch(*PatchOptions)
+}
+
+var _ PatchOption = &PatchOptions{}
+
+type PatchOptions struct {
+	// ResourceVersion is a precondition, when set the patch fails with a
+	// conflict if the object in the store has a different resource version
+	ResourceVersion string
+	// Schema is an empty typed object, e.g. &corev1.Pod{}, whose struct tags
+	// provide the merge keys of a strategic merge patch of unstructured objects
+	Schema runtime.Object
+	// DryRun runs the patch without storing the object or notifying the
+	// watchers, the would-be result is returned with the resource version it
+	// would get
+	DryRun bool
+}
+
+func (o *PatchOptions) ApplyToPatch(lo *PatchOptions) {
+	if o.ResourceVersion != "" {
+		lo.ResourceVersion = o.ResourceVersion
+	}
+	if o.Schema != nil {
+		lo.Schema = o.Schema
+	}
+	if o.DryRun {
+		lo.DryRun = o.DryRun
+	}
+}
+
+func (o *PatchOptions) ApplyOptions(opts []PatchOption) *PatchOptions {
+	for _, opt := range opts {
+		opt.ApplyToPatch(o)
+	}
+	return o
+}
+
 //server side
 //getOpts := GetOptions{}
 //getOpts.ApplyOptions(opts)
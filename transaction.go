@@ -0,0 +1,296 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"sync"
+
+	"github.com/henderiw/store/watch"
+)
+
+type TxOperationType string
+
+const (
+	TxCreate TxOperationType = "Create"
+	TxUpdate TxOperationType = "Update"
+	TxApply  TxOperationType = "Apply"
+	TxDelete TxOperationType = "Delete"
+	// TxCheck does not change the object, it only checks the resource version
+	TxCheck TxOperationType = "Check"
+)
+
+// TxOperation is an operation staged in a transaction
+type TxOperation[T1 any] struct {
+	Type   TxOperationType
+	Key    Key
+	Object T1
+	// ResourceVersion is a precondition, when set the transaction fails with a
+	// conflict if the object has a different resource version
+	ResourceVersion string
+	// DryRun plans and validates the operation without applying it
+	DryRun bool
+	// FieldManager and Force make an apply a server-side apply, see ApplyOptions
+	FieldManager string
+	Force        bool
+}
+
+// TxCommitFunc commits the operations of a transaction all or nothing
+type TxCommitFunc[T1 any] func(ctx context.Context, ops []TxOperation[T1]) error
+
+// Transactor is implemented by the stores supporting transactions, the Storer
+// of such a store implements it after AdaptV2
+type Transactor[T1 any] interface {
+	// Begin starts a transaction
+	Begin() *Tx[T1]
+}
+
+// Tx is a transaction on the objects of a store. The operations are staged
+// without changing the store and are validated and applied all or nothing by
+// Commit, the watchers get the events of the changes once the transaction is
+// committed. A transaction is finished by Commit or Rollback. A transaction of
+// operations with the dry run option is planned and validated by Commit without
+// changing the store, the objects get the resource versions they would get.
+type Tx[T1 any] struct {
+	m          sync.Mutex
+	commitFunc TxCommitFunc[T1]
+	ops        []TxOperation[T1]
+	done       bool
+}
+
+// NewTx returns a transaction committed by the commitFunc of the store
+func NewTx[T1 any](commitFunc TxCommitFunc[T1]) *Tx[T1] {
+	return &Tx[T1]{commitFunc: commitFunc}
+}
+
+// Create stages the creation of the object, the transaction fails if it exists
+func (r *Tx[T1]) Create(key Key, data T1, opts ...CreateOption) error {
+	o := CreateOptions{}
+	o.ApplyOptions(opts)
+	return r.stage(TxOperation[T1]{Type: TxCreate, Key: key, Object: data, DryRun: o.DryRun})
+}
+
+// Update stages the update of the object, the object is created if it does not exist
+func (r *Tx[T1]) Update(key Key, data T1, opts ...UpdateOption) error {
+	o := UpdateOptions{}
+	o.ApplyOptions(opts)
+	return r.stage(TxOperation[T1]{Type: TxUpdate, Key: key, Object: data, ResourceVersion: o.ResourceVersion, DryRun: o.DryRun})
+}
+
+// Apply stages the creation or update of the object, with a field manager the
+// object is merged into the stored object by a server-side apply when the
+// transaction is committed
+func (r *Tx[T1]) Apply(key Key, data T1, opts ...ApplyOption) error {
+	o := ApplyOptions{}
+	o.ApplyOptions(opts)
+	return r.stage(TxOperation[T1]{Type: TxApply, Key: key, Object: data, DryRun: o.DryRun, FieldManager: o.FieldManager, Force: o.Force})
+}
+
+// Delete stages the deletion of the object, deleting an object that does not
+// exist does not fail the transaction
+func (r *Tx[T1]) Delete(key Key, opts ...DeleteOption) error {
+	o := DeleteOptions{}
+	o.ApplyOptions(opts)
+	return r.stage(TxOperation[T1]{Type: TxDelete, Key: key, ResourceVersion: o.ResourceVersion, DryRun: o.DryRun})
+}
+
+// Check guards the transaction with the resource version of an object that is
+// not changed by the transaction, an empty resource version requires the
+// object not to exist
+func (r *Tx[T1]) Check(key Key, resourceVersion string) error {
+	return r.stage(TxOperation[T1]{Type: TxCheck, Key: key, ResourceVersion: resourceVersion})
+}
+
+func (r *Tx[T1]) stage(op TxOperation[T1]) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.done {
+		return &Error{Err: ErrInvalid, Key: op.Key, Message: "transaction is finished"}
+	}
+	r.ops = append(r.ops, op)
+	return nil
+}
+
+// Commit applies the staged operations, either all operations are applied or
+// none. The transaction is finished, also when the commit fails.
+func (r *Tx[T1]) Commit(ctx context.Context) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.done {
+		return &Error{Err: ErrInvalid, Message: "transaction is finished"}
+	}
+	r.done = true
+	if len(r.ops) == 0 {
+		return nil
+	}
+	// a transaction is either a dry run or applied as a whole
+	dryRun := TxDryRun(r.ops)
+	for _, op := range r.ops {
+		if op.Type != TxCheck && op.DryRun != dryRun {
+			return NewInvalidError(op.Key, "the operations of a transaction must all or none be a dry run", nil)
+		}
+	}
+	return r.commitFunc(ctx, r.ops)
+}
+
+// Rollback discards the staged operations
+func (r *Tx[T1]) Rollback() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.done = true
+	r.ops = nil
+}
+
+// TxChange is the change of an object by a transaction
+type TxChange[T1 any] struct {
+	// Type is watch.Added, watch.Modified or watch.Deleted
+	Type      watch.EventType
+	Key       Key
+	Object    T1
+	OldObject T1
+}
+
+// TxObjectFunc returns the stored object of the key, its resource version and
+// whether it exists
+type TxObjectFunc[T1 any] func(key Key) (obj T1, resourceVersion string, exists bool, err error)
+
+// PlanTx validates the operations of a transaction against the objects returned
+// by getFunc and returns the changes in the order of the operations, the
+// operations see the changes of the earlier operations. The changes do not get
+// a resource version, a precondition on an object changed earlier in the
+// transaction fails. The store must not change until the changes are applied.
+func PlanTx[T1 any](ops []TxOperation[T1], getFunc TxObjectFunc[T1]) ([]TxChange[T1], error) {
+	type state struct {
+		obj    T1
+		rv     string
+		exists bool
+		staged bool
+	}
+	states := map[Key]*state{}
+	get := func(key Key) (*state, error) {
+		if s, ok := states[key]; ok {
+			return s, nil
+		}
+		obj, rv, exists, err := getFunc(key)
+		if err != nil {
+			return nil, err
+		}
+		s := &state{obj: obj, rv: rv, exists: exists}
+		states[key] = s
+		return s, nil
+	}
+	check := func(key Key, precondition string, s *state) error {
+		if precondition == "" {
+			return nil
+		}
+		if s.staged {
+			return NewConflictError(key, precondition, "")
+		}
+		return CheckResourceVersion(key, precondition, s.rv)
+	}
+
+	changes := []TxChange[T1]{}
+	for _, op := range ops {
+		s, err := get(op.Key)
+		if err != nil {
+			return nil, err
+		}
+		switch op.Type {
+		case TxCheck:
+			if op.ResourceVersion == "" {
+				if s.exists {
+					return nil, NewAlreadyExistsError(op.Key)
+				}
+				continue
+			}
+			if !s.exists {
+				return nil, NewNotFoundError(op.Key, nil)
+			}
+			if err := check(op.Key, op.ResourceVersion, s); err != nil {
+				return nil, err
+			}
+			continue
+		case TxCreate:
+			if s.exists {
+				return nil, NewAlreadyExistsError(op.Key)
+			}
+		case TxUpdate:
+			if err := check(op.Key, op.ResourceVersion, s); err != nil {
+				return nil, err
+			}
+			if s.exists && !s.staged {
+				// an update that does not change the data does not allocate a new resource version
+				if EqualIgnoringResourceVersion(s.obj, op.Object) {
+					continue
+				}
+			}
+		case TxApply:
+			if op.FieldManager != "" {
+				changed, err := ServerSideApply(op.Key, s.obj, s.exists, op.Object, &ApplyOptions{FieldManager: op.FieldManager, Force: op.Force})
+				if err != nil {
+					return nil, err
+				}
+				// an apply that does not change the object does not allocate a new resource version
+				if !changed {
+					continue
+				}
+			}
+		case TxDelete:
+			if !s.exists {
+				continue
+			}
+			if err := check(op.Key, op.ResourceVersion, s); err != nil {
+				return nil, err
+			}
+			changes = append(changes, TxChange[T1]{Type: watch.Deleted, Key: op.Key, Object: s.obj, OldObject: s.obj})
+			states[op.Key] = &state{staged: true}
+			continue
+		default:
+			return nil, NewInvalidError(op.Key, "unknown transaction operation "+string(op.Type), nil)
+		}
+		change := TxChange[T1]{Type: watch.Added, Key: op.Key, Object: op.Object}
+		if s.exists {
+			change.Type = watch.Modified
+			change.OldObject = s.obj
+		}
+		changes = append(changes, change)
+		states[op.Key] = &state{obj: op.Object, exists: true, staged: true}
+	}
+	return changes, nil
+}
+
+// TxDryRun returns true when the operations of a transaction are a dry run, the
+// store plans and validates the changes without applying them
+func TxDryRun[T1 any](ops []TxOperation[T1]) bool {
+	for _, op := range ops {
+		if op.DryRun {
+			return true
+		}
+	}
+	return false
+}
+
+// TxKeys returns the keys of the operations without duplicates
+func TxKeys[T1 any](ops []TxOperation[T1]) []Key {
+	seen := map[Key]bool{}
+	keys := []Key{}
+	for _, op := range ops {
+		if !seen[op.Key] {
+			seen[op.Key] = true
+			keys = append(keys, op.Key)
+		}
+	}
+	return keys
+}
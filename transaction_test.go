@@ -0,0 +1,197 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/henderiw/store/watch"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func testKey(name string) Key {
+	return KeyFromNSN(types.NamespacedName{Namespace: "default", Name: name})
+}
+
+func testObject(name, rv string, data map[string]any) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]any{"name": name, "namespace": "default"},
+	}}
+	if data != nil {
+		u.Object["data"] = data
+	}
+	if rv != "" {
+		u.SetResourceVersion(rv)
+	}
+	return u
+}
+
+func TestPlanTx(t *testing.T) {
+	// a exists with resource version 1, b does not exist
+	stored := map[Key]*unstructured.Unstructured{
+		testKey("a"): testObject("a", "1", map[string]any{"x": "1"}),
+	}
+	getFunc := func(key Key) (*unstructured.Unstructured, string, bool, error) {
+		obj, ok := stored[key]
+		if !ok {
+			return nil, "", false, nil
+		}
+		return obj, obj.GetResourceVersion(), true, nil
+	}
+	changed := testObject("a", "", map[string]any{"x": "2"})
+
+	cases := map[string]struct {
+		ops     []TxOperation[*unstructured.Unstructured]
+		changes []watch.EventType
+		errFunc func(error) bool
+	}{
+		"CreateNew": {
+			ops:     []TxOperation[*unstructured.Unstructured]{{Type: TxCreate, Key: testKey("b"), Object: testObject("b", "", nil)}},
+			changes: []watch.EventType{watch.Added},
+		},
+		"CreateExisting": {
+			ops:     []TxOperation[*unstructured.Unstructured]{{Type: TxCreate, Key: testKey("a"), Object: changed}},
+			errFunc: IsAlreadyExists,
+		},
+		"UpdateMatchingResourceVersion": {
+			ops:     []TxOperation[*unstructured.Unstructured]{{Type: TxUpdate, Key: testKey("a"), Object: changed, ResourceVersion: "1"}},
+			changes: []watch.EventType{watch.Modified},
+		},
+		"UpdateStaleResourceVersion": {
+			ops:     []TxOperation[*unstructured.Unstructured]{{Type: TxUpdate, Key: testKey("a"), Object: changed, ResourceVersion: "2"}},
+			errFunc: IsConflict,
+		},
+		"UpdateMissingWithResourceVersion": {
+			ops:     []TxOperation[*unstructured.Unstructured]{{Type: TxUpdate, Key: testKey("b"), Object: testObject("b", "", nil), ResourceVersion: "1"}},
+			errFunc: IsConflict,
+		},
+		"UpdateUnchanged": {
+			ops:     []TxOperation[*unstructured.Unstructured]{{Type: TxUpdate, Key: testKey("a"), Object: testObject("a", "", map[string]any{"x": "1"})}},
+			changes: []watch.EventType{},
+		},
+		"DeleteMissing": {
+			ops:     []TxOperation[*unstructured.Unstructured]{{Type: TxDelete, Key: testKey("b")}},
+			changes: []watch.EventType{},
+		},
+		"DeleteStaleResourceVersion": {
+			ops:     []TxOperation[*unstructured.Unstructured]{{Type: TxDelete, Key: testKey("a"), ResourceVersion: "2"}},
+			errFunc: IsConflict,
+		},
+		"DeleteThenCreate": {
+			ops: []TxOperation[*unstructured.Unstructured]{
+				{Type: TxDelete, Key: testKey("a"), ResourceVersion: "1"},
+				{Type: TxCreate, Key: testKey("a"), Object: changed},
+			},
+			changes: []watch.EventType{watch.Deleted, watch.Added},
+		},
+		"PreconditionAfterChange": {
+			ops: []TxOperation[*unstructured.Unstructured]{
+				{Type: TxUpdate, Key: testKey("a"), Object: changed},
+				{Type: TxDelete, Key: testKey("a"), ResourceVersion: "1"},
+			},
+			errFunc: IsConflict,
+		},
+		"CheckMatchingResourceVersion": {
+			ops: []TxOperation[*unstructured.Unstructured]{
+				{Type: TxCheck, Key: testKey("a"), ResourceVersion: "1"},
+				{Type: TxCreate, Key: testKey("b"), Object: testObject("b", "", nil)},
+			},
+			changes: []watch.EventType{watch.Added},
+		},
+		"CheckStaleResourceVersion": {
+			ops:     []TxOperation[*unstructured.Unstructured]{{Type: TxCheck, Key: testKey("a"), ResourceVersion: "2"}},
+			errFunc: IsConflict,
+		},
+		"CheckMissing": {
+			ops:     []TxOperation[*unstructured.Unstructured]{{Type: TxCheck, Key: testKey("b"), ResourceVersion: "1"}},
+			errFunc: IsNotFound,
+		},
+		"CheckAbsentExisting": {
+			ops:     []TxOperation[*unstructured.Unstructured]{{Type: TxCheck, Key: testKey("a")}},
+			errFunc: IsAlreadyExists,
+		},
+		"UnknownOperation": {
+			ops:     []TxOperation[*unstructured.Unstructured]{{Type: "Move", Key: testKey("a")}},
+			errFunc: IsInvalid,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			changes, err := PlanTx(tc.ops, getFunc)
+			if tc.errFunc != nil {
+				if err == nil || !tc.errFunc(err) {
+					t.Fatalf("want error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(changes) != len(tc.changes) {
+				t.Fatalf("want %d changes, got %d", len(tc.changes), len(changes))
+			}
+			for i, change := range changes {
+				if change.Type != tc.changes[i] {
+					t.Errorf("change %d: want %s, got %s", i, tc.changes[i], change.Type)
+				}
+			}
+		})
+	}
+}
+
+func TestTxCommitDryRun(t *testing.T) {
+	cases := map[string]struct {
+		dryRun  []bool
+		wantErr bool
+	}{
+		"AllDryRun":  {dryRun: []bool{true, true}},
+		"NoneDryRun": {dryRun: []bool{false, false}},
+		"Mixed":      {dryRun: []bool{true, false}, wantErr: true},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			committed := false
+			tx := NewTx(func(ctx context.Context, ops []TxOperation[*unstructured.Unstructured]) error {
+				committed = true
+				return nil
+			})
+			for i, dryRun := range tc.dryRun {
+				opts := []CreateOption{}
+				if dryRun {
+					opts = append(opts, &CreateOptions{DryRun: true})
+				}
+				if err := tx.Create(testKey(string(rune('a'+i))), testObject("a", "", nil), opts...); err != nil {
+					t.Fatalf("cannot stage: %v", err)
+				}
+			}
+			err := tx.Commit(context.Background())
+			if tc.wantErr {
+				if !IsInvalid(err) || committed {
+					t.Fatalf("want invalid error without commit, got %v", err)
+				}
+				return
+			}
+			if err != nil || !committed {
+				t.Fatalf("want commit, got %v", err)
+			}
+		})
+	}
+}
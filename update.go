@@ -0,0 +1,60 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"reflect"
+
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// DeepCopy returns a copy of the object such that the updateFunc of
+// UpdateWithKeyFn can change it, objects that are not a runtime.Object are
+// returned as is
+func DeepCopy[T1 any](obj T1) T1 {
+	o, ok := any(obj).(runtime.Object)
+	if !ok || isNil(obj) {
+		return obj
+	}
+	if c, ok := o.DeepCopyObject().(T1); ok {
+		return c
+	}
+	return obj
+}
+
+// CheckUpdated validates the object returned by the updateFunc of
+// UpdateWithKeyFn, a nil object cannot be stored
+func CheckUpdated[T1 any](key Key, exists bool, obj T1) error {
+	if !isNil(obj) {
+		return nil
+	}
+	if !exists {
+		return NewNotFoundError(key, nil)
+	}
+	return NewInvalidError(key, "update func returned a nil object", nil)
+}
+
+// isNil reports whether the object is nil, also when it is a nil pointer
+func isNil(obj any) bool {
+	if obj == nil {
+		return true
+	}
+	v := reflect.ValueOf(obj)
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface, reflect.Func, reflect.Chan:
+		return v.IsNil()
+	}
+	return false
+}
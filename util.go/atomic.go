@@ -0,0 +1,96 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// TempFilePrefix is the prefix of the temporary files of WriteFileAtomic,
+// a leftover of a crash is a hidden file that is never a stored object
+const TempFilePrefix = ".tmp-"
+
+// WriteFileAtomic writes the data to the file such that the file either has
+// its old or its new content after a crash. The data is written to a temporary
+// file in the same directory, synced to disk and renamed to the file, after
+// which the directory is synced to persist the rename.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmpName, err := writeTempFile(filename, data, perm)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, filename); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return SyncDir(filepath.Dir(filename))
+}
+
+// CreateFileAtomic creates the file with the data like WriteFileAtomic, it fails
+// with an error matching os.ErrExist when the file exists. The temporary file is
+// linked to the file, which fails atomically if the file exists like O_EXCL.
+func CreateFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmpName, err := writeTempFile(filename, data, perm)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+	if err := os.Link(tmpName, filename); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(filename))
+}
+
+// writeTempFile writes the data to a temporary file next to the file and syncs
+// it to disk, it returns the name of the temporary file
+func writeTempFile(filename string, data []byte, perm os.FileMode) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(filename), TempFilePrefix+filepath.Base(filename)+"-*")
+	if err != nil {
+		return "", err
+	}
+	tmpName := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmpName)
+		return "", err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(tmpName)
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpName)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpName)
+		return "", err
+	}
+	return tmpName, nil
+}
+
+// SyncDir syncs the directory to disk such that the creation, rename or
+// removal of its entries survives a crash
+func SyncDir(dirname string) error {
+	d, err := os.Open(dirname)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	cases := map[string]struct {
+		// old is the content of the file before the write, the file does not
+		// exist when not set
+		old    string
+		create bool
+		want   string
+		errIs  error
+	}{
+		"Write":          {want: "new"},
+		"Overwrite":      {old: "old", want: "new"},
+		"Create":         {create: true, want: "new"},
+		"CreateExisting": {old: "old", create: true, want: "old", errIs: os.ErrExist},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			filename := filepath.Join(dir, "a.yaml")
+			if tc.old != "" {
+				if err := os.WriteFile(filename, []byte(tc.old), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			write := WriteFileAtomic
+			if tc.create {
+				write = CreateFileAtomic
+			}
+			err := write(filename, []byte("new"), 0600)
+			if tc.errIs != nil {
+				if !errors.Is(err, tc.errIs) {
+					t.Fatalf("want %v, got %v", tc.errIs, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("want %q, got %q", tc.want, got)
+			}
+			if tc.errIs == nil {
+				info, err := os.Stat(filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Mode().Perm() != 0600 {
+					t.Errorf("want mode 0600, got %v", info.Mode().Perm())
+				}
+			}
+			// the temporary file is removed
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("want only the file, got %v", entries)
+			}
+		})
+	}
+}
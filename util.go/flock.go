@@ -0,0 +1,177 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FileLock is an advisory lock on a file, it coordinates the processes using
+// the file but does not prevent access to it
+type FileLock struct {
+	f *os.File
+}
+
+// LockFile locks the file, the file is created if it does not exist. It blocks
+// until the lock is acquired, an exclusive lock excludes all other locks and a
+// shared lock only excludes exclusive locks.
+func LockFile(filename string, exclusive bool) (*FileLock, error) {
+	if err := EnsureDir(filepath.Dir(filename)); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(f, exclusive); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileLock{f: f}, nil
+}
+
+// Unlock releases the lock
+func (r *FileLock) Unlock() error {
+	if err := funlock(r.f); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+const (
+	// storeLockFile is the store wide lock in the root path of a store
+	storeLockFile = ".lock"
+	// keyLockDir is the directory of the key locks in the root path of a store
+	keyLockDir = ".locks"
+	// resourceVersionFile holds the last resource version allocated in a store
+	resourceVersionFile = ".rv"
+)
+
+// StoreLocks are the advisory locks shared by the processes using the same root
+// path of a file based store. Locks are acquired in the following order:
+//
+//  1. the mutex of the store in the process
+//  2. the key lock, exclusive while an object is read, modified and written
+//  3. the store lock, exclusive while a resource version is allocated
+//
+// An operation holds one key lock, a transaction holds the key locks of all its
+// objects acquired with LockKeys. Reads do not need a lock as files are written
+// atomically.
+type StoreLocks struct {
+	rootPath string
+}
+
+func NewStoreLocks(rootPath string) *StoreLocks {
+	return &StoreLocks{rootPath: rootPath}
+}
+
+// LockStore locks the whole store
+func (r *StoreLocks) LockStore(exclusive bool) (*FileLock, error) {
+	return LockFile(filepath.Join(r.rootPath, storeLockFile), exclusive)
+}
+
+// LockKey locks the object stored in the path relative to the root path. The
+// paths are spread over a fixed number of lock files such that lock files never
+// have to be removed, objects sharing a lock file are serialized.
+func (r *StoreLocks) LockKey(path string, exclusive bool) (*FileLock, error) {
+	return LockFile(r.keyLockFile(path), exclusive)
+}
+
+// LockKeys locks the objects stored in the paths relative to the root path. The
+// lock files are locked once and in sorted order, such that processes locking
+// multiple objects do not deadlock.
+func (r *StoreLocks) LockKeys(paths []string, exclusive bool) (FileLocks, error) {
+	filenames := map[string]struct{}{}
+	for _, path := range paths {
+		filenames[r.keyLockFile(path)] = struct{}{}
+	}
+	sorted := make([]string, 0, len(filenames))
+	for filename := range filenames {
+		sorted = append(sorted, filename)
+	}
+	sort.Strings(sorted)
+
+	locks := make(FileLocks, 0, len(sorted))
+	for _, filename := range sorted {
+		l, err := LockFile(filename, exclusive)
+		if err != nil {
+			locks.Unlock()
+			return nil, err
+		}
+		locks = append(locks, l)
+	}
+	return locks, nil
+}
+
+func (r *StoreLocks) keyLockFile(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(r.rootPath, keyLockDir, hex.EncodeToString(sum[:1])+".lock")
+}
+
+// FileLocks are locks acquired together
+type FileLocks []*FileLock
+
+// Unlock releases the locks in reverse order, the first error is returned
+func (r FileLocks) Unlock() error {
+	var err error
+	for i := len(r) - 1; i >= 0; i-- {
+		if uerr := r[i].Unlock(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}
+	return err
+}
+
+// ReadResourceVersion returns the last resource version allocated in the store,
+// 0 if none is allocated yet
+func (r *StoreLocks) ReadResourceVersion() (uint64, error) {
+	b, err := os.ReadFile(filepath.Join(r.rootPath, resourceVersionFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// NextResourceVersion allocates a resource version that is higher than the
+// resource versions allocated by any process and than the current resource
+// version of the process
+func (r *StoreLocks) NextResourceVersion(current uint64) (uint64, error) {
+	l, err := r.LockStore(true)
+	if err != nil {
+		return 0, err
+	}
+	defer l.Unlock()
+
+	rv, err := r.ReadResourceVersion()
+	if err != nil {
+		return 0, err
+	}
+	rv = max(rv, current) + 1
+	if err := WriteFileAtomic(filepath.Join(r.rootPath, resourceVersionFile), []byte(strconv.FormatUint(rv, 10)), 0644); err != nil {
+		return 0, err
+	}
+	return rv, nil
+}
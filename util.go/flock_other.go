@@ -0,0 +1,42 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !unix
+
+package util
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/henderiw/logger/log"
+)
+
+// advisory file locks are not supported, only the stores in a single process
+// are coordinated by their mutex
+var warnOnce sync.Once
+
+func flock(f *os.File, exclusive bool) error {
+	warnOnce.Do(func() {
+		log := log.FromContext(context.Background())
+		log.Warn("file locks are not supported on "+runtime.GOOS+", the processes sharing a store are not coordinated", "file", f.Name())
+	})
+	return nil
+}
+
+func funlock(f *os.File) error {
+	return nil
+}
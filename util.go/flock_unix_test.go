@@ -0,0 +1,169 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package util
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tryLock locks the file in a goroutine and returns a channel that gets the
+// lock once it is acquired
+func tryLock(t *testing.T, filename string, exclusive bool) <-chan *FileLock {
+	t.Helper()
+	ch := make(chan *FileLock, 1)
+	go func() {
+		l, err := LockFile(filename, exclusive)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ch <- l
+	}()
+	return ch
+}
+
+func TestLockFile(t *testing.T) {
+	cases := map[string]struct {
+		held      bool
+		exclusive bool
+		// blocks is true when the exclusive lock excludes the lock
+		blocks bool
+	}{
+		"ExclusiveExclusive": {held: true, exclusive: true, blocks: true},
+		"ExclusiveShared":    {held: true, exclusive: false, blocks: true},
+		"SharedExclusive":    {held: false, exclusive: true, blocks: true},
+		"SharedShared":       {held: false, exclusive: false, blocks: false},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "locks", "a.lock")
+			l, err := LockFile(filename, tc.held)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the locks of the open files of a process exclude each other like
+			// the locks of processes
+			ch := tryLock(t, filename, tc.exclusive)
+			select {
+			case l2 := <-ch:
+				if tc.blocks {
+					t.Fatalf("want the lock to wait")
+				}
+				l2.Unlock()
+			case <-time.After(100 * time.Millisecond):
+				if !tc.blocks {
+					t.Fatalf("want the lock to be acquired")
+				}
+			}
+			if err := l.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+			if tc.blocks {
+				select {
+				case l2 := <-ch:
+					l2.Unlock()
+				case <-time.After(5 * time.Second):
+					t.Fatalf("want the lock to be acquired after the unlock")
+				}
+			}
+		})
+	}
+}
+
+func TestLockKeys(t *testing.T) {
+	locks := NewStoreLocks(t.TempDir())
+	// the paths sharing a lock file are locked once
+	l, err := locks.LockKeys([]string{"default/a", "default/b", "default/a"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan FileLocks, 1)
+	go func() {
+		l, err := locks.LockKeys([]string{"default/b"}, true)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ch <- l
+	}()
+	select {
+	case <-ch:
+		t.Fatalf("want the key lock to wait")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case l := <-ch:
+		l.Unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("want the key lock to be acquired after the unlock")
+	}
+}
+
+func TestNextResourceVersion(t *testing.T) {
+	rootPath := t.TempDir()
+	const stores, allocations = 4, 25
+
+	// the stores share the root path like processes
+	var m sync.Mutex
+	rvs := map[uint64]struct{}{}
+	var wg sync.WaitGroup
+	for i := 0; i < stores; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			locks := NewStoreLocks(rootPath)
+			current := uint64(0)
+			for j := 0; j < allocations; j++ {
+				rv, err := locks.NextResourceVersion(current)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if rv <= current {
+					t.Errorf("want a resource version after %d, got %d", current, rv)
+				}
+				current = rv
+				m.Lock()
+				rvs[rv] = struct{}{}
+				m.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(rvs) != stores*allocations {
+		t.Errorf("want %d unique resource versions, got %d", stores*allocations, len(rvs))
+	}
+	locks := NewStoreLocks(rootPath)
+	rv, err := locks.ReadResourceVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv != stores*allocations {
+		t.Errorf("want resource version %d, got %d", stores*allocations, rv)
+	}
+	// a process ahead of the shared resource version keeps its order
+	if rv, err := locks.NextResourceVersion(1000); err != nil || rv != 1001 {
+		t.Errorf("want resource version 1001, got %d, %v", rv, err)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// journalDir is the directory of the journals in the root path of a store
+	journalDir = ".journal"
+	// journalExt is the extension of a journal, it is never the extension of an object
+	journalExt = ".journal"
+)
+
+// JournalEntry is a file written or removed by a transaction
+type JournalEntry struct {
+	// Key is the path of the key lock of the file, see StoreLocks.LockKey
+	Key string `json:"key"`
+	// Path is the path of the file relative to the root path
+	Path string `json:"path"`
+	// Data is the new content of the file
+	Data []byte `json:"data,omitempty"`
+	// Delete removes the file
+	Delete bool `json:"delete,omitempty"`
+	// Old is the content of the file before the transaction, set by Commit
+	Old []byte `json:"old,omitempty"`
+	// Exists is set by Commit when the file exists before the transaction
+	Exists bool `json:"exists,omitempty"`
+}
+
+// Journal makes the changes of multiple files atomic. The changes and the content
+// of the files before the changes are written to a journal before any file is
+// changed, the transaction is committed when the journal is removed. A journal
+// left behind by a crash is rolled back by Recover such that either all or none
+// of the changes survive.
+type Journal struct {
+	rootPath string
+}
+
+func NewJournal(rootPath string) *Journal {
+	return &Journal{rootPath: rootPath}
+}
+
+// Commit writes the entries to a journal, applies them in order and removes the
+// journal. The caller must hold the key locks of the entries. When applying the
+// entries fails the files are restored before the error is returned, a journal
+// that cannot be rolled back is kept and rolled back by Recover.
+func (r *Journal) Commit(entries []JournalEntry) error {
+	entries = append([]JournalEntry{}, entries...)
+	for i := range entries {
+		old, err := os.ReadFile(filepath.Join(r.rootPath, filepath.FromSlash(entries[i].Path)))
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		entries[i].Old, entries[i].Exists = old, true
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	dirname := filepath.Join(r.rootPath, journalDir)
+	if err := EnsureDir(dirname); err != nil {
+		return err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	filename := filepath.Join(dirname, "tx-"+hex.EncodeToString(id)+journalExt)
+	if err := WriteFileAtomic(filename, data, 0644); err != nil {
+		return err
+	}
+	err = r.apply(entries)
+	if err == nil {
+		if err = r.remove(filename); err == nil {
+			return nil
+		}
+	}
+	if rerr := r.rollback(entries); rerr != nil {
+		return fmt.Errorf("cannot apply journal %s, it is rolled back on recovery: %w", filename, errors.Join(err, rerr))
+	}
+	if rerr := r.remove(filename); rerr != nil && !errors.Is(rerr, os.ErrNotExist) {
+		return fmt.Errorf("cannot apply journal %s, it is rolled back on recovery: %w", filename, errors.Join(err, rerr))
+	}
+	return fmt.Errorf("cannot apply journal %s, it is rolled back: %w", filename, err)
+}
+
+// Recover rolls back the journals left behind by a crash and returns the
+// number of recovered journals. The journals are rolled back under the key locks
+// of their entries, such that the journals of running transactions are skipped.
+func (r *Journal) Recover(locks *StoreLocks) (int, error) {
+	dirents, err := os.ReadDir(filepath.Join(r.rootPath, journalDir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	n := 0
+	for _, dirent := range dirents {
+		if dirent.IsDir() || !strings.HasSuffix(dirent.Name(), journalExt) || strings.HasPrefix(dirent.Name(), TempFilePrefix) {
+			continue
+		}
+		ok, err := r.recover(locks, filepath.Join(r.rootPath, journalDir, dirent.Name()))
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *Journal) recover(locks *StoreLocks, filename string) (bool, error) {
+	entries, err := readJournal(filename)
+	if err != nil {
+		// the transaction completed since the directory was read
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	keys := make([]string, 0, len(entries))
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	l, err := locks.LockKeys(keys, true)
+	if err != nil {
+		return false, err
+	}
+	defer l.Unlock()
+
+	// the transaction completed while waiting for the locks
+	if _, err := os.Stat(filename); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err := r.rollback(entries); err != nil {
+		return false, err
+	}
+	return true, r.remove(filename)
+}
+
+func readJournal(filename string) ([]JournalEntry, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	entries := []JournalEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("cannot decode journal %s, err: %v", filename, err)
+	}
+	return entries, nil
+}
+
+// apply applies the entries, applying them again has the same result
+func (r *Journal) apply(entries []JournalEntry) error {
+	for _, e := range entries {
+		filename := filepath.Join(r.rootPath, filepath.FromSlash(e.Path))
+		if e.Delete {
+			if err := os.Remove(filename); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			if err := SyncDir(filepath.Dir(filename)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := EnsureDir(filepath.Dir(filename)); err != nil {
+			return err
+		}
+		if err := WriteFileAtomic(filename, e.Data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback restores the content of the files of the entries before the journal,
+// rolling back again has the same result
+func (r *Journal) rollback(entries []JournalEntry) error {
+	undo := make([]JournalEntry, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		undo = append(undo, JournalEntry{
+			Key:    entries[i].Key,
+			Path:   entries[i].Path,
+			Data:   entries[i].Old,
+			Delete: !entries[i].Exists,
+		})
+	}
+	return r.apply(undo)
+}
+
+func (r *Journal) remove(filename string) error {
+	if err := os.Remove(filename); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(filename))
+}
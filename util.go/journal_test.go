@@ -0,0 +1,158 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readFiles returns the content of the files in the root path, hidden
+// directories are skipped
+func readFiles(t *testing.T, rootPath string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(rootPath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != rootPath && d.Name()[0] == '.' {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(rootPath, path)
+		files[filepath.ToSlash(rel)] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func writeFiles(t *testing.T, rootPath string, files map[string]string) {
+	t.Helper()
+	for path, content := range files {
+		filename := filepath.Join(rootPath, filepath.FromSlash(path))
+		if err := EnsureDir(filepath.Dir(filename)); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestJournalCommit(t *testing.T) {
+	rootPath := t.TempDir()
+	writeFiles(t, rootPath, map[string]string{"ns/a.yaml": "a1", "ns/b.yaml": "b1"})
+
+	err := NewJournal(rootPath).Commit([]JournalEntry{
+		{Key: "ns/a", Path: "ns/a.yaml", Data: []byte("a2")},
+		{Key: "ns/b", Path: "ns/b.yaml", Delete: true},
+		{Key: "ns/c", Path: "ns/c.yaml", Data: []byte("c2")},
+	})
+	if err != nil {
+		t.Fatalf("cannot commit: %v", err)
+	}
+	got := readFiles(t, rootPath)
+	want := map[string]string{"ns/a.yaml": "a2", "ns/c.yaml": "c2"}
+	if len(got) != len(want) {
+		t.Fatalf("want files %v, got %v", want, got)
+	}
+	for path, content := range want {
+		if got[path] != content {
+			t.Errorf("%s: want %q, got %q", path, content, got[path])
+		}
+	}
+	journals, _ := os.ReadDir(filepath.Join(rootPath, journalDir))
+	if len(journals) != 0 {
+		t.Errorf("want no journal after commit, got %d", len(journals))
+	}
+}
+
+func TestJournalRecoverPartialApply(t *testing.T) {
+	initial := map[string]string{"ns/a.yaml": "a1", "ns/b.yaml": "b1"}
+	entries := []JournalEntry{
+		{Key: "ns/a", Path: "ns/a.yaml", Data: []byte("a2")},
+		{Key: "ns/b", Path: "ns/b.yaml", Delete: true},
+		{Key: "ns/c", Path: "ns/c.yaml", Data: []byte("c2")},
+		{Key: "ns/a", Path: "ns/a.yaml", Data: []byte("a3")},
+	}
+
+	cases := map[string]struct {
+		// applied is the number of entries applied before the crash
+		applied int
+	}{
+		"NothingApplied": {applied: 0},
+		"WriteApplied":   {applied: 1},
+		"DeleteApplied":  {applied: 2},
+		"CreateApplied":  {applied: 3},
+		"AllApplied":     {applied: 4},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rootPath := t.TempDir()
+			writeFiles(t, rootPath, initial)
+
+			// the journal records the content before the transaction like Commit
+			journaled := append([]JournalEntry{}, entries...)
+			for i := range journaled {
+				if old, ok := initial[journaled[i].Path]; ok {
+					journaled[i].Old, journaled[i].Exists = []byte(old), true
+				}
+			}
+			data, err := json.Marshal(journaled)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeFiles(t, rootPath, map[string]string{journalDir + "/tx-crash" + journalExt: string(data)})
+
+			j := NewJournal(rootPath)
+			if err := j.apply(journaled[:tc.applied]); err != nil {
+				t.Fatalf("cannot apply: %v", err)
+			}
+
+			n, err := j.Recover(NewStoreLocks(rootPath))
+			if err != nil {
+				t.Fatalf("cannot recover: %v", err)
+			}
+			if n != 1 {
+				t.Errorf("want 1 recovered journal, got %d", n)
+			}
+			got := readFiles(t, rootPath)
+			if len(got) != len(initial) {
+				t.Fatalf("want files %v, got %v", initial, got)
+			}
+			for path, content := range initial {
+				if got[path] != content {
+					t.Errorf("%s: want %q, got %q", path, content, got[path])
+				}
+			}
+			if n, err := j.Recover(NewStoreLocks(rootPath)); err != nil || n != 0 {
+				t.Errorf("want nothing to recover twice, got %d, %v", n, err)
+			}
+		})
+	}
+}
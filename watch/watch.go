@@ -14,6 +14,8 @@
 
 package watch
 
+import "github.com/henderiw/store/key"
+
 // Interface can be implemented by anything that knows how to watch and report changes.
 type WatchInterface[T1 any] interface {
 	// Stop stops watching. Will close the channel returned by ResultChan(). Releases
@@ -30,21 +32,60 @@ var (
 	DefaultChanSize int32 = 100
 )
 
+// SlowConsumerPolicy defines what happens with the events of a watcher
+// when its buffer is full because the consumer does not keep up
+type SlowConsumerPolicy int
+
+const (
+	// TerminatePolicy terminates the watch with an Error event, this is the default
+	TerminatePolicy SlowConsumerPolicy = iota
+	// DropOldestPolicy drops the oldest buffered event to make room for the new one
+	DropOldestPolicy
+	// BlockPolicy waits until the consumer catches up, this delays the
+	// delivery of events to the other watchers of the store but never the
+	// changes of the store. The watch is terminated when the events that wait
+	// for the consumer exceed the pending events of the watchermanager.
+	BlockPolicy
+)
+
+func (r SlowConsumerPolicy) String() string {
+	return [...]string{"Terminate", "DropOldest", "Block"}[r]
+}
+
 // Event represents a single event to a watched resource.
 // +k8s:deepcopy-gen=true
 type WatchEvent[T1 any] struct {
 	Type EventType
 
+	// Key identifies the object in the store
+	Key key.Key
+
 	// Object is:
 	//  * If Type is Added or Modified: the new state of the object.
 	//  * If Type is Deleted: the state of the object immediately before deletion.
-	//  * If Type is Bookmark: the object (instance of a type being watched) where
-	//    only ResourceVersion field is set. On successful restart of watch from a
-	//    bookmark resourceVersion, client is guaranteed to not get repeat event
-	//    nor miss any events.
+	//  * If Type is Bookmark: the zero value, the resource version is carried by
+	//    ResourceVersion. On successful restart of watch from a bookmark
+	//    resourceVersion, client is guaranteed to not get repeat event nor miss
+	//    any events.
 	//  * If Type is Error: *api.Status is recommended; other types may make sense
 	//    depending on context.
 	Object T1
+
+	// OldObject is:
+	//  * If Type is Modified: the state of the object before the modification.
+	//  * If Type is Deleted: the state of the object immediately before deletion.
+	//  * Otherwise: the zero value.
+	OldObject T1
+
+	// ResourceVersion is the resource version of the store after the change.
+	// If Type is Bookmark: the resource version the watch can be resumed from.
+	ResourceVersion string
+
+	// Commit is the commit of the change for stores backed by git
+	Commit string
+
+	// Err is the reason the watch terminated if Type is Error
+	Err error
 }
 
 type EventType int
@@ -58,5 +99,5 @@ const (
 )
 
 func (r EventType) String() string {
-	return [...]string{"Added", "Modified", "Deleted"}[r]
+	return [...]string{"Added", "Modified", "Deleted", "Bookmark", "Error"}[r]
 }
@@ -40,8 +40,31 @@ type Watcher[T1 any] struct {
 	done          bool
 }
 
+// New returns a watcher whose result channel buffers the events according to
+// the WatchBufferSize of the options
+func New[T1 any](cancel func(), wm watchermanager.WatcherManager[T1], newFn func() T1, opts ...store.ListOption) *Watcher[T1] {
+	o := &store.ListOptions{}
+	o.ApplyOptions(opts)
+	bufferSize := o.WatchBufferSize
+	if bufferSize <= 0 {
+		bufferSize = int(watch.DefaultChanSize)
+	}
+	return &Watcher[T1]{
+		Cancel:         cancel,
+		ResultChannel:  make(chan watch.WatchEvent[T1], bufferSize),
+		WatcherManager: wm,
+		New:            newFn,
+	}
+}
+
 var _ watch.WatchInterface[any] = &Watcher[any]{}
 
+// Lister lists the objects of a store, it is satisfied by store.StorerV2 and
+// store.UnstructuredStoreV2
+type Lister[T1 any] interface {
+	List(ctx context.Context, visitorFunc func(store.Key, T1) error, opts ...store.ListOption) error
+}
+
 // Stop stops watching. Will close the channel returned by ResultChan(). Releases
 // any resources used by the watch.
 func (r *Watcher[T1]) Stop() {
@@ -64,17 +87,21 @@ func (r *Watcher[T1]) OnChange(eventType watch.WatchEvent[T1]) bool {
 	return r.eventCallback(eventType)
 }
 
-func (r *Watcher[T1]) ListAndWatch(ctx context.Context, store store.Storer[T1], opts ...store.ListOption) {
+func (r *Watcher[T1]) ListAndWatch(ctx context.Context, l Lister[T1], opts ...store.ListOption) {
 	log := log.FromContext(ctx)
-	if err := r.innerListAndWatch(ctx, store, opts...); err != nil {
+	if err := r.innerListAndWatch(ctx, l, opts...); err != nil {
 		// TODO: We need to populate the object on this error
 		// Most likely happens when we cancel a context, stop a watch
 		log.Debug("sending error to watch stream", "error", err)
 		ev := watch.WatchEvent[T1]{
 			Type:   watch.Error,
 			Object: r.New(),
+			Err:    err,
+		}
+		select {
+		case r.ResultChannel <- ev:
+		case <-ctx.Done():
 		}
-		r.ResultChannel <- ev
 	}
 
 	log.Debug("stop listAndWatch")
@@ -84,16 +111,34 @@ func (r *Watcher[T1]) ListAndWatch(ctx context.Context, store store.Storer[T1],
 // innerListAndWatch provides the callback handler
 // 1. add a callback handler to receive any event we get while collecting the list of existing resources
 // 2.
-func (r *Watcher[T1]) innerListAndWatch(ctx context.Context, s store.Storer[T1], opts ...store.ListOption) error {
+func (r *Watcher[T1]) innerListAndWatch(ctx context.Context, l Lister[T1], opts ...store.ListOption) error {
 	log := log.FromContext(ctx)
 
 	o := &store.ListOptions{}
 	o.ApplyOptions(opts)
 
-	errorResult := make(chan error)
+	// errorResult receives the error that terminates the watch, e.g. a slow consumer
+	errorResult := make(chan error, 1)
+	terminate := func(err error) {
+		select {
+		case errorResult <- err:
+		default:
+		}
+	}
 
 	// backlog logs the events during startup
 	var backlog []watch.WatchEvent[T1]
+	// listed are the resource versions of the listed objects, the events up to
+	// these resource versions are already part of the list
+	listed := map[store.Key]uint64{}
+	inList := func(ev watch.WatchEvent[T1]) bool {
+		listedRV, ok := listed[ev.Key]
+		if !ok {
+			return false
+		}
+		rv, err := store.ParseResourceVersion(ev.ResourceVersion)
+		return err == nil && rv != 0 && rv <= listedRV
+	}
 	// Make sure we hold the lock when setting the eventCallback, as it
 	// will be read by other goroutines when events happen.
 	r.m.Lock()
@@ -101,6 +146,10 @@ func (r *Watcher[T1]) innerListAndWatch(ctx context.Context, s store.Storer[T1],
 		if r.done {
 			return false
 		}
+		if event.Type == watch.Error {
+			terminate(event.Err)
+			return false
+		}
 		backlog = append(backlog, event)
 		return true
 	}
@@ -115,20 +164,47 @@ func (r *Watcher[T1]) innerListAndWatch(ctx context.Context, s store.Storer[T1],
 	}
 
 	// options.Watch means watch only no listing
-	if !o.Watch {
+	// a watch resuming from a resource version gets the events replayed by the
+	// watchermanager instead of a listing
+	if !o.Watch && o.ResourceVersion == "" {
 		log.Debug("starting list watch")
 
-		s.List(func(k store.Key, t T1) {
-			ev := watch.WatchEvent[T1]{
-				Type:   watch.Added,
-				Object: t,
+		listOpts := opts
+		if o.ErrorFunc == nil {
+			// an unreadable object does not fail the watch, it is logged
+			listOpts = append(append([]store.ListOption{}, opts...), &store.ListOptions{ErrorFunc: func(key store.Key, err error) {
+				log.Error("skipping unreadable object", "key", key.String(), "error", err.Error())
+			}})
+		}
+		// the events are sent once the list is done, the store can hold a lock
+		// while it calls the visitor. The list and the backlog are sent as they
+		// come, the slow consumer policy applies to the events that follow.
+		var events []watch.WatchEvent[T1]
+		if err := l.List(ctx, func(k store.Key, t T1) error {
+			if rv, err := store.ParseResourceVersion(store.GetResourceVersion(t)); err == nil {
+				listed[k] = rv
+			}
+			events = append(events, watch.WatchEvent[T1]{
+				Type:            watch.Added,
+				Key:             k,
+				Object:          t,
+				ResourceVersion: store.GetResourceVersion(t),
+			})
+			return nil
+		}, listOpts...); err != nil {
+			r.setDone()
+			return err
+		}
+		for _, ev := range events {
+			if err := r.sendWatchEvent(ctx, watch.BlockPolicy, ev); err != nil {
+				r.setDone()
+				return err
 			}
-			r.sendWatchEvent(ctx, ev)
-		})
+		}
 
 		log.Debug("finished list watch")
 	} else {
-		log.Debug("watch only, no list")
+		log.Debug("watch only, no list", "resourceVersion", o.ResourceVersion)
 	}
 
 	// Repeatedly flush the backlog until we catch up
@@ -143,14 +219,27 @@ func (r *Watcher[T1]) innerListAndWatch(ctx context.Context, s store.Storer[T1],
 		}
 		log.Debug("flushing backlog", "chunk length", len(chunk))
 		for _, ev := range chunk {
-			r.sendWatchEvent(ctx, ev)
+			if inList(ev) {
+				continue
+			}
+			if err := r.sendWatchEvent(ctx, watch.BlockPolicy, ev); err != nil {
+				r.setDone()
+				return err
+			}
 		}
 	}
 
 	r.m.Lock()
 	// Pick up anything that squeezed in
 	for _, ev := range backlog {
-		r.sendWatchEvent(ctx, ev)
+		if inList(ev) {
+			continue
+		}
+		if err := r.sendWatchEvent(ctx, watch.BlockPolicy, ev); err != nil {
+			r.done = true
+			r.m.Unlock()
+			return err
+		}
 	}
 
 	log.Debug("moving into streaming mode")
@@ -160,8 +249,18 @@ func (r *Watcher[T1]) innerListAndWatch(ctx context.Context, s store.Storer[T1],
 		if r.done {
 			return false
 		}
-		ev := event
-		r.sendWatchEvent(ctx, ev)
+		if event.Type == watch.Error {
+			terminate(event.Err)
+			return false
+		}
+		// the dispatch of the events notified before the list can lag behind
+		if inList(event) {
+			return true
+		}
+		if err := r.sendWatchEvent(ctx, o.WatchPolicy, event); err != nil {
+			terminate(err)
+			return false
+		}
 		return true
 	}
 	r.m.Unlock()
@@ -177,13 +276,45 @@ func (r *Watcher[T1]) innerListAndWatch(ctx context.Context, s store.Storer[T1],
 	}
 }
 
-func (r *Watcher[T1]) sendWatchEvent(ctx context.Context, event watch.WatchEvent[T1]) {
-	// TODO: Handle the case that the watch channel is full?
-
+// sendWatchEvent sends the event to the result channel according to the slow
+// consumer policy, an error is returned when the watch terminates
+func (r *Watcher[T1]) sendWatchEvent(ctx context.Context, policy watch.SlowConsumerPolicy, event watch.WatchEvent[T1]) error {
 	log := log.FromContext(ctx).With("event", event.Type)
 	log.Debug("sending watch event")
 
-	r.ResultChannel <- event
+	switch policy {
+	case watch.DropOldestPolicy:
+		for {
+			select {
+			case r.ResultChannel <- event:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			// make room by dropping the oldest event
+			select {
+			case <-r.ResultChannel:
+			default:
+			}
+		}
+	case watch.BlockPolicy:
+		select {
+		case r.ResultChannel <- event:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	default:
+		select {
+		case r.ResultChannel <- event:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			return store.NewUnavailableError("watcher too slow, buffer full", nil)
+		}
+	}
 }
 
 func (r *Watcher[T1]) setDone() {
@@ -0,0 +1,163 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watcher
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/watch"
+	"github.com/henderiw/store/watchermanager"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// manager is a watchermanager that keeps the callback of the watcher such that
+// the test delivers the events
+type manager struct {
+	watchermanager.WatcherManager[*unstructured.Unstructured]
+	callback chan watchermanager.Watcher[*unstructured.Unstructured]
+}
+
+func (r *manager) Add(ctx context.Context, callback watchermanager.Watcher[*unstructured.Unstructured], opts ...store.ListOption) error {
+	r.callback <- callback
+	return nil
+}
+
+// lister lists the objects and calls during while it lists
+type lister struct {
+	objs   []*unstructured.Unstructured
+	during func()
+}
+
+func (r *lister) List(ctx context.Context, visitorFunc func(store.Key, *unstructured.Unstructured) error, opts ...store.ListOption) error {
+	r.during()
+	for _, obj := range r.objs {
+		if err := visitorFunc(testKey(obj.GetName()), obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func testKey(name string) store.Key {
+	return store.KeyFromNSN(types.NamespacedName{Namespace: "default", Name: name})
+}
+
+func testEvent(eventType watch.EventType, name, rv string) watch.WatchEvent[*unstructured.Unstructured] {
+	obj := &unstructured.Unstructured{Object: map[string]any{}}
+	obj.SetName(name)
+	obj.SetResourceVersion(rv)
+	return watch.WatchEvent[*unstructured.Unstructured]{Type: eventType, Key: testKey(name), Object: obj, ResourceVersion: rv}
+}
+
+func TestListAndWatchSkipsListedEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := &manager{callback: make(chan watchermanager.Watcher[*unstructured.Unstructured], 1)}
+	w := New(cancel, m, func() *unstructured.Unstructured { return &unstructured.Unstructured{} })
+
+	// a and b are listed, the events of a and b up to the listed resource
+	// versions are notified while the watcher lists
+	l := &lister{
+		objs: []*unstructured.Unstructured{testEvent(watch.Added, "a", "1").Object, testEvent(watch.Added, "b", "2").Object},
+	}
+	l.during = func() {
+		callback := <-m.callback
+		callback.OnChange(testEvent(watch.Added, "a", "1"))
+		callback.OnChange(testEvent(watch.Modified, "b", "3"))
+		// the dispatch of the event of b lags behind the list
+		go func() {
+			callback.OnChange(testEvent(watch.Added, "b", "2"))
+			callback.OnChange(testEvent(watch.Modified, "a", "4"))
+		}()
+	}
+	go w.ListAndWatch(ctx, l)
+
+	want := []string{"Added a 1", "Added b 2", "Modified b 3", "Modified a 4"}
+	for _, want := range want {
+		select {
+		case event := <-w.ResultChan():
+			if got := event.Type.String() + " " + event.Key.Name + " " + event.ResourceVersion; got != want {
+				t.Fatalf("want %s, got %s", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("want %s", want)
+		}
+	}
+	select {
+	case event := <-w.ResultChan():
+		t.Fatalf("want no more events, got %s of %s", event.Type, event.Key.Name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSendWatchEventPolicy(t *testing.T) {
+	cases := map[string]struct {
+		policy watch.SlowConsumerPolicy
+		// want are the resource versions of the events in the buffer
+		want []string
+		// errFunc checks the error of the send of the third event
+		errFunc func(error) bool
+	}{
+		"Terminate": {
+			policy:  watch.TerminatePolicy,
+			want:    []string{"1", "2"},
+			errFunc: store.IsUnavailable,
+		},
+		"DropOldest": {
+			policy: watch.DropOldestPolicy,
+			want:   []string{"2", "3"},
+		},
+		"Block": {
+			policy:  watch.BlockPolicy,
+			want:    []string{"1", "2"},
+			errFunc: func(err error) bool { return errors.Is(err, context.DeadlineExceeded) },
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			w := New(cancel, nil, func() *unstructured.Unstructured { return &unstructured.Unstructured{} }, &store.ListOptions{WatchBufferSize: 2})
+			for _, rv := range []string{"1", "2"} {
+				if err := w.sendWatchEvent(ctx, tc.policy, testEvent(watch.Added, "a", rv)); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			// the consumer does not keep up
+			err := w.sendWatchEvent(ctx, tc.policy, testEvent(watch.Modified, "a", "3"))
+			if tc.errFunc != nil {
+				if !tc.errFunc(err) {
+					t.Fatalf("want error, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := []string{}
+			for len(w.ResultChannel) > 0 {
+				got = append(got, (<-w.ResultChannel).ResourceVersion)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2024 Nokia.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package watchermanager
+
+import (
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/watch"
+)
+
+// history is a bounded ring of the most recent events, it allows watchers to
+// resume from a resource version without listing the store again
+type history[T1 any] struct {
+	events []historyEntry[T1]
+	start  int
+	count  int
+	// minRV is the resource version of the store before the oldest event in the history
+	minRV uint64
+	// lastRV is the resource version of the most recent event
+	lastRV uint64
+}
+
+type historyEntry[T1 any] struct {
+	rv    uint64
+	event watch.WatchEvent[T1]
+}
+
+func newHistory[T1 any](size int) *history[T1] {
+	if size < 1 {
+		size = 1
+	}
+	return &history[T1]{
+		events: make([]historyEntry[T1], size),
+	}
+}
+
+// reset clears the history, watches can resume from the resource version onwards
+func (r *history[T1]) reset(rv uint64) {
+	clear(r.events)
+	r.start = 0
+	r.count = 0
+	r.minRV = rv
+	r.lastRV = rv
+}
+
+// add records the event, when the history is full the oldest event is dropped.
+// Events without a resource version are not recorded.
+func (r *history[T1]) add(event watch.WatchEvent[T1]) {
+	rv, err := store.ParseResourceVersion(event.ResourceVersion)
+	if err != nil || rv == 0 {
+		return
+	}
+	if r.count == len(r.events) {
+		r.minRV = r.events[r.start].rv
+		r.start = (r.start + 1) % len(r.events)
+		r.count--
+	}
+	r.events[(r.start+r.count)%len(r.events)] = historyEntry[T1]{rv: rv, event: event}
+	r.count++
+	if rv > r.lastRV {
+		r.lastRV = rv
+	}
+}
+
+// since returns the events that happened after the resource version.
+// false is returned when the history no longer covers the resource version.
+func (r *history[T1]) since(rv uint64) ([]watch.WatchEvent[T1], bool) {
+	if rv < r.minRV {
+		return nil, false
+	}
+	events := []watch.WatchEvent[T1]{}
+	for i := 0; i < r.count; i++ {
+		entry := r.events[(r.start+i)%len(r.events)]
+		if entry.rv > rv {
+			events = append(events, entry.event)
+		}
+	}
+	return events, true
+}
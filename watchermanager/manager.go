@@ -16,8 +16,8 @@ package watchermanager
 
 import (
 	"context"
-	"fmt"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/henderiw/logger/log"
@@ -26,19 +26,44 @@ import (
 	"golang.org/x/sync/semaphore"
 )
 
+var (
+	// DefaultHistorySize is the number of events kept to resume watches
+	DefaultHistorySize = 1024
+	// DefaultPendingSize is the number of events that wait for a watcher with
+	// the block policy before this watcher is terminated
+	DefaultPendingSize = 1024
+)
+
+// DefaultBookmarkInterval is the interval at which bookmark events are sent when
+// the watch has no ListOptions.BookmarkInterval
+const DefaultBookmarkInterval = time.Minute
+
 type WatcherManager[T1 any] interface {
 	// start the generic watcher channel
 	Start(ctx context.Context)
 	Stop()
+	// WatchChan returns a channel to send events to the watchers, sending blocks
+	// until the watchermanager picks up the event
 	WatchChan() chan watch.WatchEvent[T1]
+	// Notify queues the event for the watchers and never blocks, events are
+	// delivered in the order they are notified. A store calls Notify under its
+	// lock, the events are dispatched once the lock is released.
+	Notify(event watch.WatchEvent[T1])
 	Add(ctx context.Context, callback Watcher[T1], opts ...store.ListOption) error // Del is handled with the isDone or callBackFn result
+	// SetResourceVersion resets the event history to the resource version of the store,
+	// watches can resume from this resource version onwards
+	SetResourceVersion(rv string)
 }
 
 func New[T1 any](maxWatchers int64) WatcherManager[T1] {
 	return &watcherManager[T1]{
-		sem:      semaphore.NewWeighted(maxWatchers),
-		watchers: newWatchersCache[T1](),
-		watchCh:  make(chan watch.WatchEvent[T1]),
+		sem:       semaphore.NewWeighted(maxWatchers),
+		watchers:  newWatchersCache[T1](),
+		watchCh:   make(chan watch.WatchEvent[T1]),
+		history:   newHistory[T1](DefaultHistorySize),
+		pendingCh: make(chan struct{}, 1),
+		overflow:  make(chan struct{}, 1),
+		bookmarks: make(chan *watcher[T1]),
 	}
 }
 
@@ -46,13 +71,63 @@ type watcherManager[T1 any] struct {
 	sem      *semaphore.Weighted
 	watchers *watchers[T1]
 	watchCh  chan watch.WatchEvent[T1]
-	cancel   context.CancelFunc
+
+	// m protects the history, the pending events and the cancel of the start;
+	// events are recorded and watchers are added under the lock such that a
+	// resumed watch does not miss events
+	m       sync.Mutex
+	cancel  context.CancelFunc
+	history *history[T1]
+	pending []watch.WatchEvent[T1]
+	// notifiedRV is the resource version of the most recent notified event, the
+	// pending events up to this resource version are not sent to a new watcher
+	notifiedRV uint64
+	// pendingCh signals the availability of pending events
+	pendingCh chan struct{}
+	// overflow signals that the pending events exceed DefaultPendingSize, the
+	// watcher with the block policy that holds up the dispatch is terminated
+	overflow chan struct{}
+	// bookmarks receives the watchers that are due a bookmark event
+	bookmarks chan *watcher[T1]
 }
 
 func (r *watcherManager[T1]) WatchChan() chan watch.WatchEvent[T1] {
 	return r.watchCh
 }
 
+func (r *watcherManager[T1]) Notify(event watch.WatchEvent[T1]) {
+	r.m.Lock()
+	r.pending = append(r.pending, event)
+	if rv, err := store.ParseResourceVersion(event.ResourceVersion); err == nil && rv > r.notifiedRV {
+		r.notifiedRV = rv
+	}
+	// the pending events only pile up when the dispatch waits for a watcher
+	// with the block policy
+	if len(r.pending) > DefaultPendingSize {
+		select {
+		case r.overflow <- struct{}{}:
+		default:
+		}
+	}
+	r.m.Unlock()
+
+	select {
+	case r.pendingCh <- struct{}{}:
+	default:
+	}
+}
+
+func (r *watcherManager[T1]) SetResourceVersion(rv string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	v, err := store.ParseResourceVersion(rv)
+	if err != nil {
+		return
+	}
+	r.history.reset(v)
+	r.notifiedRV = v
+}
+
 // Add adds a watcher to the watcherManager and allocates a uuid per watcher to make the delete
 // easier, the uuid is used only internally
 func (r *watcherManager[T1]) Add(ctx context.Context, callback Watcher[T1], opts ...store.ListOption) error {
@@ -63,14 +138,17 @@ func (r *watcherManager[T1]) Add(ctx context.Context, callback Watcher[T1], opts
 	// see if we have to clean done watcher
 	for _, w := range r.watchers.list() {
 		if err := w.isDone(); err != nil {
-			r.watchers.del(w.key)
-			r.sem.Release(1)
+			r.remove(w)
 		}
 	}
 
 	ok := r.sem.TryAcquire(1)
 	if !ok {
-		return fmt.Errorf("max number of watchers reached")
+		return store.NewUnavailableError("max number of watchers reached", nil)
+	}
+	bufferSize := o.WatchBufferSize
+	if bufferSize <= 0 {
+		bufferSize = int(watch.DefaultChanSize)
 	}
 	// allocate uuid for the watcher
 	uuid := uuid.New().String()
@@ -78,62 +156,166 @@ func (r *watcherManager[T1]) Add(ctx context.Context, callback Watcher[T1], opts
 	w := &watcher[T1]{
 		key:           uuid,
 		isDone:        ctx.Err, // handles watcher stop and deletion gracefully
+		done:          ctx.Done(),
 		callback:      callback,
 		filterOptions: o,
+		queue:         make(chan watch.WatchEvent[T1], bufferSize),
+		policy:        o.WatchPolicy,
+		terminate:     make(chan error, 1),
+	}
+	if o.AllowBookmarks {
+		w.bookmarkInterval = o.BookmarkInterval
+		if w.bookmarkInterval <= 0 {
+			w.bookmarkInterval = DefaultBookmarkInterval
+		}
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	// a new watch gets the events after the notified events, the changes up to
+	// there are part of its list
+	w.startRV = r.notifiedRV
+	// a watch resuming from a resource version gets the events since this
+	// resource version replayed before any new event
+	if o.ResourceVersion != "" {
+		rv, err := store.ParseResourceVersion(o.ResourceVersion)
+		if err != nil {
+			r.sem.Release(1)
+			return store.NewInvalidError(store.Key{}, "invalid resourceVersion "+o.ResourceVersion, err)
+		}
+		events, ok := r.history.since(rv)
+		if !ok {
+			r.sem.Release(1)
+			return store.NewGoneError("too old resource version: " + o.ResourceVersion)
+		}
+		w.startRV = rv
+		log.Debug("replaying events", "resourceVersion", o.ResourceVersion, "events", len(events))
+		for _, event := range events {
+			if event, ok := w.filter(event); ok {
+				callback.OnChange(event)
+			}
+		}
 	}
 	r.watchers.add(uuid, w)
+	go w.run(r.bookmarks, func() { r.remove(w) })
 	log.Debug("watchers", "total", r.watchers.len())
 	return nil
 }
 
+// remove deletes the watcher and releases its slot, this is only done once per watcher
+func (r *watcherManager[T1]) remove(w *watcher[T1]) {
+	w.stopOnce.Do(func() {
+		r.watchers.del(w.key)
+		r.sem.Release(1)
+	})
+}
+
 // Start is a blocking function that handles Change events from a server implementation
 // and sends them to the watchers it is managing
-// The events are send via callback fn in a concurrent waitGroup to handle concurrent operation
-// when an error or the callback signals the delete
+// Every watcher buffers its events and delivers them from its own goroutine, such that
+// a slow watcher only impacts the other watchers when it uses the block policy
+// The watchermanager can be started again once it is stopped, a start stops the
+// previous start such that the events are dispatched by one goroutine.
 func (r *watcherManager[T1]) Start(ctx context.Context) {
+	r.m.Lock()
+	if r.cancel != nil {
+		r.cancel()
+	}
 	ctx, r.cancel = context.WithCancel(ctx)
+	r.m.Unlock()
 	log := log.FromContext(ctx)
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case event := <-r.watchCh:
-			log.Debug("watchermanager event received", "eventType", event.Type, "watchers", r.watchers.len())
-			var wg sync.WaitGroup
-			for _, w := range r.watchers.list() {
-				w := w
-				log.Debug("watcher event processing", "eventType", event.Type, "key", w.key)
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					if err := w.isDone(); err != nil {
-						log.Debug("stopping watcher due to error", "key", w.key)
-						r.watchers.del(w.key)
-						r.sem.Release(1)
-						return
-					}
-
-					// the callback deals with filtering
-					if keepGoing := w.callback.OnChange(watch.WatchEvent[T1]{
-						Type:   event.Type,
-						Object: event.Object,
-					}); !keepGoing {
-						log.Debug("stopping watcher due to !keepGoing", "key", w.key)
-						r.watchers.del(w.key)
-						r.sem.Release(1)
-						return
-					}
-					log.Debug("watch callback done", "key", w.key)
-				}()
+			r.Notify(event)
+		case w := <-r.bookmarks:
+			r.sendBookmark(ctx, w)
+		case <-r.pendingCh:
+			for {
+				event, watchers, ok := r.next()
+				if !ok {
+					break
+				}
+				log.Debug("watchermanager event received", "eventType", event.Type, "watchers", len(watchers))
+				r.dispatch(ctx, event, watchers)
+			}
+		}
+	}
+}
+
+// next pops the oldest pending event, records it in the history and returns
+// it with the watchers it has to be delivered to
+func (r *watcherManager[T1]) next() (watch.WatchEvent[T1], []*watcher[T1], bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if len(r.pending) == 0 {
+		return watch.WatchEvent[T1]{}, nil, false
+	}
+	event := r.pending[0]
+	r.pending[0] = watch.WatchEvent[T1]{}
+	r.pending = r.pending[1:]
+	if len(r.pending) <= DefaultPendingSize {
+		select {
+		case <-r.overflow:
+		default:
+		}
+	}
+	r.history.add(event)
+	return event, r.watchers.list(), true
+}
+
+// dispatch queues the event for every watcher according to its slow consumer policy
+func (r *watcherManager[T1]) dispatch(ctx context.Context, event watch.WatchEvent[T1], watchers []*watcher[T1]) {
+	log := log.FromContext(ctx)
+	for _, w := range watchers {
+		if err := w.isDone(); err != nil {
+			log.Debug("stopping watcher due to error", "key", w.key)
+			r.remove(w)
+			continue
+		}
+		if w.terminated || !w.after(event) {
+			continue
+		}
+		// events that dont match the filter of the watcher are not sent
+		event, ok := w.filter(event)
+		if !ok {
+			continue
+		}
+		if ok := w.enqueue(event, r.overflow); !ok {
+			log.Debug("terminating slow watcher", "key", w.key, "policy", w.policy.String())
+			w.terminated = true
+			select {
+			case w.terminate <- store.NewUnavailableError("watcher too slow, buffer full", nil):
+			default:
 			}
-			log.Debug("watchermanager goroutines waiting", "eventType", event.Type, "watchers", r.watchers.len())
-			wg.Wait()
-			log.Debug("watchermanager goroutines done waiting", "eventType", event.Type, "watchers", r.watchers.len())
 		}
 	}
 }
 
+// sendBookmark sends a bookmark event with the latest dispatched resource version
+// to the watcher, it is sent between the dispatch of the events such that the
+// events up to the resource version are queued before the bookmark
+func (r *watcherManager[T1]) sendBookmark(ctx context.Context, w *watcher[T1]) {
+	log := log.FromContext(ctx)
+	if w.isDone() != nil || w.terminated {
+		return
+	}
+	r.m.Lock()
+	rv := store.FormatResourceVersion(r.history.lastRV)
+	r.m.Unlock()
+
+	log.Debug("sending bookmark", "key", w.key, "resourceVersion", rv)
+	w.tryEnqueue(watch.WatchEvent[T1]{
+		Type:            watch.Bookmark,
+		ResourceVersion: rv,
+	})
+}
+
 func (r *watcherManager[T1]) Stop() {
+	r.m.Lock()
+	defer r.m.Unlock()
 	if r.cancel != nil {
 		r.cancel()
 	}
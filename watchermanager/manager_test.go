@@ -0,0 +1,380 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watchermanager
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/watch"
+)
+
+// recorder records the resource versions of the events it gets
+type recorder struct {
+	m   sync.Mutex
+	rvs []string
+}
+
+func (r *recorder) OnChange(event watch.WatchEvent[string]) bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if event.Type == watch.Error {
+		r.rvs = append(r.rvs, "error")
+		return false
+	}
+	r.rvs = append(r.rvs, event.ResourceVersion)
+	return true
+}
+
+// stalled is a recorder that does not handle any event until it is released
+type stalled struct {
+	recorder
+	// waiting is closed when the first event is received
+	waiting chan struct{}
+	once    sync.Once
+	release chan struct{}
+}
+
+func newStalled() *stalled {
+	return &stalled{waiting: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (r *stalled) OnChange(event watch.WatchEvent[string]) bool {
+	r.once.Do(func() { close(r.waiting) })
+	<-r.release
+	return r.recorder.OnChange(event)
+}
+
+func (r *recorder) list() []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]string{}, r.rvs...)
+}
+
+// waitFor waits until the recorder got n events
+func (r *recorder) waitFor(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if rvs := r.list(); len(rvs) >= n {
+			return rvs
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("want %d events, got %v", n, r.list())
+	return nil
+}
+
+func event(rv uint64) watch.WatchEvent[string] {
+	return watch.WatchEvent[string]{Type: watch.Added, Object: "obj", ResourceVersion: store.FormatResourceVersion(rv)}
+}
+
+// notify notifies the events with the resource versions and waits until they
+// are dispatched
+func notify(t *testing.T, m *watcherManager[string], rvs ...uint64) {
+	t.Helper()
+	for _, rv := range rvs {
+		m.Notify(event(rv))
+	}
+	waitDispatched(t, m, rvs[len(rvs)-1])
+}
+
+// waitDispatched waits until the events up to the resource version are dispatched
+func waitDispatched(t *testing.T, m *watcherManager[string], rv uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		m.m.Lock()
+		done := len(m.pending) == 0 && m.history.lastRV == rv
+		m.m.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("events are not dispatched")
+}
+
+func TestWatchResume(t *testing.T) {
+	cases := map[string]struct {
+		historySize int
+		// reset is the resource version the history is reset to before the events
+		reset           string
+		events          []uint64
+		resourceVersion string
+		errFunc         func(error) bool
+		want            []string
+	}{
+		"ResumeFromStart": {
+			historySize:     10,
+			events:          []uint64{1, 2, 3},
+			resourceVersion: "0",
+			want:            []string{"1", "2", "3", "4"},
+		},
+		"ResumeFromMiddle": {
+			historySize:     10,
+			events:          []uint64{1, 2, 3},
+			resourceVersion: "2",
+			want:            []string{"3", "4"},
+		},
+		"ResumeFromLatest": {
+			historySize:     10,
+			events:          []uint64{1, 2, 3},
+			resourceVersion: "3",
+			want:            []string{"4"},
+		},
+		"ResumeFromOldestKept": {
+			historySize:     2,
+			events:          []uint64{1, 2, 3},
+			resourceVersion: "1",
+			want:            []string{"2", "3", "4"},
+		},
+		"GoneAfterHistoryWrap": {
+			historySize:     2,
+			events:          []uint64{1, 2, 3},
+			resourceVersion: "0",
+			errFunc:         store.IsGone,
+		},
+		"GoneBeforeReset": {
+			historySize:     10,
+			reset:           "5",
+			events:          []uint64{6, 7},
+			resourceVersion: "4",
+			errFunc:         store.IsGone,
+		},
+		"ResumeFromReset": {
+			historySize:     10,
+			reset:           "5",
+			events:          []uint64{6, 7},
+			resourceVersion: "5",
+			want:            []string{"6", "7", "8"},
+		},
+		"InvalidResourceVersion": {
+			historySize:     10,
+			events:          []uint64{1},
+			resourceVersion: "x",
+			errFunc:         store.IsInvalid,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			defer func(size int) { DefaultHistorySize = size }(DefaultHistorySize)
+			DefaultHistorySize = tc.historySize
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			m := New[string](4).(*watcherManager[string])
+			go m.Start(ctx)
+			defer m.Stop()
+			if tc.reset != "" {
+				m.SetResourceVersion(tc.reset)
+			}
+			notify(t, m, tc.events...)
+
+			r := &recorder{}
+			err := m.Add(ctx, r, &store.ListOptions{ResourceVersion: tc.resourceVersion})
+			if tc.errFunc != nil {
+				if err == nil || !tc.errFunc(err) {
+					t.Fatalf("want error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// the replayed events are followed by the new events
+			notify(t, m, tc.events[len(tc.events)-1]+1)
+			got := r.waitFor(t, len(tc.want))
+			if len(got) != len(tc.want) {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("want %v, got %v", tc.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestWatchBookmark(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := New[string](4).(*watcherManager[string])
+	go m.Start(ctx)
+	defer m.Stop()
+	notify(t, m, 1, 2)
+
+	r := &recorder{}
+	if err := m.Add(ctx, r, &store.ListOptions{AllowBookmarks: true, BookmarkInterval: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.waitFor(t, 1); got[0] != "2" {
+		t.Fatalf("want a bookmark with resource version 2, got %v", got)
+	}
+}
+
+func TestSlowConsumerPolicy(t *testing.T) {
+	cases := map[string]struct {
+		policy watch.SlowConsumerPolicy
+		// want are the events of the slow watcher once it is released, nil
+		// when the slow watcher is terminated
+		want []string
+	}{
+		"Terminate": {
+			policy: watch.TerminatePolicy,
+		},
+		"DropOldest": {
+			policy: watch.DropOldestPolicy,
+			want:   []string{"1", "17", "18", "19", "20"},
+		},
+		"Block": {
+			policy: watch.BlockPolicy,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			defer func(size int) { DefaultPendingSize = size }(DefaultPendingSize)
+			DefaultPendingSize = 4
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			m := New[string](4).(*watcherManager[string])
+			go m.Start(ctx)
+			defer m.Stop()
+
+			slow := newStalled()
+			if err := m.Add(ctx, slow, &store.ListOptions{WatchPolicy: tc.policy, WatchBufferSize: 4}); err != nil {
+				t.Fatal(err)
+			}
+			fast := &recorder{}
+			if err := m.Add(ctx, fast); err != nil {
+				t.Fatal(err)
+			}
+			notify(t, m, 1)
+			<-slow.waiting
+
+			// notify never waits for the slow watcher
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for rv := uint64(2); rv <= 20; rv++ {
+					m.Notify(event(rv))
+				}
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("notify is blocked by the slow watcher")
+			}
+			waitDispatched(t, m, 20)
+			if got := fast.waitFor(t, 20); len(got) != 20 {
+				t.Errorf("want 20 events for the fast watcher, got %v", got)
+			}
+
+			close(slow.release)
+			if tc.want == nil {
+				deadline := time.Now().Add(5 * time.Second)
+				for time.Now().Before(deadline) {
+					if got := slow.list(); len(got) > 0 && got[len(got)-1] == "error" {
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+				t.Fatalf("want the slow watcher to be terminated, got %v", slow.list())
+			}
+			got := slow.waitFor(t, len(tc.want))
+			if len(got) != len(tc.want) {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("want %v, got %v", tc.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := New[string](4).(*watcherManager[string])
+	r := &recorder{}
+	if err := m.Add(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{}
+	for rv := uint64(1); rv <= 10; rv++ {
+		go m.Start(ctx)
+		notify(t, m, rv)
+		want = append(want, store.FormatResourceVersion(rv))
+		m.Stop()
+	}
+	got := r.waitFor(t, len(want))
+	if len(got) != len(want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	}
+}
+
+func TestWatchPendingEvents(t *testing.T) {
+	cases := map[string]struct {
+		resourceVersion string
+		want            []string
+	}{
+		"New":    {want: []string{"3"}},
+		"Resume": {resourceVersion: "1", want: []string{"2", "3"}},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			m := New[string](4).(*watcherManager[string])
+			// the events are pending until the watchermanager is started
+			m.Notify(event(1))
+			m.Notify(event(2))
+
+			r := &recorder{}
+			if err := m.Add(ctx, r, &store.ListOptions{ResourceVersion: tc.resourceVersion}); err != nil {
+				t.Fatal(err)
+			}
+			go m.Start(ctx)
+			defer m.Stop()
+			notify(t, m, 3)
+
+			got := r.waitFor(t, len(tc.want))
+			if len(got) != len(tc.want) {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("want %v, got %v", tc.want, got)
+				}
+			}
+		})
+	}
+}
@@ -17,6 +17,9 @@ limitations under the License.
 package watchermanager
 
 import (
+	"sync"
+	"time"
+
 	"github.com/henderiw/store"
 	"github.com/henderiw/store/watch"
 )
@@ -30,6 +33,147 @@ type watcher[T1 any] struct {
 	// isDone should return non-nil when the watcher is finished.
 	// This is normally bound to ctx.Err()
 	isDone        func() error
+	done          <-chan struct{}    // closed when the watcher is finished, bound to ctx.Done()
 	callback      Watcher[T1]        // interface that handles OnChange
-	filterOptions *store.ListOptions // TODO update this
+	filterOptions *store.ListOptions // namespace, label and field restrictions of the watcher
+
+	// queue buffers the events between the watchermanager and the callback
+	queue  chan watch.WatchEvent[T1]
+	policy watch.SlowConsumerPolicy
+	// terminate carries the error that terminates the watcher
+	terminate chan error
+	// terminated is set when the watcher gets no more events, it is only
+	// accessed by the dispatch of the watchermanager
+	terminated bool
+	// stopOnce ensures the watcher is only removed once
+	stopOnce sync.Once
+	// bookmarkInterval is the interval of the bookmark events, 0 when the
+	// watcher does not allow bookmarks
+	bookmarkInterval time.Duration
+	// startRV is the resource version the watcher starts from, the events up to
+	// this resource version are not sent
+	startRV uint64
+}
+
+// after reports whether the event happened after the watcher started, events
+// without a resource version are always sent
+func (r *watcher[T1]) after(event watch.WatchEvent[T1]) bool {
+	rv, err := store.ParseResourceVersion(event.ResourceVersion)
+	if err != nil || rv == 0 {
+		return true
+	}
+	return rv > r.startRV
+}
+
+// filter returns the event as seen by the watcher given its filter options and
+// false if the event is not relevant for the watcher.
+// A modification of an object that starts matching the filter is sent as Added,
+// a modification of an object that stops matching the filter is sent as Deleted.
+func (r *watcher[T1]) filter(event watch.WatchEvent[T1]) (watch.WatchEvent[T1], bool) {
+	if r.filterOptions == nil || !r.filterOptions.HasFilter() {
+		return event, true
+	}
+	if event.Type != watch.Added && event.Type != watch.Modified && event.Type != watch.Deleted {
+		return event, true
+	}
+	newMatch := r.filterOptions.Matches(event.Key, event.Object)
+	if event.Type != watch.Modified {
+		return event, newMatch
+	}
+	oldMatch := r.filterOptions.Matches(event.Key, event.OldObject)
+	switch {
+	case newMatch && oldMatch:
+		return event, true
+	case newMatch:
+		event.Type = watch.Added
+		event.OldObject = *new(T1)
+		return event, true
+	case oldMatch:
+		event.Type = watch.Deleted
+		event.Object = event.OldObject
+		return event, true
+	default:
+		return event, false
+	}
+}
+
+// enqueue buffers the event for the watcher according to its slow consumer policy.
+// false is returned when the watcher has to be terminated, a watcher with the
+// block policy is terminated when it holds up the dispatch until overflow.
+func (r *watcher[T1]) enqueue(event watch.WatchEvent[T1], overflow <-chan struct{}) bool {
+	switch r.policy {
+	case watch.DropOldestPolicy:
+		for {
+			select {
+			case r.queue <- event:
+				return true
+			default:
+			}
+			// make room by dropping the oldest event
+			select {
+			case <-r.queue:
+			default:
+			}
+		}
+	case watch.BlockPolicy:
+		select {
+		case r.queue <- event:
+			return true
+		case <-r.done:
+			return true
+		case <-overflow:
+			return false
+		}
+	default:
+		select {
+		case r.queue <- event:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// tryEnqueue buffers the event if there is room, used for events that can be
+// skipped like bookmarks
+func (r *watcher[T1]) tryEnqueue(event watch.WatchEvent[T1]) {
+	select {
+	case r.queue <- event:
+	default:
+	}
+}
+
+// run delivers the buffered events to the callback until the watcher is done,
+// the watcher is sent to bookmarks when a bookmark is due and stop is called when
+// the watcher finishes
+func (r *watcher[T1]) run(bookmarks chan<- *watcher[T1], stop func()) {
+	defer stop()
+	var tick <-chan time.Time
+	if r.bookmarkInterval > 0 {
+		ticker := time.NewTicker(r.bookmarkInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-tick:
+			// a bookmark is skipped when the watchermanager is busy
+			select {
+			case bookmarks <- r:
+			default:
+			}
+		case err := <-r.terminate:
+			r.callback.OnChange(watch.WatchEvent[T1]{
+				Type: watch.Error,
+				Err:  err,
+			})
+			return
+		case event := <-r.queue:
+			if keepGoing := r.callback.OnChange(event); !keepGoing {
+				return
+			}
+		}
+	}
 }
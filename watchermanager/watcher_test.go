@@ -0,0 +1,134 @@
+// Copyright 2023 The xxx Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watchermanager
+
+import (
+	"testing"
+
+	"github.com/henderiw/store"
+	"github.com/henderiw/store/watch"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestFilter(t *testing.T) {
+	labeled := func(app string) *unstructured.Unstructured {
+		u := &unstructured.Unstructured{Object: map[string]any{}}
+		u.SetName("a")
+		if app != "" {
+			u.SetLabels(map[string]string{"app": app})
+		}
+		return u
+	}
+	a, b := labeled("a"), labeled("b")
+	key := store.KeyFromNSN(types.NamespacedName{Namespace: "default", Name: "a"})
+	selector := &store.ListOptions{LabelSelector: labels.SelectorFromSet(labels.Set{"app": "a"})}
+
+	cases := map[string]struct {
+		event      watch.WatchEvent[*unstructured.Unstructured]
+		opts       *store.ListOptions
+		want       bool
+		wantType   watch.EventType
+		wantObj    *unstructured.Unstructured
+		wantOldObj *unstructured.Unstructured
+	}{
+		"NoFilter": {
+			event:    watch.WatchEvent[*unstructured.Unstructured]{Type: watch.Added, Key: key, Object: b},
+			want:     true,
+			wantType: watch.Added,
+			wantObj:  b,
+		},
+		"AddedMatch": {
+			event:    watch.WatchEvent[*unstructured.Unstructured]{Type: watch.Added, Key: key, Object: a},
+			opts:     selector,
+			want:     true,
+			wantType: watch.Added,
+			wantObj:  a,
+		},
+		"AddedNoMatch": {
+			event: watch.WatchEvent[*unstructured.Unstructured]{Type: watch.Added, Key: key, Object: b},
+			opts:  selector,
+		},
+		"ModifiedMatch": {
+			event:      watch.WatchEvent[*unstructured.Unstructured]{Type: watch.Modified, Key: key, Object: a, OldObject: a},
+			opts:       selector,
+			want:       true,
+			wantType:   watch.Modified,
+			wantObj:    a,
+			wantOldObj: a,
+		},
+		// an object that starts matching is added for the watcher
+		"ModifiedIntoSelector": {
+			event:    watch.WatchEvent[*unstructured.Unstructured]{Type: watch.Modified, Key: key, Object: a, OldObject: b},
+			opts:     selector,
+			want:     true,
+			wantType: watch.Added,
+			wantObj:  a,
+		},
+		// an object that stops matching is deleted for the watcher with the
+		// state it had when it last matched
+		"ModifiedOutOfSelector": {
+			event:      watch.WatchEvent[*unstructured.Unstructured]{Type: watch.Modified, Key: key, Object: b, OldObject: a},
+			opts:       selector,
+			want:       true,
+			wantType:   watch.Deleted,
+			wantObj:    a,
+			wantOldObj: a,
+		},
+		"ModifiedNoMatch": {
+			event: watch.WatchEvent[*unstructured.Unstructured]{Type: watch.Modified, Key: key, Object: b, OldObject: b},
+			opts:  selector,
+		},
+		"DeletedMatch": {
+			event:      watch.WatchEvent[*unstructured.Unstructured]{Type: watch.Deleted, Key: key, Object: a, OldObject: a},
+			opts:       selector,
+			want:       true,
+			wantType:   watch.Deleted,
+			wantObj:    a,
+			wantOldObj: a,
+		},
+		"DeletedNoMatch": {
+			event: watch.WatchEvent[*unstructured.Unstructured]{Type: watch.Deleted, Key: key, Object: b, OldObject: b},
+			opts:  selector,
+		},
+		"Bookmark": {
+			event:    watch.WatchEvent[*unstructured.Unstructured]{Type: watch.Bookmark, ResourceVersion: "1"},
+			opts:     selector,
+			want:     true,
+			wantType: watch.Bookmark,
+		},
+		"OtherNamespace": {
+			event: watch.WatchEvent[*unstructured.Unstructured]{Type: watch.Added, Key: key, Object: a},
+			opts:  &store.ListOptions{Namespace: "other"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			w := &watcher[*unstructured.Unstructured]{filterOptions: tc.opts}
+			event, ok := w.filter(tc.event)
+			if ok != tc.want {
+				t.Fatalf("want %t, got %t", tc.want, ok)
+			}
+			if !ok {
+				return
+			}
+			if event.Type != tc.wantType || event.Object != tc.wantObj || event.OldObject != tc.wantOldObj {
+				t.Errorf("want %s with %v and old %v, got %s with %v and old %v", tc.wantType, tc.wantObj, tc.wantOldObj, event.Type, event.Object, event.OldObject)
+			}
+		})
+	}
+}